@@ -0,0 +1,471 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	ahrs.go: Attitude and heading estimator. A complementary (Mahony) filter on a quaternion: the gyro is integrated
+	 and pulled towards the attitude given by the accelerometer, once the accelerations of turning, speeding up and
+	 climbing (from the GPS speed and the gyro) are taken out. Heading is held by the gyro and corrected towards GPS
+	 track when moving, or a magnetometer when there is one. Gyro bias is measured while stationary at startup, and
+	 tracked by the filter after that. The estimator keeps a rough uncertainty of its attitude and heading, which
+	 decides whether they are reported as valid.
+
+	 Axes are those of the aircraft: X forward, Y right, Z down. Angles are degrees.
+*/
+
+package ahrs
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	UPDATE_RATE = 50 // Sensor reads and filter updates per second, in stratux.
+
+	// Filter gains, 1/s. Time constants are 1/gain.
+	KP_ACCEL = 0.5   // Attitude towards the accelerometer.
+	KI_ACCEL = 0.01  // Gyro bias, from attitude errors.
+	KP_GPS   = 0.05  // Heading towards GPS track. Low, since track differs from heading by the wind correction angle.
+	KP_MAG   = 0.1   // Heading towards the magnetometer.
+	KI_MAG   = 0.002 // Magnetic to true heading offset, learned while GPS track is available.
+
+	KI_HEADING = 0.1 // Gyro bias from heading errors, as a fraction of the heading gain.
+
+	ACCEL_TOLERANCE = 0.1 // g. The accelerometer isn't used when it is further than this from 1 g, after taking out the accelerations of flight.
+	ACCEL_FILTER    = 2.0 // s. Time constant of the along-track acceleration from GPS speed.
+	GPS_MIN_SPEED   = 10  // kt. GPS track is used for heading above this.
+	GPS_MAX_AGE     = 3 * time.Second
+
+	// Gyro bias calibration at startup.
+	CAL_TIME        = 5 * time.Second  // Stationary time needed.
+	CAL_TIMEOUT     = 60 * time.Second // Start without a calibration if not stationary by then, or straight away if the GPS shows we're moving.
+	CAL_GYRO_MOTION = 1.0              // deg/s. Gyro difference from the calibration mean that counts as moving.
+	CAL_ACCEL_LEVEL = 0.05             // g. Accelerometer difference from 1 g that counts as moving.
+
+	// Uncertainty model. Uncertainty grows at the drift rate, and decays towards the accuracy of a reference while
+	// the reference is in use.
+	DRIFT_CALIBRATED   = 0.05 // deg/s.
+	DRIFT_UNCALIBRATED = 1.0  // deg/s, falling towards DRIFT_CALIBRATED as the filter finds the bias.
+	ACCEL_ACCURACY     = 1.0  // deg.
+	GPS_ACCURACY       = 3.0  // deg. GPS track in still air.
+	MAG_ACCURACY       = 5.0  // deg.
+	WIND_ALLOWANCE     = 20.0 // kt. Wind assumed when GPS ground speed is taken as airspeed, and track as heading.
+	MAX_CRAB           = 12.0 // deg. Largest wind correction angle allowed for. Light aircraft seldom crab more in cruise.
+	ALONG_ACC_ERROR    = 0.5  // Fraction of the along-track acceleration that may be wrong, as the filtered GPS speed lags.
+	INITIAL_ATTITUDE   = 10.0 // deg. Uncertainty of an attitude taken from the accelerometer without calibration.
+
+	MAX_ATTITUDE_UNCERTAINTY = 5.0  // deg. Pitch and roll are reported valid below this.
+	MAX_HEADING_UNCERTAINTY  = 20.0 // deg. Heading is reported valid below this.
+	HEADING_SNAP             = 30.0 // deg. Heading is set straight from a reference when more uncertain than this.
+)
+
+// Calibration states.
+const (
+	CAL_RUNNING = "calibrating"
+	CAL_DONE    = "calibrated"
+	CAL_NONE    = "uncalibrated" // Wasn't stationary at startup. Gyro bias is left to the filter.
+)
+
+// Heading sources.
+const (
+	HEADING_GPS  = "gps"
+	HEADING_MAG  = "magnetometer"
+	HEADING_GYRO = "gyro" // No reference: heading drifts.
+)
+
+// Input is one set of sensor readings and GPS data for an update.
+type Input struct {
+	Gyro        [3]float64 // deg/s, uncorrected.
+	Accel       [3]float64 // g.
+	Mag         [3]float64 // Any units - only the direction is used.
+	MagValid    bool
+	GPSValid    bool    // Ground speed, track and vertical speed are current.
+	GroundSpeed float64 // kt.
+	TrueCourse  float64 // deg.
+	VertSpeed   float64 // ft/s.
+}
+
+// Status is the state of the estimator.
+type Status struct {
+	Valid               bool // Pitch and roll can be used.
+	HeadingValid        bool
+	Calibration         string     // CAL_*.
+	GyroBias            [3]float64 // deg/s.
+	AttitudeUncertainty float64    // deg.
+	HeadingUncertainty  float64    // deg.
+	HeadingSource       string     // HEADING_*.
+	AccelInUse          bool       // Accelerometer is being used as the attitude reference (not maneuvering).
+	MagOffset           float64    // deg. True minus magnetic heading, learned from GPS track.
+	MagOffsetValid      bool
+}
+
+// Estimator is the filter state. It isn't safe for concurrent use.
+type Estimator struct {
+	q    [4]float64 // Attitude quaternion (w, x, y, z), body to earth (north, east, down).
+	bias [3]float64 // Gyro bias, deg/s.
+	time float64    // Seconds of updates.
+
+	cal          string
+	calStart     float64 // Start of the current calibration window.
+	calStarted   float64 // Start of calibration.
+	calEnded     float64
+	calN         int
+	calGyroSum   [3]float64
+	calAccelSum  [3]float64
+	attitudeInit bool
+
+	attUnc    float64
+	hdgUnc    float64
+	hdgSource string
+	accelUsed bool
+
+	magOffset      float64
+	magOffsetValid bool
+
+	lastSpeed float64 // m/s.
+	alongAcc  float64 // m/s^2, filtered.
+
+	// Latest outputs.
+	rate  [3]float64 // deg/s, bias corrected.
+	accel [3]float64 // g, as measured.
+}
+
+// New returns an estimator, starting with a gyro calibration.
+func New() *Estimator {
+	e := &Estimator{q: [4]float64{1, 0, 0, 0}}
+	e.StartCalibration()
+	return e
+}
+
+// StartCalibration measures the gyro bias again. The aircraft must be kept still for CAL_TIME.
+func (e *Estimator) StartCalibration() {
+	e.cal = CAL_RUNNING
+	e.calStarted = e.time
+	e.resetCalibrationWindow()
+	e.attitudeInit = false
+	e.attUnc = 90
+	e.hdgUnc = 180
+	e.hdgSource = HEADING_GYRO
+}
+
+func (e *Estimator) resetCalibrationWindow() {
+	e.calStart = e.time
+	e.calN = 0
+	e.calGyroSum = [3]float64{}
+	e.calAccelSum = [3]float64{}
+}
+
+func radians(deg float64) float64 {
+	return deg * math.Pi / 180
+}
+
+func degrees(rad float64) float64 {
+	return rad * 180 / math.Pi
+}
+
+func vecNorm(v [3]float64) float64 {
+	return math.Sqrt(v[0]*v[0] + v[1]*v[1] + v[2]*v[2])
+}
+
+func vecCross(a, b [3]float64) [3]float64 {
+	return [3]float64{a[1]*b[2] - a[2]*b[1], a[2]*b[0] - a[0]*b[2], a[0]*b[1] - a[1]*b[0]}
+}
+
+// Angle difference, -180 to 180 degrees.
+func relAngle(a float64) float64 {
+	a = math.Mod(a, 360)
+	if a > 180 {
+		a -= 360
+	} else if a < -180 {
+		a += 360
+	}
+	return a
+}
+
+// Rotation matrix, body to earth.
+func (e *Estimator) rotation() [3][3]float64 {
+	w, x, y, z := e.q[0], e.q[1], e.q[2], e.q[3]
+	return [3][3]float64{
+		{1 - 2*(y*y+z*z), 2 * (x*y - w*z), 2 * (x*z + w*y)},
+		{2 * (x*y + w*z), 1 - 2*(x*x+z*z), 2 * (y*z - w*x)},
+		{2 * (x*z - w*y), 2 * (y*z + w*x), 1 - 2*(x*x+y*y)},
+	}
+}
+
+// Earth to body.
+func toBody(r [3][3]float64, v [3]float64) [3]float64 {
+	return [3]float64{
+		r[0][0]*v[0] + r[1][0]*v[1] + r[2][0]*v[2],
+		r[0][1]*v[0] + r[1][1]*v[1] + r[2][1]*v[2],
+		r[0][2]*v[0] + r[1][2]*v[1] + r[2][2]*v[2],
+	}
+}
+
+func (e *Estimator) setEuler(roll, pitch, yaw float64) {
+	cr, sr := math.Cos(radians(roll)/2), math.Sin(radians(roll)/2)
+	cp, sp := math.Cos(radians(pitch)/2), math.Sin(radians(pitch)/2)
+	cy, sy := math.Cos(radians(yaw)/2), math.Sin(radians(yaw)/2)
+	e.q = [4]float64{
+		cr*cp*cy + sr*sp*sy,
+		sr*cp*cy - cr*sp*sy,
+		cr*sp*cy + sr*cp*sy,
+		cr*cp*sy - sr*sp*cy,
+	}
+}
+
+// Euler returns roll, pitch and heading, degrees.
+func (e *Estimator) Euler() (roll, pitch, heading float64) {
+	r := e.rotation()
+	roll = degrees(math.Atan2(r[2][1], r[2][2]))
+	pitch = -degrees(math.Asin(math.Max(-1, math.Min(1, r[2][0]))))
+	heading = degrees(math.Atan2(r[1][0], r[0][0]))
+	if heading < 0 {
+		heading += 360
+	}
+	return
+}
+
+// Set the attitude from the accelerometer, keeping the heading.
+func (e *Estimator) levelFromAccel(a [3]float64) {
+	_, _, heading := e.Euler()
+	roll := degrees(math.Atan2(-a[1], -a[2]))
+	pitch := degrees(math.Asin(math.Max(-1, math.Min(1, a[0]/vecNorm(a)))))
+	e.setEuler(roll, pitch, heading)
+}
+
+// Gyro bias calibration. Returns true while calibration is still running.
+func (e *Estimator) calibrate(in Input) bool {
+	moving := math.Abs(vecNorm(in.Accel)-1) > CAL_ACCEL_LEVEL
+	if e.calN > 0 {
+		for i := 0; i < 3; i++ {
+			if math.Abs(in.Gyro[i]-e.calGyroSum[i]/float64(e.calN)) > CAL_GYRO_MOTION {
+				moving = true
+			}
+		}
+	}
+	if moving {
+		e.resetCalibrationWindow()
+	} else {
+		e.calN++
+		for i := 0; i < 3; i++ {
+			e.calGyroSum[i] += in.Gyro[i]
+			e.calAccelSum[i] += in.Accel[i]
+		}
+	}
+
+	if e.calN > 0 && e.time-e.calStart >= CAL_TIME.Seconds() {
+		var accel [3]float64
+		for i := 0; i < 3; i++ {
+			e.bias[i] = e.calGyroSum[i] / float64(e.calN)
+			accel[i] = e.calAccelSum[i] / float64(e.calN)
+		}
+		e.levelFromAccel(accel)
+		e.cal = CAL_DONE
+		e.attUnc = ACCEL_ACCURACY
+		e.attitudeInit = true
+		return false
+	}
+	if e.time-e.calStarted >= CAL_TIMEOUT.Seconds() || (in.GPSValid && in.GroundSpeed >= GPS_MIN_SPEED) {
+		// Start as best we can. The filter will find the bias.
+		e.levelFromAccel(in.Accel)
+		e.cal = CAL_NONE
+		e.calEnded = e.time
+		e.attUnc = INITIAL_ATTITUDE
+		e.attitudeInit = true
+		return false
+	}
+	return true
+}
+
+// Heading error to a reference, and whether the reference is used.
+func (e *Estimator) headingReference(in Input, heading, dt float64) (err float64, gain float64, accuracy float64, ok bool) {
+	var magHeading float64
+	if in.MagValid {
+		// Tilt compensated: the field rotated to level with the current roll and pitch.
+		roll, pitch, _ := e.Euler()
+		cr, sr := math.Cos(radians(roll)), math.Sin(radians(roll))
+		cp, sp := math.Cos(radians(pitch)), math.Sin(radians(pitch))
+		mx := cp*in.Mag[0] + sp*sr*in.Mag[1] + sp*cr*in.Mag[2]
+		my := cr*in.Mag[1] - sr*in.Mag[2]
+		magHeading = degrees(math.Atan2(-my, mx))
+	}
+
+	gpsOK := in.GPSValid && in.GroundSpeed >= GPS_MIN_SPEED
+	if in.MagValid {
+		if gpsOK {
+			// Learn the offset from magnetic heading (variation, and any mounting error). Slowly, so that the wind
+			// correction angle averages out over the turns.
+			offErr := relAngle(in.TrueCourse - magHeading - e.magOffset)
+			if !e.magOffsetValid {
+				e.magOffset += offErr
+				e.magOffsetValid = true
+			} else {
+				e.magOffset += offErr * math.Min(1, KI_MAG*dt)
+			}
+			e.magOffset = relAngle(e.magOffset)
+		}
+		e.hdgSource = HEADING_MAG
+		return relAngle(magHeading + e.magOffset - heading), KP_MAG, MAG_ACCURACY, true
+	}
+	if gpsOK {
+		// Track differs from heading by the wind correction angle, which we don't know.
+		crab := math.Min(MAX_CRAB, degrees(math.Asin(math.Min(1, WIND_ALLOWANCE/in.GroundSpeed))))
+		e.hdgSource = HEADING_GPS
+		return relAngle(in.TrueCourse - heading), KP_GPS, GPS_ACCURACY + crab, true
+	}
+	e.hdgSource = HEADING_GYRO
+	return 0, 0, 0, false
+}
+
+// Move 'unc' towards 'accuracy' at rate 'gain'.
+func converge(unc, accuracy, gain, dt float64) float64 {
+	return unc + (accuracy-unc)*math.Min(1, gain*dt)
+}
+
+// Update processes one set of readings, 'dt' seconds after the last.
+func (e *Estimator) Update(in Input, dt float64) {
+	if dt <= 0 {
+		return
+	}
+	e.time += dt
+	e.accel = in.Accel
+	for i := 0; i < 3; i++ {
+		e.rate[i] = in.Gyro[i] - e.bias[i]
+	}
+
+	if e.cal == CAL_RUNNING && e.calibrate(in) {
+		return
+	}
+
+	w := [3]float64{radians(e.rate[0]), radians(e.rate[1]), radians(e.rate[2])} // rad/s.
+	r := e.rotation()
+
+	// Accelerations of flight, in the body frame, assuming the velocity is along X: speeding up along X, and
+	// turning (rate x velocity).
+	speed := 0.0
+	if in.GPSValid {
+		gs := in.GroundSpeed * 0.514444 // m/s.
+		vs := in.VertSpeed * 0.3048
+		speed = math.Sqrt(gs*gs + vs*vs)
+		if e.lastSpeed > 0 {
+			e.alongAcc += ((speed-e.lastSpeed)/dt - e.alongAcc) * math.Min(1, dt/ACCEL_FILTER)
+		}
+	} else {
+		e.alongAcc = 0
+	}
+	e.lastSpeed = speed
+	kinematic := [3]float64{e.alongAcc, w[2] * speed, -w[1] * speed}
+
+	// The turn is taken out with the ground speed, not the airspeed, so it is wrong by up to the turn rate times the
+	// wind. With the lag of the along-track acceleration, this limits how well the accelerometer gives the attitude.
+	accAccuracy := ACCEL_ACCURACY
+	if speed > 0 {
+		kinErr := math.Sqrt(w[1]*w[1]+w[2]*w[2])*WIND_ALLOWANCE*0.514444 + ALONG_ACC_ERROR*math.Abs(e.alongAcc)
+		accAccuracy += degrees(math.Atan(kinErr / 9.80665))
+	}
+	var a [3]float64
+	for i := 0; i < 3; i++ {
+		a[i] = in.Accel[i] - kinematic[i]/9.80665
+	}
+
+	// Attitude error from the accelerometer: the measured "up" against the estimated one.
+	var errAcc [3]float64
+	n := vecNorm(a)
+	e.accelUsed = n > 0 && math.Abs(n-1) < ACCEL_TOLERANCE
+	if e.accelUsed {
+		up := toBody(r, [3]float64{0, 0, -1})
+		errAcc = vecCross([3]float64{a[0] / n, a[1] / n, a[2] / n}, up)
+	}
+
+	// Heading error, as a rotation about the earth's down axis.
+	_, _, heading := e.Euler()
+	hdgErr, hdgGain, hdgAccuracy, hdgOK := e.headingReference(in, heading, dt)
+	if hdgOK && e.hdgUnc > HEADING_SNAP {
+		roll, pitch, _ := e.Euler()
+		e.setEuler(roll, pitch, heading+hdgErr)
+		e.hdgUnc = hdgAccuracy
+		hdgErr = 0
+		r = e.rotation()
+	}
+	errHdg := toBody(r, [3]float64{0, 0, radians(hdgErr)})
+
+	// Bias, tracked by integrating the errors. Not from GPS track, whose difference from heading changes through a
+	// turn with the wind.
+	kiHdg := 0.0
+	if e.hdgSource == HEADING_MAG {
+		kiHdg = KI_HEADING * hdgGain
+	}
+	for i := 0; i < 3; i++ {
+		e.bias[i] -= degrees((KI_ACCEL*errAcc[i] + kiHdg*errHdg[i]) * dt)
+		w[i] += KP_ACCEL*errAcc[i] + hdgGain*errHdg[i]
+	}
+
+	// Integrate: q' = q * (0, w) / 2.
+	qw, qx, qy, qz := e.q[0], e.q[1], e.q[2], e.q[3]
+	e.q[0] += 0.5 * dt * (-qx*w[0] - qy*w[1] - qz*w[2])
+	e.q[1] += 0.5 * dt * (qw*w[0] + qy*w[2] - qz*w[1])
+	e.q[2] += 0.5 * dt * (qw*w[1] - qx*w[2] + qz*w[0])
+	e.q[3] += 0.5 * dt * (qw*w[2] + qx*w[1] - qy*w[0])
+	qn := math.Sqrt(e.q[0]*e.q[0] + e.q[1]*e.q[1] + e.q[2]*e.q[2] + e.q[3]*e.q[3])
+	for i := 0; i < 4; i++ {
+		e.q[i] /= qn
+	}
+
+	// Uncertainty.
+	drift := DRIFT_CALIBRATED
+	if e.cal == CAL_NONE {
+		drift += (DRIFT_UNCALIBRATED - DRIFT_CALIBRATED) * math.Exp(-KI_ACCEL*(e.time-e.calEnded))
+	}
+	e.attUnc = math.Min(90, e.attUnc+drift*dt)
+	if e.accelUsed {
+		e.attUnc = converge(e.attUnc, accAccuracy, KP_ACCEL, dt)
+	}
+	e.hdgUnc = math.Min(180, e.hdgUnc+drift*dt)
+	if hdgOK {
+		e.hdgUnc = converge(e.hdgUnc, hdgAccuracy, hdgGain, dt)
+	}
+}
+
+// AttitudeValid reports whether pitch and roll can be used.
+func (e *Estimator) AttitudeValid() bool {
+	return e.attitudeInit && e.attUnc <= MAX_ATTITUDE_UNCERTAINTY
+}
+
+// HeadingValid reports whether heading, as well as pitch and roll, can be used.
+func (e *Estimator) HeadingValid() bool {
+	return e.AttitudeValid() && e.hdgUnc <= MAX_HEADING_UNCERTAINTY
+}
+
+// SlipSkid is the deflection of a slip/skid ball, degrees. Positive is ball to the right. The accelerometer measures the reaction
+// to gravity and acceleration, which points up in coordinated flight; the ball moves the opposite way.
+func (e *Estimator) SlipSkid() float64 {
+	return degrees(math.Atan2(-e.accel[1], -e.accel[2]))
+}
+
+// YawRate is the rate of turn, deg/s. Positive is to the right.
+func (e *Estimator) YawRate() float64 {
+	return e.rate[2]
+}
+
+// GLoad is the load factor, g.
+func (e *Estimator) GLoad() float64 {
+	return vecNorm(e.accel)
+}
+
+// Status returns the state of the estimator.
+func (e *Estimator) Status() Status {
+	return Status{
+		Valid:               e.AttitudeValid(),
+		HeadingValid:        e.HeadingValid(),
+		Calibration:         e.cal,
+		GyroBias:            e.bias,
+		AttitudeUncertainty: e.attUnc,
+		HeadingUncertainty:  e.hdgUnc,
+		HeadingSource:       e.hdgSource,
+		AccelInUse:          e.accelUsed,
+		MagOffset:           e.magOffset,
+		MagOffsetValid:      e.magOffsetValid,
+	}
+}
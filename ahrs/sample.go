@@ -0,0 +1,70 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	sample.go: One estimator update, flattened for the flight log ("ahrs" table) and for replay with
+	 test/ahrs_eval.go.
+*/
+
+package ahrs
+
+// Sample is the input to one update, and the attitude the estimator gave after it.
+type Sample struct {
+	Time float64 // Seconds since the estimator started. Replay takes dt from consecutive samples.
+
+	GyroX, GyroY, GyroZ    float64 // deg/s, uncorrected.
+	AccelX, AccelY, AccelZ float64 // g.
+	MagX, MagY, MagZ       float64
+	MagValid               bool
+	GPSValid               bool
+	GroundSpeed            float64 // kt.
+	TrueCourse             float64 // deg.
+	VertSpeed              float64 // ft/s.
+
+	Roll, Pitch, Heading float64 // deg.
+	Valid                bool
+	HeadingValid         bool
+}
+
+// NewSample records input 'in', given to 'e' at time 't', and the resulting attitude.
+func NewSample(t float64, in Input, e *Estimator) Sample {
+	s := Sample{
+		Time:        t,
+		GyroX:       in.Gyro[0],
+		GyroY:       in.Gyro[1],
+		GyroZ:       in.Gyro[2],
+		AccelX:      in.Accel[0],
+		AccelY:      in.Accel[1],
+		AccelZ:      in.Accel[2],
+		MagX:        in.Mag[0],
+		MagY:        in.Mag[1],
+		MagZ:        in.Mag[2],
+		MagValid:    in.MagValid,
+		GPSValid:    in.GPSValid,
+		GroundSpeed: in.GroundSpeed,
+		TrueCourse:  in.TrueCourse,
+		VertSpeed:   in.VertSpeed,
+	}
+	if e != nil {
+		s.Roll, s.Pitch, s.Heading = e.Euler()
+		s.Valid = e.AttitudeValid()
+		s.HeadingValid = e.HeadingValid()
+	}
+	return s
+}
+
+// Input returns the estimator input recorded in the sample.
+func (s Sample) Input() Input {
+	return Input{
+		Gyro:        [3]float64{s.GyroX, s.GyroY, s.GyroZ},
+		Accel:       [3]float64{s.AccelX, s.AccelY, s.AccelZ},
+		Mag:         [3]float64{s.MagX, s.MagY, s.MagZ},
+		MagValid:    s.MagValid,
+		GPSValid:    s.GPSValid,
+		GroundSpeed: s.GroundSpeed,
+		TrueCourse:  s.TrueCourse,
+		VertSpeed:   s.VertSpeed,
+	}
+}
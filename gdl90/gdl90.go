@@ -0,0 +1,704 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	gdl90.go: De-framing, CRC checking and decoding of the GDL90 messages sent by stratux.
+	Message formats are from the GDL90 Public ICD Rev A (notes/GDL90_Public_ICD_RevA.PDF), plus the
+	"0xCC" and "SX" stratux heartbeat/status messages, the "LE" (0x4C) AHRS report and the "XATT" ForeFlight
+	simulator attitude string.
+*/
+
+package gdl90
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	FLAG_BYTE    = 0x7E
+	CONTROL_BYTE = 0x7D
+
+	MSG_HEARTBEAT         = 0x00
+	MSG_INITIALIZATION    = 0x02
+	MSG_UPLINK            = 0x07
+	MSG_HEIGHT_ABOVE_TERR = 0x09
+	MSG_OWNSHIP           = 0x0A
+	MSG_OWNSHIP_GEO_ALT   = 0x0B
+	MSG_TRAFFIC           = 0x14
+	MSG_BASIC_REPORT      = 0x1E
+	MSG_LONG_REPORT       = 0x1F
+	MSG_AHRS              = 0x4C // "LE".
+	MSG_STRATUX_STATUS    = 0x53 // "SX".
+	MSG_STRATUX_HEARTBEAT = 0xCC
+
+	UPLINK_PAYLOAD_BYTES = 432
+	BASIC_PAYLOAD_BYTES  = 18
+	LONG_PAYLOAD_BYTES   = 34
+	TRAFFIC_REPORT_BYTES = 28
+	STRATUX_STATUS_BYTES = 29
+
+	TOR_INVALID        = 0xFFFFFF
+	TOR_RESOLUTION_NS  = 80
+	ALTITUDE_INVALID   = 0xFFF
+	HVELOCITY_INVALID  = 0xFFF
+	VVELOCITY_INVALID  = 0x800
+	VFOM_NOT_AVAILABLE = 0x7FFF
+	AHRS_INVALID       = 0x7FFF
+	AHRS_ALT_INVALID   = 0xFFFF
+	AHRS_ALT_OFFSET    = 5000 // Pressure altitude is sent +5000 ft.
+	LON_LAT_RESOLUTION = 180.0 / 8388608.0
+	TRACK_RESOLUTION   = 360.0 / 256.0
+	XATT_PREFIX        = "XATT"
+)
+
+// Traffic report "m" field, see p.20.
+const (
+	TRACK_TYPE_INVALID     = 0
+	TRACK_TYPE_TRUE_TRACK  = 1
+	TRACK_TYPE_MAG_HEADING = 2
+	TRACK_TYPE_TRUE_HEAD   = 3
+)
+
+var crc16Table [256]uint16
+
+// Construct the CRC table, see p.7.
+func init() {
+	for i := uint16(0); i < 256; i++ {
+		crc := i << 8
+		for bitctr := 0; bitctr < 8; bitctr++ {
+			z := uint16(0)
+			if (crc & 0x8000) != 0 {
+				z = 0x1021
+			}
+			crc = (crc << 1) ^ z
+		}
+		crc16Table[i] = crc
+	}
+}
+
+// CRC computes the GDL90 FCS (CRC-CCITT) of an unframed message.
+func CRC(data []byte) uint16 {
+	ret := uint16(0)
+	for i := 0; i < len(data); i++ {
+		ret = crc16Table[ret>>8] ^ (ret << 8) ^ uint16(data[i])
+	}
+	return ret
+}
+
+// Frame appends the CRC to 'msg', escapes it and adds the start and end flags. This is what stratux's
+// prepareMessage() does.
+func Frame(msg []byte) []byte {
+	crc := CRC(msg)
+	data := make([]byte, 0, len(msg)+2)
+	data = append(data, msg...)
+	data = append(data, byte(crc&0xFF), byte(crc>>8))
+
+	ret := []byte{FLAG_BYTE}
+	for _, c := range data {
+		if c == FLAG_BYTE || c == CONTROL_BYTE {
+			ret = append(ret, CONTROL_BYTE, c^0x20)
+			continue
+		}
+		ret = append(ret, c)
+	}
+	return append(ret, FLAG_BYTE)
+}
+
+// Unframe un-escapes one framed message and checks its CRC. The start and end flags are optional. Returns the
+// message without the CRC.
+func Unframe(frame []byte) ([]byte, error) {
+	if len(frame) > 0 && frame[0] == FLAG_BYTE {
+		frame = frame[1:]
+	}
+	if len(frame) > 0 && frame[len(frame)-1] == FLAG_BYTE {
+		frame = frame[:len(frame)-1]
+	}
+
+	data := make([]byte, 0, len(frame))
+	for i := 0; i < len(frame); i++ {
+		c := frame[i]
+		if c == FLAG_BYTE {
+			return nil, errors.New(fmt.Sprintf("Unframe: flag byte inside frame at offset %d.", i))
+		}
+		if c == CONTROL_BYTE {
+			i++
+			if i >= len(frame) {
+				return nil, errors.New("Unframe: frame ends with control-escape.")
+			}
+			c = frame[i] ^ 0x20
+		}
+		data = append(data, c)
+	}
+
+	if len(data) < 3 {
+		return nil, errors.New(fmt.Sprintf("Unframe: frame too short (%d bytes).", len(data)))
+	}
+	msg := data[:len(data)-2]
+	crc := uint16(data[len(data)-2]) | (uint16(data[len(data)-1]) << 8)
+	if c := CRC(msg); c != crc {
+		return nil, errors.New(fmt.Sprintf("Unframe: CRC mismatch (got %04X, computed %04X).", crc, c))
+	}
+	return msg, nil
+}
+
+// SplitFrames returns the framed messages in 'buf' (for example, one UDP datagram), without their flags. Bytes
+// before the first flag and after the last one are dropped.
+func SplitFrames(buf []byte) [][]byte {
+	ret := make([][]byte, 0)
+	start := bytes.IndexByte(buf, FLAG_BYTE)
+	end := bytes.LastIndexByte(buf, FLAG_BYTE)
+	if start < 0 || end <= start {
+		return ret
+	}
+	// Back-to-back messages have two flags in a row, giving empty frames in between.
+	for _, frame := range bytes.Split(buf[start+1:end], []byte{FLAG_BYTE}) {
+		if len(frame) > 0 {
+			ret = append(ret, frame)
+		}
+	}
+	return ret
+}
+
+// ScanFrames is a bufio.SplitFunc for reading framed messages from a stream (serial port, TCP connection or
+// capture file). Tokens are frames without their flags, suitable for Unframe().
+func ScanFrames(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	start := bytes.IndexByte(data, FLAG_BYTE)
+	if start < 0 {
+		// No frame in progress, drop what we have.
+		return len(data), nil, nil
+	}
+	// Skip flags between frames.
+	for start+1 < len(data) && data[start+1] == FLAG_BYTE {
+		start++
+	}
+	end := bytes.IndexByte(data[start+1:], FLAG_BYTE)
+	if end < 0 {
+		if atEOF {
+			return len(data), nil, nil
+		}
+		return start, nil, nil // Need more data.
+	}
+	end += start + 1
+	return end, data[start+1 : end], nil
+}
+
+// Heartbeat message (0x00), see p.10.
+type Heartbeat struct {
+	GPSPositionValid  bool
+	MaintRequired     bool
+	IDENT             bool
+	AddressType       bool // Talkback: transmitting with a self-assigned address.
+	GPSBatteryLow     bool
+	RATCS             bool
+	UATInitialized    bool
+	CSARequested      bool
+	CSANotAvailable   bool
+	UTCOK             bool
+	Timestamp         uint32 // Seconds since 0000Z.
+	UplinkMessages    uint8  // Received last second.
+	BasicLongMessages uint16 // Received last second.
+}
+
+// Initialization message (0x02, display to GDL90), see p.13.
+type Initialization struct {
+	AudioTest       bool
+	AudioInhibit    bool
+	CDTIOK          bool
+	CSAAudioDisable bool
+	CSADisable      bool
+}
+
+// Uplink data message (0x07), see p.15.
+type Uplink struct {
+	TOR      uint32 // Time of reception, 80ns units into the current second.
+	TORValid bool
+	Payload  []byte // UAT-specific header and application data, 432 bytes.
+}
+
+// Height above terrain message (0x09, display to GDL90), see p.27.
+type HeightAboveTerrain struct {
+	Height int16 // ft.
+	Valid  bool
+}
+
+// TrafficReport is the traffic (0x14) and ownship (0x0A) report data, see p.17.
+type TrafficReport struct {
+	AlertStatus     uint8
+	AddressType     uint8
+	Address         uint32
+	Lat             float64
+	Lng             float64
+	PositionValid   bool  // Lat, Lng and NIC all zero means no position.
+	Altitude        int32 // ft, pressure altitude.
+	AltitudeValid   bool
+	TrackType       uint8 // TRACK_TYPE_*.
+	Extrapolated    bool
+	Airborne        bool
+	NIC             uint8
+	NACp            uint8
+	Speed           uint16 // kts.
+	SpeedValid      bool
+	Vvel            int32 // ft/min.
+	VvelValid       bool
+	Track           float64 // Degrees, see TrackType.
+	EmitterCategory uint8
+	Callsign        string
+	Priority        uint8 // Emergency/priority code.
+}
+
+// OwnshipReport (0x0A) has the same format as a traffic report.
+type OwnshipReport struct {
+	TrafficReport
+}
+
+// Ownship geometric altitude message (0x0B), see p.28.
+type OwnshipGeoAltitude struct {
+	Altitude        int32 // ft, height above the WGS-84 ellipsoid.
+	VerticalWarning bool
+	VFOM            uint16 // m.
+	VFOMValid       bool
+}
+
+// PassThroughReport is a basic (0x1E) or long (0x1F) UAT report, see p.26.
+type PassThroughReport struct {
+	Long     bool
+	TOR      uint32
+	TORValid bool
+	Payload  []byte
+}
+
+// StratuxHeartbeat is the stratux heartbeat message (0xCC). See makeStratuxHeartbeat().
+type StratuxHeartbeat struct {
+	ProtocolVersion uint8
+	GPSValid        bool
+	AHRSValid       bool
+}
+
+// StratuxTower is an ADS-B tower heard in the last minute, from the "SX" status message.
+type StratuxTower struct {
+	Lat         float64
+	Lng         float64
+	Signal      int8 // Average RSSI over the last minute, dB.
+	SignalValid bool // Older versions don't send the signal strengths.
+}
+
+// StratuxStatus is the "SX" stratux status message. See makeStratuxStatus() and
+// http://hiltonsoftware.com/stratux/ (V104).
+type StratuxStatus struct {
+	StatusID          uint8 // 1.
+	MessageVersion    uint8
+	VersionMajor      uint8
+	VersionMinor      uint8
+	VersionType       uint8 // 1 = beta, 2 = release, 3 = release candidate.
+	VersionBuild      uint8
+	HardwareRevision  uint32
+	GPSFix            uint8 // 0 = none, 1 = 3D, 2 = DGPS (SBAS/WAAS).
+	AHRSValid         bool
+	PressureValid     bool
+	CPUTempValid      bool
+	UATEnabled        bool
+	ESEnabled         bool
+	GPSEnabled        bool
+	AHRSEnabled       bool
+	Radios            uint8
+	IMUConnected      bool
+	SatellitesLocked  uint8
+	SatellitesTracked uint8
+	UATTraffic        uint16
+	ESTraffic         uint16
+	UATMessagesPerMin uint16
+	ESMessagesPerMin  uint16
+	CPUTemp           float64 // °C.
+	Towers            []StratuxTower
+}
+
+// AHRSReport is the "LE" (0x4C) AHRS report. Angles in degrees, rates in degrees/second. Version 1 adds airspeed,
+// pressure altitude and vertical speed; they are invalid in version 0 reports.
+type AHRSReport struct {
+	SubID         uint8 // 1 = AHRS.
+	Version       uint8
+	Roll          float64
+	RollValid     bool
+	Pitch         float64
+	PitchValid    bool
+	Heading       float64
+	HeadingValid  bool
+	SlipSkid      float64
+	SlipSkidValid bool
+	YawRate       float64
+	YawRateValid  bool
+	G             float64
+	GValid        bool
+
+	Airspeed           float64 // Knots, indicated.
+	AirspeedValid      bool
+	PressureAlt        float64 // Feet.
+	PressureAltValid   bool
+	VerticalSpeed      float64 // Feet/minute.
+	VerticalSpeedValid bool
+}
+
+// XATTReport is the ForeFlight simulator attitude string, "XATT<name>,<heading>,<pitch>,<roll>". It is sent
+// unframed.
+type XATTReport struct {
+	Name    string
+	Heading float64
+	Pitch   float64
+	Roll    float64
+}
+
+// Unknown is a CRC-valid message of a type not decoded here.
+type Unknown struct {
+	ID   uint8
+	Data []byte
+}
+
+func tooShort(name string, msg []byte, n int) error {
+	if len(msg) < n {
+		return errors.New(fmt.Sprintf("Decode: %s message too short (%d bytes, expected %d).", name, len(msg), n))
+	}
+	return nil
+}
+
+// 24-bit signed binary fraction, see p.19.
+func decodeLatLng(b []byte) float64 {
+	v := int32(b[0])<<16 | int32(b[1])<<8 | int32(b[2])
+	if v&0x800000 != 0 {
+		v -= 0x1000000
+	}
+	return float64(v) * LON_LAT_RESOLUTION
+}
+
+// 24-bit time of reception, LS byte first, see p.15.
+func decodeTOR(b []byte) (uint32, bool) {
+	tor := uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+	return tor, tor != TOR_INVALID
+}
+
+func decodeHeartbeat(msg []byte) (*Heartbeat, error) {
+	if err := tooShort("heartbeat", msg, 7); err != nil {
+		return nil, err
+	}
+	h := &Heartbeat{
+		GPSPositionValid: msg[1]&0x80 != 0,
+		MaintRequired:    msg[1]&0x40 != 0,
+		IDENT:            msg[1]&0x20 != 0,
+		AddressType:      msg[1]&0x10 != 0,
+		GPSBatteryLow:    msg[1]&0x08 != 0,
+		RATCS:            msg[1]&0x04 != 0,
+		UATInitialized:   msg[1]&0x01 != 0,
+		CSARequested:     msg[2]&0x40 != 0,
+		CSANotAvailable:  msg[2]&0x20 != 0,
+		UTCOK:            msg[2]&0x01 != 0,
+	}
+	h.Timestamp = uint32(msg[2]>>7)<<16 | uint32(msg[4])<<8 | uint32(msg[3])
+	h.UplinkMessages = msg[5] >> 3
+	h.BasicLongMessages = uint16(msg[5]&0x03)<<8 | uint16(msg[6])
+	return h, nil
+}
+
+func decodeInitialization(msg []byte) (*Initialization, error) {
+	if err := tooShort("initialization", msg, 3); err != nil {
+		return nil, err
+	}
+	return &Initialization{
+		AudioTest:       msg[1]&0x40 != 0,
+		AudioInhibit:    msg[1]&0x02 != 0,
+		CDTIOK:          msg[1]&0x01 != 0,
+		CSAAudioDisable: msg[2]&0x02 != 0,
+		CSADisable:      msg[2]&0x01 != 0,
+	}, nil
+}
+
+func decodeUplink(msg []byte) (*Uplink, error) {
+	if err := tooShort("uplink", msg, 4+UPLINK_PAYLOAD_BYTES); err != nil {
+		return nil, err
+	}
+	u := &Uplink{Payload: msg[4:]}
+	u.TOR, u.TORValid = decodeTOR(msg[1:4])
+	return u, nil
+}
+
+func decodeHeightAboveTerrain(msg []byte) (*HeightAboveTerrain, error) {
+	if err := tooShort("height above terrain", msg, 3); err != nil {
+		return nil, err
+	}
+	raw := uint16(msg[1])<<8 | uint16(msg[2])
+	return &HeightAboveTerrain{Height: int16(raw), Valid: raw != 0x8000}, nil
+}
+
+func decodeTrafficReport(msg []byte) (*TrafficReport, error) {
+	if err := tooShort("traffic report", msg, TRAFFIC_REPORT_BYTES); err != nil {
+		return nil, err
+	}
+	t := &TrafficReport{
+		AlertStatus: msg[1] >> 4,
+		AddressType: msg[1] & 0x0F,
+		Address:     uint32(msg[2])<<16 | uint32(msg[3])<<8 | uint32(msg[4]),
+		Lat:         decodeLatLng(msg[5:8]),
+		Lng:         decodeLatLng(msg[8:11]),
+		NIC:         msg[13] >> 4,
+		NACp:        msg[13] & 0x0F,
+	}
+	t.PositionValid = t.Lat != 0 || t.Lng != 0 || t.NIC != 0
+
+	alt := uint16(msg[11])<<4 | uint16(msg[12]>>4)
+	if alt != ALTITUDE_INVALID {
+		t.AltitudeValid = true
+		t.Altitude = int32(alt)*25 - 1000
+	}
+
+	m := msg[12] & 0x0F
+	t.TrackType = m & 0x03
+	t.Extrapolated = m&0x04 != 0
+	t.Airborne = m&0x08 != 0
+
+	spd := uint16(msg[14])<<4 | uint16(msg[15]>>4)
+	if spd != HVELOCITY_INVALID {
+		t.SpeedValid = true
+		t.Speed = spd
+	}
+
+	vv := uint16(msg[15]&0x0F)<<8 | uint16(msg[16])
+	if vv != VVELOCITY_INVALID {
+		t.VvelValid = true
+		v := int32(vv)
+		if v&0x800 != 0 {
+			v -= 0x1000
+		}
+		t.Vvel = v * 64
+	}
+
+	t.Track = float64(msg[17]) * TRACK_RESOLUTION
+	t.EmitterCategory = msg[18]
+	t.Callsign = strings.TrimRight(string(msg[19:27]), " \x00")
+	t.Priority = msg[27] >> 4
+	return t, nil
+}
+
+func decodeOwnshipGeoAltitude(msg []byte) (*OwnshipGeoAltitude, error) {
+	if err := tooShort("ownship geometric altitude", msg, 5); err != nil {
+		return nil, err
+	}
+	g := &OwnshipGeoAltitude{
+		Altitude:        int32(int16(uint16(msg[1])<<8|uint16(msg[2]))) * 5,
+		VerticalWarning: msg[3]&0x80 != 0,
+		VFOM:            uint16(msg[3]&0x7F)<<8 | uint16(msg[4]),
+	}
+	g.VFOMValid = g.VFOM != VFOM_NOT_AVAILABLE
+	return g, nil
+}
+
+func decodePassThroughReport(msg []byte) (*PassThroughReport, error) {
+	r := &PassThroughReport{Long: msg[0] == MSG_LONG_REPORT}
+	n := BASIC_PAYLOAD_BYTES
+	if r.Long {
+		n = LONG_PAYLOAD_BYTES
+	}
+	if err := tooShort("pass-through report", msg, 4+n); err != nil {
+		return nil, err
+	}
+	r.TOR, r.TORValid = decodeTOR(msg[1:4])
+	r.Payload = msg[4 : 4+n]
+	return r, nil
+}
+
+func decodeStratuxHeartbeat(msg []byte) (*StratuxHeartbeat, error) {
+	if err := tooShort("stratux heartbeat", msg, 2); err != nil {
+		return nil, err
+	}
+	return &StratuxHeartbeat{
+		ProtocolVersion: msg[1] >> 2,
+		GPSValid:        msg[1]&0x02 != 0,
+		AHRSValid:       msg[1]&0x01 != 0,
+	}, nil
+}
+
+func decodeStratuxStatus(msg []byte) (*StratuxStatus, error) {
+	if err := tooShort("stratux status", msg, STRATUX_STATUS_BYTES); err != nil {
+		return nil, err
+	}
+	if msg[1] != 'X' {
+		return nil, errors.New(fmt.Sprintf("Decode: unknown stratux message 'S%c'.", msg[1]))
+	}
+	s := &StratuxStatus{
+		StatusID:          msg[2],
+		MessageVersion:    msg[3],
+		VersionMajor:      msg[4],
+		VersionMinor:      msg[5],
+		VersionType:       msg[6],
+		VersionBuild:      msg[7],
+		HardwareRevision:  uint32(msg[8])<<24 | uint32(msg[9])<<16 | uint32(msg[10])<<8 | uint32(msg[11]),
+		AHRSEnabled:       msg[12]&0x01 != 0,
+		GPSFix:            msg[13] & 0x03,
+		AHRSValid:         msg[13]&(1<<2) != 0,
+		PressureValid:     msg[13]&(1<<3) != 0,
+		CPUTempValid:      msg[13]&(1<<4) != 0,
+		UATEnabled:        msg[13]&(1<<5) != 0,
+		ESEnabled:         msg[13]&(1<<6) != 0,
+		GPSEnabled:        msg[13]&(1<<7) != 0,
+		Radios:            msg[15] & 0x03,
+		IMUConnected:      msg[15]&(1<<2) != 0,
+		SatellitesLocked:  msg[16],
+		SatellitesTracked: msg[17],
+		UATTraffic:        uint16(msg[18])<<8 | uint16(msg[19]),
+		ESTraffic:         uint16(msg[20])<<8 | uint16(msg[21]),
+		UATMessagesPerMin: uint16(msg[22])<<8 | uint16(msg[23]),
+		ESMessagesPerMin:  uint16(msg[24])<<8 | uint16(msg[25]),
+		CPUTemp:           float64(int16(uint16(msg[26])<<8|uint16(msg[27]))) / 10.0,
+	}
+
+	n := int(msg[28])
+	if err := tooShort("stratux status", msg, STRATUX_STATUS_BYTES+6*n); err != nil {
+		return nil, err
+	}
+	s.Towers = make([]StratuxTower, n)
+	for i := 0; i < n; i++ {
+		b := msg[STRATUX_STATUS_BYTES+6*i:]
+		s.Towers[i] = StratuxTower{Lat: decodeLatLng(b[0:3]), Lng: decodeLatLng(b[3:6])}
+	}
+	// Signal strengths follow the tower list, one byte per tower.
+	if len(msg) >= STRATUX_STATUS_BYTES+7*n {
+		for i := 0; i < n; i++ {
+			s.Towers[i].Signal = int8(msg[STRATUX_STATUS_BYTES+6*n+i])
+			s.Towers[i].SignalValid = true
+		}
+	}
+	return s, nil
+}
+
+func decodeAHRSValue(b []byte) (float64, bool) {
+	raw := int16(uint16(b[0])<<8 | uint16(b[1]))
+	if raw == AHRS_INVALID {
+		return 0, false
+	}
+	return float64(raw) / 10.0, true
+}
+
+func decodeAHRSReport(msg []byte) (*AHRSReport, error) {
+	if err := tooShort("AHRS", msg, 16); err != nil {
+		return nil, err
+	}
+	if msg[1] != 'E' {
+		return nil, errors.New(fmt.Sprintf("Decode: unknown 'L' message 'L%c'.", msg[1]))
+	}
+	a := &AHRSReport{SubID: msg[2], Version: msg[3]}
+	a.Roll, a.RollValid = decodeAHRSValue(msg[4:6])
+	a.Pitch, a.PitchValid = decodeAHRSValue(msg[6:8])
+	a.Heading, a.HeadingValid = decodeAHRSValue(msg[8:10])
+	a.SlipSkid, a.SlipSkidValid = decodeAHRSValue(msg[10:12])
+	a.YawRate, a.YawRateValid = decodeAHRSValue(msg[12:14])
+	a.G, a.GValid = decodeAHRSValue(msg[14:16])
+	if a.Version < 1 {
+		return a, nil
+	}
+	if err := tooShort("AHRS", msg, 22); err != nil {
+		return nil, err
+	}
+	if raw := int16(uint16(msg[16])<<8 | uint16(msg[17])); raw != AHRS_INVALID {
+		a.Airspeed, a.AirspeedValid = float64(raw), true
+	}
+	if raw := uint16(msg[18])<<8 | uint16(msg[19]); raw != AHRS_ALT_INVALID {
+		a.PressureAlt, a.PressureAltValid = float64(raw)-AHRS_ALT_OFFSET, true
+	}
+	if raw := int16(uint16(msg[20])<<8 | uint16(msg[21])); raw != AHRS_INVALID {
+		a.VerticalSpeed, a.VerticalSpeedValid = float64(raw), true
+	}
+	return a, nil
+}
+
+// Decode decodes an unframed message (as returned by Unframe()). The result is one of *Heartbeat,
+// *Initialization, *Uplink, *HeightAboveTerrain, *OwnshipReport, *OwnshipGeoAltitude, *TrafficReport,
+// *PassThroughReport, *AHRSReport, *StratuxStatus, *StratuxHeartbeat or *Unknown.
+func Decode(msg []byte) (interface{}, error) {
+	if len(msg) == 0 {
+		return nil, errors.New("Decode: empty message.")
+	}
+	switch msg[0] {
+	case MSG_HEARTBEAT:
+		return decodeHeartbeat(msg)
+	case MSG_INITIALIZATION:
+		return decodeInitialization(msg)
+	case MSG_UPLINK:
+		return decodeUplink(msg)
+	case MSG_HEIGHT_ABOVE_TERR:
+		return decodeHeightAboveTerrain(msg)
+	case MSG_OWNSHIP:
+		t, err := decodeTrafficReport(msg)
+		if err != nil {
+			return nil, err
+		}
+		return &OwnshipReport{*t}, nil
+	case MSG_OWNSHIP_GEO_ALT:
+		return decodeOwnshipGeoAltitude(msg)
+	case MSG_TRAFFIC:
+		return decodeTrafficReport(msg)
+	case MSG_BASIC_REPORT, MSG_LONG_REPORT:
+		return decodePassThroughReport(msg)
+	case MSG_AHRS:
+		return decodeAHRSReport(msg)
+	case MSG_STRATUX_STATUS:
+		return decodeStratuxStatus(msg)
+	case MSG_STRATUX_HEARTBEAT:
+		return decodeStratuxHeartbeat(msg)
+	}
+	return &Unknown{ID: msg[0], Data: msg}, nil
+}
+
+// ParseXATT parses a ForeFlight simulator attitude string, e.g. "XATTStratux,123.4,2.5,-10.1".
+func ParseXATT(s string) (*XATTReport, error) {
+	if !strings.HasPrefix(s, XATT_PREFIX) {
+		return nil, errors.New("ParseXATT: not an XATT message.")
+	}
+	x := strings.Split(strings.TrimSpace(s[len(XATT_PREFIX):]), ",")
+	if len(x) != 4 {
+		return nil, errors.New(fmt.Sprintf("ParseXATT: expected 4 fields, got %d.", len(x)))
+	}
+	var v [3]float64
+	for i := range v {
+		f, err := strconv.ParseFloat(x[i+1], 64)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("ParseXATT: invalid value '%s'.", x[i+1]))
+		}
+		v[i] = f
+	}
+	return &XATTReport{Name: x[0], Heading: v[0], Pitch: v[1], Roll: v[2]}, nil
+}
+
+// Parse decodes everything in one datagram (a UDP packet from port 4000, or the AHRS simulator port). A
+// datagram holds one or more framed messages, or an unframed XATT string. Messages that fail to decode are
+// returned as errors and don't stop the rest of the datagram from being decoded.
+func Parse(buf []byte) ([]interface{}, []error) {
+	msgs := make([]interface{}, 0)
+	errs := make([]error, 0)
+	if bytes.HasPrefix(buf, []byte(XATT_PREFIX)) {
+		x, err := ParseXATT(string(buf))
+		if err != nil {
+			errs = append(errs, err)
+		} else {
+			msgs = append(msgs, x)
+		}
+		return msgs, errs
+	}
+
+	for _, frame := range SplitFrames(buf) {
+		msg, err := Unframe(frame)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		m, err := Decode(msg)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, errs
+}
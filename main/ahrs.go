@@ -0,0 +1,41 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	ahrs.go: The running attitude estimator (package ahrs), fed by attitudeReaderSender() and read by the web
+	 interface.
+*/
+
+package main
+
+import (
+	"../ahrs"
+	"sync"
+)
+
+const (
+	AHRS_REPORT_INTERVAL = 5 // Attitude is reported every AHRS_REPORT_INTERVAL updates (10 Hz).
+)
+
+var myAHRS *ahrs.Estimator
+var myAHRSStatus ahrs.Status // Copy of myAHRS.Status() as of the last attitude report.
+var ahrsMutex = &sync.Mutex{}
+
+// Status of the estimator as of the last attitude report.
+func getAHRSStatus() ahrs.Status {
+	ahrsMutex.Lock()
+	defer ahrsMutex.Unlock()
+	return myAHRSStatus
+}
+
+// Start a gyro calibration. The aircraft must be kept still.
+func calibrateAHRS() {
+	ahrsMutex.Lock()
+	defer ahrsMutex.Unlock()
+	if myAHRS != nil {
+		myAHRS.StartCalibration()
+		myAHRSStatus = myAHRS.Status()
+	}
+}
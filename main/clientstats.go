@@ -0,0 +1,134 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	clientstats.go: Per-client network statistics history, for diagnosing clients that stop receiving data.
+*/
+
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	CLIENT_STATS_INTERVAL = 15 * time.Second // How often each client's counters are sampled (messageQueueSender's timer).
+	CLIENT_STATS_HISTORY  = 30 * time.Minute // How long samples are kept, including for clients that have gone.
+)
+
+// Counters of a client at one time. Counters are cumulative since the client connected.
+type clientStatsSample struct {
+	Time               time.Time // UTC.
+	MessagesSent       uint64
+	BytesSent          uint64
+	MessagesDropped    uint64
+	SleepTime          float64 // Seconds.
+	ThrottleTime       float64 // Seconds.
+	QueueLen           int
+	Sleeping           bool
+	LastUnreachableAge float64 // Seconds since the last ICMP Unreachable, -1 if none has been received.
+	sampled            time.Time
+}
+
+type clientHistory struct {
+	Ip       string
+	Port     uint32
+	Hostname string // From the DHCP lease.
+	App      string // EFB app, if it identified itself.
+	Samples  []clientStatsSample
+}
+
+var clientStatsHistory map[string]*clientHistory // Indexed by "ip:port".
+
+// Add sleep and throttle time for every client. 'dt' is the time since the last call, seconds. Must be called with
+// netMutex held.
+func updateClientSleepTimes(dt float64) {
+	for k, netconn := range outSockets {
+		if isSleeping(k) {
+			netconn.SleepTime += dt
+		} else if !netconn.Static && stratuxClock.Since(netconn.LastUnreachable) < 15*time.Second {
+			netconn.ThrottleTime += dt // See isThrottled().
+		}
+		outSockets[k] = netconn
+	}
+}
+
+// Record a sample of every client's counters, and drop samples older than CLIENT_STATS_HISTORY.
+func sampleClientStats() {
+	netMutex.Lock()
+	defer netMutex.Unlock()
+	if clientStatsHistory == nil {
+		clientStatsHistory = make(map[string]*clientHistory)
+	}
+	for k, netconn := range outSockets {
+		h, ok := clientStatsHistory[k]
+		if !ok {
+			h = &clientHistory{Ip: netconn.Ip, Port: netconn.Port}
+			clientStatsHistory[k] = h
+		}
+		h.Hostname = dhcpLeases[netconn.Ip]
+		h.App = netconn.App
+		sample := clientStatsSample{
+			Time:               time.Now().UTC(),
+			MessagesSent:       netconn.MessagesSent,
+			BytesSent:          netconn.BytesSent,
+			MessagesDropped:    netconn.MessagesDropped,
+			SleepTime:          netconn.SleepTime,
+			ThrottleTime:       netconn.ThrottleTime,
+			QueueLen:           len(netconn.messageQueue),
+			Sleeping:           isSleeping(k),
+			LastUnreachableAge: -1,
+			sampled:            stratuxClock.Time,
+		}
+		if !netconn.LastUnreachable.IsZero() {
+			sample.LastUnreachableAge = stratuxClock.Since(netconn.LastUnreachable).Seconds()
+		}
+		h.Samples = append(h.Samples, sample)
+	}
+
+	for k, h := range clientStatsHistory {
+		i := 0
+		for i < len(h.Samples) && stratuxClock.Since(h.Samples[i].sampled) > CLIENT_STATS_HISTORY {
+			i++
+		}
+		h.Samples = h.Samples[i:]
+		if len(h.Samples) == 0 {
+			delete(clientStatsHistory, k)
+		}
+	}
+}
+
+type clientHistoryByAddr []clientHistory
+
+func (c clientHistoryByAddr) Len() int      { return len(c) }
+func (c clientHistoryByAddr) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+func (c clientHistoryByAddr) Less(i, j int) bool {
+	if c[i].Ip != c[j].Ip {
+		return c[i].Ip < c[j].Ip
+	}
+	return c[i].Port < c[j].Port
+}
+
+// History of every client over the last 'd'.
+func getClientStatsHistory(d time.Duration) []clientHistory {
+	netMutex.Lock()
+	defer netMutex.Unlock()
+	ret := make([]clientHistory, 0, len(clientStatsHistory))
+	for _, h := range clientStatsHistory {
+		c := *h
+		c.Samples = make([]clientStatsSample, 0, len(h.Samples))
+		for _, sample := range h.Samples {
+			if stratuxClock.Since(sample.sampled) <= d {
+				c.Samples = append(c.Samples, sample)
+			}
+		}
+		if len(c.Samples) > 0 {
+			ret = append(ret, c)
+		}
+	}
+	sort.Sort(clientHistoryByAddr(ret))
+	return ret
+}
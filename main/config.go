@@ -0,0 +1,458 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	config.go: Settings file. Reading (with migrations from older formats), validation, atomic writes, and reloading
+	 when the file changes or on SIGHUP.
+*/
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	SETTINGS_VERSION       = 1               // Format written by saveSettings().
+	SETTINGS_POLL_INTERVAL = 5 * time.Second // How often the settings file is checked for changes.
+	SETTINGS_MAX_PPM       = 1000            // Larger SDR frequency corrections are typos.
+)
+
+// Migrations of the settings file, from version i to i+1. 'buf' is the file, 's' the settings read from it.
+var settingsMigrations = []func(buf []byte, s *settings){
+	migrateOutputSettings, // 0 -> 1: UDP, TCP and serial outputs moved to the Outputs list.
+}
+
+// Checks of individual settings, by key. Outputs are checked by checkOutputs().
+var settingsChecks = map[string]func(s *settings) error{
+	"PPM": func(s *settings) error {
+		if s.PPM < -SETTINGS_MAX_PPM || s.PPM > SETTINGS_MAX_PPM {
+			return fmt.Errorf("must be between %d and %d", -SETTINGS_MAX_PPM, SETTINGS_MAX_PPM)
+		}
+		return nil
+	},
+	"FlightLogLevel": func(s *settings) error {
+		if s.FlightLogLevel < FLIGHT_LOG_LEVEL_OFF || s.FlightLogLevel > FLIGHT_LOG_LEVEL_DEBUG {
+			return fmt.Errorf("must be between %d and %d", FLIGHT_LOG_LEVEL_OFF, FLIGHT_LOG_LEVEL_DEBUG)
+		}
+		return nil
+	},
+	"OwnshipModeS": func(s *settings) error {
+		if _, err := hex.DecodeString(s.OwnshipModeS); err != nil || len(s.OwnshipModeS) != 6 {
+			return errors.New("must be 6 hex digits")
+		}
+		return nil
+	},
+	"OwnshipTail": func(s *settings) error {
+		if len(s.OwnshipTail) > 8 || strings.Trim(s.OwnshipTail, "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "" {
+			return errors.New("must be up to 8 letters and digits")
+		}
+		return nil
+	},
+	"OwnshipCategory": func(s *settings) error {
+		if s.OwnshipCategory > 39 {
+			return errors.New("must be a GDL90 emitter category, 0 to 39")
+		}
+		return nil
+	},
+	"OwnshipAircraftType": func(s *settings) error {
+		if len(s.OwnshipAircraftType) > 4 {
+			return errors.New("must be an ICAO type designator, up to 4 characters")
+		}
+		return nil
+	},
+	"TrafficAlertDistance": func(s *settings) error {
+		if s.TrafficAlertDistance <= 0 {
+			return errors.New("must be greater than 0")
+		}
+		return nil
+	},
+	"TrafficAlertAltitude": func(s *settings) error {
+		if s.TrafficAlertAltitude <= 0 {
+			return errors.New("must be greater than 0")
+		}
+		return nil
+	},
+	"TrafficAlertTime": func(s *settings) error {
+		if s.TrafficAlertTime < 0 {
+			return errors.New("must not be negative")
+		}
+		return nil
+	},
+	"TrafficCoastTime": func(s *settings) error {
+		if s.TrafficCoastTime < 0 || s.TrafficCoastTime > TRAFFIC_COAST_MAX_TIME {
+			return fmt.Errorf("must be between 0 and %d", TRAFFIC_COAST_MAX_TIME)
+		}
+		return nil
+	},
+}
+
+// Check every output. Returns the valid outputs, and an error for each invalid one keyed "Outputs.{ID}". An output
+// that conflicts with an earlier one is invalid.
+func checkOutputs(outputs []outputEndpoint) ([]outputEndpoint, map[string]string) {
+	valid := make([]outputEndpoint, 0, len(outputs))
+	invalid := make(map[string]string)
+	for _, o := range outputs {
+		key := fmt.Sprintf("Outputs.%d", o.ID)
+		if o.ID <= 0 {
+			invalid[key] = "invalid output ID"
+			continue
+		}
+		if outputIndexIn(valid, o.ID) >= 0 {
+			invalid[key] = "duplicate output ID"
+			continue
+		}
+		if err := validateOutput(o, valid); err != nil {
+			invalid[key] = err.Error()
+			continue
+		}
+		valid = append(valid, o)
+	}
+	return valid, invalid
+}
+
+// Check all settings. Returns an error message for each invalid setting, by key.
+func validateSettings(s *settings) map[string]string {
+	_, invalid := checkOutputs(s.Outputs)
+	for key, check := range settingsChecks {
+		if err := check(s); err != nil {
+			invalid[key] = err.Error()
+		}
+	}
+	return invalid
+}
+
+// Read a settings file over the defaults, migrating it from older versions. Settings that can't be read or are
+// invalid keep their defaults (invalid outputs are dropped), and are returned in 'invalid'. An error is returned only
+// if the file isn't a JSON object.
+func parseSettings(buf []byte) (s settings, invalid map[string]string, err error) {
+	var raw map[string]json.RawMessage
+	if err = json.Unmarshal(buf, &raw); err != nil {
+		return
+	}
+
+	s = newDefaultSettings()
+	s.SettingsVersion = 0 // Files before versioning don't have one.
+	s.Outputs = nil       // Replaced, not merged into the defaults. Filled in below if missing.
+	defaults := newDefaultSettings()
+	invalid = make(map[string]string)
+
+	// Field by field, so that one bad value doesn't lose the rest of the file.
+	v := reflect.ValueOf(&s).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Name
+		msg, ok := raw[name]
+		if !ok {
+			continue
+		}
+		field := v.Field(i)
+		if e := json.Unmarshal(msg, field.Addr().Interface()); e != nil {
+			field.Set(reflect.ValueOf(defaults).Field(i))
+			invalid[name] = e.Error()
+		}
+	}
+
+	if s.SettingsVersion > SETTINGS_VERSION {
+		log.Printf("settings file version %d is newer than this version of Stratux (%d).\n", s.SettingsVersion, SETTINGS_VERSION)
+	}
+	for ver := s.SettingsVersion; ver >= 0 && ver < len(settingsMigrations); ver++ {
+		settingsMigrations[ver](buf, &s)
+	}
+	if s.Outputs == nil {
+		s.Outputs = defaultOutputs()
+	}
+	s.SettingsVersion = SETTINGS_VERSION
+
+	var badOutputs map[string]string
+	s.Outputs, badOutputs = checkOutputs(s.Outputs)
+	for key, msg := range badOutputs {
+		invalid[key] = msg
+	}
+	for key, check := range settingsChecks {
+		if e := check(&s); e != nil {
+			v.FieldByName(key).Set(reflect.ValueOf(defaults).FieldByName(key))
+			invalid[key] = e.Error()
+		}
+	}
+	return
+}
+
+// Modification time and size of the settings file when it was last read or written, to tell our own writes from
+// changes made by something else.
+var settingsFileStamp struct {
+	modTime time.Time
+	size    int64
+}
+var settingsFileMutex = &sync.Mutex{}
+
+func updateSettingsFileStamp() {
+	if fi, err := os.Stat(configLocation); err == nil {
+		settingsFileStamp.modTime = fi.ModTime()
+		settingsFileStamp.size = fi.Size()
+	}
+}
+
+// Read configLocation. Invalid settings are reported as system errors.
+func loadSettingsFile() (settings, error) {
+	settingsFileMutex.Lock()
+	buf, err := ioutil.ReadFile(configLocation)
+	updateSettingsFileStamp()
+	settingsFileMutex.Unlock()
+	if err != nil {
+		return settings{}, err
+	}
+	s, invalid, err := parseSettings(buf)
+	if err != nil {
+		return s, err
+	}
+	keys := make([]string, 0, len(invalid))
+	for key := range invalid {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		action := "The default is being used."
+		if strings.HasPrefix(key, "Outputs.") {
+			action = "The output is disabled."
+		}
+		err_set := fmt.Errorf("Setting %s in %s is invalid (%s). %s", key, configLocation, invalid[key], action)
+		addSystemError(err_set)
+		log.Printf("%s\n", err_set.Error())
+	}
+	return s, nil
+}
+
+func readSettings() {
+	s, err := loadSettingsFile()
+	if err != nil {
+		log.Printf("can't read settings %s: %s\n", configLocation, err.Error())
+		defaultSettings()
+		return
+	}
+	globalSettings = s
+	log.Printf("read in settings.\n")
+}
+
+// Write the settings to a temporary file and rename it over configLocation, so that a crash or power loss while
+// saving leaves either the old or the new file.
+func saveSettings() {
+	outputsMutex.Lock()
+	globalSettings.SettingsVersion = SETTINGS_VERSION
+	jsonSettings, _ := json.Marshal(&globalSettings)
+	outputsMutex.Unlock()
+
+	settingsFileMutex.Lock()
+	defer settingsFileMutex.Unlock()
+	tmp := configLocation + ".tmp"
+	err := writeFileSync(tmp, jsonSettings, os.FileMode(0644))
+	if err == nil {
+		err = os.Rename(tmp, configLocation)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		err_ret := fmt.Errorf("can't save settings %s: %s", configLocation, err.Error())
+		addSystemError(err_ret)
+		log.Printf("%s\n", err_ret.Error())
+		return
+	}
+	updateSettingsFileStamp()
+	log.Printf("wrote settings.\n")
+}
+
+// Write 'data' to 'fn' and flush it to disk.
+func writeFileSync(fn string, data []byte, perm os.FileMode) error {
+	fd, err := os.OpenFile(fn, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err = fd.Write(data); err == nil {
+		err = fd.Sync()
+	}
+	if errClose := fd.Close(); err == nil {
+		err = errClose
+	}
+	return err
+}
+
+// Re-read the settings file and apply it. The current settings are kept if the file can't be read.
+func reloadSettings() {
+	s, err := loadSettingsFile()
+	if err != nil {
+		err_ret := fmt.Errorf("can't reload settings %s: %s", configLocation, err.Error())
+		addSystemError(err_ret)
+		log.Printf("%s\n", err_ret.Error())
+		return
+	}
+	outputsMutex.Lock()
+	globalSettings = s
+	outputsMutex.Unlock()
+	applyOutputs()
+	log.Printf("reloaded settings.\n")
+}
+
+// Whether the settings file has been changed since it was last read or written by us.
+func settingsFileChanged() bool {
+	settingsFileMutex.Lock()
+	defer settingsFileMutex.Unlock()
+	fi, err := os.Stat(configLocation)
+	if err != nil {
+		return false
+	}
+	return !fi.ModTime().Equal(settingsFileStamp.modTime) || fi.Size() != settingsFileStamp.size
+}
+
+// Reload the settings on SIGHUP, or when the file is changed by something else.
+func settingsWatcher() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(SETTINGS_POLL_INTERVAL)
+	for {
+		select {
+		case <-hup:
+			log.Printf("SIGHUP - reloading settings.\n")
+			reloadSettings()
+		case <-ticker.C:
+			if settingsFileChanged() {
+				log.Printf("%s changed - reloading settings.\n", configLocation)
+				reloadSettings()
+			}
+		}
+	}
+}
+
+// Set one setting from a /setSettings request. 'val' is the decoded JSON value. Values are checked for type here, and
+// for range by validateSettings().
+func setSetting(s *settings, key string, val interface{}) (err error) {
+	switch key {
+	case "UAT_Enabled":
+		s.UAT_Enabled, err = settingBool(val)
+	case "ES_Enabled":
+		s.ES_Enabled, err = settingBool(val)
+	case "Ping_Enabled":
+		s.Ping_Enabled, err = settingBool(val)
+	case "GPS_Enabled":
+		s.GPS_Enabled, err = settingBool(val)
+	case "AHRS_Enabled":
+		s.AHRS_Enabled, err = settingBool(val)
+	case "DEBUG":
+		s.DEBUG, err = settingBool(val)
+	case "DisplayTrafficSource":
+		s.DisplayTrafficSource, err = settingBool(val)
+	case "ReplayLog":
+		s.ReplayLog, err = settingBool(val)
+	case "PPM":
+		s.PPM, err = settingInt(val)
+	case "FlightLogLevel":
+		s.FlightLogLevel, err = settingInt(val)
+	case "Baud", "SerialCapability":
+		// Settings page shortcuts for the default serial output. Other outputs are set through /outputs.
+		i := outputIndexIn(s.Outputs, serialOutputID(OUTPUT_SERIAL_DEFAULT))
+		if i < 0 {
+			return nil // No serial output connected.
+		}
+		var v int
+		if v, err = settingInt(val); err != nil {
+			return err
+		}
+		if key == "Baud" {
+			s.Outputs[i].Baud = v
+		} else if v != NETWORK_GDL90_STANDARD && v != NETWORK_NMEA {
+			return fmt.Errorf("must be %d (GDL90) or %d (NMEA)", NETWORK_GDL90_STANDARD, NETWORK_NMEA)
+		} else {
+			s.Outputs[i].Capability = uint8(v)
+		}
+	case "WatchList":
+		s.WatchList, err = settingString(val)
+	case "TrafficAlert_Enabled":
+		s.TrafficAlert_Enabled, err = settingBool(val)
+	case "TrafficAlertDistance":
+		s.TrafficAlertDistance, err = settingFloat(val)
+	case "TrafficAlertAltitude":
+		s.TrafficAlertAltitude, err = settingInt(val)
+	case "TrafficAlertTime":
+		s.TrafficAlertTime, err = settingInt(val)
+	case "TrafficCoastTime":
+		s.TrafficCoastTime, err = settingInt(val)
+	case "OwnshipModeS":
+		// Hex, up to 6 digits (24 bits). Padded to 6.
+		var v string
+		if v, err = settingString(val); err == nil {
+			v = strings.ToUpper(v)
+			for len(v) < 6 {
+				v = "0" + v
+			}
+			s.OwnshipModeS = v
+		}
+	case "OwnshipTail":
+		var v string
+		if v, err = settingString(val); err == nil {
+			s.OwnshipTail = strings.ToUpper(strings.TrimSpace(v))
+		}
+	case "OwnshipCategory":
+		var v int
+		if v, err = settingInt(val); err == nil {
+			if v < 0 || v > 255 {
+				return errors.New("must be a GDL90 emitter category, 0 to 39")
+			}
+			s.OwnshipCategory = uint8(v)
+		}
+	case "OwnshipAircraftType":
+		var v string
+		if v, err = settingString(val); err == nil {
+			s.OwnshipAircraftType = strings.ToUpper(strings.TrimSpace(v))
+		}
+	default:
+		return errors.New("unknown setting")
+	}
+	return err
+}
+
+// Values from /setSettings requests. JSON numbers are float64.
+
+func settingBool(val interface{}) (bool, error) {
+	v, ok := val.(bool)
+	if !ok {
+		return false, errors.New("must be true or false")
+	}
+	return v, nil
+}
+
+func settingInt(val interface{}) (int, error) {
+	v, ok := val.(float64)
+	if !ok || v != math.Trunc(v) || math.Abs(v) > math.MaxInt32 {
+		return 0, errors.New("must be a whole number")
+	}
+	return int(v), nil
+}
+
+func settingFloat(val interface{}) (float64, error) {
+	v, ok := val.(float64)
+	if !ok {
+		return 0, errors.New("must be a number")
+	}
+	return v, nil
+}
+
+func settingString(val interface{}) (string, error) {
+	v, ok := val.(string)
+	if !ok {
+		return "", errors.New("must be a string")
+	}
+	return v, nil
+}
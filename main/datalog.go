@@ -20,10 +20,12 @@ import (
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"encoding/json"
 	"github.com/kellydunn/golang-geo"
 	"github.com/bradfitz/latlong"
+	"../ahrs"
 )
 
 const (
@@ -59,7 +61,35 @@ var replayStatus ReplayData
 
 var dataLogStarted bool
 var dataLogReadyToWrite bool
+
+// Situation from the last GPS situation event, for the flight log and its events.
+var flightLogSituation SituationData
+var flightLogSituationMutex = &sync.Mutex{}
+
+func setFlightLogSituation(s SituationData) {
+	flightLogSituationMutex.Lock()
+	flightLogSituation = s
+	flightLogSituationMutex.Unlock()
+}
+
+func getFlightLogSituation() SituationData {
+	flightLogSituationMutex.Lock()
+	defer flightLogSituationMutex.Unlock()
+	return flightLogSituation
+}
+
+// Write statistics, for /metrics. Updated by dataLogWriter() after each write.
+type dataLogWriteStats struct {
+	Writes      uint64  // Transactions written, one per second while logging.
+	Rows        uint64  // Rows written.
+	Seconds     float64 // Total time spent writing.
+	LastSeconds float64 // Time taken by the last write.
+}
+
+var dataLogStats dataLogWriteStats
+var dataLogStatsMutex = &sync.Mutex{}
 var lastSituationLogMs uint64
+var lastTrafficLogTime = make(map[uint32]time.Time) // By ICAO address. Only used by dataLogEventReader().
 
 var stratuxStartupID int64
 var dataLogTimestamps []StratuxTimestamp
@@ -269,6 +299,52 @@ func makeTable(i interface{}, tbl string, db *sql.DB) {
 	}
 }
 
+/*
+	updateTable().
+		Adds columns for fields added to the logged structs since the database was created.
+*/
+
+func updateTable(i interface{}, tbl string, db *sql.DB) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", tbl))
+	if err != nil {
+		fmt.Printf("ERROR: %s\n", err.Error())
+		return
+	}
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var cid, notnull, pk int
+		var name, colType string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notnull, &dflt, &pk); err != nil {
+			fmt.Printf("ERROR: %s\n", err.Error())
+			rows.Close()
+			return
+		}
+		existing[name] = true
+	}
+	rows.Close()
+	if len(existing) == 0 {
+		makeTable(i, tbl, db) // Table didn't exist.
+		return
+	}
+
+	val := reflect.ValueOf(i)
+	for i := 0; i < val.NumField(); i++ {
+		fieldName := val.Type().Field(i).Name
+		sqlTypeAlias := sqlTypeMap[val.Field(i).Kind()]
+		if sqlTypeAlias == "struct" && !structCanBeMarshalled(val.Field(i)) {
+			continue
+		}
+		if sqlTypeAlias == "notsupported" || fieldName == "id" || existing[fieldName] {
+			continue
+		}
+		_, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", tbl, fieldName, sqliteMarshalFunctions[sqlTypeAlias].FieldType))
+		if err != nil {
+			fmt.Printf("ERROR: %s\n", err.Error())
+		}
+	}
+}
+
 /*
 	bulkInsert().
 		Reads insertBatch and insertBatchIfs. This is called after a group of insertData() calls.
@@ -459,6 +535,12 @@ func dataLogWriter(db *sql.DB) {
 			tx.Commit()
 			rowsQueuedForWrite = make([]DataLogRow, 0) // Zero the queue.
 			timeElapsed := stratuxClock.Since(timeStart)
+			dataLogStatsMutex.Lock()
+			dataLogStats.Writes++
+			dataLogStats.Rows += uint64(nRows)
+			dataLogStats.Seconds += timeElapsed.Seconds()
+			dataLogStats.LastSeconds = timeElapsed.Seconds()
+			dataLogStatsMutex.Unlock()
 			if globalSettings.DEBUG {
 				rowsPerSecond := float64(nRows) / float64(timeElapsed.Seconds())
 				log.Printf("Writing finished. %d rows in %.2f seconds (%.1f rows per second).\n", nRows, float64(timeElapsed.Seconds()), rowsPerSecond)
@@ -527,7 +609,7 @@ func dataLog() {
 	// Do we need to create the database?
 	if createDatabase {
 		makeTable(StratuxTimestamp{}, "timestamp", db)
-		makeTable(mySituation, "mySituation", db)
+		makeTable(SituationData{}, "mySituation", db)
 		makeTable(globalStatus, "status", db)
 		makeTable(globalSettings, "settings", db)
 		makeTable(TrafficInfo{}, "traffic", db)
@@ -536,6 +618,19 @@ func dataLog() {
 		makeTable(Dump1090TermMessage{}, "dump1090_terminal", db)
 		makeTable(FlightLog{}, "startup", db)
 		makeTable(FlightEvent{}, "events", db)
+		makeTable(ahrs.Sample{}, "ahrs", db)
+	} else {
+		updateTable(StratuxTimestamp{}, "timestamp", db)
+		updateTable(SituationData{}, "mySituation", db)
+		updateTable(globalStatus, "status", db)
+		updateTable(globalSettings, "settings", db)
+		updateTable(TrafficInfo{}, "traffic", db)
+		updateTable(msg{}, "messages", db)
+		updateTable(esmsg{}, "es_messages", db)
+		updateTable(Dump1090TermMessage{}, "dump1090_terminal", db)
+		updateTable(FlightLog{}, "startup", db)
+		updateTable(FlightEvent{}, "events", db)
+		updateTable(ahrs.Sample{}, "ahrs", db)
 	}
 
 	// The first entry to be created is the "startup" entry.
@@ -578,7 +673,7 @@ func setDataLogTimeWithGPS(sit SituationData) {
 		Take that value and stick it in the current "startup" record. 
 	
 	*/
-	if isGPSClockValid() {
+	if sit.gpsClockValid() {
 		var ts StratuxTimestamp
 		// Piggyback a GPS time update from this update.
 		ts.id = 0
@@ -655,6 +750,29 @@ func findAirport(lat float64, lng float64) (airport, error) {
 	return ret, nil
 }
 
+/*
+	findAirportByID(): look up an airport by ICAO or FAA identifier, e.g. "KOLY" or "OLY".
+	Used to place weather reports.
+*/
+func findAirportByID(id string) (airport, error) {
+	var ret airport
+
+	aptdb, err := sql.Open("sqlite3", "/root/log/airports.sqlite")
+	if err != nil {
+		return ret, err
+	}
+
+	defer aptdb.Close()
+
+	faaId := id
+	if len(id) == 4 && id[0] == 'K' {
+		faaId = id[1:] // US ICAO identifiers are the FAA identifier with a 'K' prefix.
+	}
+
+	err = aptdb.QueryRow("SELECT faaid, icaoid, name, lat, lng, alt FROM airport WHERE icaoid = ? OR faaid = ? ORDER BY id ASC LIMIT 1;", id, faaId).Scan(&ret.faaId, &ret.icaoId, &ret.name, &ret.lat, &ret.lng, &ret.alt)
+	return ret, err
+}
+
 /*
 	FlightLog structure - replaces 'startup' structure as the basis for the startup
 	table in the SQLite database. A single FlightLog variable is used throughout a
@@ -711,12 +829,13 @@ func replayUAT(flight int64, db *sql.DB, timestamp int64) {
 	
 	var ts1, ts2 int64
 	var data string
+	var tor sql.NullInt64 // NULL in messages logged before the time of reception was.
 	var msgCount int64
 	
 	uatReplayComplete = false
 	
-	sql := fmt.Sprintf("SELECT timestamp_id, data FROM messages WHERE startup_id = %d AND timestamp_id > %d ORDER BY timestamp_id ASC;", flight, timestamp)
-	rows, err := db.Query(sql)
+	query := fmt.Sprintf("SELECT timestamp_id, data, TOR FROM messages WHERE startup_id = %d AND timestamp_id > %d ORDER BY timestamp_id ASC;", flight, timestamp)
+	rows, err := db.Query(query)
 	if err != nil {
 		fmt.Printf("Error querying messages: %s\n", err.Error())
 		return
@@ -729,7 +848,7 @@ func replayUAT(flight int64, db *sql.DB, timestamp int64) {
 		msgCount++
 		
 		if (ts1 == 0) {
-			err = rows.Scan(&ts1, &data)
+			err = rows.Scan(&ts1, &data, &tor)
 			if (err != nil) {
 				fmt.Printf("Error scanning row 1: %s\n", err.Error())
 				uatReplayComplete = true
@@ -739,7 +858,7 @@ func replayUAT(flight int64, db *sql.DB, timestamp int64) {
 		}
 		
 		if (ts2 == 0) {
-			err = rows.Scan(&ts2, &data)
+			err = rows.Scan(&ts2, &data, &tor)
 			if (err != nil) {
 				fmt.Printf("Error scanning row 2: %s\n", err.Error())
 				uatReplayComplete = true
@@ -767,10 +886,14 @@ func replayUAT(flight int64, db *sql.DB, timestamp int64) {
 				}
 			}
 			
-			// queue the message
-			o, msgtype := parseInput(data)
+			// queue the message, with the time of reception it was logged with
+			o, msgtype, _ := parseInput(data)
 			if o != nil && msgtype != 0 {
-				relayMessage(msgtype, o)
+				replayTOR := uint32(UPLINK_TOR_INVALID)
+				if tor.Valid {
+					replayTOR = uint32(tor.Int64)
+				}
+				relayMessage(msgtype, o, replayTOR)
 			}	
 		}
 		
@@ -890,6 +1013,26 @@ func replay1090(flight int64, db *sql.DB, timestamp int64) {
 	
 }
 
+/*
+	setReplaySituation(): Copies the replayed fields into mySituation, and publishes
+		the result like a GPS update so that the GDL90 sender picks it up.
+*/
+func setReplaySituation(r SituationData) {
+	mySituation.mu_GPS.Lock()
+	mySituation.mu_Attitude.Lock()
+	mySituation.Lat = r.Lat
+	mySituation.Lng = r.Lng
+	mySituation.Pressure_alt = r.Pressure_alt
+	mySituation.Alt = r.Alt
+	mySituation.NACp = r.NACp
+	mySituation.GroundSpeed = r.GroundSpeed
+	mySituation.TrueCourse = r.TrueCourse
+	s := mySituation
+	mySituation.mu_Attitude.Unlock()
+	mySituation.mu_GPS.Unlock()
+	publishEvent(EVENT_SITUATION, situationEvent{Situation: s, GPS: true})
+}
+
 /*
 	Rather than trying to reload a complete mySituation structure from the database
 	(which is painful due to the lack of discrete date types in SQLite), we're just
@@ -899,6 +1042,7 @@ func replay1090(flight int64, db *sql.DB, timestamp int64) {
 func replaySituation(flight int64, db *sql.DB, timestamp int64) {
 	
 	var ts1, ts2 int64
+	var r SituationData
 	
 	situationReplayComplete = false
 	
@@ -916,18 +1060,20 @@ func replaySituation(flight int64, db *sql.DB, timestamp int64) {
 	for rows.Next() {
 		
 		if (ts1 == 0) {
-			err = rows.Scan(&mySituation.Lat, &mySituation.Lng, &mySituation.Pressure_alt, &mySituation.Alt, &mySituation.NACp, &mySituation.GroundSpeed, &mySituation.TrueCourse, &ts1)
+			err = rows.Scan(&r.Lat, &r.Lng, &r.Pressure_alt, &r.Alt, &r.NACp, &r.GroundSpeed, &r.TrueCourse, &ts1)
 			if (err != nil) {
 				return
 			}
+			setReplaySituation(r)
 			continue
 		}
 		
 		if (ts2 == 0) {
-			err = rows.Scan(&mySituation.Lat, &mySituation.Lng, &mySituation.Pressure_alt, &mySituation.Alt, &mySituation.NACp, &mySituation.GroundSpeed, &mySituation.TrueCourse, &ts2)
+			err = rows.Scan(&r.Lat, &r.Lng, &r.Pressure_alt, &r.Alt, &r.NACp, &r.GroundSpeed, &r.TrueCourse, &ts2)
 			if (err != nil) {
 				return
 			}
+			setReplaySituation(r)
 		} 
 		
 		// wait for the appropriate number of ms
@@ -956,7 +1102,7 @@ func replaySituation(flight int64, db *sql.DB, timestamp int64) {
 
 
 		// don't do anything else - the ownship message should be sent out
-		// by the heartBeatSender
+		// by the heartBeatSender, from the event published by setReplaySituation()
 		
 
 		if pauseReplay {
@@ -1122,23 +1268,24 @@ func updateFlightLog(db *sql.DB) {
 	the initial place / time values.
 */
 func startFlightLog() {
+	situation := getFlightLogSituation()
 
 	// gps coordinates at startup
-	flightlog.start_lat = float64(mySituation.Lat)
-	flightlog.start_lng = float64(mySituation.Lng)
-	flightlog.start_alt = mySituation.Alt
-	flightlog.max_alt = mySituation.Alt
+	flightlog.start_lat = float64(situation.Lat)
+	flightlog.start_lng = float64(situation.Lng)
+	flightlog.start_alt = situation.Alt
+	flightlog.max_alt = situation.Alt
 	
 	// time, timezone, localtime
 	flightlog.start_timestamp = (stratuxClock.RealTime.UnixNano() / 1000000)
-	flightlog.start_tz = latlong.LookupZoneName(float64(mySituation.Lat), float64(mySituation.Lng))
+	flightlog.start_tz = latlong.LookupZoneName(float64(situation.Lat), float64(situation.Lng))
 	loc, err := time.LoadLocation(flightlog.start_tz)
 	if (err == nil) {
 		flightlog.start_localtime = stratuxClock.RealTime.In(loc).String()
 	}
 	
 	// airport code and name
-	apt, err := findAirport(float64(mySituation.Lat), float64(mySituation.Lng))
+	apt, err := findAirport(float64(situation.Lat), float64(situation.Lng))
 	if (err == nil) {
 		flightlog.start_airport_id = apt.faaId
 		flightlog.start_airport_name = apt.name
@@ -1157,21 +1304,22 @@ func startFlightLog() {
 	all of them.
 */
 func stopFlightLog(fullstop bool) {
+	situation := getFlightLogSituation()
 
 	// gps coordinates at startup
-	flightlog.end_lat = float64(mySituation.Lat)
-	flightlog.end_lng = float64(mySituation.Lng)
+	flightlog.end_lat = float64(situation.Lat)
+	flightlog.end_lng = float64(situation.Lng)
 	
 	// time, timezone, localtime
 	flightlog.end_timestamp = stratuxClock.RealTime.Unix()
-	flightlog.end_tz = latlong.LookupZoneName(float64(mySituation.Lat), float64(mySituation.Lng))
+	flightlog.end_tz = latlong.LookupZoneName(float64(situation.Lat), float64(situation.Lng))
 	loc, err := time.LoadLocation(flightlog.end_tz)
 	if (err == nil) {
-		flightlog.end_localtime = mySituation.GPSTime.In(loc).String()
+		flightlog.end_localtime = situation.GPSTime.In(loc).String()
 	}
 	
 	// airport code and name
-	apt, err := findAirport(float64(mySituation.Lat), float64(mySituation.Lng))
+	apt, err := findAirport(float64(situation.Lat), float64(situation.Lng))
 	if (err == nil) {
 		flightlog.end_airport_id = apt.faaId
 		flightlog.end_airport_name = apt.name
@@ -1196,21 +1344,22 @@ func stopFlightLog(fullstop bool) {
 	append a flight event record to the 'events' table in the database
 */
 func addFlightEvent(event string) {
+	situation := getFlightLogSituation()
 	
 	var myEvent FlightEvent
 	myEvent.event = event
-	myEvent.lat = float64(mySituation.Lat)
-	myEvent.lng = float64(mySituation.Lng)
+	myEvent.lat = float64(situation.Lat)
+	myEvent.lng = float64(situation.Lng)
 	
 	
-	timezone := latlong.LookupZoneName(float64(mySituation.Lat), float64(mySituation.Lng))
+	timezone := latlong.LookupZoneName(float64(situation.Lat), float64(situation.Lng))
 	loc, err := time.LoadLocation(timezone)
 	if (err == nil) {
 		lt := stratuxClock.RealTime.In(loc)
 		myEvent.localtime = lt.Format("15:04:05 MST") 
 	}
 	
-	apt, err := findAirport(float64(mySituation.Lat), float64(mySituation.Lng))
+	apt, err := findAirport(float64(situation.Lat), float64(situation.Lng))
 	if (err == nil) {
 		myEvent.airport_id = apt.faaId
 		myEvent.airport_name = apt.name
@@ -1222,7 +1371,7 @@ func addFlightEvent(event string) {
 }
 
 /*
-	logSituation() - pushes the current 'mySituation' record into the logging channel
+	logSituation() - pushes a 'mySituation' record from a GPS situation event into the logging channel
 	for writing to the SQLite database. Also provides triggers for startFlightLog(),
 	stopFlightLog() and updates the running distance and time tallies for the flight.
 	
@@ -1230,12 +1379,13 @@ func addFlightEvent(event string) {
 	situation records are pretty well worthless anyway.
 */
 
-func logSituation() {
+func logSituation(situation SituationData) {
 	if globalSettings.ReplayLog && isDataLogReady() && (globalStatus.ReplayMode == false) {
+		setFlightLogSituation(situation)
 		
 		// make sure we have valid GPS Clock time
 		if (flightlog.start_timestamp == 0) {
-			if (isGPSValid() && stratuxClock.HasRealTimeReference()) {
+			if (situation.gpsValid() && stratuxClock.HasRealTimeReference()) {
 				startFlightLog()
 			} else {
 				// not initialized / can't initialize yet - no clock
@@ -1251,30 +1401,30 @@ func logSituation() {
 		var flightState int = FLIGHT_STATE_UNKNOWN
 
 		// if we are stopped and the gps detects that we are moving faster than 5 mph, then we are taxiing
-		if ((flightState0 == FLIGHT_STATE_STOPPED) || (flightState0 == FLIGHT_STATE_UNKNOWN)) && ((mySituation.GroundSpeed > startTaxiingSpeed) && (mySituation.GroundSpeed <= startFlyingSpeed)) {
+		if ((flightState0 == FLIGHT_STATE_STOPPED) || (flightState0 == FLIGHT_STATE_UNKNOWN)) && ((situation.GroundSpeed > startTaxiingSpeed) && (situation.GroundSpeed <= startFlyingSpeed)) {
 			flightState = FLIGHT_STATE_TAXIING
 		} else
 
 		// if we are taxiing and the gps detects that we are moving faster than 60 mph, then we are flying
-		if ((flightState0 == FLIGHT_STATE_TAXIING) || (flightState0 == FLIGHT_STATE_UNKNOWN)) && (mySituation.GroundSpeed > startFlyingSpeed) {
+		if ((flightState0 == FLIGHT_STATE_TAXIING) || (flightState0 == FLIGHT_STATE_UNKNOWN)) && (situation.GroundSpeed > startFlyingSpeed) {
 			flightState = FLIGHT_STATE_FLYING
 		} else
 		
 		// if we are taxiing and the gps detects that we are moving 0 mph, then we are stopped
-		if (flightState0 == FLIGHT_STATE_TAXIING) && (mySituation.GroundSpeed <= stopTaxiingSpeed) {
+		if (flightState0 == FLIGHT_STATE_TAXIING) && (situation.GroundSpeed <= stopTaxiingSpeed) {
 			flightState = FLIGHT_STATE_STOPPED
 		} else
 
 		// if we are flying and the gps detects that we are moving less than 50 mph, then we are taxiing
-		if (flightState0 == FLIGHT_STATE_FLYING) && (mySituation.GroundSpeed <= stopFlyingSpeed) {
+		if (flightState0 == FLIGHT_STATE_FLYING) && (situation.GroundSpeed <= stopFlyingSpeed) {
 			flightState = FLIGHT_STATE_TAXIING
 		} else
 
 		// non-transitional states
-		if (mySituation.GroundSpeed > startFlyingSpeed) {
+		if (situation.GroundSpeed > startFlyingSpeed) {
 			flightState = FLIGHT_STATE_FLYING
 		} else
-		if (mySituation.GroundSpeed > startTaxiingSpeed) {
+		if (situation.GroundSpeed > startTaxiingSpeed) {
 			flightState = FLIGHT_STATE_TAXIING
 		} else {
 			flightState = FLIGHT_STATE_STOPPED
@@ -1337,8 +1487,8 @@ func logSituation() {
 		}
 		
 		// update altitude value - used for determining "real" flights vs non-flight startups
-		if (mySituation.Alt > flightlog.max_alt) {
-			flightlog.max_alt = mySituation.Alt
+		if (situation.Alt > flightlog.max_alt) {
+			flightlog.max_alt = situation.Alt
 		}
 		
 		// if log level is anything less than DEMO (3), we want to limit the update frequency
@@ -1361,10 +1511,10 @@ func logSituation() {
 		// only bother to write records if we are moving somehow
 		if (flightState0 == FLIGHT_STATE_FLYING) || (flightState0 == FLIGHT_STATE_TAXIING) {
 		
-			dataLogChan <- DataLogRow{tbl: "mySituation", data: mySituation}
+			dataLogChan <- DataLogRow{tbl: "situation", data: situation}
 			
 			// update the distance traveled in nautical miles
-			p := geo.NewPoint(float64(mySituation.Lat), float64(mySituation.Lng))
+			p := geo.NewPoint(float64(situation.Lat), float64(situation.Lng))
 			if (lastPoint != nil) {
 				segment := p.GreatCircleDistance(lastPoint);
 				flightlog.distance = flightlog.distance + (segment * NM_PER_KM)
@@ -1381,9 +1531,9 @@ func logSituation() {
 	}
 }
 
-func logStatus() {
+func logStatus(s status) {
 	if globalSettings.ReplayLog && isDataLogReady() && (globalStatus.ReplayMode == false) {
-		dataLogChan <- DataLogRow{tbl: "status", data: globalStatus}
+		dataLogChan <- DataLogRow{tbl: "status", data: s}
 	}
 }
 
@@ -1393,7 +1543,18 @@ func logSettings() {
 	}
 }
 
+/*
+	logTraffic(): Logs a traffic event if the target has a position that would be sent to
+		the EFB, at most once per second per target to keep the SQLite log small.
+*/
 func logTraffic(ti TrafficInfo) {
+	if !ti.Position_valid || (stratuxClock.Since(ti.Last_seen).Seconds() >= TRAFFIC_STALE_AGE && !ti.ExtrapolatedPosition) {
+		return
+	}
+	if last, ok := lastTrafficLogTime[ti.Icao_addr]; ok && stratuxClock.Since(last) < 1*time.Second {
+		return
+	}
+	lastTrafficLogTime[ti.Icao_addr] = stratuxClock.Time
 	if globalSettings.ReplayLog && isDataLogReady() && (globalSettings.FlightLogLevel == FLIGHT_LOG_LEVEL_DEBUG) && (globalStatus.ReplayMode == false) {
 		dataLogChan <- DataLogRow{tbl: "traffic", data: ti}
 	}
@@ -1417,17 +1578,51 @@ func logDump1090TermMessage(m Dump1090TermMessage) {
 	}
 }
 
+// Every attitude estimator update, for replay with test/ahrs_eval.go.
+func logAHRS(s ahrs.Sample) {
+	if globalSettings.ReplayLog && isDataLogReady() && (globalSettings.FlightLogLevel == FLIGHT_LOG_LEVEL_DEBUG) && (globalStatus.ReplayMode == false) {
+		dataLogChan <- DataLogRow{tbl: "ahrs", data: s}
+	}
+}
+
 func initDataLog() {
 	//log.Printf("dataLogStarted = %t. dataLogReadyToWrite = %t\n", dataLogStarted, dataLogReadyToWrite) //REMOVE -- DEBUG
 	insertString = make(map[string]string)
 	insertBatchIfs = make(map[string][][]interface{})
 	go dataLogWatchdog()
+	go dataLogEventReader()
 	//log.Printf("datalog.go: initDataLog() complete.\n") //REMOVE -- DEBUG
 	
 	replayChan = make(chan ReplayData)
 	go flightLogReplayThread()
 }
 
+/*
+	dataLogEventReader(): Subscribes to the messages, traffic, situation and status events that are logged,
+		and passes them to the log*() functions. The subscription blocks, so no rows are lost
+		while the log is behind.
+*/
+
+func dataLogEventReader() {
+	sub := subscribeEvents("datalog", EVENT_UAT_FRAME|EVENT_ES_FRAME|EVENT_TRAFFIC|EVENT_SITUATION|EVENT_STATUS, 1024, EVENT_BLOCK)
+	for ev := range sub.C {
+		switch ev.Type {
+		case EVENT_UAT_FRAME:
+			logMsg(ev.Data.(msg))
+		case EVENT_ES_FRAME:
+			logESMsg(ev.Data.(esmsg))
+		case EVENT_TRAFFIC:
+			logTraffic(ev.Data.(TrafficInfo))
+		case EVENT_SITUATION:
+			if se := ev.Data.(situationEvent); se.GPS {
+				logSituation(se.Situation)
+			}
+		case EVENT_STATUS:
+			logStatus(ev.Data.(status))
+		}
+	}
+}
+
 /*
 	dataLogWatchdog(): Watchdog function to control startup / shutdown of data logging subsystem.
 		Called by initDataLog as a goroutine. It iterates once per second to determine if
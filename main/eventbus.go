@@ -0,0 +1,146 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	eventbus.go: In-process publish/subscribe bus. Producers (UAT and 1090ES decoders, GPS, AHRS, weather) publish typed
+	 events; consumers (GDL90 sender, datalog, websockets, plugins) subscribe to the types they want, each with its own
+	 buffered channel and drop policy, so a slow consumer can't hold up the others unless it asks to.
+*/
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Event types. A subscription takes a mask of these. Data is given for each type.
+const (
+	EVENT_UAT_FRAME = 1 << iota // msg. Every UAT message received, after parsing.
+	EVENT_ES_FRAME              // esmsg. Every dump1090 record that updated a target.
+	EVENT_TRAFFIC               // TrafficInfo. Target updated, or refreshed while it ages.
+	EVENT_SITUATION             // situationEvent. Copy of mySituation, taken under its locks, after a GPS, attitude or pressure update.
+	EVENT_WEATHER               // WeatherMessage. Text weather report received.
+	EVENT_STATUS                // status. Copy of globalStatus, published with the periodic statistics.
+
+	EVENT_ALL = EVENT_UAT_FRAME | EVENT_ES_FRAME | EVENT_TRAFFIC | EVENT_SITUATION | EVENT_WEATHER | EVENT_STATUS
+)
+
+// What to do with an event when a subscriber's channel is full.
+const (
+	EVENT_DROP_NEWEST = iota // Discard the new event.
+	EVENT_DROP_OLDEST        // Discard the oldest queued event to make room.
+	EVENT_BLOCK              // Wait for the subscriber. Holds up the publisher - only for consumers that must see every event.
+)
+
+type busEvent struct {
+	Type int
+	Time time.Time // stratuxClock.Time when published.
+	Data interface{}
+}
+
+// EVENT_SITUATION data.
+// Each is a complete copy, so a subscriber that drops events only misses the ones in between.
+type situationEvent struct {
+	Situation SituationData
+	GPS       bool // Published for a GPS sentence, UBX message or replayed position.
+	Attitude  bool // Published for an attitude update. Neither is set for a pressure update.
+}
+
+type eventSubscription struct {
+	Name    string
+	Types   int // Mask of EVENT_* types.
+	Policy  int // EVENT_DROP_NEWEST, EVENT_DROP_OLDEST or EVENT_BLOCK.
+	C       chan busEvent
+	dropped uint64 // Protected by eventDropMutex.
+}
+
+var eventSubscriptions []*eventSubscription
+var eventBusMutex = &sync.RWMutex{} // Held to publish (read) or change eventSubscriptions (write).
+var eventDropMutex = &sync.Mutex{}  // Publishers may drop events for the same subscriber concurrently.
+
+// Subscribe to the event types in mask 'types'. Events are delivered on the returned subscription's channel, which
+// holds up to 'size' events.
+func subscribeEvents(name string, types int, size int, policy int) *eventSubscription {
+	s := &eventSubscription{Name: name, Types: types, Policy: policy, C: make(chan busEvent, size)}
+	eventBusMutex.Lock()
+	eventSubscriptions = append(eventSubscriptions, s)
+	eventBusMutex.Unlock()
+	return s
+}
+
+// Stop delivering events to 's'. Its channel is closed.
+func unsubscribeEvents(s *eventSubscription) {
+	eventBusMutex.Lock()
+	defer eventBusMutex.Unlock()
+	for i, other := range eventSubscriptions {
+		if other == s {
+			eventSubscriptions = append(eventSubscriptions[:i], eventSubscriptions[i+1:]...)
+			close(s.C)
+			return
+		}
+	}
+}
+
+// Deliver an event to every subscriber of 'eventType'. 'data' must not be changed after publishing: pass copies of
+// shared structures.
+func publishEvent(eventType int, data interface{}) {
+	ev := busEvent{Type: eventType, Time: stratuxClock.Time, Data: data}
+	eventBusMutex.RLock()
+	defer eventBusMutex.RUnlock()
+	for _, s := range eventSubscriptions {
+		if (s.Types & eventType) == 0 {
+			continue
+		}
+		switch s.Policy {
+		case EVENT_BLOCK:
+			s.C <- ev
+		case EVENT_DROP_OLDEST:
+			for delivered := false; !delivered; {
+				select {
+				case s.C <- ev:
+					delivered = true
+				default:
+					select {
+					case <-s.C:
+						eventDropped(s)
+					default:
+					}
+				}
+			}
+		default:
+			select {
+			case s.C <- ev:
+			default:
+				eventDropped(s)
+			}
+		}
+	}
+}
+
+func eventDropped(s *eventSubscription) {
+	eventDropMutex.Lock()
+	s.dropped++
+	eventDropMutex.Unlock()
+}
+
+type eventSubscriptionStats struct {
+	Name      string
+	QueueLen  int
+	QueueSize int
+	Dropped   uint64
+}
+
+func getEventSubscriptionStats() []eventSubscriptionStats {
+	eventBusMutex.RLock()
+	defer eventBusMutex.RUnlock()
+	eventDropMutex.Lock()
+	defer eventDropMutex.Unlock()
+	ret := make([]eventSubscriptionStats, 0, len(eventSubscriptions))
+	for _, s := range eventSubscriptions {
+		ret = append(ret, eventSubscriptionStats{Name: s.Name, QueueLen: len(s.C), QueueSize: cap(s.C), Dropped: s.dropped})
+	}
+	return ret
+}
@@ -14,7 +14,6 @@ import (
 	"bufio"
 	"compress/gzip"
 	"encoding/hex"
-	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
@@ -70,6 +69,8 @@ const (
 	MSGTYPE_BASIC_REPORT = 0x1E
 	MSGTYPE_LONG_REPORT  = 0x1F
 
+	UPLINK_TOR_INVALID = 0xFFFFFF // Time of reception "not valid".
+
 	MSGCLASS_UAT = 0
 	MSGCLASS_ES  = 1
 
@@ -116,6 +117,7 @@ type msg struct {
 	Signal_amplitude int
 	Signal_strength  float64
 	ADSBTowerID      string // Index in the 'ADSBTowers' map, if this is a parseable uplink message.
+	TOR              uint32 // GDL90 time of reception: 80 ns units since the start of the UTC second. UPLINK_TOR_INVALID if the GPS clock isn't valid.
 	uatMsg           *uatparse.UATMsg
 }
 
@@ -202,8 +204,44 @@ func makeLatLng(v float32) []byte {
 	return ret
 }
 
-func makeOwnshipReport() bool {
-	if !isGPSValid() {
+// Ownship vertical speed, ft/min. From the GPS if it reports vertical velocity, otherwise from the pressure
+// altitude trend.
+func ownshipVerticalVelocity(s *SituationData) (float64, bool) {
+	if stratuxClock.Since(s.LastGPSVertVelTime) < 3*time.Second {
+		return float64(s.GPSVertVel) * 60, true
+	}
+	if s.tempPressValid() && stratuxClock.Since(s.LastPressVVelTime) < 15*time.Second {
+		return s.Pressure_vvel, true
+	}
+	return 0, false
+}
+
+// GDL90 12-bit vertical velocity, 64 ft/min resolution. 0x1FE/0xE02 are "more than 32,576 ft/min" up/down.
+func makeVerticalVelocity(vvel float64) int16 {
+	v := int16(math.Max(-510, math.Min(510, math.Floor(vvel/64+0.5))))
+	return v & 0x0FFF
+}
+
+// GDL90 call sign: eight characters, 0-9, A-Z and space. 'def' is sent as-is if 's' is empty.
+func makeCallsign(s string, def string) []byte {
+	ret := []byte("        ")
+	if len(strings.TrimSpace(s)) == 0 {
+		copy(ret, def)
+		return ret
+	}
+	s = strings.ToUpper(s)
+	for i := 0; i < len(s) && i < 8; i++ {
+		c := s[i]
+		if !((c >= '0' && c <= '9') || (c >= 'A' && c <= 'Z')) {
+			c = ' '
+		}
+		ret[i] = c
+	}
+	return ret
+}
+
+func makeOwnshipReport(s *SituationData) bool {
+	if !s.gpsValid() {
 		return false
 	}
 	msg := make([]byte, 28)
@@ -224,12 +262,12 @@ func makeOwnshipReport() bool {
 		msg[4] = code[2] // Mode S address.
 	}
 
-	tmp := makeLatLng(mySituation.Lat)
+	tmp := makeLatLng(s.Lat)
 	msg[5] = tmp[0] // Latitude.
 	msg[6] = tmp[1] // Latitude.
 	msg[7] = tmp[2] // Latitude.
 
-	tmp = makeLatLng(mySituation.Lng)
+	tmp = makeLatLng(s.Lng)
 	msg[8] = tmp[0]  // Longitude.
 	msg[9] = tmp[1]  // Longitude.
 	msg[10] = tmp[2] // Longitude.
@@ -243,10 +281,10 @@ func makeOwnshipReport() bool {
 	var alt uint16
 	var altf float64
 
-	if isTempPressValid() {
-		altf = float64(mySituation.Pressure_alt)
+	if s.tempPressValid() {
+		altf = float64(s.Pressure_alt)
 	} else {
-		altf = float64(mySituation.Alt) //FIXME: Pass GPS altitude if PA not available. **WORKAROUND FOR FF**
+		altf = float64(s.Alt) //FIXME: Pass GPS altitude if PA not available. **WORKAROUND FOR FF**
 	}
 	altf = (altf + 1000) / 25
 
@@ -254,31 +292,33 @@ func makeOwnshipReport() bool {
 
 	msg[11] = byte((alt & 0xFF0) >> 4) // Altitude.
 	msg[12] = byte((alt & 0x00F) << 4)
-	if isGPSGroundTrackValid() {
+	if s.groundTrackValid() {
 		msg[12] = msg[12] | 0x09 // "Airborne" + "True Track"
 	}
 
-	msg[13] = byte(0x80 | (mySituation.NACp & 0x0F)) //Set NIC = 8 and use NACp from ry835ai.go.
+	msg[13] = byte((calculateNIC(s.Accuracy) << 4) | (s.NACp & 0x0F)) // NIC and NACp from the GPS accuracy.
 
 	gdSpeed := uint16(0) // 1kt resolution.
-	if isGPSGroundTrackValid() {
-		gdSpeed = mySituation.GroundSpeed
+	if s.groundTrackValid() {
+		gdSpeed = s.GroundSpeed
 	}
 
 	// gdSpeed should fit in 12 bits.
 	msg[14] = byte((gdSpeed & 0xFF0) >> 4)
 	msg[15] = byte((gdSpeed & 0x00F) << 4)
 
-	verticalVelocity := int16(0x800) // ft/min. 64 ft/min resolution.
-	//TODO: 0x800 = no information available.
+	verticalVelocity := int16(0x800) // ft/min. 64 ft/min resolution. 0x800 = no information available.
+	if vvel, ok := ownshipVerticalVelocity(s); ok {
+		verticalVelocity = makeVerticalVelocity(vvel)
+	}
 	// verticalVelocity should fit in 12 bits.
 	msg[15] = msg[15] | byte((verticalVelocity&0x0F00)>>8)
 	msg[16] = byte(verticalVelocity & 0xFF)
 
 	// Track is degrees true, set from GPS true course.
 	groundTrack := float32(0)
-	if isGPSGroundTrackValid() {
-		groundTrack = mySituation.TrueCourse
+	if s.groundTrackValid() {
+		groundTrack = s.TrueCourse
 	}
 
 	tempTrack := groundTrack + TRACK_RESOLUTION/2 // offset by half the 8-bit resolution to minimize binning error
@@ -296,38 +336,36 @@ func makeOwnshipReport() bool {
 
 	msg[17] = byte(trk)
 
-	msg[18] = 0x01 // "Light (ICAO) < 15,500 lbs"
+	msg[18] = globalSettings.OwnshipCategory // Default "Light (ICAO) < 15,500 lbs"
 
-	// Create callsign "Stratux".
-	msg[19] = 0x53
-	msg[20] = 0x74
-	msg[21] = 0x72
-	msg[22] = 0x61
-	msg[23] = 0x74
-	msg[24] = 0x75
-	msg[25] = 0x78
+	// Callsign. "Stratux" if not set.
+	copy(msg[19:27], makeCallsign(globalSettings.OwnshipTail, "Stratux"))
 
 	// debug: useful for monitoring GPS drift on the ground
-	//fmt.Printf("Sending ownship with %.6f, %.6f coordinates, %d ground speed, %d alt, %.6f ground track.\n", mySituation.Lat, mySituation.Lng, gdSpeed, alt, groundTrack)
+	//fmt.Printf("Sending ownship with %.6f, %.6f coordinates, %d ground speed, %d alt, %.6f ground track.\n", s.Lat, s.Lng, gdSpeed, alt, groundTrack)
 
 	sendGDL90(prepareMessage(msg), false)
 	return true
 }
 
-func makeOwnshipGeometricAltitudeReport() bool {
-	if !isGPSValid() {
+func makeOwnshipGeometricAltitudeReport(s *SituationData) bool {
+	if !s.gpsValid() {
 		return false
 	}
 	msg := make([]byte, 5)
 	// See p.28.
 	msg[0] = 0x0B                     // Message type "Ownship Geo Alt".
-	alt := int16(mySituation.Alt / 5) // GPS Altitude, encoded to 16-bit int using 5-foot resolution
+	alt := int16(s.Alt / 5) // GPS Altitude, encoded to 16-bit int using 5-foot resolution
 	msg[1] = byte(alt >> 8)           // Altitude.
 	msg[2] = byte(alt & 0x00FF)       // Altitude.
 
-	//TODO: "Figure of Merit". 0x7FFF "Not available".
-	msg[3] = 0x00
-	msg[4] = 0x0A
+	// Vertical Figure of Merit, meters. 0x7FFF "Not available", 0x7FFE "> 32766 m".
+	vfom := uint16(0x7FFF)
+	if s.AccuracyVert > 0 {
+		vfom = uint16(math.Min(float64(s.AccuracyVert)+0.5, 0x7FFE))
+	}
+	msg[3] = byte(vfom >> 8)
+	msg[4] = byte(vfom & 0x00FF)
 
 	sendGDL90(prepareMessage(msg), false)
 	return true
@@ -340,21 +378,23 @@ func makeOwnshipGeometricAltitudeReport() bool {
 
 */
 
-func makeStratuxStatus() []byte {
-	msg := make([]byte, 29)
-	msg[0] = 'S'
-	msg[1] = 'X'
-	msg[2] = 1
-
-	msg[3] = 1 // "message version".
-
-	// Version code. Messy parsing to fit into four bytes.
-	thisVers := stratuxVersion[1:]                       // Skip first character, should be 'v'.
-	m_str := thisVers[0:strings.Index(thisVers, ".")]    // Major version.
-	mib_str := thisVers[strings.Index(thisVers, ".")+1:] // Minor and build version.
+// Version code for the "SX" message from a version string like "v1.0r1", "v1.1b2" or "v1.2rc1": major, minor,
+// build type (1 = beta, 2 = release, 3 = release candidate) and build number. Unparseable parts are zero.
+func stratuxVersionCode(vers string) (byte, byte, byte, byte) {
+	thisVers := strings.TrimPrefix(vers, "v")
+	if i := strings.IndexAny(thisVers, "-+ "); i >= 0 {
+		thisVers = thisVers[:i] // "v1.0r1-4-gabcdef".
+	}
+	dot := strings.Index(thisVers, ".")
+	if dot < 0 {
+		m, _ := strconv.Atoi(thisVers)
+		return byte(m), 0, 0, 0
+	}
+	m_str := thisVers[0:dot]    // Major version.
+	mib_str := thisVers[dot+1:] // Minor and build version.
 
 	tp := 0 // Build "type".
-	mi_str := ""
+	mi_str := mib_str
 	b_str := ""
 	if strings.Index(mib_str, "rc") != -1 {
 		tp = 3
@@ -374,13 +414,29 @@ func makeStratuxStatus() []byte {
 	m, _ := strconv.Atoi(m_str)
 	mi, _ := strconv.Atoi(mi_str)
 	b, _ := strconv.Atoi(b_str)
+	return byte(m), byte(mi), byte(tp), byte(b)
+}
+
+// Clamp a count to 16 bits.
+func stratuxStatusCount(n uint) uint16 {
+	if n > 0xFFFF {
+		return 0xFFFF
+	}
+	return uint16(n)
+}
 
-	msg[4] = byte(m)
-	msg[5] = byte(mi)
-	msg[6] = byte(tp)
-	msg[7] = byte(b)
+func makeStratuxStatus(s *SituationData) []byte {
+	msg := make([]byte, 29)
+	msg[0] = 'S'
+	msg[1] = 'X'
+	msg[2] = 1
 
-	//TODO: Hardware revision.
+	msg[3] = 1 // "message version".
+
+	// Version code.
+	msg[4], msg[5], msg[6], msg[7] = stratuxVersionCode(stratuxVersion)
+
+	// Hardware revision: not available.
 	msg[8] = 0xFF
 	msg[9] = 0xFF
 	msg[10] = 0xFF
@@ -388,8 +444,8 @@ func makeStratuxStatus() []byte {
 
 	// Valid and enabled flags.
 	// Valid/Enabled: GPS portion.
-	if isGPSValid() {
-		switch mySituation.Quality {
+	if s.gpsValid() {
+		switch s.Quality {
 		case 1: // 1 = 3D GPS.
 			msg[13] = 1
 		case 2: // 2 = DGPS (SBAS /WAAS).
@@ -399,12 +455,12 @@ func makeStratuxStatus() []byte {
 	}
 
 	// Valid/Enabled: AHRS portion.
-	if isAHRSValid() {
+	if s.attitudeValid() {
 		msg[13] = msg[13] | (1 << 2)
 	}
 
 	// Valid/Enabled: Pressure altitude portion.
-	if isTempPressValid() {
+	if s.tempPressValid() {
 		msg[13] = msg[13] | (1 << 3)
 	}
 
@@ -456,6 +512,7 @@ func makeStratuxStatus() []byte {
 	// Summarize number of UAT and 1090ES traffic targets for reports that follow.
 	var uat_traffic_targets uint16
 	var es_traffic_targets uint16
+	trafficMutex.Lock()
 	for _, traf := range traffic {
 		switch traf.Last_source {
 		case TRAFFIC_SOURCE_1090ES:
@@ -464,6 +521,7 @@ func makeStratuxStatus() []byte {
 			uat_traffic_targets++
 		}
 	}
+	trafficMutex.Unlock()
 
 	// Number of UAT traffic targets.
 	msg[18] = byte((uat_traffic_targets & 0xFF00) >> 8)
@@ -473,26 +531,35 @@ func makeStratuxStatus() []byte {
 	msg[21] = byte(es_traffic_targets & 0xFF)
 
 	// Number of UAT messages per minute.
-	msg[22] = byte((globalStatus.UAT_messages_last_minute & 0xFF00) >> 8)
-	msg[23] = byte(globalStatus.UAT_messages_last_minute & 0xFF)
+	uat_messages := stratuxStatusCount(globalStatus.UAT_messages_last_minute)
+	msg[22] = byte((uat_messages & 0xFF00) >> 8)
+	msg[23] = byte(uat_messages & 0xFF)
 	// Number of 1090ES messages per minute.
-	msg[24] = byte((globalStatus.ES_messages_last_minute & 0xFF00) >> 8)
-	msg[25] = byte(globalStatus.ES_messages_last_minute & 0xFF)
+	es_messages := stratuxStatusCount(globalStatus.ES_messages_last_minute)
+	msg[24] = byte((es_messages & 0xFF00) >> 8)
+	msg[25] = byte(es_messages & 0xFF)
 
-	// CPU temperature.
-	v := uint16(float32(10.0) * globalStatus.CPUTemp)
+	// CPU temperature, 0.1°C resolution.
+	v := int16(float32(10.0) * globalStatus.CPUTemp)
 
-	msg[26] = byte((v & 0xFF00) >> 8)
+	msg[26] = byte((v >> 8) & 0xFF)
 	msg[27] = byte(v & 0xFF)
 
-	// Number of ADS-B towers. Map structure is protected by ADSBTowerMutex.
+	// Connected ADS-B towers: those heard in the last minute. Map structure is protected by ADSBTowerMutex.
 	ADSBTowerMutex.Lock()
-	num_towers := uint8(len(ADSBTowers))
+	towers := make([]ADSBTower, 0)
+	for _, tower := range ADSBTowers {
+		if tower.Messages_last_minute > 0 && len(towers) < 255 {
+			towers = append(towers, tower)
+		}
+	}
+	ADSBTowerMutex.Unlock()
 
-	msg[28] = byte(num_towers)
+	// Number of ADS-B towers.
+	msg[28] = byte(len(towers))
 
 	// List of ADS-B towers (lat, lng).
-	for _, tower := range ADSBTowers {
+	for _, tower := range towers {
 		tmp := makeLatLng(float32(tower.Lat))
 		msg = append(msg, tmp[0]) // Latitude.
 		msg = append(msg, tmp[1]) // Latitude.
@@ -503,7 +570,19 @@ func makeStratuxStatus() []byte {
 		msg = append(msg, tmp[1]) // Longitude.
 		msg = append(msg, tmp[2]) // Longitude.
 	}
-	ADSBTowerMutex.Unlock()
+
+	// Per-tower signal strength, in the same order as the list above: average RSSI over the last minute, signed dB.
+	// This follows the V104 tower list so that readers expecting 6 bytes per tower are unaffected.
+	for _, tower := range towers {
+		sig := math.Floor(tower.Signal_strength_last_minute + 0.5)
+		if sig < -128 {
+			sig = -128
+		} else if sig > 127 {
+			sig = 127
+		}
+		msg = append(msg, byte(int8(sig)))
+	}
+
 	return prepareMessage(msg)
 }
 
@@ -517,14 +596,14 @@ func makeStratuxStatus() []byte {
 	Protocol 1: GPS on/off | AHRS on/off.
 */
 
-func makeStratuxHeartbeat() []byte {
+func makeStratuxHeartbeat(s *SituationData) []byte {
 	msg := make([]byte, 2)
 	msg[0] = 0xCC // Message type "Stratux".
 	msg[1] = 0
-	if isGPSValid() {
+	if s.gpsValid() {
 		msg[1] = 0x02
 	}
-	if isAHRSValid() {
+	if s.attitudeValid() {
 		msg[1] = msg[1] | 0x01
 	}
 
@@ -534,12 +613,12 @@ func makeStratuxHeartbeat() []byte {
 	return prepareMessage(msg)
 }
 
-func makeHeartbeat() []byte {
+func makeHeartbeat(s *SituationData) []byte {
 	msg := make([]byte, 7)
 	// See p.10.
 	msg[0] = 0x00 // Message type "Heartbeat".
 	msg[1] = 0x01 // "UAT Initialized".
-	if isGPSValid() {
+	if s.gpsValid() {
 		msg[1] = msg[1] | 0x80
 	}
 	msg[1] = msg[1] | 0x10 //FIXME: Addr talkback.
@@ -560,13 +639,24 @@ func makeHeartbeat() []byte {
 	return prepareMessage(msg)
 }
 
-func relayMessage(msgtype uint16, msg []byte) {
+// GDL90 time of reception of a message received at 'received' (stratuxClock), from the GPS clock. The GPS time is
+// only as accurate as the arrival of the GPS time messages, typically within a few tens of milliseconds.
+func makeTOR(received time.Time) uint32 {
+	s := copySituation()
+	if !s.gpsClockValid() {
+		return UPLINK_TOR_INVALID
+	}
+	t := s.GPSTime.Add(received.Sub(s.LastGPSTimeTime))
+	return uint32(t.Nanosecond() / 80)
+}
+
+func relayMessage(msgtype uint16, msg []byte, tor uint32) {
 	ret := make([]byte, len(msg)+4)
 	// See p.15.
-	ret[0] = byte(msgtype) // Uplink message ID.
-	ret[1] = 0x00          //TODO: Time.
-	ret[2] = 0x00          //TODO: Time.
-	ret[3] = 0x00          //TODO: Time.
+	ret[0] = byte(msgtype)            // Uplink message ID.
+	ret[1] = byte(tor & 0xFF)         // Time of reception, LSB first.
+	ret[2] = byte((tor >> 8) & 0xFF)  // Time of reception.
+	ret[3] = byte((tor >> 16) & 0xFF) // Time of reception.
 
 	for i := 0; i < len(msg); i++ {
 		ret[i+4] = msg[i]
@@ -575,21 +665,37 @@ func relayMessage(msgtype uint16, msg []byte) {
 	sendGDL90(prepareMessage(ret), true)
 }
 
+/*
+	heartBeatSender(): The GDL90 sender. Ownship, AHRS and status reports are made from the situation events, not
+		from mySituation: 'situation' is the copy from the latest event.
+*/
+
 func heartBeatSender() {
 	timer := time.NewTicker(1 * time.Second)
 	timerMessageStats := time.NewTicker(2 * time.Second)
+	sub := subscribeEvents("gdl90", EVENT_SITUATION, 64, EVENT_DROP_OLDEST)
+	var situation SituationData
 	for {
 		select {
+		case ev := <-sub.C:
+			se := ev.Data.(situationEvent)
+			situation = se.Situation
+			if se.Attitude {
+				// makeFFAHRSSimReport(&situation) // simultaneous use of GDL90 and FFSIM not supported in FF 7.5.1 or later. Function definition will be kept for AHRS debugging and future workarounds.
+				makeAHRSGDL90Report(&situation)
+			}
 		case <-timer.C:
 			// Turn on green ACT LED on the Pi.
 			ioutil.WriteFile("/sys/class/leds/led0/brightness", []byte("1\n"), 0644)
 
-			sendGDL90(makeHeartbeat(), false)
-			sendGDL90(makeStratuxHeartbeat(), false)
-			sendGDL90(makeStratuxStatus(), false)
+			sendGDL90(makeHeartbeat(&situation), false)
+			sendGDL90(makeStratuxHeartbeat(&situation), false)
+			sendGDL90(makeStratuxStatus(&situation), false)
 			
-			makeOwnshipReport()
-			makeOwnshipGeometricAltitudeReport()
+			makeOwnshipReport(&situation)
+			makeOwnshipGeometricAltitudeReport(&situation)
+			makeNMEAGPSReport(&situation)
+			makeJSONSituationReport(&situation)
 
 			// --- debug code: traffic demo ---
 			// Uncomment and compile to display large number of artificial traffic targets
@@ -609,7 +715,7 @@ func heartBeatSender() {
 			*/
 
 			// ---end traffic demo code ---
-			sendTrafficUpdates()
+			sendTrafficUpdates(&situation)
 			updateStatus()
 		case <-timerMessageStats.C:
 			// Save a bit of CPU by not pruning the message log every 1 second.
@@ -726,6 +832,12 @@ func cpuTempMonitor() {
 }
 
 func updateStatus() {
+	mySituation.mu_GPS.Lock()
+	if !mySituation.gpsValid() {
+		// Fix lost. Don't report the last one's solution.
+		mySituation.Quality = 0
+		mySituation.Satellites = 0
+	}
 	if mySituation.Quality == 2 {
 		globalStatus.GPS_solution = "GPS + SBAS (WAAS)"
 	} else if mySituation.Quality == 1 {
@@ -756,6 +868,7 @@ func updateStatus() {
 	globalStatus.GPS_satellites_seen = mySituation.SatellitesSeen
 	globalStatus.GPS_satellites_tracked = mySituation.SatellitesTracked
 	globalStatus.GPS_position_accuracy = mySituation.Accuracy
+	mySituation.mu_GPS.Unlock()
 
 	// Update Uptime value
 	globalStatus.Uptime = int64(stratuxClock.Milliseconds)
@@ -763,6 +876,8 @@ func updateStatus() {
 
 	usage = du.NewDiskUsage("/")
 	globalStatus.DiskBytesFree = usage.Free()
+
+	globalStatus.Plugins = getPluginStatus()
 }
 
 type WeatherMessage struct {
@@ -771,40 +886,66 @@ type WeatherMessage struct {
 	Time              string
 	Data              string
 	LocaltimeReceived time.Time
+
+	// Decoded report, depending on Type. nil if the report couldn't be parsed.
+	METAR *uatparse.METAR      `json:",omitempty"`
+	TAF   *uatparse.TAF        `json:",omitempty"`
+	PIREP *uatparse.PIREP      `json:",omitempty"`
+	Winds *uatparse.WindsAloft `json:",omitempty"`
 }
 
-// Send update to connected websockets.
-func registerADSBTextMessageReceived(msg string) {
+// Split a text report into a WeatherMessage and decode it, if it's a type we know how to decode.
+func newWeatherMessage(msg string) (WeatherMessage, bool) {
+	var wm WeatherMessage
 	x := strings.Split(msg, " ")
 	if len(x) < 5 {
-		return
+		return wm, false
 	}
 
-	var wm WeatherMessage
+	wm.Type = x[0]
+	wm.Location = x[1]
+	wm.Time = x[2]
+	wm.Data = strings.Join(x[3:], " ")
+	wm.LocaltimeReceived = stratuxClock.Time
+
+	// Report times only have the day of month - resolve them against the current date.
+	now := time.Now().UTC()
+	switch wm.Type {
+	case "METAR", "SPECI":
+		wm.METAR, _ = uatparse.ParseMETAR(msg, now)
+	case "TAF", "TAF.AMD":
+		wm.TAF, _ = uatparse.ParseTAF(msg, now)
+	case "PIREP":
+		wm.PIREP, _ = uatparse.ParsePIREP(msg, now)
+	case "WINDS":
+		wm.Winds, _ = uatparse.ParseWindsAloft(msg, now)
+	}
+	return wm, true
+}
+
+// Send update to connected websockets.
+func registerADSBTextMessageReceived(msg string) {
+	wm, ok := newWeatherMessage(msg)
+	if !ok {
+		return
+	}
 
-	if (x[0] == "METAR") || (x[0] == "SPECI") {
+	if (wm.Type == "METAR") || (wm.Type == "SPECI") {
 		globalStatus.UAT_METAR_total++
 	}
-	if (x[0] == "TAF") || (x[0] == "TAF.AMD") {
+	if (wm.Type == "TAF") || (wm.Type == "TAF.AMD") {
 		globalStatus.UAT_TAF_total++
 	}
-	if x[0] == "WINDS" {
+	if wm.Type == "WINDS" {
 		globalStatus.UAT_TAF_total++
 	}
-	if x[0] == "PIREP" {
+	if wm.Type == "PIREP" {
 		globalStatus.UAT_PIREP_total++
 	}
 
-	wm.Type = x[0]
-	wm.Location = x[1]
-	wm.Time = x[2]
-	wm.Data = strings.Join(x[3:], " ")
-	wm.LocaltimeReceived = stratuxClock.Time
-
-	wmJSON, _ := json.Marshal(&wm)
+	weatherStoreAddText(wm, msg)
 
-	// Send to weatherUpdate channel for any connected clients.
-	weatherUpdate.Send(wmJSON)
+	publishEvent(EVENT_WEATHER, wm)
 }
 
 func UpdateUATStats(ProductID uint32) {
@@ -830,12 +971,12 @@ func UpdateUATStats(ProductID uint32) {
 	}
 }
 
-func parseInput(buf string) ([]byte, uint16) {
+func parseInput(buf string) ([]byte, uint16, uint32) {
 	//FIXME: We're ignoring all invalid format UAT messages (not sending to datalog).
 	x := strings.Split(buf, ";") // Discard everything after the first ';'.
 	s := x[0]
 	if len(s) == 0 {
-		return nil, 0
+		return nil, 0, 0
 	}
 	msgtype := uint16(0)
 	isUplink := false
@@ -871,7 +1012,7 @@ func parseInput(buf string) ([]byte, uint16) {
 	msglen := len(s) / 2
 
 	if len(s)%2 != 0 { // Bad format.
-		return nil, 0
+		return nil, 0, 0
 	}
 
 	if isUplink && msglen == UPLINK_FRAME_DATA_BYTES {
@@ -898,6 +1039,7 @@ func parseInput(buf string) ([]byte, uint16) {
 	var thisMsg msg
 	thisMsg.MessageClass = MSGCLASS_UAT
 	thisMsg.TimeReceived = stratuxClock.Time
+	thisMsg.TOR = makeTOR(thisMsg.TimeReceived)
 	thisMsg.Data = buf
 	thisMsg.Signal_amplitude = thisSignalStrength
 	if thisSignalStrength > 0 {
@@ -923,14 +1065,17 @@ func parseInput(buf string) ([]byte, uint16) {
 			for _, r := range textReports {
 				registerADSBTextMessageReceived(r)
 			}
+			for _, f := range uatMsg.Frames {
+				weatherStoreAddFrame(f)
+			}
 			thisMsg.uatMsg = uatMsg
 		}
 	}
 
 	MsgLog = append(MsgLog, thisMsg)
-	logMsg(thisMsg)
+	publishEvent(EVENT_UAT_FRAME, thisMsg)
 
-	return frame, msgtype
+	return frame, msgtype, thisMsg.TOR
 }
 
 var product_name_map = map[int]string{
@@ -1006,20 +1151,28 @@ func getProductNameFromId(product_id int) string {
 }
 
 type settings struct {
+	SettingsVersion      int // Format of the settings file. See settingsMigrations.
 	UAT_Enabled          bool
 	ES_Enabled           bool
 	Ping_Enabled         bool
 	GPS_Enabled          bool
-	NetworkOutputs       []networkConnection
-	SerialOutputs        map[string]serialConnection
+	Outputs              []outputEndpoint
 	AHRS_Enabled         bool
 	DisplayTrafficSource bool
 	DEBUG                bool
 	ReplayLog            bool
 	PPM                  int
 	OwnshipModeS         string
+	OwnshipTail          string // Call sign sent in the ownship report.
+	OwnshipCategory      uint8  // GDL90 emitter category, e.g. 1 = Light.
+	OwnshipAircraftType  string // ICAO aircraft type designator, e.g. "C172".
 	WatchList            string
 	FlightLogLevel       int
+	TrafficAlert_Enabled bool
+	TrafficAlertDistance float64 // Alert when traffic is within this horizontal distance, nm...
+	TrafficAlertAltitude int     // ... and this vertical distance, ft...
+	TrafficAlertTime     int     // ... now or within this many seconds.
+	TrafficCoastTime     int     // Dead-reckon traffic for up to this many seconds after the last position. 0 disables.
 }
 
 type status struct {
@@ -1041,6 +1194,7 @@ type status struct {
 	GPS_connected                              bool
 	GPS_solution                               string
 	RY835AI_connected                          bool
+	AHRS_sensors                               string // Sensors found on the I2C bus, e.g. "MPU-9250, AK8963, BMP280".
 	Uptime                                     int64
 	UptimeClock                                time.Time
 	CPUTemp                                    float32
@@ -1059,6 +1213,7 @@ type status struct {
 	UAT_PIREP_total                            uint32
 	UAT_NOTAM_total                            uint32
 	UAT_OTHER_total                            uint32
+	Plugins                                    []pluginStatus
     ReplayMode								   bool
     
 	Errors                                     []string
@@ -1067,67 +1222,37 @@ type status struct {
 var globalSettings settings
 var globalStatus status
 
-func defaultSettings() {
-	globalSettings.UAT_Enabled = true
-	globalSettings.ES_Enabled = true
-	globalSettings.GPS_Enabled = true
-	//FIXME: Need to change format below.
-	globalSettings.NetworkOutputs = []networkConnection{
-		{Conn: nil, Ip: "", Port: 4000, Capability: NETWORK_GDL90_STANDARD | NETWORK_AHRS_GDL90},
-		//		{Conn: nil, Ip: "", Port: 49002, Capability: NETWORK_AHRS_FFSIM},
-	}
-	globalSettings.AHRS_Enabled = false
-	globalSettings.DEBUG = false
-	globalSettings.DisplayTrafficSource = false
-	globalSettings.ReplayLog = false //TODO: 'true' for debug builds.
-	globalSettings.OwnshipModeS = "F00000"
-	globalSettings.FlightLogLevel = FLIGHT_LOG_LEVEL_DEBRIEF
+// Settings for a new install, and for any setting missing from the settings file.
+func newDefaultSettings() settings {
+	var s settings
+	s.SettingsVersion = SETTINGS_VERSION
+	s.UAT_Enabled = true
+	s.ES_Enabled = true
+	s.GPS_Enabled = true
+	s.Outputs = defaultOutputs()
+	s.AHRS_Enabled = false
+	s.DEBUG = false
+	s.DisplayTrafficSource = false
+	s.ReplayLog = false //TODO: 'true' for debug builds.
+	s.OwnshipModeS = "F00000"
+	s.OwnshipCategory = 1 // "Light (ICAO) < 15,500 lbs"
+	s.FlightLogLevel = FLIGHT_LOG_LEVEL_DEBRIEF
+	s.TrafficAlert_Enabled = true
+	s.TrafficAlertDistance = TRAFFIC_ALERT_DEFAULT_DISTANCE
+	s.TrafficAlertAltitude = TRAFFIC_ALERT_DEFAULT_ALTITUDE
+	s.TrafficAlertTime = TRAFFIC_ALERT_DEFAULT_TIME
+	s.TrafficCoastTime = TRAFFIC_COAST_DEFAULT_TIME
+	return s
 }
 
-func readSettings() {
-	fd, err := os.Open(configLocation)
-	if err != nil {
-		log.Printf("can't read settings %s: %s\n", configLocation, err.Error())
-		defaultSettings()
-		return
-	}
-	defer fd.Close()
-	buf := make([]byte, 1024)
-	count, err := fd.Read(buf)
-	if err != nil {
-		log.Printf("can't read settings %s: %s\n", configLocation, err.Error())
-		defaultSettings()
-		return
-	}
-	var newSettings settings
-	err = json.Unmarshal(buf[0:count], &newSettings)
-	if err != nil {
-		log.Printf("can't read settings %s: %s\n", configLocation, err.Error())
-		defaultSettings()
-		return
-	}
-	globalSettings = newSettings
-	log.Printf("read in settings.\n")
+func defaultSettings() {
+	globalSettings = newDefaultSettings()
 }
 
 func addSystemError(err error) {
 	globalStatus.Errors = append(globalStatus.Errors, err.Error())
 }
 
-func saveSettings() {
-	fd, err := os.OpenFile(configLocation, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(0644))
-	if err != nil {
-		err_ret := fmt.Errorf("can't save settings %s: %s", configLocation, err.Error())
-		addSystemError(err_ret)
-		log.Printf("%s\n", err_ret.Error())
-		return
-	}
-	defer fd.Close()
-	jsonSettings, _ := json.Marshal(&globalSettings)
-	fd.Write(jsonSettings)
-	log.Printf("wrote settings.\n")
-}
-
 func openReplay(fn string, compressed bool) (WriteCloser, error) {
 	fp, err := os.OpenFile(fn, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
 
@@ -1163,8 +1288,9 @@ func printStats() {
 		log.Printf(" - UAT/min %s/%s [maxSS=%.02f%%], ES/min %s/%s, Total traffic targets tracked=%s", humanize.Comma(int64(globalStatus.UAT_messages_last_minute)), humanize.Comma(int64(globalStatus.UAT_messages_max)), float64(maxSignalStrength)/10.0, humanize.Comma(int64(globalStatus.ES_messages_last_minute)), humanize.Comma(int64(globalStatus.ES_messages_max)), humanize.Comma(int64(len(seenTraffic))))
 		log.Printf(" - Network data messages sent: %d total, %d nonqueueable.  Network data bytes sent: %d total, %d nonqueueable.\n", globalStatus.NetworkDataMessagesSent, globalStatus.NetworkDataMessagesSentNonqueueable, globalStatus.NetworkDataBytesSent, globalStatus.NetworkDataBytesSentNonqueueable)
 		if globalSettings.GPS_Enabled {
-			log.Printf(" - Last GPS fix: %s, GPS solution type: %d using %d satellites (%d/%d seen/tracked), NACp: %d, est accuracy %.02f m\n", stratuxClock.HumanizeTime(mySituation.LastFixLocalTime), mySituation.Quality, mySituation.Satellites, mySituation.SatellitesSeen, mySituation.SatellitesTracked, mySituation.NACp, mySituation.Accuracy)
-			log.Printf(" - GPS vertical velocity: %.02f ft/sec; GPS vertical accuracy: %v m\n", mySituation.GPSVertVel, mySituation.AccuracyVert)
+			s := copySituation()
+			log.Printf(" - Last GPS fix: %s, GPS solution type: %d using %d satellites (%d/%d seen/tracked), NACp: %d, est accuracy %.02f m\n", stratuxClock.HumanizeTime(s.LastFixLocalTime), s.Quality, s.Satellites, s.SatellitesSeen, s.SatellitesTracked, s.NACp, s.Accuracy)
+			log.Printf(" - GPS vertical velocity: %.02f ft/sec; GPS vertical accuracy: %v m\n", s.GPSVertVel, s.AccuracyVert)
 		}
 		// Check if we're using more than 95% of the free space. If so, throw a warning (only once).
 		if !diskUsageWarning && usage.Usage() > 95.0 {
@@ -1172,7 +1298,9 @@ func printStats() {
 			addSystemError(err_p)
 			diskUsageWarning = true
 		}
-		logStatus()
+		s := globalStatus
+		s.Errors = append([]string{}, globalStatus.Errors...)
+		publishEvent(EVENT_STATUS, s)
 	}
 }
 
@@ -1209,9 +1337,9 @@ func uatReplay(f ReadCloser, replaySpeed uint64) {
 
 			p := strings.Trim(linesplit[1], " ;\r\n")
 			buf := fmt.Sprintf("%s;\n", p)
-			o, msgtype := parseInput(buf)
+			o, msgtype, tor := parseInput(buf)
 			if o != nil && msgtype != 0 {
-				relayMessage(msgtype, o)
+				relayMessage(msgtype, o, tor)
 			}
 			curTick = i
 		}
@@ -1251,6 +1379,9 @@ func gracefulShutdown() {
 	sdrKill()
 	pingKill()
 
+	// Shut down plugins before the data log, so their last events are logged.
+	stopPlugins()
+
 	// Shut down data logging.
 	if dataLogStarted {
 		closeDataLog()
@@ -1348,6 +1479,7 @@ func main() {
 	ADSBTowers = make(map[string]ADSBTower)
 	ADSBTowerMutex = &sync.Mutex{}
 	MsgLog = make([]msg, 0)
+	weatherStoreInit()
 
 	crcInit() // Initialize CRC16 table.
 
@@ -1378,6 +1510,12 @@ func main() {
 	// Initialize the (out) network handler.
 	initNetwork()
 
+	// Reload the settings on SIGHUP or when the settings file is changed.
+	go settingsWatcher()
+
+	// Start plugins, now that they can send to the outputs.
+	startPlugins()
+
 	// Start printing stats periodically to the logfiles.
 	go printStats()
 
@@ -1408,9 +1546,9 @@ func main() {
 				log.Printf("lost stdin.\n")
 				break
 			}
-			o, msgtype := parseInput(buf)
+			o, msgtype, tor := parseInput(buf)
 			if o != nil && msgtype != 0 {
-				relayMessage(msgtype, o)
+				relayMessage(msgtype, o, tor)
 			}
 		}
 	} else {
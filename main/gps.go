@@ -0,0 +1,504 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	gps.go: GPS receiver drivers. Each receiver type registers itself from init() with registerGPSDriver(), giving the
+	 serial devices it is found on and a function to configure it. initGPSSerial() uses the first driver with a device
+	 present.
+
+	 The receiver's output is split into NMEA sentences, handled by processNMEALine(), and UBX binary messages, handled
+	 by processUBXMessage() (ubx.go). Receivers that send UBX-NAV-PVT have their position, velocity and time taken from
+	 it, and the NMEA equivalents are ignored; NMEA is the fallback for everything else.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/tarm/serial"
+)
+
+type gpsDriver struct {
+	Name    string
+	Devices []string // Serial devices to look for, in order of preference.
+	// Configure sets up the receiver on 'device', and returns the baud rate it now sends at.
+	Configure func(device string) (baudrate int, err error)
+}
+
+var gpsDrivers []*gpsDriver
+var myGPSDriver *gpsDriver // Driver of the receiver in use.
+
+func registerGPSDriver(d *gpsDriver) {
+	gpsDrivers = append(gpsDrivers, d)
+}
+
+func init() {
+	registerGPSDriver(&gpsDriver{
+		Name:    "u-blox 8",
+		Devices: []string{"/dev/ublox8"}, // RY83xAI over USB.
+		Configure: func(device string) (int, error) {
+			return configureUBlox(device, 8)
+		},
+	})
+	registerGPSDriver(&gpsDriver{
+		Name:    "u-blox 7",
+		Devices: []string{"/dev/ublox7"}, // VK-172, RY725AI over USB.
+		Configure: func(device string) (int, error) {
+			return configureUBlox(device, 7)
+		},
+	})
+	registerGPSDriver(&gpsDriver{
+		Name:    "u-blox 6",
+		Devices: []string{"/dev/ublox6"}, // VK-162.
+		Configure: func(device string) (int, error) {
+			return configureUBlox(device, 6)
+		},
+	})
+	registerGPSDriver(&gpsDriver{
+		Name:      "SiRF IV",
+		Devices:   []string{"/dev/prolific0"}, // Assume it's a BU-353-S4. TODO: Check a "serialout" flag and/or deal with multiple prolific devices.
+		Configure: configureSiRFIV,
+	})
+	registerGPSDriver(&gpsDriver{
+		Name:    "u-blox",
+		Devices: []string{"/dev/ttyAMA0"}, // PL011 UART (GPIO pins 8 and 10) on all RPi. RY835AI or RY725AI, so u-blox 7 or 8.
+		Configure: func(device string) (int, error) {
+			return configureUBlox(device, 0)
+		},
+	})
+}
+
+/*
+u-blox5_Referenzmanual.pdf
+Platform settings
+Airborne <2g Recommended for typical airborne environment. No 2D position fixes supported.
+p.91 - CFG-MSG
+Navigation/Measurement Rate Settings
+Header 0xB5 0x62
+ID 0x06 0x08
+0x0064 (100 ms)
+0x0001
+0x0001 (GPS time)
+{0xB5, 0x62, 0x06, 0x08, 0x00, 0x64, 0x00, 0x01, 0x00, 0x01}
+p.109 CFG-NAV5 (0x06 0x24)
+Poll Navigation Engine Settings
+*/
+
+func chksumUBX(msg []byte) []byte {
+	ret := make([]byte, 2)
+	for i := 0; i < len(msg); i++ {
+		ret[0] = ret[0] + msg[i]
+		ret[1] = ret[1] + ret[0]
+	}
+	return ret
+}
+
+// p.62
+func makeUBXCFG(class, id byte, msglen uint16, msg []byte) []byte {
+	ret := make([]byte, 6)
+	ret[0] = 0xB5
+	ret[1] = 0x62
+	ret[2] = class
+	ret[3] = id
+	ret[4] = byte(msglen & 0xFF)
+	ret[5] = byte((msglen >> 8) & 0xFF)
+	ret = append(ret, msg...)
+	chk := chksumUBX(ret[2:])
+	ret = append(ret, chk[0])
+	ret = append(ret, chk[1])
+	return ret
+}
+
+func makeNMEACmd(cmd string) []byte {
+	chk_sum := byte(0)
+	for i := range cmd {
+		chk_sum = chk_sum ^ byte(cmd[i])
+	}
+	return []byte(fmt.Sprintf("$%s*%02x\x0d\x0a", cmd, chk_sum))
+}
+
+/*
+configureUBlox sets up a u-blox receiver of generation 'gen' (6, 7 or 8; 0 if unknown) for 5 Hz airborne fixes
+
+	at 38400 baud.
+
+	u-blox 7 and 8 send UBX-NAV-PVT on each fix and UBX-NAV-DOP every 5th. u-blox 8 also sends UBX-NAV-SAT every 5th,
+	which replaces PUBX,03. u-blox 6 has none of these, and sends PUBX,00 on each fix, PUBX,03 every 5th and PUBX,04
+	every 10th. All get GGA every 5th, as a fallback. When the generation isn't known, all
+	of the above are requested; whatever the receiver sends is used.
+*/
+func configureUBlox(device string, gen int) (int, error) {
+	/* Developer option -- uncomment to allow "hot" configuration of GPS (assuming 38.4 kpbs on warm start)
+		serialConfig = &serial.Config{Name: device, Baud: 38400}
+		p, err := serial.OpenPort(serialConfig)
+		if err != nil {
+			log.Printf("serial port err: %s\n", err.Error())
+			return false
+		} else { // reset port to 9600 baud for configuration
+		        cfg1 := make([]byte, 20)
+		        cfg1[0] = 0x01 // portID.
+		        cfg1[1] = 0x00 // res0.
+		        cfg1[2] = 0x00 // res1.
+		        cfg1[3] = 0x00 // res1.
+
+	        	//      [   7   ] [   6   ] [   5   ] [   4   ]
+		        //      0000 0000 0000 0000 1000 0000 1100 0000
+		        // UART mode. 0 stop bits, no parity, 8 data bits. Little endian order.
+		        cfg1[4] = 0xC0
+		        cfg1[5] = 0x08
+		        cfg1[6] = 0x00
+		        cfg1[7] = 0x00
+
+	        	// Baud rate. Little endian order.
+		        bdrt1 := uint32(9600)
+		        cfg1[11] = byte((bdrt1 >> 24) & 0xFF)
+		        cfg1[10] = byte((bdrt1 >> 16) & 0xFF)
+		        cfg1[9] = byte((bdrt1 >> 8) & 0xFF)
+		        cfg1[8] = byte(bdrt1 & 0xFF)
+
+	        	// inProtoMask. NMEA and UBX. Little endian.
+		        cfg1[12] = 0x03
+		        cfg1[13] = 0x00
+
+		        // outProtoMask. NMEA. Little endian.
+		        cfg1[14] = 0x02
+		        cfg1[15] = 0x00
+
+	        	cfg1[16] = 0x00 // flags.
+		        cfg1[17] = 0x00 // flags.
+
+	        	cfg1[18] = 0x00 //pad.
+		        cfg1[19] = 0x00 //pad.
+
+	        	p.Write(makeUBXCFG(0x06, 0x00, 20, cfg1))
+			p.Close()
+		}
+
+		-- End developer option */
+
+	// Open port at default baud for config.
+	p, err := serial.OpenPort(&serial.Config{Name: device, Baud: 9600})
+	if err != nil {
+		return 0, err
+	}
+	defer p.Close()
+
+	// Set 5 Hz update. Little endian order.
+	//p.Write(makeUBXCFG(0x06, 0x08, 6, []byte{0x64, 0x00, 0x01, 0x00, 0x01, 0x00})) // 10 Hz
+	p.Write(makeUBXCFG(0x06, 0x08, 6, []byte{0xc8, 0x00, 0x01, 0x00, 0x01, 0x00})) // 5 Hz
+
+	// Set navigation settings.
+	nav := make([]byte, 36)
+	nav[0] = 0x05 // Set dyn and fixMode only.
+	nav[1] = 0x00
+	// dyn.
+	nav[2] = 0x07 // "Airborne with >2g Acceleration".
+	nav[3] = 0x02 // 3D only.
+
+	p.Write(makeUBXCFG(0x06, 0x24, 36, nav))
+
+	// GNSS configuration CFG-GNSS for ublox 7 higher, p. 125 (v8)
+	// NOTE: Max position rate = 5 Hz if GPS+GLONASS used.
+
+	// TESTING: 5Hz unified GPS + GLONASS
+
+	// Disable GLONASS to enable 10 Hz solution rate. GLONASS is not used
+	// for SBAS (WAAS), so little real-world impact.
+
+	cfgGnss := []byte{0x00, 0x20, 0x20, 0x05}
+	gps := []byte{0x00, 0x08, 0x10, 0x00, 0x01, 0x00, 0x01, 0x01}  // enable GPS with 8-16 tracking channels
+	sbas := []byte{0x01, 0x02, 0x03, 0x00, 0x01, 0x00, 0x01, 0x01} // enable SBAS (WAAS) with 2-3 tracking channels
+	beidou := []byte{0x03, 0x00, 0x10, 0x00, 0x00, 0x00, 0x01, 0x01}
+	qzss := []byte{0x05, 0x00, 0x03, 0x00, 0x00, 0x00, 0x01, 0x01}
+	//glonass := []byte{0x06, 0x04, 0x0E, 0x00, 0x00, 0x00, 0x01, 0x01} // this disables GLONASS
+	glonass := []byte{0x06, 0x08, 0x0E, 0x00, 0x01, 0x00, 0x01, 0x01} // this enables GLONASS with 8-14 tracking channels
+	cfgGnss = append(cfgGnss, gps...)
+	cfgGnss = append(cfgGnss, sbas...)
+	cfgGnss = append(cfgGnss, beidou...)
+	cfgGnss = append(cfgGnss, qzss...)
+	cfgGnss = append(cfgGnss, glonass...)
+	p.Write(makeUBXCFG(0x06, 0x3E, uint16(len(cfgGnss)), cfgGnss))
+
+	// SBAS configuration for ublox 6 and higher
+	p.Write(makeUBXCFG(0x06, 0x16, 8, []byte{0x01, 0x07, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00}))
+
+	// Message output configuration. 'rate' is every how many fixes the message is sent, or 0 for never.
+	setRate := func(class, id, rate byte) {
+		// Msg, then the rate on DDC, UART1, UART2, USB and I2C.
+		p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{class, id, rate, rate, rate, rate, rate, 0x00}))
+	}
+	navPVT := gen != 6 // UBX-NAV-PVT and UBX-NAV-DOP.
+	navSAT := gen != 6 && gen != 7
+	rate := func(enable bool, rate byte) byte {
+		if enable {
+			return rate
+		}
+		return 0
+	}
+	setRate(UBX_CLASS_NAV, UBX_NAV_PVT, rate(navPVT, 1))
+	setRate(UBX_CLASS_NAV, UBX_NAV_DOP, rate(navPVT, 5))
+	setRate(UBX_CLASS_NAV, UBX_NAV_SAT, rate(navSAT, 5))
+	setRate(0xF1, 0x00, rate(!navPVT || gen == 0, 1))  // PUBX,00
+	setRate(0xF1, 0x03, rate(!navSAT || gen == 0, 5))  // PUBX,03
+	setRate(0xF1, 0x04, rate(!navPVT || gen == 0, 10)) // PUBX,04
+
+	//                                             Msg   DDC   UART1 UART2 USB   I2C   Res
+	p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{0xF0, 0x00, 0x00, 0x05, 0x00, 0x05, 0x00, 0x01})) // GGA enabled every 5th message
+	p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{0xF0, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01})) // GLL disabled
+	p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{0xF0, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01})) // GSA disabled
+	//p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{0xF0, 0x02, 0x00, 0x05, 0x00, 0x05, 0x00, 0x01})) // GSA enabled disabled every 5th position (used for testing only)
+	p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{0xF0, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01})) // GSV disabled
+	//p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{0xF0, 0x03, 0x00, 0x05, 0x00, 0x05, 0x00, 0x01})) // GSV enabled for every 5th position (used for testing only)
+	p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{0xF0, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01})) // RMC
+	p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{0xF0, 0x05, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01})) // VGT
+	p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{0xF0, 0x06, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})) // GRS
+	p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{0xF0, 0x07, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})) // GST
+	p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{0xF0, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})) // ZDA
+	p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{0xF0, 0x09, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})) // GBS
+	p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{0xF0, 0x0A, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})) // DTM
+	p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{0xF0, 0x0D, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})) // GNS
+	p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{0xF0, 0x0E, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})) // ???
+	p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{0xF0, 0x0F, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})) // VLW
+
+	// Reconfigure serial port.
+	cfg := make([]byte, 20)
+	cfg[0] = 0x01 // portID.
+	cfg[1] = 0x00 // res0.
+	cfg[2] = 0x00 // res1.
+	cfg[3] = 0x00 // res1.
+
+	//      [   7   ] [   6   ] [   5   ] [   4   ]
+	//	0000 0000 0000 0000 0000 10x0 1100 0000
+	// UART mode. 0 stop bits, no parity, 8 data bits. Little endian order.
+	cfg[4] = 0xC0
+	cfg[5] = 0x08
+	cfg[6] = 0x00
+	cfg[7] = 0x00
+
+	// Baud rate. Little endian order.
+	bdrt := uint32(38400)
+	cfg[11] = byte((bdrt >> 24) & 0xFF)
+	cfg[10] = byte((bdrt >> 16) & 0xFF)
+	cfg[9] = byte((bdrt >> 8) & 0xFF)
+	cfg[8] = byte(bdrt & 0xFF)
+
+	// inProtoMask. NMEA and UBX. Little endian.
+	cfg[12] = 0x03
+	cfg[13] = 0x00
+
+	// outProtoMask. NMEA and UBX. Little endian.
+	cfg[14] = 0x03
+	cfg[15] = 0x00
+
+	cfg[16] = 0x00 // flags.
+	cfg[17] = 0x00 // flags.
+
+	cfg[18] = 0x00 //pad.
+	cfg[19] = 0x00 //pad.
+
+	p.Write(makeUBXCFG(0x06, 0x00, 20, cfg))
+	//	time.Sleep(100* time.Millisecond) // pause and wait for the GPS to finish configuring itself before closing / reopening the port
+
+	if globalSettings.DEBUG {
+		log.Printf("Finished writing u-blox GPS config to %s. Opening port to test connection.\n", device)
+	}
+	return 38400, nil
+}
+
+// configureSiRFIV sets up a SiRF IV receiver for 5 Hz NMEA at 38400 baud.
+func configureSiRFIV(device string) (int, error) {
+	log.Printf("Using SiRFIV config.\n")
+	p, err := serial.OpenPort(&serial.Config{Name: device, Baud: 4800})
+	if err != nil {
+		return 0, err
+	}
+	// Enable 38400 baud.
+	p.Write(makeNMEACmd("PSRF100,1,38400,8,1,0"))
+	p.Close()
+
+	time.Sleep(250 * time.Millisecond)
+	// Re-open port at newly configured baud so we can configure 5Hz messages.
+	p, err = serial.OpenPort(&serial.Config{Name: device, Baud: 38400})
+	if err != nil {
+		return 0, err
+	}
+	defer p.Close()
+
+	// Enable 5Hz. (To switch back to 1Hz: $PSRF103,00,7,00,0*22)
+	p.Write(makeNMEACmd("PSRF103,00,6,00,0"))
+
+	// Enable GGA.
+	p.Write(makeNMEACmd("PSRF103,00,00,01,01"))
+	// Enable GSA.
+	p.Write(makeNMEACmd("PSRF103,02,00,01,01"))
+	// Enable RMC.
+	p.Write(makeNMEACmd("PSRF103,04,00,01,01"))
+	// Enable VTG.
+	p.Write(makeNMEACmd("PSRF103,05,00,01,01"))
+	// Enable GSV (once every 5 position updates)
+	p.Write(makeNMEACmd("PSRF103,03,00,05,01"))
+
+	if globalSettings.DEBUG {
+		log.Printf("Finished writing SiRF GPS config to %s. Opening port to test connection.\n", device)
+	}
+	return 38400, nil
+}
+
+func initGPSSerial() bool {
+	var device string
+	var driver *gpsDriver
+	for _, d := range gpsDrivers {
+		for _, dev := range d.Devices {
+			if _, err := os.Stat(dev); err == nil {
+				device = dev
+				break
+			}
+		}
+		if device != "" {
+			driver = d
+			break
+		}
+	}
+	if driver == nil {
+		log.Printf("No suitable device found.\n")
+		return false
+	}
+	if globalSettings.DEBUG {
+		log.Printf("Using %s for GPS (%s)\n", device, driver.Name)
+	}
+
+	baudrate, err := driver.Configure(device)
+	if err != nil {
+		log.Printf("serial port err: %s\n", err.Error())
+		return false
+	}
+
+	time.Sleep(250 * time.Millisecond)
+	// Re-open port at newly configured baud so we can read messages. ReadTimeout is set to keep from blocking the gpsSerialReader() on misconfigures or ttyAMA disconnects
+	serialConfig = &serial.Config{Name: device, Baud: baudrate, ReadTimeout: time.Millisecond * 2500}
+	p, err := serial.OpenPort(serialConfig)
+	if err != nil {
+		log.Printf("serial port err: %s\n", err.Error())
+		return false
+	}
+
+	serialPort = p
+	myGPSDriver = driver
+	return true
+}
+
+// setGPSTime records 't', the UTC time of the latest fix, in 's' and makes it the real time reference. The system
+// clock is set if it is more than three seconds out. Times before 2016 are not valid, and are ignored.
+func setGPSTime(s *SituationData, t time.Time) bool {
+	if t.Before(time.Date(2016, time.January, 1, 0, 0, 0, 0, time.UTC)) { // Unless we're in a flying Delorean.
+		return false
+	}
+	s.LastGPSTimeTime = stratuxClock.Time
+	s.GPSTime = t
+	stratuxClock.SetRealTimeReference(t)
+	if time.Since(t) > 3*time.Second || time.Since(t) < -3*time.Second {
+		setStr := t.Format("20060102 15:04:05.000") + " UTC"
+		log.Printf("setting system time to: '%s'\n", setStr)
+		if err := exec.Command("date", "-s", setStr).Run(); err != nil {
+			log.Printf("Set Date failure: %s error\n", err)
+		} else {
+			log.Printf("Time set from GPS. Current time is %v\n", time.Now())
+		}
+	}
+	return true
+}
+
+// scanGPSMessages is a bufio.SplitFunc for a receiver's output. Tokens are NMEA sentences, without the line ending,
+// and whole UBX frames, sync characters to checksum. Anything else, including UBX frames with a bad checksum, is
+// skipped.
+func scanGPSMessages(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	// More data is needed for a message starting at 'i'.
+	more := func(i int) (int, []byte, error) {
+		if atEOF {
+			return len(data), nil, nil
+		}
+		return i, nil, nil
+	}
+	for i := 0; i < len(data); i++ {
+		switch data[i] {
+		case '$':
+			n := bytes.IndexByte(data[i:], '\n')
+			if n < 0 {
+				if atEOF {
+					return len(data), bytes.TrimRight(data[i:], "\r"), nil
+				}
+				return i, nil, nil
+			}
+			return i + n + 1, bytes.TrimRight(data[i:i+n], "\r"), nil
+		case UBX_SYNC1:
+			if i+1 < len(data) && data[i+1] != UBX_SYNC2 {
+				continue
+			}
+			if len(data)-i < 6 {
+				return more(i)
+			}
+			payloadLen := int(data[i+4]) | int(data[i+5])<<8
+			if payloadLen > UBX_MAX_PAYLOAD { // Not a frame.
+				continue
+			}
+			if len(data)-i < payloadLen+8 {
+				return more(i)
+			}
+			if frame := data[i : i+payloadLen+8]; validateUBXFrame(frame) {
+				return i + len(frame), frame, nil
+			}
+		}
+	}
+	return len(data), nil, nil
+}
+
+func gpsSerialReader() {
+	defer serialPort.Close()
+	readyToInitGPS = false // TO-DO: replace with channel control to terminate goroutine when complete
+
+	i := 0 //debug monitor
+	scanner := bufio.NewScanner(serialPort)
+	scanner.Split(scanGPSMessages)
+	for scanner.Scan() && globalStatus.GPS_connected && globalSettings.GPS_Enabled {
+		i++
+		if globalSettings.DEBUG && i%100 == 0 {
+			log.Printf("gpsSerialReader() scanner loop iteration i=%d\n", i) // debug monitor
+		}
+
+		msg := scanner.Bytes()
+
+		// process the incoming data unless we are currently in Replay mode
+		if globalStatus.ReplayMode {
+			continue
+		}
+		if msg[0] == UBX_SYNC1 {
+			if !processUBXMessage(msg) && globalSettings.DEBUG {
+				fmt.Printf("processUBXMessage() exited early -- %02X %02X\n", msg[2], msg[3])
+			}
+		} else {
+			s := string(msg)
+			if !processNMEALine(s) && globalSettings.DEBUG {
+				fmt.Printf("processNMEALine() exited early -- %s\n", s)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("reading standard input: %s\n", err.Error())
+	}
+
+	if globalSettings.DEBUG {
+		log.Printf("Exiting gpsSerialReader() after i=%d loops\n", i) // debug monitor
+	}
+	globalStatus.GPS_connected = false
+	readyToInitGPS = true // TO-DO: replace with channel control to terminate goroutine when complete
+	return
+}
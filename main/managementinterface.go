@@ -13,7 +13,6 @@ import (
 	"database/sql"
 	"github.com/elgs/gosqljson"
 	_ "github.com/mattn/go-sqlite3"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	humanize "github.com/dustin/go-humanize"
@@ -57,8 +56,14 @@ var tables = map[string]string{
 	The /weather websocket starts off by sending the current buffer of weather messages, then sends updates as they are received.
 */
 func handleWeatherWS(conn *websocket.Conn) {
-	// Subscribe the socket to receive updates.
+	// Subscribe the socket to receive updates first, so that nothing received during the replay is missed. A product
+	// may be sent twice.
 	weatherUpdate.AddSocket(conn)
+	// Replay the current weather products.
+	for _, p := range weatherQuery(WeatherQuery{}) {
+		wxJSON, _ := json.Marshal(&p)
+		conn.Write(wxJSON)
+	}
 
 	// Connection closes when function returns. Since uibroadcast is writing and we don't need to read anything (for now), just keep it busy.
 	for {
@@ -136,7 +141,8 @@ func handleSituationWS(conn *websocket.Conn) {
 	timer := time.NewTicker(100 * time.Millisecond)
 	for {
 		<-timer.C
-		situationJSON, _ := json.Marshal(&mySituation)
+		situation := copySituation()
+		situationJSON, _ := json.Marshal(&situation)
 		_, err := conn.Write(situationJSON)
 
 		if err != nil {
@@ -175,10 +181,36 @@ func handleStatusRequest(w http.ResponseWriter, r *http.Request) {
 func handleSituationRequest(w http.ResponseWriter, r *http.Request) {
 	setNoCache(w)
 	setJSONHeaders(w)
-	situationJSON, _ := json.Marshal(&mySituation)
+	situation := copySituation()
+	situationJSON, _ := json.Marshal(&situation)
 	fmt.Fprintf(w, "%s\n", situationJSON)
 }
 
+// AJAX call - /getAHRS. Responds with the attitude estimator's validity, uncertainty and calibration state.
+func handleAHRSRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	ahrsJSON, _ := json.Marshal(getAHRSStatus())
+	fmt.Fprintf(w, "%s\n", ahrsJSON)
+}
+
+// POST /calibrateAHRS. Measures the gyro bias again - the aircraft must be kept still for a few seconds.
+func handleAHRSCalibrateRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !globalStatus.RY835AI_connected || !globalSettings.AHRS_Enabled {
+		http.Error(w, "AHRS not running", http.StatusServiceUnavailable)
+		return
+	}
+	calibrateAHRS()
+	ahrsJSON, _ := json.Marshal(getAHRSStatus())
+	fmt.Fprintf(w, "%s\n", ahrsJSON)
+}
+
 // AJAX call - /getTowers. Responds with all ADS-B ground towers that have sent messages that we were able to parse, along with its stats.
 func handleTowersRequest(w http.ResponseWriter, r *http.Request) {
 	setNoCache(w)
@@ -195,6 +227,63 @@ func handleTowersRequest(w http.ResponseWriter, r *http.Request) {
 	ADSBTowerMutex.Unlock()
 }
 
+// Parse a comma separated list of 'n' floats, e.g. "40.1,-84.2".
+func parseFloatList(s string, n int) ([]float64, bool) {
+	x := strings.Split(s, ",")
+	if len(x) != n {
+		return nil, false
+	}
+	ret := make([]float64, n)
+	for i, v := range x {
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return nil, false
+		}
+		ret[i] = f
+	}
+	return ret, true
+}
+
+// AJAX call - /getWeather. Responds with the current weather products, including decoded METAR, TAF, PIREP and winds
+// aloft reports and AIRMET/SIGMET/NOTAM/SUA graphics. Optional parameters filter the list:
+//  type=METAR
+//  location=KOLY (station ID, or report number for graphical products)
+//  bbox=<min lat>,<min lng>,<max lat>,<max lng>
+//  lat=<lat>&lng=<lng>&radius=<nm>
+func handleWeatherRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+
+	var q WeatherQuery
+	v := r.URL.Query()
+	q.Type = strings.ToUpper(v.Get("type"))
+	q.Location = strings.ToUpper(v.Get("location"))
+	if len(v.Get("bbox")) > 0 {
+		box, ok := parseFloatList(v.Get("bbox"), 4)
+		if !ok {
+			http.Error(w, "invalid bbox", http.StatusBadRequest)
+			return
+		}
+		q.HasBox = true
+		q.MinLat, q.MinLng, q.MaxLat, q.MaxLng = box[0], box[1], box[2], box[3]
+	}
+	if len(v.Get("radius")) > 0 {
+		pt, ok := parseFloatList(v.Get("lat")+","+v.Get("lng")+","+v.Get("radius"), 3)
+		if !ok {
+			http.Error(w, "invalid lat/lng/radius", http.StatusBadRequest)
+			return
+		}
+		q.HasRadius = true
+		q.Lat, q.Lng, q.Radius = pt[0], pt[1], pt[2]
+	}
+
+	weatherJSON, err := json.Marshal(weatherQuery(q))
+	if err != nil {
+		log.Printf("Error sending weather JSON data: %s\n", err.Error())
+	}
+	fmt.Fprintf(w, "%s\n", weatherJSON)
+}
+
 // AJAX call - /getSatellites. Responds with all GNSS satellites that are being tracked, along with status information.
 func handleSatellitesRequest(w http.ResponseWriter, r *http.Request) {
 	setNoCache(w)
@@ -230,6 +319,15 @@ func handleSettingsSetRequest(w http.ResponseWriter, r *http.Request) {
 		// raw, _ := httputil.DumpRequest(r, true)
 		// log.Printf("handleSettingsSetRequest:raw: %s\n", raw)
 
+		// Settings are changed on a copy, and only saved if all of them are valid.
+		outputsMutex.Lock()
+		newSettings := globalSettings
+		newSettings.Outputs = make([]outputEndpoint, len(globalSettings.Outputs))
+		copy(newSettings.Outputs, globalSettings.Outputs)
+		outputsMutex.Unlock()
+		outputsSet := false
+
+		invalid := make(map[string]string)
 		decoder := json.NewDecoder(r.Body)
 		for {
 			var msg map[string]interface{} // support arbitrary JSON
@@ -239,74 +337,42 @@ func handleSettingsSetRequest(w http.ResponseWriter, r *http.Request) {
 				break
 			} else if err != nil {
 				log.Printf("handleSettingsSetRequest:error: %s\n", err.Error())
-			} else {
-				for key, val := range msg {
-					// log.Printf("handleSettingsSetRequest:json: testing for key:%s of type %s\n", key, reflect.TypeOf(val))
-					switch key {
-					case "UAT_Enabled":
-						globalSettings.UAT_Enabled = val.(bool)
-					case "ES_Enabled":
-						globalSettings.ES_Enabled = val.(bool)
-					case "Ping_Enabled":
-						globalSettings.Ping_Enabled = val.(bool)
-					case "GPS_Enabled":
-						globalSettings.GPS_Enabled = val.(bool)
-					case "AHRS_Enabled":
-						globalSettings.AHRS_Enabled = val.(bool)
-					case "DEBUG":
-						globalSettings.DEBUG = val.(bool)
-					case "DisplayTrafficSource":
-						globalSettings.DisplayTrafficSource = val.(bool)
-					case "ReplayLog":
-						v := val.(bool)
-						if v != globalSettings.ReplayLog { // Don't mark the files unless there is a change.
-							globalSettings.ReplayLog = v
-						}
-					case "PPM":
-						globalSettings.PPM = int(val.(float64))
-					case "FlightLogLevel":
-						globalSettings.FlightLogLevel = int(val.(float64))
-					case "Baud":
-						if serialOut, ok := globalSettings.SerialOutputs["/dev/serialout0"]; ok { //FIXME: Only one device for now.
-							newBaud := int(val.(float64))
-							if newBaud == serialOut.Baud { // Same baud rate. No change.
-								continue
-							}
-							log.Printf("changing /dev/serialout0 baud rate from %d to %d.\n", serialOut.Baud, newBaud)
-							serialOut.Baud = newBaud
-							// Close the port if it is open.
-							if serialOut.serialPort != nil {
-								log.Printf("closing /dev/serialout0 for baud rate change.\n")
-								serialOut.serialPort.Close()
-								serialOut.serialPort = nil
-							}
-							globalSettings.SerialOutputs["/dev/serialout0"] = serialOut
-						}
-					case "WatchList":
-						globalSettings.WatchList = val.(string)
-					case "OwnshipModeS":
-						// Expecting a hex string less than 6 characters (24 bits) long.
-						if len(val.(string)) > 6 { // Too long.
-							continue
-						}
-						// Pad string, must be 6 characters long.
-						vals := strings.ToUpper(val.(string))
-						for len(vals) < 6 {
-							vals = "0" + vals
-						}
-						hexn, err := hex.DecodeString(vals)
-						if err != nil { // Number not valid.
-							log.Printf("handleSettingsSetRequest:OwnshipModeS: %s\n", err.Error())
-							continue
-						}
-						globalSettings.OwnshipModeS = fmt.Sprintf("%02X%02X%02X", hexn[0], hexn[1], hexn[2])
-					default:
-						log.Printf("handleSettingsSetRequest:json: unrecognized key:%s\n", key)
-					}
+				invalid["request"] = err.Error()
+				break
+			}
+			for key, val := range msg {
+				// log.Printf("handleSettingsSetRequest:json: testing for key:%s of type %s\n", key, reflect.TypeOf(val))
+				if err := setSetting(&newSettings, key, val); err != nil {
+					log.Printf("handleSettingsSetRequest:%s: %s\n", key, err.Error())
+					invalid[key] = err.Error()
 				}
-				saveSettings()
+				if key == "Baud" || key == "SerialCapability" {
+					outputsSet = true
+				}
+			}
+		}
+		for key, msg := range validateSettings(&newSettings) {
+			if _, ok := invalid[key]; !ok {
+				invalid[key] = msg
 			}
 		}
+		if len(invalid) > 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			errorsJSON, _ := json.Marshal(map[string]interface{}{"Errors": invalid})
+			fmt.Fprintf(w, "%s\n", errorsJSON)
+			return
+		}
+
+		outputsMutex.Lock()
+		if !outputsSet {
+			newSettings.Outputs = globalSettings.Outputs // Keep any changes made through /outputs meanwhile.
+		}
+		globalSettings = newSettings
+		outputsMutex.Unlock()
+		saveSettings()
+		if outputsSet {
+			applyOutputs() // The serial port is reopened at the new baud rate or format.
+		}
 
 		// while it may be redundent, we return the latest settings
 		settingsJSON, _ := json.Marshal(&globalSettings)
@@ -340,6 +406,146 @@ func handleClientsGetRequest(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "%s\n", clientsJSON)
 }
 
+// AJAX call - /getClientHistory?minutes=N. Responds with per-client counters sampled over the last N minutes (all
+// history kept if not given).
+func handleClientHistoryRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	d := CLIENT_STATS_HISTORY
+	if m := r.URL.Query().Get("minutes"); m != "" {
+		minutes, err := strconv.ParseFloat(m, 64)
+		if err != nil || minutes <= 0 {
+			http.Error(w, "Invalid minutes value", http.StatusBadRequest)
+			return
+		}
+		d = time.Duration(minutes * float64(time.Minute))
+	}
+	historyJSON, _ := json.Marshal(getClientStatsHistory(d))
+	fmt.Fprintf(w, "%s\n", historyJSON)
+}
+
+/*
+	REST API for output endpoints:
+		GET    /outputs      - all outputs.
+		POST   /outputs      - add an output. Responds with the output, including its assigned ID.
+		GET    /outputs/{id} - one output.
+		PUT    /outputs/{id} - replace an output.
+		DELETE /outputs/{id} - remove an output.
+	Changes are saved, and applied to the running outputs.
+*/
+func handleOutputsRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Origin, X-Requested-With, Content-Type, Accept")
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	id := -1
+	if len(path) > 2 {
+		http.NotFound(w, r)
+		return
+	}
+	if len(path) == 2 {
+		var err error
+		if id, err = strconv.Atoi(path[1]); err != nil {
+			http.Error(w, "Invalid output ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var o outputEndpoint
+	if r.Method == "POST" || r.Method == "PUT" {
+		if err := json.NewDecoder(r.Body).Decode(&o); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var ret interface{}
+	switch {
+	case r.Method == "GET" && id < 0:
+		ret = getOutputs()
+	case r.Method == "GET":
+		var ok bool
+		if ret, ok = getOutput(id); !ok {
+			http.NotFound(w, r)
+			return
+		}
+	case r.Method == "POST" && id < 0:
+		newOutput, err := addOutput(o)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		ret = newOutput
+	case r.Method == "PUT" && id >= 0:
+		if _, ok := getOutput(id); !ok {
+			http.NotFound(w, r)
+			return
+		}
+		o.ID = id
+		if err := updateOutput(o); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ret = o
+	case r.Method == "DELETE" && id >= 0:
+		if err := deleteOutput(id); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		ret = map[string]int{"deleted": id}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	retJSON, _ := json.Marshal(ret)
+	fmt.Fprintf(w, "%s\n", retJSON)
+}
+
+/*
+	Plugins:
+		GET  /plugins        - status of all plugins.
+		POST /plugins/{name} - send the request body to the plugin's Input, as a command.
+*/
+func handlePluginsRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/plugins"), "/")
+	if name == "" {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		pluginsJSON, _ := json.Marshal(getPluginStatus())
+		fmt.Fprintf(w, "%s\n", pluginsJSON)
+		return
+	}
+	p := getPlugin(name)
+	if p == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !sendPluginInput(p, string(body)) {
+		http.Error(w, "Plugin is not accepting commands", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintf(w, "{}\n")
+}
+
 
 
 func openDatabase() (db *sql.DB, err error) {
@@ -1125,6 +1331,7 @@ func viewLogs(w http.ResponseWriter, r *http.Request) {
 func managementInterface() {
 	weatherUpdate = NewUIBroadcaster()
 	trafficUpdate = NewUIBroadcaster()
+	go uiEventForwarder()
 
 	http.HandleFunc("/", defaultServer)
 	
@@ -1171,13 +1378,22 @@ func managementInterface() {
 
 	http.HandleFunc("/getStatus", handleStatusRequest)
 	http.HandleFunc("/getSituation", handleSituationRequest)
+	http.HandleFunc("/getAHRS", handleAHRSRequest)
+	http.HandleFunc("/calibrateAHRS", handleAHRSCalibrateRequest)
 	http.HandleFunc("/getTowers", handleTowersRequest)
+	http.HandleFunc("/getWeather", handleWeatherRequest)
 	http.HandleFunc("/getSatellites", handleSatellitesRequest)
 	http.HandleFunc("/getSettings", handleSettingsGetRequest)
 	http.HandleFunc("/setSettings", handleSettingsSetRequest)
 	http.HandleFunc("/shutdown", handleShutdownRequest)
 	http.HandleFunc("/reboot", handleRebootRequest)
 	http.HandleFunc("/getClients", handleClientsGetRequest)
+	http.HandleFunc("/getClientHistory", handleClientHistoryRequest)
+	http.HandleFunc("/outputs", handleOutputsRequest)
+	http.HandleFunc("/outputs/", handleOutputsRequest)
+	http.HandleFunc("/metrics", handleMetricsRequest)
+	http.HandleFunc("/plugins", handlePluginsRequest)
+	http.HandleFunc("/plugins/", handlePluginsRequest)
 	http.HandleFunc("/updateUpload", handleUpdatePostRequest)
 	http.HandleFunc("/roPartitionRebuild", handleroPartitionRebuild)
 	http.HandleFunc("/flightlog/", handleFlightLogRequest)
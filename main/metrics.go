@@ -0,0 +1,256 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	metrics.go: /metrics endpoint. Receiver, GPS, tower, network and datalog statistics in the Prometheus text
+	 exposition format, for scraping by a local Prometheus.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const METRICS_CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+
+// Builds a Prometheus text exposition. Samples of one metric must be written together: HELP and TYPE are written
+// before the first sample of each metric name.
+type metricsWriter struct {
+	buf       bytes.Buffer
+	described map[string]bool
+}
+
+var metricsLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatMetricValue(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Write one sample. 'typ' is "gauge", "counter" or "summary". 'labels' are name, value pairs.
+func (m *metricsWriter) sample(name, typ, help string, v float64, labels ...string) {
+	family := name
+	if typ == "summary" {
+		family = strings.TrimSuffix(strings.TrimSuffix(name, "_sum"), "_count")
+	}
+	if !m.described[family] {
+		m.described[family] = true
+		fmt.Fprintf(&m.buf, "# HELP %s %s\n# TYPE %s %s\n", family, help, family, typ)
+	}
+	m.buf.WriteString(name)
+	if len(labels) > 0 {
+		m.buf.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				m.buf.WriteByte(',')
+			}
+			fmt.Fprintf(&m.buf, "%s=\"%s\"", labels[i], metricsLabelEscaper.Replace(labels[i+1]))
+		}
+		m.buf.WriteByte('}')
+	}
+	fmt.Fprintf(&m.buf, " %s\n", formatMetricValue(v))
+}
+
+func (m *metricsWriter) gauge(name, help string, v float64, labels ...string) {
+	m.sample(name, "gauge", help, v, labels...)
+}
+
+func (m *metricsWriter) counter(name, help string, v float64, labels ...string) {
+	m.sample(name, "counter", help, v, labels...)
+}
+
+func boolMetric(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func writeStatusMetrics(m *metricsWriter) {
+	m.gauge("stratux_info", "Stratux version and build.", 1, "version", globalStatus.Version, "build", globalStatus.Build, "hardware_build", globalStatus.HardwareBuild)
+	m.gauge("stratux_uptime_seconds", "Time since Stratux started.", float64(globalStatus.Uptime)/1000)
+	m.gauge("stratux_cpu_temperature_celsius", "CPU temperature.", float64(globalStatus.CPUTemp))
+	m.gauge("stratux_disk_free_bytes", "Free space on the root filesystem.", float64(globalStatus.DiskBytesFree))
+	m.gauge("stratux_sdr_devices", "Number of SDRs in use.", float64(globalStatus.Devices))
+	m.gauge("stratux_errors", "Number of system errors being reported.", float64(len(globalStatus.Errors)))
+	m.gauge("stratux_ping_connected", "Whether a Ping receiver is connected.", boolMetric(globalStatus.Ping_connected))
+	m.gauge("stratux_ahrs_connected", "Whether the AHRS sensors are connected.", boolMetric(globalStatus.RY835AI_connected))
+
+	m.gauge("stratux_messages_last_minute", "Messages received in the last minute.", float64(globalStatus.UAT_messages_last_minute), "source", "uat")
+	m.gauge("stratux_messages_last_minute", "", float64(globalStatus.ES_messages_last_minute), "source", "es")
+	m.gauge("stratux_messages_max_per_minute", "Most messages received in one minute since startup.", float64(globalStatus.UAT_messages_max), "source", "uat")
+	m.gauge("stratux_messages_max_per_minute", "", float64(globalStatus.ES_messages_max), "source", "es")
+	m.gauge("stratux_message_log_length", "Messages kept for the last-minute statistics.", float64(len(MsgLog)))
+
+	products := []struct {
+		name  string
+		total uint32
+	}{
+		{"metar", globalStatus.UAT_METAR_total},
+		{"taf", globalStatus.UAT_TAF_total},
+		{"nexrad", globalStatus.UAT_NEXRAD_total},
+		{"sigmet", globalStatus.UAT_SIGMET_total},
+		{"pirep", globalStatus.UAT_PIREP_total},
+		{"notam", globalStatus.UAT_NOTAM_total},
+		{"other", globalStatus.UAT_OTHER_total},
+	}
+	for _, p := range products {
+		m.counter("stratux_uat_products_total", "UAT weather and NOTAM products received, by type.", float64(p.total), "product", p.name)
+	}
+
+	m.gauge("stratux_gps_connected", "Whether a GPS is connected.", boolMetric(globalStatus.GPS_connected))
+	m.gauge("stratux_gps_satellites", "GPS satellites, by state.", float64(globalStatus.GPS_satellites_locked), "state", "locked")
+	m.gauge("stratux_gps_satellites", "", float64(globalStatus.GPS_satellites_seen), "state", "seen")
+	m.gauge("stratux_gps_satellites", "", float64(globalStatus.GPS_satellites_tracked), "state", "tracked")
+	m.gauge("stratux_gps_position_accuracy_meters", "Horizontal position accuracy (95% confidence).", float64(globalStatus.GPS_position_accuracy))
+}
+
+func writeTowerMetrics(m *metricsWriter) {
+	ADSBTowerMutex.Lock()
+	ids := make([]string, 0, len(ADSBTowers))
+	towers := make(map[string]ADSBTower)
+	for id, tower := range ADSBTowers {
+		ids = append(ids, id)
+		towers[id] = tower
+	}
+	ADSBTowerMutex.Unlock()
+	sort.Strings(ids)
+
+	// Samples of each metric are written together.
+	for _, id := range ids {
+		m.gauge("stratux_tower_signal_strength_db", "Current RSSI of a UAT ground station.", towers[id].Signal_strength_now, "tower", id)
+	}
+	for _, id := range ids {
+		m.gauge("stratux_tower_signal_strength_max_db", "Peak RSSI of a UAT ground station since startup.", towers[id].Signal_strength_max, "tower", id)
+	}
+	for _, id := range ids {
+		m.gauge("stratux_tower_signal_strength_last_minute_db", "Average RSSI of a UAT ground station over the last minute.", towers[id].Signal_strength_last_minute, "tower", id)
+	}
+	for _, id := range ids {
+		m.gauge("stratux_tower_messages_last_minute", "Messages received from a UAT ground station in the last minute.", float64(towers[id].Messages_last_minute), "tower", id)
+	}
+}
+
+func writeNetworkMetrics(m *metricsWriter) {
+	m.gauge("stratux_connected_users", "Connected network clients.", float64(globalStatus.Connected_Users))
+	m.counter("stratux_network_messages_sent_total", "Messages sent to network clients.", float64(globalStatus.NetworkDataMessagesSent))
+	m.counter("stratux_network_bytes_sent_total", "Bytes sent to network clients.", float64(globalStatus.NetworkDataBytesSent))
+	m.counter("stratux_network_messages_sent_nonqueueable_total", "Non-queueable messages sent to network clients.", float64(globalStatus.NetworkDataMessagesSentNonqueueable))
+	m.counter("stratux_network_bytes_sent_nonqueueable_total", "Bytes of non-queueable messages sent to network clients.", float64(globalStatus.NetworkDataBytesSentNonqueueable))
+	m.gauge("stratux_network_message_queue_length", "Messages waiting to be sent to the outputs.", float64(len(messageQueue)))
+
+	netMutex.Lock()
+	clients := make([]string, 0, len(outSockets))
+	conns := make(map[string]networkConnection)
+	for k, netconn := range outSockets {
+		clients = append(clients, k)
+		conns[k] = netconn
+	}
+	sleeping := make(map[string]bool)
+	for _, k := range clients {
+		sleeping[k] = isSleeping(k)
+	}
+	netMutex.Unlock()
+	sort.Strings(clients)
+
+	for _, k := range clients {
+		m.gauge("stratux_client_queue_length", "Messages queued for a UDP client.", float64(conns[k].MessageQueueLen), "client", k)
+	}
+	for _, k := range clients {
+		m.gauge("stratux_client_sleeping", "Whether a UDP client is sleeping.", boolMetric(sleeping[k]), "client", k)
+	}
+	for _, k := range clients {
+		m.counter("stratux_client_messages_sent_total", "Messages sent to a UDP client since it connected.", float64(conns[k].MessagesSent), "client", k)
+	}
+	for _, k := range clients {
+		m.counter("stratux_client_bytes_sent_total", "Bytes sent to a UDP client since it connected.", float64(conns[k].BytesSent), "client", k)
+	}
+	for _, k := range clients {
+		m.counter("stratux_client_messages_dropped_total", "Messages dropped for a UDP client since it connected.", float64(conns[k].MessagesDropped), "client", k)
+	}
+	for _, k := range clients {
+		m.counter("stratux_client_sleep_seconds_total", "Time a UDP client has spent sleeping.", conns[k].SleepTime, "client", k)
+	}
+	for _, k := range clients {
+		m.counter("stratux_client_throttle_seconds_total", "Time a UDP client has spent throttled.", conns[k].ThrottleTime, "client", k)
+	}
+
+	tcpMutex.Lock()
+	tcpAddrs := make([]string, 0, len(tcpClients))
+	tcpQueues := make(map[string]int)
+	tcpDropped := make(map[string]uint32)
+	for addr, client := range tcpClients {
+		tcpAddrs = append(tcpAddrs, addr)
+		tcpQueues[addr] = len(client.queue)
+		tcpDropped[addr] = client.dropped
+	}
+	tcpMutex.Unlock()
+	sort.Strings(tcpAddrs)
+
+	m.gauge("stratux_tcp_clients", "Connected TCP clients.", float64(len(tcpAddrs)))
+	for _, addr := range tcpAddrs {
+		m.gauge("stratux_tcp_client_queue_length", "Messages queued for a TCP client.", float64(tcpQueues[addr]), "client", addr)
+	}
+	for _, addr := range tcpAddrs {
+		m.counter("stratux_tcp_client_messages_dropped_total", "Messages dropped for a TCP client since it connected.", float64(tcpDropped[addr]), "client", addr)
+	}
+}
+
+func writeTrafficMetrics(m *metricsWriter) {
+	trafficMutex.Lock()
+	n := len(traffic)
+	trafficMutex.Unlock()
+	m.gauge("stratux_traffic_targets", "Traffic targets being tracked.", float64(n))
+}
+
+func writeDataLogMetrics(m *metricsWriter) {
+	dataLogStatsMutex.Lock()
+	stats := dataLogStats
+	dataLogStatsMutex.Unlock()
+
+	m.gauge("stratux_datalog_enabled", "Whether the SQLite datalog is running.", boolMetric(dataLogStarted))
+	m.gauge("stratux_datalog_queue_length", "Rows waiting to be queued for the next datalog write.", float64(len(dataLogWriteChan)))
+	m.sample("stratux_datalog_write_duration_seconds_sum", "summary", "Time taken by datalog writes (one transaction per second).", stats.Seconds)
+	m.sample("stratux_datalog_write_duration_seconds_count", "summary", "", float64(stats.Writes))
+	m.gauge("stratux_datalog_last_write_duration_seconds", "Time taken by the last datalog write.", stats.LastSeconds)
+	m.counter("stratux_datalog_rows_written_total", "Rows written to the datalog.", float64(stats.Rows))
+}
+
+func writeEventBusMetrics(m *metricsWriter) {
+	subs := getEventSubscriptionStats()
+	for _, s := range subs {
+		m.gauge("stratux_event_queue_length", "Events waiting for an event bus subscriber.", float64(s.QueueLen), "subscriber", s.Name)
+	}
+	for _, s := range subs {
+		m.counter("stratux_event_dropped_total", "Events dropped because an event bus subscriber's queue was full.", float64(s.Dropped), "subscriber", s.Name)
+	}
+}
+
+func handleMetricsRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	m := &metricsWriter{described: make(map[string]bool)}
+	writeStatusMetrics(m)
+	writeTowerMetrics(m)
+	writeTrafficMetrics(m)
+	writeNetworkMetrics(m)
+	writeDataLogMetrics(m)
+	writeEventBusMetrics(m)
+	w.Header().Set("Content-Type", METRICS_CONTENT_TYPE)
+	w.Write(m.buf.Bytes())
+}
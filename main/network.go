@@ -31,6 +31,8 @@ type networkMessage struct {
 	msgType   uint8
 	queueable bool
 	ts        time.Time
+	traffic   []TrafficInfo  // If set, 'msg' is made from these for each output, using its TrafficFilter.
+	situation *SituationData // Ownship situation for 'traffic'.
 }
 
 type networkConnection struct {
@@ -49,12 +51,21 @@ type networkConnection struct {
 	numOverflows    uint32    // Number of times the queue has overflowed - for calculating the amount to chop off from the queue.
 	SleepFlag       bool      // Whether or not this client has been marked as sleeping - only used for debugging (relies on messages being sent to update this flag in sendToAllConnectedClients()).
 	FFCrippled      bool
+	TrafficFilter   *TrafficFilter `json:",omitempty"` // nil sends all traffic.
+	Static          bool           // Configured destination (not a DHCP client). Never considered sleeping, and not pinged.
+	App             string         // EFB app, if it identified itself.
+	// Per-client counters, since the client connected. See clientstats.go.
+	MessagesSent    uint64 // Writes to the socket: non-queueable messages, and batches of queued messages.
+	BytesSent       uint64
+	MessagesDropped uint64  // Chopped from the queue on overflow, or non-queueable messages discarded while sleeping.
+	SleepTime       float64 // Seconds spent sleeping.
+	ThrottleTime    float64 // Seconds spent throttled after an ICMP Unreachable.
 }
 
+// An open serial output port, and the output it was opened for.
 type serialConnection struct {
-	DeviceString string
-	Baud         int
-	serialPort   *serial.Port
+	output     outputEndpoint
+	serialPort *serial.Port
 }
 
 var messageQueue chan networkMessage
@@ -70,6 +81,8 @@ const (
 	NETWORK_GDL90_STANDARD = 1
 	NETWORK_AHRS_FFSIM     = 2
 	NETWORK_AHRS_GDL90     = 4
+	NETWORK_NMEA           = 8
+	NETWORK_JSON           = 16
 	dhcp_lease_file        = "/var/lib/dhcp/dhcpd.leases"
 	extra_hosts_file       = "/etc/stratux-static-hosts.conf"
 )
@@ -122,6 +135,9 @@ func getDHCPLeases() (map[string]string, error) {
 }
 
 func isSleeping(k string) bool {
+	if outSockets[k].Static {
+		return false
+	}
 	ipAndPort := strings.Split(k, ":")
 	lastPing, ok := pingResponse[ipAndPort[0]]
 	// No ping response. Assume disconnected/sleeping device.
@@ -141,10 +157,14 @@ func isThrottled(k string) bool {
 }
 
 func sendToAllConnectedClients(msg networkMessage) {
-	if (msg.msgType & NETWORK_GDL90_STANDARD) != 0 {
-		// It's a GDL90 message. Send to serial output channel (which may or may not cause something to happen).
-		serialOutputChan <- msg.msg
+	if (msg.msgType & (NETWORK_GDL90_STANDARD | NETWORK_NMEA)) != 0 {
+		// It's a GDL90 or NMEA message. Send to serial output channel (which may or may not cause something to happen).
+		serialOutputChan <- msg
 	}
+	sendToTCPClients(msg)
+
+	// Traffic reports, by filter. Outputs with the same filter get the same message.
+	trafficMsgs := make(map[TrafficFilter][]byte)
 
 	netMutex.Lock()
 	defer netMutex.Unlock()
@@ -158,6 +178,22 @@ func sendToAllConnectedClients(msg networkMessage) {
 		if (netconn.Capability & msg.msgType) == 0 {
 			continue
 		}
+
+		if msg.traffic != nil {
+			var f TrafficFilter
+			if netconn.TrafficFilter != nil {
+				f = *netconn.TrafficFilter
+			}
+			b, ok := trafficMsgs[f]
+			if !ok {
+				b = makeTrafficMessage(msg.msgType, msg.traffic, &f, msg.situation)
+				trafficMsgs[f] = b
+			}
+			if len(b) == 0 {
+				continue
+			}
+			msg.msg = b
+		}
 		// Send non-queueable messages immediately, or discard if the client is in sleep mode.
 
 		if !sleepFlag {
@@ -166,9 +202,14 @@ func sendToAllConnectedClients(msg networkMessage) {
 
 		if !msg.queueable {
 			if sleepFlag {
+				netconn.MessagesDropped++
+				outSockets[k] = netconn
 				continue
 			}
 			netconn.Conn.Write(msg.msg) // Write immediately.
+			netconn.MessagesSent++
+			netconn.BytesSent += uint64(len(msg.msg))
+			outSockets[k] = netconn
 			totalNetworkMessagesSent++
 			globalStatus.NetworkDataMessagesSent++
 			globalStatus.NetworkDataMessagesSentNonqueueable++
@@ -181,8 +222,10 @@ func sendToAllConnectedClients(msg networkMessage) {
 				netconn.numOverflows++
 				s := 2 * netconn.numOverflows // Double the amount we chop off on each overflow.
 				if int(s) >= len(netconn.messageQueue) {
+					netconn.MessagesDropped += uint64(len(netconn.messageQueue))
 					netconn.messageQueue = make([][]byte, 0)
 				} else {
+					netconn.MessagesDropped += uint64(s)
 					netconn.messageQueue = netconn.messageQueue[s:]
 				}
 			}
@@ -192,60 +235,92 @@ func sendToAllConnectedClients(msg networkMessage) {
 	}
 }
 
-var serialOutputChan chan []byte
+var serialOutputChan chan networkMessage
+var serialOutputsChanged = make(chan bool, 1) // Signals serialOutWatcher that globalSettings.Outputs changed.
+
+// Open ports for the serial outputs whose devices exist, and close ports whose outputs were removed or changed.
+// Adds an output for OUTPUT_SERIAL_DEFAULT if it appears and has no output.
+func refreshSerialOutputs(conns map[int]serialConnection) {
+	if _, err := os.Stat(OUTPUT_SERIAL_DEFAULT); err == nil && serialOutputID(OUTPUT_SERIAL_DEFAULT) < 0 {
+		log.Printf("detected new serial output, setting up now: %s. Default baudrate 38400.\n", OUTPUT_SERIAL_DEFAULT)
+		if _, err := addOutput(outputEndpoint{Transport: OUTPUT_SERIAL, Host: OUTPUT_SERIAL_DEFAULT, Baud: 38400, Capability: NETWORK_GDL90_STANDARD}); err != nil {
+			log.Printf("serialout (%s): %s\n", OUTPUT_SERIAL_DEFAULT, err.Error())
+		}
+	}
+
+	outputs := make(map[int]outputEndpoint)
+	for _, o := range getOutputs() {
+		if o.Transport == OUTPUT_SERIAL {
+			outputs[o.ID] = o
+		}
+	}
+	for id, conn := range conns {
+		o, ok := outputs[id]
+		if ok && o.Host == conn.output.Host && o.Baud == conn.output.Baud {
+			conn.output = o // Capability and filter changes don't need the port reopened.
+			conns[id] = conn
+			continue
+		}
+		log.Printf("closing serialout %s.\n", conn.output.Host)
+		conn.serialPort.Close()
+		delete(conns, id)
+	}
+	for id, o := range outputs {
+		if _, ok := conns[id]; ok {
+			continue
+		}
+		if _, err := os.Stat(o.Host); os.IsNotExist(err) { // Check if the device file exists.
+			continue
+		}
+		p, err := serial.OpenPort(&serial.Config{Name: o.Host, Baud: o.Baud})
+		if err != nil {
+			log.Printf("serialout port (%s) err: %s\n", o.Host, err.Error())
+			continue // We'll attempt again in 30 seconds.
+		}
+		log.Printf("opened serialout: Name: %s, Baud: %d\n", o.Host, o.Baud)
+		conns[id] = serialConnection{output: o, serialPort: p}
+	}
+}
 
-// Monitor serial output channel, send to serial port.
+// Monitor serial output channel, send to serial ports.
 func serialOutWatcher() {
-	// Check every 30 seconds for a serial output device.
+	// Check every 30 seconds for serial output devices.
 	serialTicker := time.NewTicker(30 * time.Second)
-
-	serialDev := "/dev/serialout0" //FIXME: This is temporary. Only one serial output device for now.
+	conns := make(map[int]serialConnection) // Open ports, by output ID.
 
 	for {
 		select {
 		case <-serialTicker.C:
-			if _, err := os.Stat(serialDev); !os.IsNotExist(err) { // Check if the device file exists.
-				var thisSerialConn serialConnection
-				// Check if we need to start handling a new device.
-				if val, ok := globalSettings.SerialOutputs[serialDev]; !ok {
-					newSerialOut := serialConnection{DeviceString: serialDev, Baud: 38400}
-					log.Printf("detected new serial output, setting up now: %s. Default baudrate 38400.\n", serialDev)
-					if globalSettings.SerialOutputs == nil {
-						globalSettings.SerialOutputs = make(map[string]serialConnection)
-					}
-					globalSettings.SerialOutputs[serialDev] = newSerialOut
-					saveSettings()
-					thisSerialConn = newSerialOut
-				} else {
-					thisSerialConn = val
+			refreshSerialOutputs(conns)
+		case <-serialOutputsChanged:
+			refreshSerialOutputs(conns)
+		case msg := <-serialOutputChan:
+			// Traffic reports, by filter. Outputs with the same filter get the same message.
+			trafficMsgs := make(map[TrafficFilter][]byte)
+			for id, conn := range conns {
+				if (conn.output.Capability & msg.msgType) == 0 {
+					continue
 				}
-				// Check if we need to open the connection now.
-				if thisSerialConn.serialPort == nil {
-					cfg := &serial.Config{Name: thisSerialConn.DeviceString, Baud: thisSerialConn.Baud}
-					p, err := serial.OpenPort(cfg)
-					if err != nil {
-						log.Printf("serialout port (%s) err: %s\n", thisSerialConn.DeviceString, err.Error())
-						break // We'll attempt again in 30 seconds.
-					} else {
-						log.Printf("opened serialout: Name: %s, Baud: %d\n", thisSerialConn.DeviceString, thisSerialConn.Baud)
+				b := msg.msg
+				if msg.traffic != nil {
+					var f TrafficFilter
+					if conn.output.TrafficFilter != nil {
+						f = *conn.output.TrafficFilter
 					}
-					// Save the serial port connection.
-					thisSerialConn.serialPort = p
-					globalSettings.SerialOutputs[serialDev] = thisSerialConn
-				}
-			}
-
-		case b := <-serialOutputChan:
-			if val, ok := globalSettings.SerialOutputs[serialDev]; ok {
-				if val.serialPort != nil {
-					_, err := val.serialPort.Write(b)
-					if err != nil { // Encountered an error in writing to the serial port. Close it and set Serial_out_enabled.
-						log.Printf("serialout (%s) port err: %s. Closing port.\n", val.DeviceString, err.Error())
-						val.serialPort.Close()
-						val.serialPort = nil
-						globalSettings.SerialOutputs[serialDev] = val
+					var ok bool
+					if b, ok = trafficMsgs[f]; !ok {
+						b = makeTrafficMessage(msg.msgType, msg.traffic, &f, msg.situation)
+						trafficMsgs[f] = b
 					}
 				}
+				if len(b) == 0 {
+					continue
+				}
+				if _, err := conn.serialPort.Write(b); err != nil { // Encountered an error in writing to the serial port. Close it, and try again later.
+					log.Printf("serialout (%s) port err: %s. Closing port.\n", conn.output.Host, err.Error())
+					conn.serialPort.Close()
+					delete(conns, id)
+				}
 			}
 		}
 	}
@@ -278,45 +353,73 @@ func getNetworkStats() {
 		}
 	}
 
+	numNonSleepingClients += uint(tcpClientCount())
+
 	globalStatus.Connected_Users = numNonSleepingClients
 }
 
-// See who has a DHCP lease and make a UDP connection to each of them.
+// See who has a DHCP lease and make a UDP connection to each of them, and to each configured UDP destination.
 func refreshConnectedClients() {
 	netMutex.Lock()
 	defer netMutex.Unlock()
-	validConnections := make(map[string]bool)
 	t, err := getDHCPLeases()
 	if err != nil {
-		log.Printf("getDHCPLeases(): %s\n", err.Error())
-		return
+		log.Printf("getDHCPLeases(): %s\n", err.Error()) // Configured destinations don't need the leases.
+	} else {
+		dhcpLeases = t
 	}
-	dhcpLeases = t
-	// Client connected that wasn't before.
-	for ip, hostname := range dhcpLeases {
-		for _, networkOutput := range globalSettings.NetworkOutputs {
-			ipAndPort := ip + ":" + strconv.Itoa(int(networkOutput.Port))
-			if _, ok := outSockets[ipAndPort]; !ok {
-				log.Printf("client connected: %s:%d (%s).\n", ip, networkOutput.Port, hostname)
-				addr, err := net.ResolveUDPAddr("udp", ipAndPort)
-				if err != nil {
-					log.Printf("ResolveUDPAddr(%s): %s\n", ipAndPort, err.Error())
-					continue
-				}
-				outConn, err := net.DialUDP("udp", nil, addr)
-				if err != nil {
-					log.Printf("DialUDP(%s): %s\n", ipAndPort, err.Error())
-					continue
-				}
-				newq := make([][]byte, 0)
-				outSockets[ipAndPort] = networkConnection{Conn: outConn, Ip: ip, Port: networkOutput.Port, Capability: networkOutput.Capability, messageQueue: newq}
+
+	// Destinations, by "ip:port". The first output for a destination wins.
+	wanted := make(map[string]networkConnection)
+	for _, o := range getOutputs() {
+		switch o.Transport {
+		case OUTPUT_UDP, OUTPUT_UDP_BROADCAST:
+		default:
+			continue
+		}
+		dest := networkConnection{Ip: o.Host, Port: o.Port, Capability: o.Capability, TrafficFilter: o.TrafficFilter, Static: true}
+		if o.Host != "" {
+			ipAndPort := o.Host + ":" + strconv.Itoa(int(o.Port))
+			if _, ok := wanted[ipAndPort]; !ok {
+				wanted[ipAndPort] = dest
+			}
+			continue
+		}
+		for ip := range dhcpLeases {
+			ipAndPort := ip + ":" + strconv.Itoa(int(o.Port))
+			if _, ok := wanted[ipAndPort]; !ok {
+				dest.Ip = ip
+				dest.Static = false
+				wanted[ipAndPort] = dest
 			}
-			validConnections[ipAndPort] = true
 		}
 	}
+
+	// Client connected that wasn't before, or whose output changed.
+	for ipAndPort, dest := range wanted {
+		if conn, ok := outSockets[ipAndPort]; ok {
+			conn.Capability, conn.TrafficFilter, conn.Static = dest.Capability, dest.TrafficFilter, dest.Static
+			outSockets[ipAndPort] = conn
+			continue
+		}
+		log.Printf("client connected: %s:%d (%s).\n", dest.Ip, dest.Port, dhcpLeases[dest.Ip])
+		addr, err := net.ResolveUDPAddr("udp", ipAndPort)
+		if err != nil {
+			log.Printf("ResolveUDPAddr(%s): %s\n", ipAndPort, err.Error())
+			continue
+		}
+		outConn, err := net.DialUDP("udp", nil, addr)
+		if err != nil {
+			log.Printf("DialUDP(%s): %s\n", ipAndPort, err.Error())
+			continue
+		}
+		dest.Conn = outConn
+		dest.messageQueue = make([][]byte, 0)
+		outSockets[ipAndPort] = dest
+	}
 	// Client that was connected before that isn't.
 	for ipAndPort, conn := range outSockets {
-		if _, ok := validConnections[ipAndPort]; !ok {
+		if _, ok := wanted[ipAndPort]; !ok {
 			log.Printf("removed connection %s.\n", ipAndPort)
 			conn.Conn.Close()
 			delete(outSockets, ipAndPort)
@@ -329,6 +432,7 @@ func messageQueueSender() {
 	queueTimer := time.NewTicker(100 * time.Millisecond)
 
 	var lastQueueTimeChange time.Time // Reevaluate	send frequency every 5 seconds.
+	lastQueueTime := stratuxClock.Time
 	for {
 		select {
 		case msg := <-messageQueue:
@@ -336,6 +440,10 @@ func messageQueueSender() {
 		case <-queueTimer.C:
 			netMutex.Lock()
 
+			dt := stratuxClock.Since(lastQueueTime).Seconds()
+			lastQueueTime = stratuxClock.Time
+			updateClientSleepTimes(dt)
+
 			averageSendableQueueSize := float64(0.0)
 			for k, netconn := range outSockets {
 				if len(netconn.messageQueue) > 0 && !isSleeping(k) && !isThrottled(k) {
@@ -363,6 +471,8 @@ func messageQueueSender() {
 					*/
 
 					netconn.Conn.Write(queuedMsg)
+					netconn.MessagesSent++
+					netconn.BytesSent += uint64(len(queuedMsg))
 					totalNetworkMessagesSent++
 					globalStatus.NetworkDataMessagesSent++
 					globalStatus.NetworkDataBytesSent += uint64(len(queuedMsg))
@@ -409,6 +519,7 @@ func messageQueueSender() {
 			netMutex.Unlock()
 		case <-secondTimer.C:
 			getNetworkStats()
+			sampleClientStats()
 		}
 	}
 }
@@ -437,7 +548,10 @@ func icmpEchoSender(c *icmp.PacketConn) {
 		<-timer.C
 		// Collect IPs.
 		ips := make(map[string]bool)
-		for k, _ := range outSockets {
+		for k, netconn := range outSockets {
+			if netconn.Static {
+				continue
+			}
 			ipAndPort := strings.Split(k, ":")
 			ips[ipAndPort[0]] = true
 		}
@@ -588,6 +702,7 @@ func ffMonitor() {
 		}
 		if strings.HasPrefix(s, "i-want-to-play-ffm-udp") || strings.HasPrefix(s, "i-can-play-ffm-udp") || strings.HasPrefix(s, "i-cannot-play-ffm-udp") {
 			p.FFCrippled = true
+			p.App = "ForeFlight"
 			//FIXME: AHRS doesn't need to be disabled globally, just messages need to be filtered.
 			globalSettings.AHRS_Enabled = false
 			if !ff_warned {
@@ -602,12 +717,13 @@ func ffMonitor() {
 }
 
 func initNetwork() {
-	messageQueue = make(chan networkMessage, 1024) // Buffered channel, 1024 messages.
-	serialOutputChan = make(chan []byte, 1024)     // Buffered channel, 1024 GDL90 messages.
+	messageQueue = make(chan networkMessage, 1024)     // Buffered channel, 1024 messages.
+	serialOutputChan = make(chan networkMessage, 1024) // Buffered channel, 1024 GDL90 messages.
 	outSockets = make(map[string]networkConnection)
 	pingResponse = make(map[string]time.Time)
 	netMutex = &sync.Mutex{}
 	refreshConnectedClients()
+	initTCPServers()
 	go monitorDHCPLeases()
 	go messageQueueSender()
 	go sleepMonitor()
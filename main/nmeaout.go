@@ -0,0 +1,234 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	nmeaout.go: NMEA 0183 output. Ownship position (GPRMC, GPGGA, GPGSA), pressure altitude (PGRMZ) and FLARM-style
+	 traffic (PFLAU, PFLAA) for moving map and gliding apps that don't speak GDL90.
+*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FLARM aircraft types (PFLAA), by GDL90 emitter category.
+var flarmAircraftType = map[uint8]string{
+	1:  "8", // Light -> powered aircraft.
+	2:  "9", // Small -> jet/turboprop.
+	3:  "9", // Large.
+	4:  "9", // High vortex large.
+	5:  "9", // Heavy.
+	6:  "9", // High performance.
+	7:  "3", // Rotorcraft -> helicopter.
+	9:  "1", // Glider.
+	10: "B", // Lighter than air -> balloon.
+	11: "4", // Parachutist -> skydiver.
+	12: "7", // Ultralight -> paraglider.
+	14: "D", // UAV.
+}
+
+// Wrap 's' in "$" and the checksum. Checksum is the XOR of all bytes between "$" and "*".
+func makeNMEASentence(s string) []byte {
+	cs := byte(0)
+	for i := 0; i < len(s); i++ {
+		cs ^= s[i]
+	}
+	return []byte(fmt.Sprintf("$%s*%02X\r\n", s, cs))
+}
+
+// "ddmm.mmmm,N,dddmm.mmmm,W".
+func makeNMEALatLng(lat, lng float64) string {
+	ns, ew := "N", "E"
+	if lat < 0 {
+		ns = "S"
+		lat = -lat
+	}
+	if lng < 0 {
+		ew = "W"
+		lng = -lng
+	}
+	latDeg, latMin := math.Floor(lat), (lat-math.Floor(lat))*60
+	lngDeg, lngMin := math.Floor(lng), (lng-math.Floor(lng))*60
+	return fmt.Sprintf("%02.0f%07.4f,%s,%03.0f%07.4f,%s", latDeg, latMin, ns, lngDeg, lngMin, ew)
+}
+
+// "hhmmss.ss" from seconds since midnight UTC.
+func makeNMEATime(sinceMidnight float32) string {
+	t := time.Unix(0, 0).UTC().Add(time.Duration(float64(sinceMidnight) * float64(time.Second)))
+	return fmt.Sprintf("%s.%02d", t.Format("150405"), t.Nanosecond()/10000000)
+}
+
+// Dilutions of precision, as reported by the receiver, or else estimated from the accuracies the GPS code derived from
+// them (or from UBX accuracies).
+func estimateDOP(s *SituationData) (pdop, hdop, vdop float64) {
+	if s.HDOP > 0 && s.VDOP > 0 && s.PDOP > 0 {
+		return float64(s.PDOP), float64(s.HDOP), float64(s.VDOP)
+	}
+	hdop = float64(s.Accuracy) / 8.0
+	if s.Quality == 2 {
+		hdop = float64(s.Accuracy) / 4.0
+	}
+	vdop = float64(s.AccuracyVert) / 5.0
+	pdop = math.Sqrt(hdop*hdop + vdop*vdop)
+	return
+}
+
+// PRNs of up to 12 satellites used in the solution, for GPGSA. Only GPS and SBAS satellites have NMEA IDs that fit
+// the GPGSA talker.
+func solutionPRNs() []string {
+	satelliteMutex.Lock()
+	defer satelliteMutex.Unlock()
+	prns := make([]int, 0)
+	for _, sat := range Satellites {
+		if sat.InSolution && sat.SatelliteNMEA > 0 && sat.SatelliteNMEA <= 64 {
+			prns = append(prns, int(sat.SatelliteNMEA))
+		}
+	}
+	sort.Ints(prns)
+	ret := make([]string, 12)
+	for i := 0; i < len(prns) && i < 12; i++ {
+		ret[i] = fmt.Sprintf("%02d", prns[i])
+	}
+	return ret
+}
+
+// Send ownship position and pressure altitude to NMEA outputs. Called once per second.
+func makeNMEAGPSReport(s *SituationData) {
+	var msg []byte
+	if s.gpsValid() {
+		latLng := makeNMEALatLng(float64(s.Lat), float64(s.Lng))
+		fixTime := makeNMEATime(s.LastFixSinceMidnightUTC)
+
+		date := ""
+		if s.gpsClockValid() {
+			date = s.GPSTime.UTC().Format("020106")
+		}
+		course := ""
+		if s.groundTrackValid() {
+			course = fmt.Sprintf("%.1f", s.TrueCourse)
+		}
+		mode := "A"
+		if s.Quality == 2 {
+			mode = "D"
+		}
+		msg = append(msg, makeNMEASentence(fmt.Sprintf("GPRMC,%s,A,%s,%d,%s,%s,,,%s", fixTime, latLng, s.GroundSpeed, course, date, mode))...)
+
+		pdop, hdop, vdop := estimateDOP(s)
+		geoidSep := float64(s.GeoidSep) / 3.28084
+		alt := float64(s.Alt) / 3.28084
+		msg = append(msg, makeNMEASentence(fmt.Sprintf("GPGGA,%s,%s,%d,%02d,%.1f,%.1f,M,%.1f,M,,", fixTime, latLng, s.Quality, s.Satellites, hdop, alt, geoidSep))...)
+		msg = append(msg, makeNMEASentence(fmt.Sprintf("GPGSA,A,3,%s,%.1f,%.1f,%.1f", strings.Join(solutionPRNs(), ","), pdop, hdop, vdop))...)
+	} else {
+		msg = append(msg, makeNMEASentence("GPRMC,,V,,,,,,,,,,N")...)
+		msg = append(msg, makeNMEASentence("GPGGA,,,,,,0,00,,,M,,M,,")...)
+		msg = append(msg, makeNMEASentence("GPGSA,A,1,,,,,,,,,,,,,,,")...)
+	}
+
+	if s.tempPressValid() {
+		fix := 2
+		if s.gpsValid() {
+			fix = 3
+		}
+		msg = append(msg, makeNMEASentence(fmt.Sprintf("PGRMZ,%.0f,f,%d", s.Pressure_alt, fix))...)
+	}
+
+	sendMsg(msg, NETWORK_NMEA, false)
+}
+
+// FLARM alarm level of a target: 0 none, 1 to 3 increasing urgency (13-18, 9-12, 0-8 seconds to collision).
+func flarmAlarmLevel(ti *TrafficInfo) int {
+	if !ti.Alert {
+		return 0
+	}
+	if ti.CPA_valid && ti.CPA_time > 0 {
+		if ti.CPA_time <= 8 {
+			return 3
+		}
+		if ti.CPA_time <= 12 {
+			return 2
+		}
+	}
+	return 1
+}
+
+// FLARM GPS status: 0 no fix, 1 on the ground, 2 airborne.
+func flarmGPSStatus(s *SituationData) int {
+	if !s.gpsValid() {
+		return 0
+	}
+	if s.GroundSpeed < TRAFFIC_OWNSHIP_MIN_SPEED {
+		return 1
+	}
+	return 2
+}
+
+// Relative position of 'ti' from ownship: meters north and east, meters above.
+func relativePosition(ti *TrafficInfo, s *SituationData) (north, east, vert float64) {
+	_, _, north, east = distRect(float64(s.Lat), float64(s.Lng), float64(ti.Lat), float64(ti.Lng))
+	ownAlt, _ := ownshipAlertAltitude(s)
+	vert = (float64(ti.Alt) - ownAlt) / 3.28084
+	return
+}
+
+// PFLAA sentence for one target.
+func makePFLAA(ti *TrafficInfo, s *SituationData) []byte {
+	north, east, vert := relativePosition(ti, s)
+	idType := 1 // ICAO address.
+	if ti.Addr_type != 0 {
+		idType = 2 // Anything else: TIS-B track file IDs, self-assigned addresses.
+	}
+	track, speed := "", ""
+	if ti.Speed_valid {
+		track = fmt.Sprintf("%d", ti.Track%360)
+		speed = fmt.Sprintf("%.0f", float64(ti.Speed)*KNOTS_TO_MPS)
+	}
+	climb := fmt.Sprintf("%.1f", float64(ti.Vvel)/196.85) // ft/min to m/s.
+	acType, ok := flarmAircraftType[ti.Emitter_category]
+	if !ok {
+		acType = "0"
+	}
+	return makeNMEASentence(fmt.Sprintf("PFLAA,%d,%.0f,%.0f,%.0f,%d,%06X,%s,,%s,%s,%s", flarmAlarmLevel(ti), north, east, vert, idType, ti.Icao_addr, track, speed, climb, acType))
+}
+
+// PFLAU status sentence for 'n' targets. 'threat' is the alerted target to report, or nil.
+func makePFLAU(n int, threat *TrafficInfo, s *SituationData) []byte {
+	// Transmit status is always reported OK: some apps treat a FLARM that isn't transmitting as failed.
+	msg := fmt.Sprintf("PFLAU,%d,1,%d,1,", n, flarmGPSStatus(s))
+	if threat == nil {
+		return makeNMEASentence(msg + "0,,0,,,")
+	}
+	north, east, vert := relativePosition(threat, s)
+	bearing := math.Atan2(east, north) * 180 / math.Pi
+	if s.groundTrackValid() {
+		bearing -= float64(s.TrueCourse)
+	}
+	bearing = math.Mod(bearing+540, 360) - 180
+	dist := math.Sqrt(north*north + east*east)
+	return makeNMEASentence(msg + fmt.Sprintf("%d,%.0f,2,%.0f,%.0f,%06X", flarmAlarmLevel(threat), bearing, vert, dist, threat.Icao_addr))
+}
+
+// NMEA traffic sentences for the targets that pass 'f', which may be nil: a PFLAA for each target, then a PFLAU with
+// the most threatening target if it is alerted. 'targets' must be sorted by threat. Relative positions need an
+// ownship position, so without one only the PFLAU is sent.
+func makeNMEATrafficReports(targets []TrafficInfo, f *TrafficFilter, s *SituationData) []byte {
+	if !s.gpsValid() {
+		return makePFLAU(0, nil, s)
+	}
+	var msg []byte
+	passed := filterTraffic(targets, f, s)
+	for i := range passed {
+		msg = append(msg, makePFLAA(&passed[i], s)...)
+	}
+	var threat *TrafficInfo
+	if len(passed) > 0 && flarmAlarmLevel(&passed[0]) > 0 {
+		threat = &passed[0]
+	}
+	return append(msg, makePFLAU(len(passed), threat, s)...)
+}
@@ -0,0 +1,257 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	outputs.go: Output endpoints. Every UDP, TCP and serial output is an entry in globalSettings.Outputs, managed through
+	 the /outputs API. Changes are applied to the running outputs without a restart.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Output transports.
+const (
+	OUTPUT_UDP           = "udp"           // Unicast to Host, or to every DHCP client if Host is empty.
+	OUTPUT_UDP_BROADCAST = "udp-broadcast" // Broadcast to Host, e.g. 192.168.10.255.
+	OUTPUT_TCP           = "tcp"           // TCP server on Port, for any client that connects.
+	OUTPUT_SERIAL        = "serial"        // Serial device Host, e.g. /dev/serialout0, at Baud.
+)
+
+const (
+	OUTPUT_CAPABILITIES   = NETWORK_GDL90_STANDARD | NETWORK_AHRS_FFSIM | NETWORK_AHRS_GDL90 | NETWORK_NMEA | NETWORK_JSON
+	OUTPUT_SERIAL_DEFAULT = "/dev/serialout0" // Serial output device added automatically when it appears.
+)
+
+type outputEndpoint struct {
+	ID            int
+	Transport     string         // OUTPUT_UDP, OUTPUT_UDP_BROADCAST, OUTPUT_TCP or OUTPUT_SERIAL.
+	Host          string         // Destination IP (UDP), broadcast address (UDP broadcast) or device (serial).
+	Port          uint32         // UDP destination port or TCP listening port.
+	Baud          int            // Serial only.
+	Capability    uint8          // Message types sent: NETWORK_GDL90_STANDARD, NETWORK_NMEA, etc.
+	TrafficFilter *TrafficFilter `json:",omitempty"` // nil sends all traffic.
+}
+
+var outputsMutex = &sync.Mutex{} // Held while reading or changing globalSettings.Outputs.
+
+// GDL90 and AHRS to every DHCP client. NMEA, JSON and TCP outputs are added through /outputs.
+func defaultOutputs() []outputEndpoint {
+	return []outputEndpoint{
+		{ID: 1, Transport: OUTPUT_UDP, Port: 4000, Capability: NETWORK_GDL90_STANDARD | NETWORK_AHRS_GDL90},
+		//		{Transport: OUTPUT_UDP, Port: 49002, Capability: NETWORK_AHRS_FFSIM},
+	}
+}
+
+// Outputs as they were saved before the Outputs list: DHCP client UDP outputs, serial outputs by device and TCP servers.
+type legacyOutputSettings struct {
+	NetworkOutputs []struct {
+		Port          uint32
+		Capability    uint8
+		TrafficFilter *TrafficFilter
+	}
+	SerialOutputs map[string]struct {
+		DeviceString  string
+		Baud          int
+		Capability    uint8
+		TrafficFilter *TrafficFilter
+	}
+	TCPServers []struct {
+		Port          uint32
+		Capability    uint8
+		TrafficFilter *TrafficFilter
+	}
+}
+
+// Fill in s.Outputs for a settings file 'buf' that doesn't have them: from the old output settings, with the defaults
+// for any that weren't saved.
+func migrateOutputSettings(buf []byte, s *settings) {
+	if s.Outputs != nil {
+		return
+	}
+	var legacy legacyOutputSettings
+	json.Unmarshal(buf, &legacy)
+
+	defaults := defaultOutputs()
+	outputs := make([]outputEndpoint, 0)
+	add := func(o outputEndpoint) {
+		o.ID = len(outputs) + 1
+		outputs = append(outputs, o)
+	}
+	if legacy.NetworkOutputs == nil {
+		for _, o := range defaults {
+			add(o)
+		}
+	}
+	for _, o := range legacy.NetworkOutputs {
+		add(outputEndpoint{Transport: OUTPUT_UDP, Port: o.Port, Capability: o.Capability, TrafficFilter: o.TrafficFilter})
+	}
+	for _, o := range legacy.TCPServers {
+		add(outputEndpoint{Transport: OUTPUT_TCP, Port: o.Port, Capability: o.Capability, TrafficFilter: o.TrafficFilter})
+	}
+	for dev, o := range legacy.SerialOutputs {
+		capability := o.Capability
+		if capability == 0 {
+			capability = NETWORK_GDL90_STANDARD
+		}
+		add(outputEndpoint{Transport: OUTPUT_SERIAL, Host: dev, Baud: o.Baud, Capability: capability, TrafficFilter: o.TrafficFilter})
+	}
+	s.Outputs = outputs
+}
+
+// Check an output for a create or update. 'outputs' are the current outputs, 'o' replaces the one with the same ID.
+func validateOutput(o outputEndpoint, outputs []outputEndpoint) error {
+	if o.Capability == 0 || (o.Capability & ^uint8(OUTPUT_CAPABILITIES)) != 0 {
+		return fmt.Errorf("invalid capability %d", o.Capability)
+	}
+	switch o.Transport {
+	case OUTPUT_UDP, OUTPUT_UDP_BROADCAST, OUTPUT_TCP:
+		if o.Port == 0 || o.Port > 65535 {
+			return fmt.Errorf("invalid port %d", o.Port)
+		}
+		if o.Transport == OUTPUT_UDP_BROADCAST && net.ParseIP(o.Host) == nil {
+			return errors.New("broadcast outputs need a broadcast address")
+		}
+		if o.Transport == OUTPUT_UDP && o.Host != "" && net.ParseIP(o.Host) == nil {
+			return fmt.Errorf("invalid IP address '%s'", o.Host)
+		}
+	case OUTPUT_SERIAL:
+		if !strings.HasPrefix(o.Host, "/dev/") {
+			return fmt.Errorf("invalid serial device '%s'", o.Host)
+		}
+		if o.Baud <= 0 {
+			return fmt.Errorf("invalid baud rate %d", o.Baud)
+		}
+	default:
+		return fmt.Errorf("invalid transport '%s'", o.Transport)
+	}
+	for _, other := range outputs {
+		if other.ID == o.ID {
+			continue
+		}
+		if o.Transport == OUTPUT_TCP && other.Transport == OUTPUT_TCP && other.Port == o.Port {
+			return fmt.Errorf("TCP port %d is already in use by output %d", o.Port, other.ID)
+		}
+		if o.Transport == OUTPUT_SERIAL && other.Transport == OUTPUT_SERIAL && other.Host == o.Host {
+			return fmt.Errorf("%s is already in use by output %d", o.Host, other.ID)
+		}
+		if o.Transport != OUTPUT_TCP && o.Transport != OUTPUT_SERIAL && other.Transport == o.Transport && other.Host == o.Host && other.Port == o.Port {
+			return fmt.Errorf("output %d already sends to %s:%d", other.ID, o.Host, o.Port)
+		}
+	}
+	return nil
+}
+
+// Copy of the current outputs.
+func getOutputs() []outputEndpoint {
+	outputsMutex.Lock()
+	defer outputsMutex.Unlock()
+	ret := make([]outputEndpoint, len(globalSettings.Outputs))
+	copy(ret, globalSettings.Outputs)
+	return ret
+}
+
+func getOutput(id int) (outputEndpoint, bool) {
+	for _, o := range getOutputs() {
+		if o.ID == id {
+			return o, true
+		}
+	}
+	return outputEndpoint{}, false
+}
+
+// Add an output, assigning its ID. Returns the new output.
+func addOutput(o outputEndpoint) (outputEndpoint, error) {
+	outputsMutex.Lock()
+	o.ID = 1
+	for _, other := range globalSettings.Outputs {
+		if other.ID >= o.ID {
+			o.ID = other.ID + 1
+		}
+	}
+	if err := validateOutput(o, globalSettings.Outputs); err != nil {
+		outputsMutex.Unlock()
+		return o, err
+	}
+	globalSettings.Outputs = append(globalSettings.Outputs, o)
+	outputsMutex.Unlock()
+	saveSettings()
+	applyOutputs()
+	return o, nil
+}
+
+// Replace the output with ID o.ID.
+func updateOutput(o outputEndpoint) error {
+	outputsMutex.Lock()
+	i := outputIndex(o.ID)
+	if i < 0 {
+		outputsMutex.Unlock()
+		return fmt.Errorf("no output %d", o.ID)
+	}
+	if err := validateOutput(o, globalSettings.Outputs); err != nil {
+		outputsMutex.Unlock()
+		return err
+	}
+	globalSettings.Outputs[i] = o
+	outputsMutex.Unlock()
+	saveSettings()
+	applyOutputs()
+	return nil
+}
+
+func deleteOutput(id int) error {
+	outputsMutex.Lock()
+	i := outputIndex(id)
+	if i < 0 {
+		outputsMutex.Unlock()
+		return fmt.Errorf("no output %d", id)
+	}
+	globalSettings.Outputs = append(globalSettings.Outputs[:i], globalSettings.Outputs[i+1:]...)
+	outputsMutex.Unlock()
+	saveSettings()
+	applyOutputs()
+	return nil
+}
+
+// Index of output 'id' in globalSettings.Outputs, or -1. Must be called with outputsMutex held.
+func outputIndex(id int) int {
+	return outputIndexIn(globalSettings.Outputs, id)
+}
+
+func outputIndexIn(outputs []outputEndpoint, id int) int {
+	for i, o := range outputs {
+		if o.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// ID of the serial output on device 'dev', or -1.
+func serialOutputID(dev string) int {
+	for _, o := range getOutputs() {
+		if o.Transport == OUTPUT_SERIAL && o.Host == dev {
+			return o.ID
+		}
+	}
+	return -1
+}
+
+// Bring the running UDP, TCP and serial outputs in line with globalSettings.Outputs.
+func applyOutputs() {
+	refreshConnectedClients()
+	applyTCPOutputs()
+	select {
+	case serialOutputsChanged <- true:
+	default: // A change is already pending.
+	}
+}
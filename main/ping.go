@@ -184,11 +184,11 @@ func pingSerialReader() {
 			// errored measurement. There will be some offset from actual due to loss
 			// in the path. In one example we measured 0x93 (-98) when injecting a
 			// -102dBm signal
-			o, msgtype := parseInput(s)
+			o, msgtype, tor := parseInput(s)
 			if o != nil && msgtype != 0 {
 				//logString = fmt.Sprintf("Relaying message, type=%d", msgtype)
 				//log.Println(logString)
-				relayMessage(msgtype, o)
+				relayMessage(msgtype, o, tor)
 			} else if o == nil {
 				//log.Println("Not relaying message, o == nil")
 			} else {
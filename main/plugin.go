@@ -1,13 +1,189 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	plugin.go: Plugin host. Plugins are compiled in: each registers itself from an init() function with
+	 registerPlugin(). main() starts them once the outputs are up, and gracefulShutdown() stops them. A plugin
+	 subscribes to event bus types (decoded UAT and 1090ES messages, traffic, situation, ...), can send messages to the
+	 outputs and reports a status line shown on the status page.
+*/
+
 package main
 
 import (
+	"fmt"
+	"log"
+	"sync"
 	"time"
 )
 
+const (
+	PLUGIN_EVENT_QUEUE_SIZE = 1024 // Default event queue size. Events are dropped when the queue is full.
+	PLUGIN_INPUT_QUEUE_SIZE = 16   // Commands queued for a plugin's Input.
+)
+
 type StratuxPlugin struct {
-	InitFunc     func() bool
-	ShutdownFunc func() bool
+	InitFunc     func() bool // Called at startup. Return false if the plugin can't run.
+	ShutdownFunc func() bool // Called at shutdown. Return false if the plugin didn't shut down cleanly.
 	Name         string
-	Clock        time.Time
-	Input        chan string
+	Clock        time.Time   // stratuxClock time the plugin was started.
+	Input        chan string // Commands POSTed to /plugins/{Name}. Created when the plugin starts, if nil.
+
+	Events     int              // Mask of EVENT_* types passed to EventFunc.
+	EventFunc  func(e busEvent) // Called for each event, from the plugin's own goroutine.
+	EventQueue int              // Events queued for EventFunc. 0 for PLUGIN_EVENT_QUEUE_SIZE.
+
+	running bool
+	status  string
+	sub     *eventSubscription
+}
+
+// Plugin state for the status page and /plugins.
+type pluginStatus struct {
+	Name          string
+	Running       bool
+	Status        string
+	Uptime        float64 // Seconds since the plugin started.
+	EventsDropped uint64
+}
+
+var plugins []*StratuxPlugin
+var pluginsMutex = &sync.Mutex{}
+
+// Add a plugin to be started with Stratux. Call from the plugin's init() function.
+func registerPlugin(p *StratuxPlugin) {
+	pluginsMutex.Lock()
+	defer pluginsMutex.Unlock()
+	for _, other := range plugins {
+		if other.Name == p.Name {
+			log.Printf("plugin %s is already registered.\n", p.Name)
+			return
+		}
+	}
+	plugins = append(plugins, p)
+}
+
+// Copy of the plugin list.
+func registeredPlugins() []*StratuxPlugin {
+	pluginsMutex.Lock()
+	defer pluginsMutex.Unlock()
+	ret := make([]*StratuxPlugin, len(plugins))
+	copy(ret, plugins)
+	return ret
+}
+
+func getPlugin(name string) *StratuxPlugin {
+	pluginsMutex.Lock()
+	defer pluginsMutex.Unlock()
+	for _, p := range plugins {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// Start every registered plugin: call its InitFunc, then deliver the events it subscribed to. Plugins may call
+// SetStatus() from InitFunc and ShutdownFunc, so they are called without pluginsMutex held.
+func startPlugins() {
+	for _, p := range registeredPlugins() {
+		if p.Input == nil {
+			p.Input = make(chan string, PLUGIN_INPUT_QUEUE_SIZE)
+		}
+		if p.InitFunc != nil && !p.InitFunc() {
+			addSystemError(fmt.Errorf("Plugin %s failed to start.", p.Name))
+			continue
+		}
+		if p.Events != 0 && p.EventFunc != nil {
+			size := p.EventQueue
+			if size <= 0 {
+				size = PLUGIN_EVENT_QUEUE_SIZE
+			}
+			p.sub = subscribeEvents("plugin:"+p.Name, p.Events, size, EVENT_DROP_NEWEST)
+			go pluginEventReader(p, p.sub)
+		}
+		pluginsMutex.Lock()
+		p.Clock = stratuxClock.Time
+		p.running = true
+		pluginsMutex.Unlock()
+		log.Printf("plugin %s started.\n", p.Name)
+	}
+}
+
+func pluginEventReader(p *StratuxPlugin, sub *eventSubscription) {
+	for e := range sub.C {
+		p.EventFunc(e)
+	}
+}
+
+// Stop every running plugin. Called from gracefulShutdown().
+func stopPlugins() {
+	for _, p := range registeredPlugins() {
+		pluginsMutex.Lock()
+		running := p.running
+		p.running = false
+		pluginsMutex.Unlock()
+		if !running {
+			continue
+		}
+		if p.sub != nil {
+			unsubscribeEvents(p.sub)
+		}
+		if p.ShutdownFunc != nil && !p.ShutdownFunc() {
+			log.Printf("plugin %s did not shut down cleanly.\n", p.Name)
+		}
+		log.Printf("plugin %s stopped.\n", p.Name)
+	}
+}
+
+// Send a message to the outputs of type 'msgType' (NETWORK_GDL90_STANDARD, NETWORK_NMEA, ...).
+func (p *StratuxPlugin) SendMsg(msg []byte, msgType uint8, queueable bool) {
+	sendMsg(msg, msgType, queueable)
+}
+
+// Set the status line shown for the plugin on the status page.
+func (p *StratuxPlugin) SetStatus(status string) {
+	pluginsMutex.Lock()
+	p.status = status
+	pluginsMutex.Unlock()
+}
+
+// Report an error on the status page.
+func (p *StratuxPlugin) Error(err error) {
+	addSystemError(fmt.Errorf("Plugin %s: %s", p.Name, err.Error()))
+}
+
+// Queue a command for a plugin's Input. Returns false if the plugin isn't running or its queue is full.
+func sendPluginInput(p *StratuxPlugin, cmd string) bool {
+	pluginsMutex.Lock()
+	defer pluginsMutex.Unlock()
+	if !p.running {
+		return false
+	}
+	select {
+	case p.Input <- cmd:
+		return true
+	default:
+		return false
+	}
+}
+
+func getPluginStatus() []pluginStatus {
+	dropped := make(map[string]uint64)
+	for _, s := range getEventSubscriptionStats() {
+		dropped[s.Name] = s.Dropped
+	}
+	pluginsMutex.Lock()
+	defer pluginsMutex.Unlock()
+	ret := make([]pluginStatus, 0, len(plugins))
+	for _, p := range plugins {
+		s := pluginStatus{Name: p.Name, Running: p.running, Status: p.status, EventsDropped: dropped["plugin:"+p.Name]}
+		if p.running {
+			s.Uptime = stratuxClock.Since(p.Clock).Seconds()
+		}
+		ret = append(ret, s)
+	}
+	return ret
 }
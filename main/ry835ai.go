@@ -10,6 +10,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"strconv"
@@ -17,17 +18,12 @@ import (
 	"sync"
 	"time"
 
-	"bufio"
-
 	"github.com/kidoman/embd"
 	_ "github.com/kidoman/embd/host/all"
-	"github.com/kidoman/embd/sensor/bmp180"
 	"github.com/tarm/serial"
 
-	"os"
-	"os/exec"
-
-	"../mpu6050"
+	"../ahrs"
+	"../sensors"
 )
 
 const (
@@ -69,15 +65,20 @@ type SituationData struct {
 	NACp                     uint8   // NACp categories are defined in AC 20-165A
 	Alt                      float32 // Feet MSL
 	AccuracyVert             float32 // 95% confidence for vertical position, meters
+	FixType                  uint8   // 0 = no fix, 1 = dead reckoning only, 2 = 2D, 3 = 3D, 4 = GPS + dead reckoning, 5 = time only. From UBX-NAV-PVT or PUBX,00.
+	PDOP                     float32 // Dilution of precision: position, horizontal and vertical. 0 if not reported.
+	HDOP                     float32
+	VDOP                     float32
 	GPSVertVel               float32 // GPS vertical velocity, feet per second
+	LastGPSVertVelTime       time.Time // stratuxClock time GPSVertVel was last set. Only sent by some GPS receivers.
 	LastFixLocalTime         time.Time
 	TrueCourse               float32
 	GroundSpeed              uint16
 	LastGroundTrackTime      time.Time
 	GPSTime                  time.Time
 	LastGPSTimeTime          time.Time // stratuxClock time since last GPS time received.
-	LastValidNMEAMessageTime time.Time // time valid NMEA message last seen
-	LastValidNMEAMessage     string    // last NMEA message processed.
+	LastValidNMEAMessageTime time.Time // time valid NMEA or UBX message last seen
+	LastValidNMEAMessage     string    // last NMEA message processed, or the UBX class and ID.
 
 	mu_Attitude *sync.Mutex
 
@@ -85,11 +86,16 @@ type SituationData struct {
 	Temp              float64
 	Pressure_alt      float64
 	LastTempPressTime time.Time
+	Pressure_vvel     float64   // Pressure altitude trend, ft/min.
+	LastPressVVelTime time.Time // stratuxClock time Pressure_vvel was last set.
 
 	// From MPU6050 accel/gyro.
 	Pitch            float64
 	Roll             float64
 	Gyro_heading     float64
+	SlipSkid         float64 // Deflection of a slip/skid ball, degrees. Positive is ball to the right.
+	YawRate          float64 // Rate of turn, degrees per second. Positive is to the right.
+	GLoad            float64 // Load factor, g. 1.0 in level flight.
 	LastAttitudeTime time.Time
 }
 
@@ -101,289 +107,6 @@ var readyToInitGPS bool // TO-DO: replace with channel control to terminate goro
 var satelliteMutex *sync.Mutex
 var Satellites map[string]SatelliteInfo
 
-/*
-u-blox5_Referenzmanual.pdf
-Platform settings
-Airborne <2g Recommended for typical airborne environment. No 2D position fixes supported.
-p.91 - CFG-MSG
-Navigation/Measurement Rate Settings
-Header 0xB5 0x62
-ID 0x06 0x08
-0x0064 (100 ms)
-0x0001
-0x0001 (GPS time)
-{0xB5, 0x62, 0x06, 0x08, 0x00, 0x64, 0x00, 0x01, 0x00, 0x01}
-p.109 CFG-NAV5 (0x06 0x24)
-Poll Navigation Engine Settings
-*/
-
-func chksumUBX(msg []byte) []byte {
-	ret := make([]byte, 2)
-	for i := 0; i < len(msg); i++ {
-		ret[0] = ret[0] + msg[i]
-		ret[1] = ret[1] + ret[0]
-	}
-	return ret
-}
-
-// p.62
-func makeUBXCFG(class, id byte, msglen uint16, msg []byte) []byte {
-	ret := make([]byte, 6)
-	ret[0] = 0xB5
-	ret[1] = 0x62
-	ret[2] = class
-	ret[3] = id
-	ret[4] = byte(msglen & 0xFF)
-	ret[5] = byte((msglen >> 8) & 0xFF)
-	ret = append(ret, msg...)
-	chk := chksumUBX(ret[2:])
-	ret = append(ret, chk[0])
-	ret = append(ret, chk[1])
-	return ret
-}
-
-func makeNMEACmd(cmd string) []byte {
-	chk_sum := byte(0)
-	for i := range cmd {
-		chk_sum = chk_sum ^ byte(cmd[i])
-	}
-	return []byte(fmt.Sprintf("$%s*%02x\x0d\x0a", cmd, chk_sum))
-}
-
-func initGPSSerial() bool {
-	var device string
-	baudrate := int(9600)
-	isSirfIV := bool(false)
-
-	if _, err := os.Stat("/dev/ublox8"); err == nil { // u-blox 8 (RY83xAI over USB).
-		device = "/dev/ublox8"
-	} else if _, err := os.Stat("/dev/ublox7"); err == nil { // u-blox 7 (VK-172, RY725AI over USB).
-		device = "/dev/ublox7"
-	} else if _, err := os.Stat("/dev/ublox6"); err == nil { // u-blox 6 (VK-162).
-		device = "/dev/ublox6"
-	} else if _, err := os.Stat("/dev/prolific0"); err == nil { // Assume it's a BU-353-S4 SIRF IV.
-		//TODO: Check a "serialout" flag and/or deal with multiple prolific devices.
-		isSirfIV = true
-		baudrate = 4800
-		device = "/dev/prolific0"
-	} else if _, err := os.Stat("/dev/ttyAMA0"); err == nil { // ttyAMA0 is PL011 UART (GPIO pins 8 and 10) on all RPi.
-		device = "/dev/ttyAMA0"
-	} else {
-		log.Printf("No suitable device found.\n")
-		return false
-	}
-	if globalSettings.DEBUG {
-		log.Printf("Using %s for GPS\n", device)
-	}
-
-	/* Developer option -- uncomment to allow "hot" configuration of GPS (assuming 38.4 kpbs on warm start)
-		serialConfig = &serial.Config{Name: device, Baud: 38400}
-		p, err := serial.OpenPort(serialConfig)
-		if err != nil {
-			log.Printf("serial port err: %s\n", err.Error())
-			return false
-		} else { // reset port to 9600 baud for configuration
-		        cfg1 := make([]byte, 20)
-		        cfg1[0] = 0x01 // portID.
-		        cfg1[1] = 0x00 // res0.
-		        cfg1[2] = 0x00 // res1.
-		        cfg1[3] = 0x00 // res1.
-
-	        	//      [   7   ] [   6   ] [   5   ] [   4   ]
-		        //      0000 0000 0000 0000 1000 0000 1100 0000
-		        // UART mode. 0 stop bits, no parity, 8 data bits. Little endian order.
-		        cfg1[4] = 0xC0
-		        cfg1[5] = 0x08
-		        cfg1[6] = 0x00
-		        cfg1[7] = 0x00
-
-	        	// Baud rate. Little endian order.
-		        bdrt1 := uint32(9600)
-		        cfg1[11] = byte((bdrt1 >> 24) & 0xFF)
-		        cfg1[10] = byte((bdrt1 >> 16) & 0xFF)
-		        cfg1[9] = byte((bdrt1 >> 8) & 0xFF)
-		        cfg1[8] = byte(bdrt1 & 0xFF)
-
-	        	// inProtoMask. NMEA and UBX. Little endian.
-		        cfg1[12] = 0x03
-		        cfg1[13] = 0x00
-
-		        // outProtoMask. NMEA. Little endian.
-		        cfg1[14] = 0x02
-		        cfg1[15] = 0x00
-
-	        	cfg1[16] = 0x00 // flags.
-		        cfg1[17] = 0x00 // flags.
-
-	        	cfg1[18] = 0x00 //pad.
-		        cfg1[19] = 0x00 //pad.
-
-	        	p.Write(makeUBXCFG(0x06, 0x00, 20, cfg1))
-			p.Close()
-		}
-
-		-- End developer option */
-
-	// Open port at default baud for config.
-	serialConfig = &serial.Config{Name: device, Baud: baudrate}
-	p, err := serial.OpenPort(serialConfig)
-	if err != nil {
-		log.Printf("serial port err: %s\n", err.Error())
-		return false
-	}
-
-	if isSirfIV {
-		log.Printf("Using SiRFIV config.\n")
-		// Enable 38400 baud.
-		p.Write(makeNMEACmd("PSRF100,1,38400,8,1,0"))
-		baudrate = 38400
-		p.Close()
-
-		time.Sleep(250 * time.Millisecond)
-		// Re-open port at newly configured baud so we can configure 5Hz messages.
-		serialConfig = &serial.Config{Name: device, Baud: baudrate}
-		p, err = serial.OpenPort(serialConfig)
-
-		// Enable 5Hz. (To switch back to 1Hz: $PSRF103,00,7,00,0*22)
-		p.Write(makeNMEACmd("PSRF103,00,6,00,0"))
-
-		// Enable GGA.
-		p.Write(makeNMEACmd("PSRF103,00,00,01,01"))
-		// Enable GSA.
-		p.Write(makeNMEACmd("PSRF103,02,00,01,01"))
-		// Enable RMC.
-		p.Write(makeNMEACmd("PSRF103,04,00,01,01"))
-		// Enable VTG.
-		p.Write(makeNMEACmd("PSRF103,05,00,01,01"))
-		// Enable GSV (once every 5 position updates)
-		p.Write(makeNMEACmd("PSRF103,03,00,05,01"))
-
-		if globalSettings.DEBUG {
-			log.Printf("Finished writing SiRF GPS config to %s. Opening port to test connection.\n", device)
-		}
-	} else {
-		// Set 5 Hz update. Little endian order.
-		//p.Write(makeUBXCFG(0x06, 0x08, 6, []byte{0x64, 0x00, 0x01, 0x00, 0x01, 0x00})) // 10 Hz
-		p.Write(makeUBXCFG(0x06, 0x08, 6, []byte{0xc8, 0x00, 0x01, 0x00, 0x01, 0x00})) // 5 Hz
-
-		// Set navigation settings.
-		nav := make([]byte, 36)
-		nav[0] = 0x05 // Set dyn and fixMode only.
-		nav[1] = 0x00
-		// dyn.
-		nav[2] = 0x07 // "Airborne with >2g Acceleration".
-		nav[3] = 0x02 // 3D only.
-
-		p.Write(makeUBXCFG(0x06, 0x24, 36, nav))
-
-		// GNSS configuration CFG-GNSS for ublox 7 higher, p. 125 (v8)
-		// NOTE: Max position rate = 5 Hz if GPS+GLONASS used.
-
-		// TESTING: 5Hz unified GPS + GLONASS
-
-		// Disable GLONASS to enable 10 Hz solution rate. GLONASS is not used
-		// for SBAS (WAAS), so little real-world impact.
-
-		cfgGnss := []byte{0x00, 0x20, 0x20, 0x05}
-		gps := []byte{0x00, 0x08, 0x10, 0x00, 0x01, 0x00, 0x01, 0x01}  // enable GPS with 8-16 tracking channels
-		sbas := []byte{0x01, 0x02, 0x03, 0x00, 0x01, 0x00, 0x01, 0x01} // enable SBAS (WAAS) with 2-3 tracking channels
-		beidou := []byte{0x03, 0x00, 0x10, 0x00, 0x00, 0x00, 0x01, 0x01}
-		qzss := []byte{0x05, 0x00, 0x03, 0x00, 0x00, 0x00, 0x01, 0x01}
-		//glonass := []byte{0x06, 0x04, 0x0E, 0x00, 0x00, 0x00, 0x01, 0x01} // this disables GLONASS
-		glonass := []byte{0x06, 0x08, 0x0E, 0x00, 0x01, 0x00, 0x01, 0x01} // this enables GLONASS with 8-14 tracking channels
-		cfgGnss = append(cfgGnss, gps...)
-		cfgGnss = append(cfgGnss, sbas...)
-		cfgGnss = append(cfgGnss, beidou...)
-		cfgGnss = append(cfgGnss, qzss...)
-		cfgGnss = append(cfgGnss, glonass...)
-		p.Write(makeUBXCFG(0x06, 0x3E, uint16(len(cfgGnss)), cfgGnss))
-
-		// SBAS configuration for ublox 6 and higher
-		p.Write(makeUBXCFG(0x06, 0x16, 8, []byte{0x01, 0x07, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00}))
-
-		// Message output configuration: UBX,00 (position) on each calculated fix; UBX,03 (satellite info) every 5th fix,
-		//  UBX,04 (timing) every 10th, GGA (NMEA position) every 5th. All other NMEA messages disabled.
-
-		//                                             Msg   DDC   UART1 UART2 USB   I2C   Res
-		p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{0xF0, 0x00, 0x00, 0x05, 0x00, 0x05, 0x00, 0x01})) // GGA enabled every 5th message
-		p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{0xF0, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01})) // GLL disabled
-		p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{0xF0, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01})) // GSA disabled
-		//p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{0xF0, 0x02, 0x00, 0x05, 0x00, 0x05, 0x00, 0x01})) // GSA enabled disabled every 5th position (used for testing only)
-		p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{0xF0, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01})) // GSV disabled
-		//p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{0xF0, 0x03, 0x00, 0x05, 0x00, 0x05, 0x00, 0x01})) // GSV enabled for every 5th position (used for testing only)
-		p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{0xF0, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01})) // RMC
-		p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{0xF0, 0x05, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01})) // VGT
-		p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{0xF0, 0x06, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})) // GRS
-		p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{0xF0, 0x07, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})) // GST
-		p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{0xF0, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})) // ZDA
-		p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{0xF0, 0x09, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})) // GBS
-		p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{0xF0, 0x0A, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})) // DTM
-		p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{0xF0, 0x0D, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})) // GNS
-		p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{0xF0, 0x0E, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})) // ???
-		p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{0xF0, 0x0F, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})) // VLW
-		p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{0xF1, 0x00, 0x01, 0x01, 0x01, 0x01, 0x01, 0x00})) // Ublox,0
-		p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{0xF1, 0x03, 0x05, 0x05, 0x05, 0x05, 0x05, 0x00})) // Ublox,3
-		p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{0xF1, 0x04, 0x0A, 0x0A, 0x0A, 0x0A, 0x0A, 0x00})) // Ublox,4
-
-		// Reconfigure serial port.
-		cfg := make([]byte, 20)
-		cfg[0] = 0x01 // portID.
-		cfg[1] = 0x00 // res0.
-		cfg[2] = 0x00 // res1.
-		cfg[3] = 0x00 // res1.
-
-		//      [   7   ] [   6   ] [   5   ] [   4   ]
-		//	0000 0000 0000 0000 0000 10x0 1100 0000
-		// UART mode. 0 stop bits, no parity, 8 data bits. Little endian order.
-		cfg[4] = 0xC0
-		cfg[5] = 0x08
-		cfg[6] = 0x00
-		cfg[7] = 0x00
-
-		// Baud rate. Little endian order.
-		bdrt := uint32(38400)
-		cfg[11] = byte((bdrt >> 24) & 0xFF)
-		cfg[10] = byte((bdrt >> 16) & 0xFF)
-		cfg[9] = byte((bdrt >> 8) & 0xFF)
-		cfg[8] = byte(bdrt & 0xFF)
-
-		// inProtoMask. NMEA and UBX. Little endian.
-		cfg[12] = 0x03
-		cfg[13] = 0x00
-
-		// outProtoMask. NMEA. Little endian.
-		cfg[14] = 0x02
-		cfg[15] = 0x00
-
-		cfg[16] = 0x00 // flags.
-		cfg[17] = 0x00 // flags.
-
-		cfg[18] = 0x00 //pad.
-		cfg[19] = 0x00 //pad.
-
-		p.Write(makeUBXCFG(0x06, 0x00, 20, cfg))
-		//	time.Sleep(100* time.Millisecond) // pause and wait for the GPS to finish configuring itself before closing / reopening the port
-		baudrate = 38400
-
-		if globalSettings.DEBUG {
-			log.Printf("Finished writing u-blox GPS config to %s. Opening port to test connection.\n", device)
-		}
-	}
-	p.Close()
-
-	time.Sleep(250 * time.Millisecond)
-	// Re-open port at newly configured baud so we can read messages. ReadTimeout is set to keep from blocking the gpsSerialReader() on misconfigures or ttyAMA disconnects
-	serialConfig = &serial.Config{Name: device, Baud: baudrate, ReadTimeout: time.Millisecond * 2500}
-	p, err = serial.OpenPort(serialConfig)
-	if err != nil {
-		log.Printf("serial port err: %s\n", err.Error())
-		return false
-	}
-
-	serialPort = p
-	return true
-}
-
 // func validateNMEAChecksum determines if a string is a properly formatted NMEA sentence with a valid checksum.
 //
 // If the input string is valid, output is the input stripped of the "$" token and checksum, along with a boolean 'true'
@@ -424,18 +147,6 @@ func validateNMEAChecksum(s string) (string, bool) {
 	return s_out, true
 }
 
-//  Only count this heading if a "sustained" >7 kts is obtained. This filters out a lot of heading
-//  changes while on the ground and "movement" is really only changes in GPS fix as it settles down.
-//TODO: Some more robust checking above current and last speed.
-//TODO: Dynamic adjust for gain based on groundspeed
-func setTrueCourse(groundSpeed uint16, trueCourse float64) {
-	if myMPU6050 != nil && globalStatus.RY835AI_connected && globalSettings.AHRS_Enabled {
-		if mySituation.GroundSpeed >= 7 && groundSpeed >= 7 {
-			myMPU6050.ResetHeading(trueCourse, 0.10)
-		}
-	}
-}
-
 func calculateNACp(accuracy float32) uint8 {
 	ret := uint8(0)
 
@@ -456,6 +167,31 @@ func calculateNACp(accuracy float32) uint8 {
 	return ret
 }
 
+// NIC from the 95% horizontal accuracy. There's no protection level from the GPS, so the containment radius is taken
+// to be twice the 95% accuracy.
+func calculateNIC(accuracy float32) uint8 {
+	rc := 2 * accuracy
+	ret := uint8(0)
+
+	if rc < 7.5 {
+		ret = 11
+	} else if rc < 25 {
+		ret = 10
+	} else if rc < 75 {
+		ret = 9
+	} else if rc < 185.2 {
+		ret = 8
+	} else if rc < 370.4 {
+		ret = 7
+	} else if rc < 1111.2 {
+		ret = 6
+	} else if rc < 1852 {
+		ret = 5
+	}
+
+	return ret
+}
+
 /*
 processNMEALine parses NMEA-0183 formatted strings against several message types.
 
@@ -471,10 +207,15 @@ func processNMEALine(l string) (sentenceUsed bool) {
 	mySituation.mu_GPS.Lock()
 
 	defer func() {
-		if sentenceUsed || globalSettings.DEBUG {
-			logSituation()
+		publish := sentenceUsed || globalSettings.DEBUG
+		var s SituationData
+		if publish {
+			s = copySituationGPSLocked()
 		}
 		mySituation.mu_GPS.Unlock()
+		if publish {
+			publishEvent(EVENT_SITUATION, situationEvent{Situation: s, GPS: true})
+		}
 	}()
 
 	l_valid, validNMEAcs := validateNMEAChecksum(l)
@@ -487,6 +228,10 @@ func processNMEALine(l string) (sentenceUsed bool) {
 	mySituation.LastValidNMEAMessageTime = stratuxClock.Time
 	mySituation.LastValidNMEAMessage = l
 
+	if ubxSupersedesNMEA(x) {
+		return false
+	}
+
 	if x[0] == "PUBX" { // UBX proprietary message
 		if x[1] == "00" { // Position fix.
 			if len(x) < 20 {
@@ -511,6 +256,16 @@ func processNMEALine(l string) (sentenceUsed bool) {
 				tmpSituation.Quality = 0 // Just a note.
 				return false
 			}
+			switch x[8] {
+			case "DR":
+				tmpSituation.FixType = 1
+			case "G2", "D2":
+				tmpSituation.FixType = 2
+			case "G3", "D3":
+				tmpSituation.FixType = 3
+			case "RK":
+				tmpSituation.FixType = 4
+			}
 
 			// field 9 = horizontal accuracy, m
 			hAcc, err := strconv.ParseFloat(x[9], 32)
@@ -611,7 +366,6 @@ func processNMEALine(l string) (sentenceUsed bool) {
 			}
 			if groundspeed > 3 { // TO-DO: use average groundspeed over last n seconds to avoid random "jumps"
 				trueCourse = float32(tc)
-				setTrueCourse(uint16(groundspeed), tc)
 				tmpSituation.TrueCourse = trueCourse
 			} else {
 				// Negligible movement. Don't update course, but do use the slow speed.
@@ -625,6 +379,7 @@ func processNMEALine(l string) (sentenceUsed bool) {
 				return false
 			}
 			tmpSituation.GPSVertVel = float32(vv * -3.28084) // convert to ft/sec and positive = up
+			tmpSituation.LastGPSVertVelTime = stratuxClock.Time
 
 			// field 14 = age of diff corrections
 
@@ -808,23 +563,11 @@ func processNMEALine(l string) (sentenceUsed bool) {
 				// Date of Fix, i.e 191115 =  19 November 2015 UTC  field 9
 				gpsTimeStr := fmt.Sprintf("%s %02d:%02d:%06.3f", x[3], hr, min, sec)
 				gpsTime, err := time.Parse("020106 15:04:05.000", gpsTimeStr)
-				if err == nil {
-					// We only update ANY of the times if all of the time parsing is complete.
-					mySituation.LastGPSTimeTime = stratuxClock.Time
-					mySituation.GPSTime = gpsTime
-					stratuxClock.SetRealTimeReference(gpsTime)
+				// We only update ANY of the times if all of the time parsing is complete.
+				if err == nil && setGPSTime(&mySituation, gpsTime) {
 					mySituation.LastFixSinceMidnightUTC = float32(3600*hr+60*min) + float32(sec)
 					// log.Printf("GPS time is: %s\n", gpsTime) //debug
-					if time.Since(gpsTime) > 3*time.Second || time.Since(gpsTime) < -3*time.Second {
-						setStr := gpsTime.Format("20060102 15:04:05.000") + " UTC"
-						log.Printf("setting system time to: '%s'\n", setStr)
-						if err := exec.Command("date", "-s", setStr).Run(); err != nil {
-							log.Printf("Set Date failure: %s error\n", err)
-						} else {
-							log.Printf("Time set from GPS. Current time is %v\n", time.Now())
-						}
-					}
-					setDataLogTimeWithGPS(mySituation)
+					setDataLogTimeWithGPS(copySituationGPSLocked())
 					return true // All possible successes lead here.
 				}
 			}
@@ -850,7 +593,6 @@ func processNMEALine(l string) (sentenceUsed bool) {
 		}
 		if groundspeed > 3 { // TO-DO: use average groundspeed over last n seconds to avoid random "jumps"
 			trueCourse = float32(tc)
-			setTrueCourse(uint16(groundspeed), tc)
 			tmpSituation.TrueCourse = trueCourse
 		} else {
 			// Negligible movement. Don't update course, but do use the slow speed.
@@ -987,19 +729,8 @@ func processNMEALine(l string) (sentenceUsed bool) {
 			// Date of Fix, i.e 191115 =  19 November 2015 UTC  field 9
 			gpsTimeStr := fmt.Sprintf("%s %02d:%02d:%06.3f", x[9], hr, min, sec)
 			gpsTime, err := time.Parse("020106 15:04:05.000", gpsTimeStr)
-			if err == nil && gpsTime.After(time.Date(2016, time.January, 0, 0, 0, 0, 0, time.UTC)) { // Ignore dates before 2016-JAN-01.
-				tmpSituation.LastGPSTimeTime = stratuxClock.Time
-				tmpSituation.GPSTime = gpsTime
-				stratuxClock.SetRealTimeReference(gpsTime)
-				if time.Since(gpsTime) > 3*time.Second || time.Since(gpsTime) < -3*time.Second {
-					setStr := gpsTime.Format("20060102 15:04:05.000") + " UTC"
-					log.Printf("setting system time to: '%s'\n", setStr)
-					if err := exec.Command("date", "-s", setStr).Run(); err != nil {
-						log.Printf("Set Date failure: %s error\n", err)
-					} else {
-						log.Printf("Time set from GPS. Current time is %v\n", time.Now())
-					}
-				}
+			if err == nil {
+				setGPSTime(&tmpSituation, gpsTime)
 			}
 		}
 
@@ -1047,7 +778,6 @@ func processNMEALine(l string) (sentenceUsed bool) {
 		}
 		if groundspeed > 3 { // TO-DO: use average groundspeed over last n seconds to avoid random "jumps"
 			trueCourse = float32(tc)
-			setTrueCourse(uint16(groundspeed), tc)
 			tmpSituation.TrueCourse = trueCourse
 		} else {
 			// Negligible movement. Don't update course, but do use the slow speed.
@@ -1058,7 +788,7 @@ func processNMEALine(l string) (sentenceUsed bool) {
 
 		// We've made it this far, so that means we've processed "everything" and can now make the change to mySituation.
 		mySituation = tmpSituation
-		setDataLogTimeWithGPS(mySituation)
+		setDataLogTimeWithGPS(copySituationGPSLocked())
 		return true
 
 	} else if (x[0] == "GNGSA") || (x[0] == "GPGSA") { // Satellite data.
@@ -1172,6 +902,14 @@ func processNMEALine(l string) (sentenceUsed bool) {
 		}
 		tmpSituation.AccuracyVert = float32(vdop * 5) // rough estimate for 95% confidence
 
+		// field 15: PDOP
+		pdop, err1 := strconv.ParseFloat(x[15], 32)
+		if err1 == nil {
+			tmpSituation.PDOP = float32(pdop)
+		}
+		tmpSituation.HDOP = float32(hdop)
+		tmpSituation.VDOP = float32(vdop)
+
 		// We've made it this far, so that means we've processed "everything" and can now make the change to mySituation.
 		mySituation = tmpSituation
 		return true
@@ -1316,117 +1054,132 @@ func processNMEALine(l string) (sentenceUsed bool) {
 	return false
 }
 
-func gpsSerialReader() {
-	defer serialPort.Close()
-	readyToInitGPS = false // TO-DO: replace with channel control to terminate goroutine when complete
+var i2cbus embd.I2CBus
+var myBarometer sensors.Barometer
+var myIMU sensors.IMU
+var myMagnetometer sensors.Magnetometer
 
-	i := 0 //debug monitor
-	scanner := bufio.NewScanner(serialPort)
-	for scanner.Scan() && globalStatus.GPS_connected && globalSettings.GPS_Enabled {
-		i++
-		if globalSettings.DEBUG && i%100 == 0 {
-			log.Printf("gpsSerialReader() scanner loop iteration i=%d\n", i) // debug monitor
-		}
+func initI2C() error {
+	i2cbus = embd.NewI2CBus(1) //TODO: error checking.
+	return nil
+}
 
-		s := scanner.Text()
-		
-		// process the incoming data unless we are currently in Replay mode
-		if (globalStatus.ReplayMode == false) {
-			if !processNMEALine(s) {
-				if globalSettings.DEBUG {
-					fmt.Printf("processNMEALine() exited early -- %s\n", s)
-				}
-			}
+// Find the sensors on the I2C bus. An IMU or a barometer is needed; a magnetometer is optional.
+func initSensors() error {
+	var names []string
+	var err error
+	var d *sensors.Driver
+	if myIMU, d, err = sensors.DetectIMU(i2cbus); err != nil {
+		log.Printf("IMU: %s\n", err.Error())
+	} else {
+		names = append(names, d.Name)
+		if myMagnetometer, d, err = sensors.DetectMagnetometer(i2cbus); err == nil {
+			names = append(names, d.Name)
 		}
 	}
-	if err := scanner.Err(); err != nil {
-		log.Printf("reading standard input: %s\n", err.Error())
-	}
-
-	if globalSettings.DEBUG {
-		log.Printf("Exiting gpsSerialReader() after i=%d loops\n", i) // debug monitor
-	}
-	globalStatus.GPS_connected = false
-	readyToInitGPS = true // TO-DO: replace with channel control to terminate goroutine when complete
-	return
-}
-
-var i2cbus embd.I2CBus
-var myBMP180 *bmp180.BMP180
-var myMPU6050 *mpu6050.MPU6050
-
-func readBMP180() (float64, float64, error) { // ºCelsius, Meters
-	temp, err := myBMP180.Temperature()
-	if err != nil {
-		return temp, 0.0, err
+	if myBarometer, d, err = sensors.DetectBarometer(i2cbus); err != nil {
+		log.Printf("barometer: %s\n", err.Error())
+	} else {
+		names = append(names, d.Name)
 	}
-	altitude, err := myBMP180.Altitude()
-	altitude = float64(1/0.3048) * altitude // Convert meters to feet.
-	if err != nil {
-		return temp, altitude, err
+	if myIMU == nil && myBarometer == nil {
+		return errors.New("no IMU or barometer found")
 	}
-	return temp, altitude, nil
-}
-
-func readMPU6050() (float64, float64, error) { //TODO: error checking.
-	pitch, roll := myMPU6050.PitchAndRoll()
-	return pitch, roll, nil
-}
-
-func initBMP180() error {
-	myBMP180 = bmp180.New(i2cbus) //TODO: error checking.
-	return nil
-}
-
-func initMPU6050() error {
-	myMPU6050 = mpu6050.New() //TODO: error checking.
-	return nil
-}
-
-func initI2C() error {
-	i2cbus = embd.NewI2CBus(1) //TODO: error checking.
+	log.Printf("AHRS sensors: %s\n", strings.Join(names, ", "))
+	globalStatus.AHRS_sensors = strings.Join(names, ", ")
 	return nil
 }
 
-// Unused at the moment. 5 second update, since read functions in bmp180 are slow.
+// 5 second update, since reads of the BMP180 are slow.
 func tempAndPressureReader() {
 	timer := time.NewTicker(5 * time.Second)
 	for globalStatus.RY835AI_connected && globalSettings.AHRS_Enabled {
 		<-timer.C
 		// Read temperature and pressure altitude.
-		temp, alt, err_bmp180 := readBMP180()
+		temp, pressure, err := myBarometer.ReadPressure()
 		// Process.
-		if err_bmp180 != nil {
-			log.Printf("readBMP180(): %s\n", err_bmp180.Error())
+		if err != nil {
+			log.Printf("ReadPressure(): %s\n", err.Error())
 			globalStatus.RY835AI_connected = false
 		} else {
+			alt := sensors.PressureAltitude(pressure)
+			mySituation.mu_Attitude.Lock()
+			// Vertical speed from consecutive readings, smoothed.
+			if mySituation.tempPressValid() {
+				dt := stratuxClock.Since(mySituation.LastTempPressTime).Minutes()
+				if dt > 0 {
+					vvel := (alt - mySituation.Pressure_alt) / dt
+					if stratuxClock.Since(mySituation.LastPressVVelTime) < 15*time.Second {
+						vvel = 0.5*mySituation.Pressure_vvel + 0.5*vvel
+					}
+					mySituation.Pressure_vvel = vvel
+					mySituation.LastPressVVelTime = stratuxClock.Time
+				}
+			}
 			mySituation.Temp = temp
 			mySituation.Pressure_alt = alt
 			mySituation.LastTempPressTime = stratuxClock.Time
+			mySituation.mu_Attitude.Unlock()
+			publishEvent(EVENT_SITUATION, situationEvent{Situation: copySituation()})
 		}
 	}
 	globalStatus.RY835AI_connected = false
 }
 
-func makeFFAHRSSimReport() {
-	s := fmt.Sprintf("XATTStratux,%f,%f,%f", mySituation.Gyro_heading, mySituation.Pitch, mySituation.Roll)
+func makeFFAHRSSimReport(s *SituationData) {
+	msg := fmt.Sprintf("XATTStratux,%f,%f,%f", s.Gyro_heading, s.Pitch, s.Roll)
 
-	sendMsg([]byte(s), NETWORK_AHRS_FFSIM, false)
+	sendMsg([]byte(msg), NETWORK_AHRS_FFSIM, false)
 }
 
-func makeAHRSGDL90Report() {
-	msg := make([]byte, 16)
+/*
+	makeAHRSGDL90Report() - 'LE' AHRS report. Message version 1 (byte 3) adds bytes 16-23 to version 0.
+
+	Bytes  Field                    Units
+	4-5    Roll                     0.1 degrees, positive right wing down. 0x7FFF if invalid.
+	6-7    Pitch                    0.1 degrees, positive nose up. 0x7FFF if invalid.
+	8-9    Heading                  0.1 degrees. 0x7FFF if invalid.
+	10-11  Slip/skid                0.1 degrees of ball deflection, positive ball right.
+	12-13  Yaw rate                 0.1 degrees per second, positive right.
+	14-15  Load factor              0.1 g.
+	16-17  Indicated airspeed       knots. 0x7FFF - no airspeed sensor.
+	18-19  Pressure altitude        feet, +5000. 0xFFFF if invalid.
+	20-21  Pressure vertical speed  feet per minute. 0x7FFF if invalid.
+	22-23  Reserved                 0x7FFF.
+
+	All fields are signed, big endian, except heading and pressure altitude.
+*/
+
+func makeAHRSGDL90Report(s *SituationData) {
+	msg := make([]byte, 24)
 	msg[0] = 0x4c
 	msg[1] = 0x45
 	msg[2] = 0x01
-	msg[3] = 0x00
-
-	pitch := int16(float64(mySituation.Pitch) * float64(10.0))
-	roll := int16(float64(mySituation.Roll) * float64(10.0))
-	hdg := uint16(float64(mySituation.Gyro_heading) * float64(10.0))
-	slip_skid := int16(float64(0) * float64(10.0))
-	yaw_rate := int16(float64(0) * float64(10.0))
-	g := int16(float64(1.0) * float64(10.0))
+	msg[3] = 0x01
+
+	pitch := int16(float64(s.Pitch) * float64(10.0))
+	roll := int16(float64(s.Roll) * float64(10.0))
+	hdg := uint16(float64(s.Gyro_heading) * float64(10.0))
+	st := getAHRSStatus()
+	if !st.Valid {
+		pitch = 0x7FFF
+		roll = 0x7FFF
+	}
+	if !st.HeadingValid {
+		hdg = 0x7FFF
+	}
+	slip_skid := int16(float64(s.SlipSkid) * float64(10.0))
+	yaw_rate := int16(float64(s.YawRate) * float64(10.0))
+	g := int16(float64(s.GLoad) * float64(10.0))
+	airspeed := int16(0x7FFF)
+	palt := uint16(0xFFFF)
+	if s.tempPressValid() {
+		palt = uint16(s.Pressure_alt + 5000.5)
+	}
+	vvel := int16(0x7FFF)
+	if s.tempPressValid() && stratuxClock.Since(s.LastPressVVelTime) < 15*time.Second {
+		vvel = int16(s.Pressure_vvel)
+	}
 
 	// Roll.
 	msg[4] = byte((roll >> 8) & 0xFF)
@@ -1452,36 +1205,97 @@ func makeAHRSGDL90Report() {
 	msg[14] = byte((g >> 8) & 0xFF)
 	msg[15] = byte(g & 0xFF)
 
+	// Indicated airspeed.
+	msg[16] = byte((airspeed >> 8) & 0xFF)
+	msg[17] = byte(airspeed & 0xFF)
+
+	// Pressure altitude.
+	msg[18] = byte((palt >> 8) & 0xFF)
+	msg[19] = byte(palt & 0xFF)
+
+	// Pressure vertical speed.
+	msg[20] = byte((vvel >> 8) & 0xFF)
+	msg[21] = byte(vvel & 0xFF)
+
+	// Reserved.
+	msg[22] = 0x7F
+	msg[23] = 0xFF
+
 	sendMsg(prepareMessage(msg), NETWORK_AHRS_GDL90, false)
 }
 
+// GPS data for the attitude estimator.
+func ahrsGPSInput(in *ahrs.Input) {
+	mySituation.mu_GPS.Lock()
+	defer mySituation.mu_GPS.Unlock()
+	in.GPSValid = mySituation.groundTrackValid() && stratuxClock.Since(mySituation.LastGroundTrackTime) < ahrs.GPS_MAX_AGE
+	in.GroundSpeed = float64(mySituation.GroundSpeed)
+	in.TrueCourse = float64(mySituation.TrueCourse)
+	if stratuxClock.Since(mySituation.LastGPSVertVelTime) < ahrs.GPS_MAX_AGE {
+		in.VertSpeed = float64(mySituation.GPSVertVel)
+	}
+}
+
 func attitudeReaderSender() {
-	timer := time.NewTicker(100 * time.Millisecond) // ~10Hz update.
+	timer := time.NewTicker(time.Second / ahrs.UPDATE_RATE)
+	ahrsMutex.Lock()
+	myAHRS = ahrs.New()
+	ahrsMutex.Unlock()
+	start := stratuxClock.Time
+	last := start
+	updates := 0
+	readErrors := 0
 	for globalStatus.RY835AI_connected && globalSettings.AHRS_Enabled {
 		<-timer.C
-		// Read pitch and roll.
-		pitch, roll, err_mpu6050 := readMPU6050()
-
-		if err_mpu6050 != nil {
-			log.Printf("readMPU6050(): %s\n", err_mpu6050.Error())
+		var in ahrs.Input
+		var err error
+		in.Accel, in.Gyro, err = myIMU.ReadIMU()
+		if err != nil {
+			// Allow for the odd failed read. Give up if they go on for a second.
+			readErrors++
+			if readErrors < ahrs.UPDATE_RATE {
+				continue
+			}
+			log.Printf("ReadIMU(): %s\n", err.Error())
 			globalStatus.RY835AI_connected = false
 			break
 		}
+		readErrors = 0
+		if myMagnetometer != nil {
+			mag, err := myMagnetometer.ReadMag()
+			in.Mag, in.MagValid = mag, err == nil
+		}
+		ahrsGPSInput(&in)
+
+		dt := stratuxClock.Since(last).Seconds()
+		last = stratuxClock.Time
+		ahrsMutex.Lock()
+		myAHRS.Update(in, dt)
+		logAHRS(ahrs.NewSample(stratuxClock.Since(start).Seconds(), in, myAHRS))
+		updates++
+		if updates%AHRS_REPORT_INTERVAL != 0 {
+			ahrsMutex.Unlock()
+			continue
+		}
+		myAHRSStatus = myAHRS.Status()
+		roll, pitch, heading := myAHRS.Euler()
+		slipSkid, yawRate, g := myAHRS.SlipSkid(), myAHRS.YawRate(), myAHRS.GLoad()
+		ahrsMutex.Unlock()
 
 		mySituation.mu_Attitude.Lock()
 
 		mySituation.Pitch = pitch
 		mySituation.Roll = roll
-		mySituation.Gyro_heading = myMPU6050.Heading() //FIXME. Experimental.
+		mySituation.Gyro_heading = heading
+		mySituation.SlipSkid = slipSkid
+		mySituation.YawRate = yawRate
+		mySituation.GLoad = g
 		mySituation.LastAttitudeTime = stratuxClock.Time
 
-		// Send, if valid.
-		//		if isGPSGroundTrackValid(), etc.
-
-		// makeFFAHRSSimReport() // simultaneous use of GDL90 and FFSIM not supported in FF 7.5.1 or later. Function definition will be kept for AHRS debugging and future workarounds.
-		makeAHRSGDL90Report()
-
 		mySituation.mu_Attitude.Unlock()
+
+		// The GDL90 sender makes the AHRS report from this event.
+		publishEvent(EVENT_SITUATION, situationEvent{Situation: copySituation(), Attitude: true})
 	}
 	globalStatus.RY835AI_connected = false
 }
@@ -1524,64 +1338,81 @@ func isGPSConnected() bool {
 }
 
 /*
-isGPSValid returns true only if a valid position fix has been seen in the last 15 seconds,
-and if the GPS subsystem has recently detected a GPS device.
+	Situation snapshots. The GPS fields of mySituation are written under mu_GPS, and the attitude and pressure fields
+	under mu_Attitude. Consumers work from a copy taken under both - the one published with each EVENT_SITUATION, or
+	copySituation() - rather than reading mySituation while it is being written. mu_GPS is always taken first.
+*/
+
+// Copy of mySituation. Called with mu_GPS held.
+func copySituationGPSLocked() SituationData {
+	mySituation.mu_Attitude.Lock()
+	defer mySituation.mu_Attitude.Unlock()
+	return mySituation
+}
+
+// Copy of mySituation. Called without mu_GPS or mu_Attitude held.
+func copySituation() SituationData {
+	mySituation.mu_GPS.Lock()
+	defer mySituation.mu_GPS.Unlock()
+	return copySituationGPSLocked()
+}
 
-If false, 'Quality` is set to 0 ("No fix"), as is the number of satellites in solution.
+/*
+gpsValid returns true only if a valid position fix has been seen in the last 15 seconds,
+and if the GPS subsystem has recently detected a GPS device.
 */
 
-func isGPSValid() bool {
-	isValid := false
+func (s *SituationData) gpsValid() bool {
 	if (globalStatus.ReplayMode) {
-		isValid = true
-	} else
-	if (stratuxClock.Since(mySituation.LastFixLocalTime) < 15*time.Second) && globalStatus.GPS_connected && mySituation.Quality > 0 {
-		isValid = true
-	} else {
-		mySituation.Quality = 0
-		mySituation.Satellites = 0
+		return true
 	}
-	return isValid
+	return (stratuxClock.Since(s.LastFixLocalTime) < 15*time.Second) && globalStatus.GPS_connected && s.Quality > 0
 }
 
-func isGPSGroundTrackValid() bool {
+func (s *SituationData) groundTrackValid() bool {
 	if (globalStatus.ReplayMode) {
 		return true
 	}
-	return stratuxClock.Since(mySituation.LastGroundTrackTime) < 15*time.Second
+	return stratuxClock.Since(s.LastGroundTrackTime) < 15*time.Second
 }
 
-func isGPSClockValid() bool {
-	return stratuxClock.Since(mySituation.LastGPSTimeTime) < 15*time.Second
+func (s *SituationData) gpsClockValid() bool {
+	return stratuxClock.Since(s.LastGPSTimeTime) < 15*time.Second
 }
 
-func isAHRSValid() bool {
-	return stratuxClock.Since(mySituation.LastAttitudeTime) < 1*time.Second // If attitude information gets to be over 1 second old, declare invalid.
+func (s *SituationData) attitudeValid() bool {
+	// If attitude information gets to be over 1 second old, declare invalid.
+	return stratuxClock.Since(s.LastAttitudeTime) < 1*time.Second && getAHRSStatus().Valid
 }
 
-func isTempPressValid() bool {
+func (s *SituationData) tempPressValid() bool {
 	if (globalStatus.ReplayMode) {
 		return true
 	}
-	return stratuxClock.Since(mySituation.LastTempPressTime) < 15*time.Second
+	return stratuxClock.Since(s.LastTempPressTime) < 15*time.Second
+}
+
+// Whether the GPS time is current. Not to be called with mu_GPS or mu_Attitude held.
+func isGPSClockValid() bool {
+	s := copySituation()
+	return s.gpsClockValid()
 }
 
 func initAHRS() error {
 	if err := initI2C(); err != nil { // I2C bus.
 		return err
 	}
-	if err := initBMP180(); err != nil { // I2C temperature and pressure altitude.
+	if err := initSensors(); err != nil { // I2C IMU, magnetometer and barometer.
 		i2cbus.Close()
 		return err
 	}
-	if err := initMPU6050(); err != nil { // I2C accel/gyro.
-		i2cbus.Close()
-		myBMP180.Close()
-		return err
-	}
 	globalStatus.RY835AI_connected = true
-	go attitudeReaderSender()
-	go tempAndPressureReader()
+	if myIMU != nil {
+		go attitudeReaderSender()
+	}
+	if myBarometer != nil {
+		go tempAndPressureReader()
+	}
 
 	return nil
 }
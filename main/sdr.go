@@ -309,9 +309,9 @@ func uatReader() {
 	log.Println("Entered uatReader() ...")
 	for {
 		uat := <-godump978.OutChan
-		o, msgtype := parseInput(uat)
+		o, msgtype, tor := parseInput(uat)
 		if o != nil && msgtype != 0 && (globalStatus.ReplayMode == false) {
-			relayMessage(msgtype, o)
+			relayMessage(msgtype, o, tor)
 		}
 	}
 }
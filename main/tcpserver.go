@@ -0,0 +1,237 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	tcpserver.go: TCP server outputs (OUTPUT_TCP). Any client that connects gets the stream for the listener's capability,
+	 whether or not it has a DHCP lease. Each client has its own queue; a client that can't keep up loses messages, not
+	 the others.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	TCP_CLIENT_QUEUE_SIZE    = 1024             // Messages queued per client before new messages are dropped.
+	TCP_CLIENT_WRITE_TIMEOUT = 10 * time.Second // Disconnect clients that don't accept data for this long.
+)
+
+// A listener for an OUTPUT_TCP output.
+type tcpServer struct {
+	output   outputEndpoint
+	listener net.Listener
+}
+
+type tcpClient struct {
+	conn    net.Conn
+	server  *tcpServer
+	queue   chan []byte
+	dropped uint32 // Messages dropped because the queue was full.
+}
+
+var tcpServers map[int]*tcpServer    // Indexed by output ID.
+var tcpClients map[string]*tcpClient // Indexed by the client's address.
+var tcpMutex *sync.Mutex
+
+// Record sent in JSON streams, one per line.
+type jsonStreamRecord struct {
+	Type string // "traffic", "situation" or "ownship".
+	Data interface{}
+}
+
+// Ownship profile, from settings, sent in the "ownship" record.
+type jsonOwnshipRecord struct {
+	ModeS        string // ICAO address, hex.
+	Tail         string // Call sign.
+	Category     uint8  // GDL90 emitter category.
+	AircraftType string // ICAO aircraft type designator, e.g. "C172".
+}
+
+func makeJSONStreamRecord(recordType string, data interface{}) []byte {
+	b, err := json.Marshal(jsonStreamRecord{Type: recordType, Data: data})
+	if err != nil {
+		log.Printf("makeJSONStreamRecord(%s): %s\n", recordType, err.Error())
+		return nil
+	}
+	return append(b, '\n')
+}
+
+// JSON traffic records for the targets that pass 'f', which may be nil. 'targets' must be sorted by threat.
+func makeJSONTrafficReports(targets []TrafficInfo, f *TrafficFilter, s *SituationData) []byte {
+	var msg []byte
+	for _, ti := range filterTraffic(targets, f, s) {
+		msg = append(msg, makeJSONStreamRecord("traffic", ti)...)
+	}
+	return msg
+}
+
+// Send ownship situation and profile to JSON outputs. Called once per second.
+func makeJSONSituationReport(s *SituationData) {
+	msg := makeJSONStreamRecord("situation", s)
+	msg = append(msg, makeJSONStreamRecord("ownship", jsonOwnshipRecord{
+		ModeS:        globalSettings.OwnshipModeS,
+		Tail:         globalSettings.OwnshipTail,
+		Category:     globalSettings.OwnshipCategory,
+		AircraftType: globalSettings.OwnshipAircraftType,
+	})...)
+	sendMsg(msg, NETWORK_JSON, false)
+}
+
+// Accept clients on one TCP port, until the listener is closed.
+func tcpServerListener(s *tcpServer, port uint32) {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			tcpMutex.Lock()
+			closed := tcpServers[s.output.ID] != s
+			tcpMutex.Unlock()
+			if closed {
+				return
+			}
+			log.Printf("tcp server (port %d): %s\n", port, err.Error())
+			time.Sleep(1 * time.Second)
+			continue
+		}
+		client := &tcpClient{conn: conn, server: s, queue: make(chan []byte, TCP_CLIENT_QUEUE_SIZE)}
+		addr := conn.RemoteAddr().String()
+		log.Printf("tcp client %s connected to port %d.\n", addr, port)
+		tcpMutex.Lock()
+		tcpClients[addr] = client
+		tcpMutex.Unlock()
+		go tcpClientSender(addr, client)
+	}
+}
+
+// Start listeners for new OUTPUT_TCP outputs, and close listeners (and their clients) for removed outputs or changed
+// ports. Capability and filter changes apply to connected clients.
+func applyTCPOutputs() {
+	outputs := make(map[int]outputEndpoint)
+	for _, o := range getOutputs() {
+		if o.Transport == OUTPUT_TCP {
+			outputs[o.ID] = o
+		}
+	}
+
+	tcpMutex.Lock()
+	defer tcpMutex.Unlock()
+	for id, s := range tcpServers {
+		o, ok := outputs[id]
+		if ok && o.Port == s.output.Port {
+			s.output = o
+			continue
+		}
+		log.Printf("tcp server on port %d closed.\n", s.output.Port)
+		delete(tcpServers, id)
+		s.listener.Close()
+		for _, client := range tcpClients {
+			if client.server == s {
+				client.conn.Close() // tcpClientSender cleans up.
+			}
+		}
+	}
+	for id, o := range outputs {
+		if _, ok := tcpServers[id]; ok {
+			continue
+		}
+		ln, err := net.Listen("tcp", fmt.Sprintf(":%d", o.Port))
+		if err != nil {
+			log.Printf("tcp server (port %d): %s\n", o.Port, err.Error())
+			continue
+		}
+		log.Printf("tcp server listening on port %d.\n", o.Port)
+		s := &tcpServer{output: o, listener: ln}
+		tcpServers[id] = s
+		go tcpServerListener(s, o.Port)
+	}
+}
+
+// Write queued messages to a client until it disconnects or stops accepting data.
+func tcpClientSender(addr string, client *tcpClient) {
+	defer func() {
+		tcpMutex.Lock()
+		delete(tcpClients, addr)
+		tcpMutex.Unlock()
+		client.conn.Close()
+		log.Printf("tcp client %s disconnected (%d messages dropped).\n", addr, client.dropped)
+	}()
+
+	// Clients aren't expected to send anything. Reading detects the disconnect, so the queue isn't held open.
+	closed := make(chan bool)
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			if _, err := client.conn.Read(buf); err != nil {
+				close(closed)
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case msg := <-client.queue:
+			client.conn.SetWriteDeadline(time.Now().Add(TCP_CLIENT_WRITE_TIMEOUT))
+			if _, err := client.conn.Write(msg); err != nil {
+				log.Printf("tcp client %s: %s\n", addr, err.Error())
+				return
+			}
+			globalStatus.NetworkDataMessagesSent++
+			globalStatus.NetworkDataBytesSent += uint64(len(msg))
+		case <-closed:
+			return
+		}
+	}
+}
+
+// Queue 'msg' for every TCP client whose listener accepts its type.
+func sendToTCPClients(msg networkMessage) {
+	// Traffic reports, by listener. Clients of the same listener get the same message.
+	trafficMsgs := make(map[*tcpServer][]byte)
+
+	tcpMutex.Lock()
+	defer tcpMutex.Unlock()
+	for _, client := range tcpClients {
+		if (client.server.output.Capability & msg.msgType) == 0 {
+			continue
+		}
+		b := msg.msg
+		if msg.traffic != nil {
+			var ok bool
+			b, ok = trafficMsgs[client.server]
+			if !ok {
+				b = makeTrafficMessage(msg.msgType, msg.traffic, client.server.output.TrafficFilter, msg.situation)
+				trafficMsgs[client.server] = b
+			}
+		}
+		if len(b) == 0 {
+			continue
+		}
+		select {
+		case client.queue <- b:
+		default:
+			client.dropped++
+		}
+	}
+}
+
+func tcpClientCount() int {
+	tcpMutex.Lock()
+	defer tcpMutex.Unlock()
+	return len(tcpClients)
+}
+
+func initTCPServers() {
+	tcpServers = make(map[int]*tcpServer)
+	tcpClients = make(map[string]*tcpClient)
+	tcpMutex = &sync.Mutex{}
+	applyTCPOutputs()
+}
@@ -109,11 +109,29 @@ type TrafficInfo struct {
 	Last_GnssDiffAlt     int32     // Altitude at last GnssDiffFromBaroAlt update.
 	Last_speed           time.Time // Time of last velocity and track update (stratuxClock).
 	Last_source          uint8     // Last frequency on which this target was received.
-	ExtrapolatedPosition bool      // TO-DO: True if Stratux is "coasting" the target from last known position.
+	ExtrapolatedPosition bool      // True if Stratux is "coasting" the target from last known position.
+	Fix_lat              float32   // Last received position and altitude. Lat, Lng and Alt are extrapolated from these while coasting.
+	Fix_lng              float32
+	Fix_alt              int32
+	Fix_time             time.Time // Last_seen when Fix_lat and Fix_lng were saved.
+	Fix_alt_time         time.Time // Last_alt when Fix_alt was saved.
 	Bearing              float64   // Bearing in degrees true to traffic from ownship, if it can be calculated.
 	Distance             float64   // Distance to traffic from ownship, if it can be calculated.
+	Alert                bool      // Traffic alert: within, or predicted to come within, the alert distance and altitude set in globalSettings.
+	Last_alert           time.Time // Time the alert conditions were last met (stratuxClock).
+	CPA_valid            bool      // Set when the CPA_ fields below could be calculated.
+	CPA_time             float64   // Time to closest point of approach, seconds. Zero if diverging.
+	CPA_distance         float64   // Horizontal distance at closest point of approach, meters.
+	CPA_vsep             int32     // Vertical separation at closest point of approach, feet. Positive if traffic is above.
+	Position_source      uint8     // TRAFFIC_SRC_* bit of the source of the current position and velocity.
+	Sources              uint8     // TRAFFIC_SRC_* bits of the sources heard from recently, including correlated duplicates.
+	Duplicate            bool      // Set when this is a TIS-B track of an aircraft that is being tracked with a better source...
+	Duplicate_of         uint32    // ... with this address. Duplicates aren't sent to the EFB.
+	Ownship_echo         bool      // Set when this target is ownship, as seen by Stratux or ground stations. Not sent to the EFB.
 	//FIXME: Some indicator that Bearing and Distance are valid, since they aren't always available.
 	//FIXME: Rename variables for consistency, especially "Last_".
+
+	source_seen [TRAFFIC_SRC_COUNT]time.Time // Last report from each source (stratuxClock), by TRAFFIC_SRC_* bit number. Not logged.
 }
 
 type dump1090Data struct {
@@ -153,6 +171,14 @@ var seenTraffic map[uint32]bool // Historical list of all ICAO addresses seen.
 
 var OwnshipTrafficInfo TrafficInfo
 
+const (
+	TRAFFIC_COAST_DEFAULT_TIME     = 15               // seconds.
+	TRAFFIC_COAST_MAX_TIME         = 60               // seconds. Targets are dropped by cleanupOldEntries() after this.
+	TRAFFIC_COAST_MIN_AGE          = 2 * time.Second  // Start coasting when the last position is this old.
+	TRAFFIC_COAST_MAX_VELOCITY_AGE = 10 * time.Second // Don't coast on a velocity this much older than the last position.
+	TRAFFIC_STALE_AGE              = 6                // seconds. Targets older than this aren't sent to the EFB unless coasted.
+)
+
 func cleanupOldEntries() {
 	for icao_addr, ti := range traffic {
 		if stratuxClock.Since(ti.Last_seen) > 60*time.Second { // keep it in the database for up to 60 seconds, so we don't lose tail number, etc...
@@ -161,25 +187,72 @@ func cleanupOldEntries() {
 	}
 }
 
-func sendTrafficUpdates() {
+// Dead-reckon the position and altitude of 'ti' from the last received values, track, speed and vertical rate.
+// Sets ExtrapolatedPosition while coasting, for up to globalSettings.TrafficCoastTime seconds. ti.Age must be current.
+func coastTraffic(ti *TrafficInfo) {
+	// Save newly received values. Lat, Lng and Alt are always real data when Last_seen/Last_alt have changed.
+	if !ti.Last_seen.Equal(ti.Fix_time) {
+		ti.Fix_lat, ti.Fix_lng = ti.Lat, ti.Lng
+		ti.Fix_time = ti.Last_seen
+	}
+	if !ti.Last_alt.Equal(ti.Fix_alt_time) {
+		ti.Fix_alt = ti.Alt
+		ti.Fix_alt_time = ti.Last_alt
+	}
+
+	coastTime := float64(globalSettings.TrafficCoastTime)
+	if !ti.Position_valid || !ti.Speed_valid || ti.Age < TRAFFIC_COAST_MIN_AGE.Seconds() || ti.Age > coastTime ||
+		ti.Fix_time.Sub(ti.Last_speed) > TRAFFIC_COAST_MAX_VELOCITY_AGE {
+		ti.Lat, ti.Lng, ti.Alt = ti.Fix_lat, ti.Fix_lng, ti.Fix_alt
+		ti.ExtrapolatedPosition = false
+		return
+	}
+
+	vN, vE := velocityNE(float64(ti.Track), float64(ti.Speed))
+	dt := ti.Age
+	ti.Lat = ti.Fix_lat + float32(degrees(vN*dt/6371008.8))
+	ti.Lng = ti.Fix_lng + float32(degrees(vE*dt/(6371008.8*math.Cos(radians(float64(ti.Fix_lat))))))
+	if ti.Lng > 180 {
+		ti.Lng -= 360
+	} else if ti.Lng < -180 {
+		ti.Lng += 360
+	}
+	ti.Alt = ti.Fix_alt
+	if ti.AgeLastAlt >= TRAFFIC_COAST_MIN_AGE.Seconds() && ti.AgeLastAlt <= coastTime {
+		ti.Alt = ti.Fix_alt + int32(float64(ti.Vvel)*ti.AgeLastAlt/60)
+	}
+	ti.ExtrapolatedPosition = true
+}
+
+// Age, coast and correlate the targets, and send them to the outputs. 's' is the ownship situation to measure them from.
+func sendTrafficUpdates(s *SituationData) {
 	trafficMutex.Lock()
 	defer trafficMutex.Unlock()
 	cleanupOldEntries()
-	var msg []byte
+	var targets []TrafficInfo
 	if globalSettings.DEBUG && (stratuxClock.Time.Second()%15) == 0 {
 		log.Printf("List of all aircraft being tracked:\n")
 		log.Printf("==================================================================\n")
 	}
 	code, _ := strconv.ParseInt(globalSettings.OwnshipModeS, 16, 32)
-	for icao, ti := range traffic { // TO-DO: Limit number of aircraft in traffic message. ForeFlight 7.5 chokes at ~1000-2000 messages depending on iDevice RAM. Practical limit likely around ~500 aircraft without filtering.
-		if isGPSValid() {
+	for icao, ti := range traffic {
+		ti.Age = stratuxClock.Since(ti.Last_seen).Seconds()
+		ti.AgeLastAlt = stratuxClock.Since(ti.Last_alt).Seconds()
+		coastTraffic(&ti)
+		if s.gpsValid() {
 			// func distRect(lat1, lon1, lat2, lon2 float64) (dist, bearing, distN, distE float64) {
-			dist, bearing := distance(float64(mySituation.Lat), float64(mySituation.Lng), float64(ti.Lat), float64(ti.Lng))
+			dist, bearing := distance(float64(s.Lat), float64(s.Lng), float64(ti.Lat), float64(ti.Lng))
 			ti.Distance = dist
 			ti.Bearing = bearing
 		}
-		ti.Age = stratuxClock.Since(ti.Last_seen).Seconds()
-		ti.AgeLastAlt = stratuxClock.Since(ti.Last_alt).Seconds()
+		traffic[icao] = ti
+	}
+	fuseTraffic(uint32(code), s)
+
+	for icao, ti := range traffic { // ForeFlight 7.5 chokes at ~1000-2000 messages depending on iDevice RAM. Limit the number of targets with an output's TrafficFilter.
+		if ti.Icao_addr != uint32(code) {
+			updateTrafficAlert(&ti, s)
+		}
 
 		// DEBUG: Print the list of all tracked targets (with data) to the log every 15 seconds if "DEBUG" option is enabled
 		if globalSettings.DEBUG && (stratuxClock.Time.Second()%15) == 0 {
@@ -194,36 +267,30 @@ func sendTrafficUpdates() {
 		traffic[icao] = ti // write the updated ti back to the map
 		//log.Printf("Traffic age of %X is %f seconds\n",icao,ti.Age)
 		if ti.Age > 2 { // if nothing polls an inactive ti, it won't push to the webUI, and its Age won't update.
-			tiJSON, _ := json.Marshal(&ti)
-			trafficUpdate.Send(tiJSON)
+			publishEvent(EVENT_TRAFFIC, ti)
 		}
-		if ti.Position_valid && ti.Age < 6 { // ... but don't pass stale data to the EFB. TO-DO: Coast old traffic? Need to determine how FF, WingX, etc deal with stale targets.
-			logTraffic(ti) // only add to the SQLite log if it's not stale
-
+		if ti.Position_valid && (ti.Age < TRAFFIC_STALE_AGE || ti.ExtrapolatedPosition) { // ... but don't pass stale data to the EFB, unless it is being coasted.
 			if ti.Icao_addr == uint32(code) { //
 				//log.Printf("Ownship target detected for code %X\n", code) // DEBUG - REMOVE
 				OwnshipTrafficInfo = ti
-			} else {
-				msg = append(msg, makeTrafficReportMsg(ti)...)
+			} else if !ti.Duplicate && !ti.Ownship_echo {
+				targets = append(targets, ti)
 			}
 		}
 	}
 
-	if len(msg) > 0 {
-		sendGDL90(msg, false)
-	}
+	sendTrafficReports(targets, s) // Filtered for each output.
 }
 
-// Send update to attached JSON client.
+// Publish a target update, for the traffic websocket and other subscribers.
 func registerTrafficUpdate(ti TrafficInfo) {
-	//logTraffic(ti) // moved to sendTrafficUpdates() to reduce SQLite log size
+	//logTraffic(ti) // logged by the datalog from this event, at most once per second per target
 	/*
 		if !ti.Position_valid { // Don't send unless a valid position exists.
 			return
 		}
 	*/ // Send all traffic to the websocket and let JS sort it out. This will provide user indication of why they see 1000 ES messages and no traffic.
-	tiJSON, _ := json.Marshal(&ti)
-	trafficUpdate.Send(tiJSON)
+	publishEvent(EVENT_TRAFFIC, ti)
 }
 
 func makeTrafficReportMsg(ti TrafficInfo) []byte {
@@ -231,7 +298,11 @@ func makeTrafficReportMsg(ti TrafficInfo) []byte {
 	// See p.16.
 	msg[0] = 0x14 // Message type "Traffic Report".
 
-	msg[1] = 0x10 | ti.Addr_type // Alert status, address type.
+	// Alert status, address type.
+	msg[1] = ti.Addr_type & 0x0F
+	if ti.Alert {
+		msg[1] = msg[1] | 0x10
+	}
 
 	// ICAO Address.
 	msg[2] = byte((ti.Icao_addr & 0x00FF0000) >> 16)
@@ -460,15 +531,22 @@ func parseDownlinkReport(s string, signalLevel int) {
 			lng = lng - 360
 		}
 	}
-	ti.Position_valid = position_valid
-	if ti.Position_valid {
-		ti.Lat = lat
-		ti.Lng = lng
-		if isGPSValid() {
-			ti.Distance, ti.Bearing = distance(float64(mySituation.Lat), float64(mySituation.Lng), float64(ti.Lat), float64(ti.Lng))
+	// Don't replace a recent position from a better source, e.g. ADS-B with TIS-B.
+	src := trafficSourceBit(TRAFFIC_SOURCE_UAT, ti.TargetType)
+	preferred := preferTrafficSource(&ti, src)
+	markTrafficSource(&ti, src)
+	if preferred {
+		ti.Position_valid = position_valid
+		if ti.Position_valid {
+			ti.Lat = lat
+			ti.Lng = lng
+			if s := copySituation(); s.gpsValid() {
+				ti.Distance, ti.Bearing = distance(float64(s.Lat), float64(s.Lng), float64(ti.Lat), float64(ti.Lng))
+			}
+			ti.Last_seen = stratuxClock.Time
+			ti.ExtrapolatedPosition = false
+			ti.Position_source = src
 		}
-		ti.Last_seen = stratuxClock.Time
-		ti.ExtrapolatedPosition = false
 	}
 
 	raw_alt := (int32(frame[10]) << 4) | ((int32(frame[11]) & 0xf0) >> 4)
@@ -558,12 +636,14 @@ func parseDownlinkReport(s string, signalLevel int) {
 		// Dimensions of vehicle - skip.
 	}
 
-	ti.Track = track
-	ti.Speed = speed
-	ti.Vvel = vvel
-	ti.Speed_valid = speed_valid
-	if ti.Speed_valid {
-		ti.Last_speed = stratuxClock.Time
+	if preferred {
+		ti.Track = track
+		ti.Speed = speed
+		ti.Vvel = vvel
+		ti.Speed_valid = speed_valid
+		if ti.Speed_valid {
+			ti.Last_speed = stratuxClock.Time
+		}
 	}
 
 	//OK.
@@ -646,7 +726,7 @@ func esListen() {
 				var eslog esmsg
 				eslog.TimeReceived = stratuxClock.Time
 				eslog.Data = buf
-				logESMsg(eslog) // log raw dump1090:30006 output to SQLite log
+				publishEvent(EVENT_ES_FRAME, eslog) // raw dump1090:30006 output, for the SQLite log
 			}
 		}
 	}
@@ -744,8 +824,13 @@ func parseDump1090Record(newTi *dump1090Data) (bool) {
 		ti.Last_GnssDiffAlt = ti.Alt
 	}
 
+	// Don't replace a recent position from a better source, e.g. ADS-B with TIS-B.
+	src := trafficSourceBit(TRAFFIC_SOURCE_1090ES, esTargetType(newTi.DF, newTi.CA))
+	preferred := preferTrafficSource(&ti, src)
+	markTrafficSource(&ti, src)
+
 	// Position updates are provided only by ES messages (DF=17 and DF=18; multiple TCs)
-	if newTi.Position_valid { // i.e. DF17 or DF18 message decoded successfully by dump1090
+	if newTi.Position_valid && preferred { // i.e. DF17 or DF18 message decoded successfully by dump1090
 		valid_position := true
 		var lat, lng float32
 
@@ -766,19 +851,20 @@ func parseDump1090Record(newTi *dump1090Data) (bool) {
 		if valid_position {
 			ti.Lat = lat
 			ti.Lng = lng
-			if isGPSValid() {
-				ti.Distance, ti.Bearing = distance(float64(mySituation.Lat), float64(mySituation.Lng), float64(ti.Lat), float64(ti.Lng))
+			if s := copySituation(); s.gpsValid() {
+				ti.Distance, ti.Bearing = distance(float64(s.Lat), float64(s.Lng), float64(ti.Lat), float64(ti.Lng))
 			}
 			ti.Position_valid = true
 			ti.ExtrapolatedPosition = false
 			ti.Last_seen = stratuxClock.Time // only update "last seen" data on position updates
+			ti.Position_source = src
 			
 			// ok, message has enough data to make it worth logging
 			used = true
 		}
 	}
 
-	if newTi.Speed_valid { // i.e. DF17 or DF18, TC 19 message decoded successfully by dump1090
+	if newTi.Speed_valid && preferred { // i.e. DF17 or DF18, TC 19 message decoded successfully by dump1090
 		valid_speed := true
 		var speed, track uint16
 
@@ -808,7 +894,7 @@ func parseDump1090Record(newTi *dump1090Data) (bool) {
 			ti.Speed_valid = true
 			ti.Last_speed = stratuxClock.Time // only update "last seen" data on position updates
 		}
-	} else if ((newTi.DF == 17) || (newTi.DF == 18)) && (newTi.TypeCode == 19) { // invalid speed on velocity message only
+	} else if ((newTi.DF == 17) || (newTi.DF == 18)) && (newTi.TypeCode == 19) && preferred { // invalid speed on velocity message only
 		ti.Speed_valid = false
 	}
 
@@ -972,9 +1058,10 @@ func updateDemoTraffic(icao uint32, tail string, relAlt float32, gs float64, off
 	// default traffic location is Oshkosh if GPS not detected
 	lat := 43.99
 	lng := -88.56
-	if isGPSValid() {
-		lat = float64(mySituation.Lat)
-		lng = float64(mySituation.Lng)
+	s := copySituation()
+	if s.gpsValid() {
+		lat = float64(s.Lat)
+		lng = float64(s.Lng)
 	}
 	traffRelLat := y / 60
 	traffRelLng := -x / (60 * math.Cos(lat*math.Pi/180.0))
@@ -1007,7 +1094,7 @@ func updateDemoTraffic(icao uint32, tail string, relAlt float32, gs float64, off
 
 	ti.Position_valid = true
 	ti.ExtrapolatedPosition = false
-	ti.Alt = int32(mySituation.Alt + relAlt)
+	ti.Alt = int32(s.Alt + relAlt)
 	ti.Track = uint16(hdg)
 	ti.Speed = uint16(gs)
 	if hdg >= 240 && hdg < 270 {
@@ -0,0 +1,169 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	trafficalert.go: Traffic collision alerting. Projects ownship and each target forward, computes the closest point of
+	 approach (CPA) and sets the GDL90 traffic alert status for threats.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	TRAFFIC_ALERT_DEFAULT_DISTANCE = 0.5 // nm.
+	TRAFFIC_ALERT_DEFAULT_ALTITUDE = 500 // ft.
+	TRAFFIC_ALERT_DEFAULT_TIME     = 30  // seconds.
+
+	TRAFFIC_ALERT_MAX_AGE     = 6 * time.Second  // Don't alert on stale positions.
+	TRAFFIC_ALERT_MAX_ALT_AGE = 15 * time.Second // Targets without a recent altitude are treated as co-altitude.
+	TRAFFIC_ALERT_HOLD        = 5 * time.Second  // Keep an alert this long after the threat goes away, to avoid flapping.
+
+	TRAFFIC_ALERT_EVENT         = "TrafficAlert"
+	TRAFFIC_ALERT_CLEARED_EVENT = "TrafficAlertCleared"
+
+	KNOTS_TO_MPS = 1852.0 / 3600.0
+)
+
+// Sent on the /traffic websocket when a target's alert status changes. TrafficInfo updates don't have an 'Event' field.
+type TrafficAlertEvent struct {
+	Event        string
+	Icao_addr    uint32
+	Tail         string
+	Distance     float64 // Current horizontal distance, meters.
+	Bearing      float64 // Degrees true.
+	Alt          int32   // Pressure altitude, feet.
+	CPA_time     float64
+	CPA_distance float64
+	CPA_vsep     int32
+	Timestamp    time.Time // UTC.
+}
+
+// Horizontal velocity (north, east), m/s, from a track and ground speed.
+func velocityNE(track float64, speed float64) (float64, float64) {
+	v := speed * KNOTS_TO_MPS
+	return v * math.Cos(radians(track)), v * math.Sin(radians(track))
+}
+
+// Ownship altitude to compare with traffic pressure altitudes, and vertical speed in ft/min. Uses GPS altitude when
+// there is no pressure altitude, as makeOwnshipReport() does.
+func ownshipAlertAltitude(s *SituationData) (float64, float64) {
+	vvel := float64(s.GPSVertVel) * 60
+	if s.tempPressValid() {
+		return s.Pressure_alt, vvel
+	}
+	return float64(s.Alt), vvel
+}
+
+// Compute the closest point of approach to 'ti', with both ownship and target at constant velocity. Sets the CPA_
+// fields. Returns false if there isn't enough data.
+func computeCPA(ti *TrafficInfo, s *SituationData) bool {
+	ti.CPA_valid = false
+	if !s.gpsValid() || !ti.Position_valid || stratuxClock.Since(ti.Last_seen) > TRAFFIC_ALERT_MAX_AGE {
+		return false
+	}
+
+	// Relative position and velocity of the target, in a flat frame centred on ownship (meters, m/s).
+	_, _, rN, rE := distRect(float64(s.Lat), float64(s.Lng), float64(ti.Lat), float64(ti.Lng))
+	var oN, oE, tN, tE float64
+	if s.groundTrackValid() {
+		oN, oE = velocityNE(float64(s.TrueCourse), float64(s.GroundSpeed))
+	}
+	if ti.Speed_valid {
+		tN, tE = velocityNE(float64(ti.Track), float64(ti.Speed))
+	}
+	vN, vE := tN-oN, tE-oE
+
+	// Time to CPA. Zero if diverging or not moving relative to each other.
+	tcpa := 0.0
+	if v2 := vN*vN + vE*vE; v2 > 0.01 {
+		tcpa = math.Max(0, -(rN*vN+rE*vE)/v2)
+	}
+	cN, cE := rN+vN*tcpa, rE+vE*tcpa
+
+	// Vertical separation at CPA, feet. Positive if the target is above.
+	vsep := 0.0
+	if stratuxClock.Since(ti.Last_alt) <= TRAFFIC_ALERT_MAX_ALT_AGE {
+		ownAlt, ownVvel := ownshipAlertAltitude(s)
+		vsep = float64(ti.Alt) - ownAlt + (float64(ti.Vvel)-ownVvel)*tcpa/60
+	}
+
+	ti.CPA_valid = true
+	ti.CPA_time = tcpa
+	ti.CPA_distance = math.Sqrt(cN*cN + cE*cE)
+	ti.CPA_vsep = int32(vsep)
+	return true
+}
+
+// Whether 'ti' is a threat: within the alert distance and altitude now, or predicted to be within them within the alert
+// time. computeCPA() must have been called.
+func isTrafficThreat(ti *TrafficInfo, s *SituationData) bool {
+	if !ti.CPA_valid || ti.OnGround || ti.Duplicate || ti.Ownship_echo {
+		return false
+	}
+	dist := globalSettings.TrafficAlertDistance * 1852.0
+	alt := float64(globalSettings.TrafficAlertAltitude)
+
+	// Current separation.
+	ownAlt, _ := ownshipAlertAltitude(s)
+	vsepNow := 0.0
+	if stratuxClock.Since(ti.Last_alt) <= TRAFFIC_ALERT_MAX_ALT_AGE {
+		vsepNow = float64(ti.Alt) - ownAlt
+	}
+	hdistNow, _, _, _ := distRect(float64(s.Lat), float64(s.Lng), float64(ti.Lat), float64(ti.Lng))
+	if hdistNow < dist && math.Abs(vsepNow) < alt {
+		return true
+	}
+
+	// Predicted separation.
+	return ti.CPA_time > 0 && ti.CPA_time <= float64(globalSettings.TrafficAlertTime) &&
+		ti.CPA_distance < dist && math.Abs(float64(ti.CPA_vsep)) < alt
+}
+
+// Update the alert status of 'ti'. Must be called with trafficMutex held.
+func updateTrafficAlert(ti *TrafficInfo, s *SituationData) {
+	wasAlert := ti.Alert
+	if globalSettings.TrafficAlert_Enabled && computeCPA(ti, s) && isTrafficThreat(ti, s) {
+		ti.Alert = true
+		ti.Last_alert = stratuxClock.Time
+	} else if !globalSettings.TrafficAlert_Enabled || stratuxClock.Since(ti.Last_alert) > TRAFFIC_ALERT_HOLD {
+		ti.Alert = false
+	}
+
+	if ti.Alert == wasAlert {
+		return
+	}
+	ev := TrafficAlertEvent{
+		Event:        TRAFFIC_ALERT_EVENT,
+		Icao_addr:    ti.Icao_addr,
+		Tail:         ti.Tail,
+		Distance:     ti.Distance,
+		Bearing:      ti.Bearing,
+		Alt:          ti.Alt,
+		CPA_time:     ti.CPA_time,
+		CPA_distance: ti.CPA_distance,
+		CPA_vsep:     ti.CPA_vsep,
+		Timestamp:    time.Now().UTC(),
+	}
+	if !ti.Alert {
+		ev.Event = TRAFFIC_ALERT_CLEARED_EVENT
+	}
+	evJSON, _ := json.Marshal(&ev)
+	trafficUpdate.Send(evJSON)
+
+	if ti.Alert && globalSettings.ReplayLog && isDataLogReady() {
+		name := ti.Tail
+		if len(name) == 0 {
+			name = fmt.Sprintf("%06X", ti.Icao_addr)
+		}
+		// Airport and timezone lookups are slow, don't hold up traffic updates.
+		go addFlightEvent(fmt.Sprintf("Traffic alert: %s, %.1f nm at %.0f°, %+d ft", name, ti.Distance/1852.0, ti.Bearing, ti.CPA_vsep))
+	}
+}
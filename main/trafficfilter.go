@@ -0,0 +1,152 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	trafficfilter.go: Per-output traffic filters. Targets are ranked by threat, and each network or serial output gets
+	 the most threatening targets that pass its filter.
+*/
+
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+const (
+	TRAFFIC_THREAT_LOOKAHEAD       = 60.0 // seconds. Closing targets are ranked by their distance this far ahead...
+	TRAFFIC_THREAT_VERTICAL_WEIGHT = 2.0  // ... plus this many meters per foot of vertical separation.
+)
+
+// TrafficFilter limits the traffic sent to one output. Zero fields don't filter.
+type TrafficFilter struct {
+	MaxTargets   int     // Send at most this many targets, most threatening first.
+	MaxRange     float64 // nm from ownship.
+	MaxAltAbove  int     // ft above ownship.
+	MaxAltBelow  int     // ft below ownship.
+	HideOnGround bool    // Don't send targets that are on the ground.
+	MaxAge       float64 // Seconds since the last position, including coasting time.
+}
+
+// Threat ranking of a target, lower is more threatening. Alerted targets come first, then targets by their horizontal
+// distance TRAFFIC_THREAT_LOOKAHEAD seconds ahead (if closing) plus a weight for vertical separation.
+func trafficThreatScore(ti *TrafficInfo, s *SituationData) float64 {
+	if !s.gpsValid() {
+		return ti.Age // Can't tell which targets are close. Prefer the freshest.
+	}
+	dist := ti.Distance
+	if ti.CPA_valid && ti.CPA_time > 0 {
+		closure := (ti.Distance - ti.CPA_distance) / ti.CPA_time // m/s.
+		dist = math.Max(ti.CPA_distance, ti.Distance-closure*TRAFFIC_THREAT_LOOKAHEAD)
+	}
+	score := dist
+	if stratuxClock.Since(ti.Last_alt) <= TRAFFIC_ALERT_MAX_ALT_AGE {
+		ownAlt, _ := ownshipAlertAltitude(s)
+		score += math.Abs(float64(ti.Alt)-ownAlt) * TRAFFIC_THREAT_VERTICAL_WEIGHT
+	}
+	if ti.Alert {
+		score -= 1e9
+	}
+	return score
+}
+
+type trafficByThreat struct {
+	targets []TrafficInfo
+	scores  []float64
+}
+
+func (t trafficByThreat) Len() int { return len(t.targets) }
+func (t trafficByThreat) Swap(i, j int) {
+	t.targets[i], t.targets[j] = t.targets[j], t.targets[i]
+	t.scores[i], t.scores[j] = t.scores[j], t.scores[i]
+}
+func (t trafficByThreat) Less(i, j int) bool { return t.scores[i] < t.scores[j] }
+
+// Sort 'targets' most threatening first.
+func sortTrafficByThreat(targets []TrafficInfo, s *SituationData) {
+	scores := make([]float64, len(targets))
+	for i := range targets {
+		scores[i] = trafficThreatScore(&targets[i], s)
+	}
+	sort.Stable(trafficByThreat{targets: targets, scores: scores})
+}
+
+// Whether 'ti' passes the filter. Range and altitude limits only apply when ownship position and altitude are known.
+func (f *TrafficFilter) passes(ti *TrafficInfo, s *SituationData) bool {
+	if f.HideOnGround && ti.OnGround {
+		return false
+	}
+	if f.MaxAge > 0 && ti.Age > f.MaxAge {
+		return false
+	}
+	if !s.gpsValid() {
+		return true
+	}
+	if f.MaxRange > 0 && ti.Distance/1852.0 > f.MaxRange {
+		return false
+	}
+	if (f.MaxAltAbove > 0 || f.MaxAltBelow > 0) && stratuxClock.Since(ti.Last_alt) <= TRAFFIC_ALERT_MAX_ALT_AGE {
+		ownAlt, _ := ownshipAlertAltitude(s)
+		rel := float64(ti.Alt) - ownAlt
+		if f.MaxAltAbove > 0 && rel > float64(f.MaxAltAbove) {
+			return false
+		}
+		if f.MaxAltBelow > 0 && -rel > float64(f.MaxAltBelow) {
+			return false
+		}
+	}
+	return true
+}
+
+// The targets that pass 'f', which may be nil, most threatening first. 'targets' must be sorted by threat.
+func filterTraffic(targets []TrafficInfo, f *TrafficFilter, s *SituationData) []TrafficInfo {
+	if f == nil {
+		return targets
+	}
+	ret := make([]TrafficInfo, 0, len(targets))
+	for i := range targets {
+		if f.MaxTargets > 0 && len(ret) >= f.MaxTargets {
+			break
+		}
+		if f.passes(&targets[i], s) {
+			ret = append(ret, targets[i])
+		}
+	}
+	return ret
+}
+
+// GDL90 traffic reports for the targets that pass 'f', which may be nil. 'targets' must be sorted by threat.
+func makeTrafficReports(targets []TrafficInfo, f *TrafficFilter, s *SituationData) []byte {
+	var msg []byte
+	for _, ti := range filterTraffic(targets, f, s) {
+		msg = append(msg, makeTrafficReportMsg(ti)...)
+	}
+	return msg
+}
+
+// Traffic message of type 'msgType' (NETWORK_GDL90_STANDARD, NETWORK_NMEA or NETWORK_JSON) for an output with
+// filter 'f'.
+func makeTrafficMessage(msgType uint8, targets []TrafficInfo, f *TrafficFilter, s *SituationData) []byte {
+	switch msgType {
+	case NETWORK_NMEA:
+		return makeNMEATrafficReports(targets, f, s)
+	case NETWORK_JSON:
+		return makeJSONTrafficReports(targets, f, s)
+	}
+	return makeTrafficReports(targets, f, s)
+}
+
+// Send traffic reports for 'targets' to all outputs, each with its own filter. 's' is the ownship situation the
+// targets' distances were computed from. NMEA outputs get a status sentence even when there is no traffic.
+func sendTrafficReports(targets []TrafficInfo, s *SituationData) {
+	sortTrafficByThreat(targets, s)
+	if len(targets) > 0 {
+		messageQueue <- networkMessage{msgType: NETWORK_GDL90_STANDARD, queueable: false, ts: stratuxClock.Time, traffic: targets, situation: s}
+		messageQueue <- networkMessage{msgType: NETWORK_JSON, queueable: false, ts: stratuxClock.Time, traffic: targets, situation: s}
+	} else {
+		targets = []TrafficInfo{} // Non-nil, to mark the message as traffic.
+	}
+	messageQueue <- networkMessage{msgType: NETWORK_NMEA, queueable: false, ts: stratuxClock.Time, traffic: targets, situation: s}
+}
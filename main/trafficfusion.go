@@ -0,0 +1,244 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	trafficfusion.go: Multi-source traffic fusion. Keeps the best source's position for each target, correlates TIS-B
+	 tracks with ADS-B/ADS-R tracks of the same aircraft, and suppresses echoes of ownship.
+*/
+
+package main
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// Traffic source bits, for TrafficInfo.Sources and TrafficInfo.Position_source.
+const (
+	TRAFFIC_SRC_1090ES_ADSB = 0x01
+	TRAFFIC_SRC_1090ES_ADSR = 0x02
+	TRAFFIC_SRC_1090ES_TISB = 0x04
+	TRAFFIC_SRC_UAT_ADSB    = 0x08
+	TRAFFIC_SRC_UAT_ADSR    = 0x10
+	TRAFFIC_SRC_UAT_TISB    = 0x20
+	TRAFFIC_SRC_COUNT       = 6
+)
+
+const (
+	TRAFFIC_FUSION_HOLD       = 3 * time.Second  // Keep a position from a better source this long before taking one from a worse source.
+	TRAFFIC_FUSION_SOURCE_AGE = 30 * time.Second // Sources not heard from in this long are dropped from TrafficInfo.Sources.
+	TRAFFIC_FUSION_DISTANCE   = 1000.0           // meters. Correlate tracks within this horizontal distance...
+	TRAFFIC_FUSION_ALTITUDE   = 300              // ... and this altitude, ft...
+	TRAFFIC_FUSION_TRACK      = 45.0             // ... with tracks within this many degrees...
+	TRAFFIC_FUSION_SPEED      = 40               // ... and speeds within this many knots.
+	TRAFFIC_FUSION_MIN_SPEED  = 50               // knots. Track is too noisy to compare below this.
+
+	TRAFFIC_OWNSHIP_DISTANCE     = 500.0 // meters. Suppress targets within this distance of ownship...
+	TRAFFIC_OWNSHIP_ALTITUDE     = 300   // ... and this altitude, ft, when ownship pressure altitude is available...
+	TRAFFIC_OWNSHIP_ALTITUDE_GPS = 500   // ... or this altitude when only GPS altitude is available...
+	TRAFFIC_OWNSHIP_TRACK        = 30.0  // ... with track within this many degrees of ownship's...
+	TRAFFIC_OWNSHIP_SPEED        = 30    // ... and speed within this many knots...
+	TRAFFIC_OWNSHIP_MIN_SPEED    = 30    // ... while ownship is moving faster than this, in knots.
+)
+
+// Source bit for a report received on 'source' (TRAFFIC_SOURCE_1090ES or TRAFFIC_SOURCE_UAT) with target type
+// 'targetType'. Zero if the report isn't ADS-B, ADS-R or TIS-B.
+func trafficSourceBit(source uint8, targetType uint8) uint8 {
+	var bit uint8
+	switch targetType {
+	case TARGET_TYPE_ADSB:
+		bit = TRAFFIC_SRC_1090ES_ADSB
+	case TARGET_TYPE_ADSR:
+		bit = TRAFFIC_SRC_1090ES_ADSR
+	case TARGET_TYPE_TISB, TARGET_TYPE_TISB_S:
+		bit = TRAFFIC_SRC_1090ES_TISB
+	default:
+		return 0
+	}
+	if source == TRAFFIC_SOURCE_UAT {
+		bit = bit << 3
+	}
+	return bit
+}
+
+// Target type of a DF17/DF18 dump1090 message. TARGET_TYPE_MODE_S for everything else.
+func esTargetType(df int, ca int) uint8 {
+	if df == 17 {
+		return TARGET_TYPE_ADSB
+	}
+	if df == 18 {
+		switch ca {
+		case 6:
+			return TARGET_TYPE_ADSR
+		case 2, 5:
+			return TARGET_TYPE_TISB
+		}
+	}
+	return TARGET_TYPE_MODE_S
+}
+
+// Preference of a source: direct ADS-B, then ADS-R, then TIS-B.
+func trafficSourceRank(bit uint8) int {
+	switch bit {
+	case TRAFFIC_SRC_1090ES_ADSB, TRAFFIC_SRC_UAT_ADSB:
+		return 3
+	case TRAFFIC_SRC_1090ES_ADSR, TRAFFIC_SRC_UAT_ADSR:
+		return 2
+	case TRAFFIC_SRC_1090ES_TISB, TRAFFIC_SRC_UAT_TISB:
+		return 1
+	}
+	return 0
+}
+
+// Record a report from source 'bit' for 'ti'.
+func markTrafficSource(ti *TrafficInfo, bit uint8) {
+	for i := uint(0); i < TRAFFIC_SRC_COUNT; i++ {
+		if bit == 1<<i {
+			ti.source_seen[i] = stratuxClock.Time
+		}
+	}
+}
+
+// Whether a position and velocity from source 'bit' should replace the ones in 'ti'. A worse source is only used once
+// the better source has gone quiet for TRAFFIC_FUSION_HOLD.
+func preferTrafficSource(ti *TrafficInfo, bit uint8) bool {
+	if !ti.Position_valid || ti.Position_source == 0 {
+		return true
+	}
+	if trafficSourceRank(bit) >= trafficSourceRank(ti.Position_source) {
+		return true
+	}
+	return stratuxClock.Since(ti.Last_seen) > TRAFFIC_FUSION_HOLD
+}
+
+// Sources heard from within TRAFFIC_FUSION_SOURCE_AGE.
+func recentTrafficSources(ti *TrafficInfo) uint8 {
+	var ret uint8
+	for i := uint(0); i < TRAFFIC_SRC_COUNT; i++ {
+		if !ti.source_seen[i].IsZero() && stratuxClock.Since(ti.source_seen[i]) < TRAFFIC_FUSION_SOURCE_AGE {
+			ret |= 1 << i
+		}
+	}
+	return ret
+}
+
+// Absolute difference between two angles, degrees.
+func angleDiff(a, b float64) float64 {
+	d := math.Mod(math.Abs(a-b), 360)
+	if d > 180 {
+		d = 360 - d
+	}
+	return d
+}
+
+// Whether two tracks are close enough in position, altitude and velocity to be the same aircraft. Positions must be
+// current (dead-reckoned to now, if coasting).
+func trafficCorrelated(a, b *TrafficInfo) bool {
+	if stratuxClock.Since(a.Last_alt) > TRAFFIC_ALERT_MAX_ALT_AGE || stratuxClock.Since(b.Last_alt) > TRAFFIC_ALERT_MAX_ALT_AGE {
+		return false
+	}
+	if math.Abs(float64(a.Alt-b.Alt)) > TRAFFIC_FUSION_ALTITUDE || a.OnGround != b.OnGround {
+		return false
+	}
+	dist, _, _, _ := distRect(float64(a.Lat), float64(a.Lng), float64(b.Lat), float64(b.Lng))
+	if dist > TRAFFIC_FUSION_DISTANCE {
+		return false
+	}
+	if a.Speed_valid && b.Speed_valid {
+		if math.Abs(float64(a.Speed)-float64(b.Speed)) > TRAFFIC_FUSION_SPEED {
+			return false
+		}
+		if a.Speed >= TRAFFIC_FUSION_MIN_SPEED && b.Speed >= TRAFFIC_FUSION_MIN_SPEED && angleDiff(float64(a.Track), float64(b.Track)) > TRAFFIC_FUSION_TRACK {
+			return false
+		}
+	}
+	return true
+}
+
+// Whether 'ti' is a reflection of ownship: ownship's own ADS-B Out when OwnshipModeS isn't set correctly, or a TIS-B
+// track of ownship.
+func isOwnshipEcho(ti *TrafficInfo, s *SituationData) bool {
+	if !s.gpsValid() || !s.groundTrackValid() || s.GroundSpeed < TRAFFIC_OWNSHIP_MIN_SPEED {
+		return false
+	}
+	if !ti.Speed_valid || stratuxClock.Since(ti.Last_alt) > TRAFFIC_ALERT_MAX_ALT_AGE {
+		return false
+	}
+	ownAlt, _ := ownshipAlertAltitude(s)
+	maxAlt := float64(TRAFFIC_OWNSHIP_ALTITUDE)
+	if !s.tempPressValid() {
+		maxAlt = TRAFFIC_OWNSHIP_ALTITUDE_GPS
+	}
+	if math.Abs(float64(ti.Alt)-ownAlt) > maxAlt {
+		return false
+	}
+	dist, _, _, _ := distRect(float64(s.Lat), float64(s.Lng), float64(ti.Lat), float64(ti.Lng))
+	if dist > TRAFFIC_OWNSHIP_DISTANCE {
+		return false
+	}
+	return math.Abs(float64(ti.Speed)-float64(s.GroundSpeed)) <= TRAFFIC_OWNSHIP_SPEED &&
+		angleDiff(float64(ti.Track), float64(s.TrueCourse)) <= TRAFFIC_OWNSHIP_TRACK
+}
+
+// Targets ordered best first: by source rank, then NACp, then age.
+type trafficByQuality []*TrafficInfo
+
+func (t trafficByQuality) Len() int      { return len(t) }
+func (t trafficByQuality) Swap(i, j int) { t[i], t[j] = t[j], t[i] }
+func (t trafficByQuality) Less(i, j int) bool {
+	ri, rj := trafficSourceRank(t[i].Position_source), trafficSourceRank(t[j].Position_source)
+	if ri != rj {
+		return ri > rj
+	}
+	if t[i].NACp != t[j].NACp {
+		return t[i].NACp > t[j].NACp
+	}
+	return t[i].Age < t[j].Age
+}
+
+// Correlate current targets. Sets Sources, Duplicate, Duplicate_of and Ownship_echo on every target in 'traffic'.
+// A TIS-B track that correlates with a better track is marked as a duplicate of it, and its sources are added to the
+// better track. Ages and positions must be current. Must be called with trafficMutex held.
+func fuseTraffic(ownshipCode uint32, s *SituationData) {
+	tracks := make([]*TrafficInfo, 0, len(traffic))
+	for icao, ti := range traffic {
+		ti.Sources = recentTrafficSources(&ti)
+		ti.Duplicate = false
+		ti.Duplicate_of = 0
+		ti.Ownship_echo = false
+		if ti.Position_valid && (ti.Age < TRAFFIC_STALE_AGE || ti.ExtrapolatedPosition) && ti.Icao_addr != ownshipCode {
+			ti.Ownship_echo = isOwnshipEcho(&ti, s)
+			if !ti.Ownship_echo {
+				t := ti
+				tracks = append(tracks, &t)
+			}
+		}
+		traffic[icao] = ti
+	}
+
+	sort.Sort(trafficByQuality(tracks))
+	for i, a := range tracks {
+		if a.Duplicate {
+			continue
+		}
+		for _, b := range tracks[i+1:] {
+			if b.Duplicate || trafficSourceRank(b.Position_source) != trafficSourceRank(TRAFFIC_SRC_UAT_TISB) {
+				continue // Only TIS-B tracks are merged. Two ADS-B targets this close are flying formation.
+			}
+			if trafficCorrelated(a, b) {
+				b.Duplicate = true
+				b.Duplicate_of = a.Icao_addr
+				a.Sources |= b.Sources
+			}
+		}
+	}
+
+	for _, t := range tracks {
+		ti := traffic[t.Icao_addr]
+		ti.Sources, ti.Duplicate, ti.Duplicate_of = t.Sources, t.Duplicate, t.Duplicate_of
+		traffic[t.Icao_addr] = ti
+	}
+}
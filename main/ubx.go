@@ -0,0 +1,320 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	ubx.go: u-blox UBX binary protocol. UBX-NAV-PVT gives position, velocity, accuracy, fix type and leap second aware
+	 UTC time in one message, UBX-NAV-DOP the dilutions of precision, and UBX-NAV-SAT the satellites.
+
+	 https://www.u-blox.com/sites/default/files/products/documents/u-blox8-M8_ReceiverDescrProtSpec_(UBX-13003221)_Public.pdf
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	UBX_SYNC1       = 0xB5
+	UBX_SYNC2       = 0x62
+	UBX_MAX_PAYLOAD = 2048 // Longest payload expected. NAV-SAT, with 8 + 12 bytes per satellite, is the longest used.
+
+	UBX_CLASS_NAV = 0x01
+	UBX_NAV_DOP   = 0x04
+	UBX_NAV_PVT   = 0x07
+	UBX_NAV_SAT   = 0x35
+
+	// NMEA position, velocity and time (or satellite) sentences are ignored while NAV-PVT (or NAV-SAT) is more recent
+	// than this.
+	UBX_NAV_TIMEOUT = 3 * time.Second
+)
+
+// stratuxClock times NAV-PVT and NAV-SAT were last received. Protected by mySituation.mu_GPS.
+var lastNAVPVTTime time.Time
+var lastNAVSATTime time.Time
+
+// validateUBXFrame checks the sync characters, length and checksum of a UBX frame.
+func validateUBXFrame(msg []byte) bool {
+	if len(msg) < 8 || msg[0] != UBX_SYNC1 || msg[1] != UBX_SYNC2 {
+		return false
+	}
+	if int(msg[4])|int(msg[5])<<8 != len(msg)-8 {
+		return false
+	}
+	chk := chksumUBX(msg[2 : len(msg)-2])
+	return chk[0] == msg[len(msg)-2] && chk[1] == msg[len(msg)-1]
+}
+
+// Little endian fields.
+func ubxU2(b []byte) uint16 {
+	return uint16(b[0]) | uint16(b[1])<<8
+}
+
+func ubxU4(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24
+}
+
+func ubxI4(b []byte) int32 {
+	return int32(ubxU4(b))
+}
+
+/*
+processUBXMessage handles a UBX frame, as split by scanGPSMessages().
+
+return is true if the message was used.
+*/
+func processUBXMessage(msg []byte) (msgUsed bool) {
+	mySituation.mu_GPS.Lock()
+
+	defer func() {
+		publish := msgUsed || globalSettings.DEBUG
+		var s SituationData
+		if publish {
+			s = copySituationGPSLocked()
+		}
+		mySituation.mu_GPS.Unlock()
+		if publish {
+			publishEvent(EVENT_SITUATION, situationEvent{Situation: s, GPS: true})
+		}
+	}()
+
+	if !validateUBXFrame(msg) {
+		log.Printf("GPS error. Invalid UBX message: % X\n", msg)
+		return false
+	}
+	class, id, payload := msg[2], msg[3], msg[6:len(msg)-2]
+
+	mySituation.LastValidNMEAMessageTime = stratuxClock.Time
+	mySituation.LastValidNMEAMessage = fmt.Sprintf("UBX %02X %02X", class, id)
+
+	if class != UBX_CLASS_NAV {
+		return false // Acknowledgements of the configuration, for example.
+	}
+	switch id {
+	case UBX_NAV_PVT:
+		return processNAVPVT(payload)
+	case UBX_NAV_DOP:
+		return processNAVDOP(payload)
+	case UBX_NAV_SAT:
+		return processNAVSAT(payload)
+	}
+	return false
+}
+
+// NAV-PVT: navigation position velocity time solution. Called with mu_GPS held.
+func processNAVPVT(p []byte) bool {
+	if len(p) < 84 { // 84 bytes from u-blox 7, 92 from u-blox 8.
+		return false
+	}
+	lastNAVPVTTime = stratuxClock.Time
+
+	// Time. Only used when the date and time are valid and fully resolved, which includes knowing the current number
+	// of leap seconds.
+	valid := p[11]
+	if valid&0x07 == 0x07 {
+		gpsTime := time.Date(int(ubxU2(p[4:])), time.Month(p[6]), int(p[7]), int(p[8]), int(p[9]), int(p[10]), 0, time.UTC)
+		gpsTime = gpsTime.Add(time.Duration(ubxI4(p[16:]))) // nano, -1e9..1e9.
+		if setGPSTime(&mySituation, gpsTime) {
+			setDataLogTimeWithGPS(copySituationGPSLocked())
+		}
+	}
+
+	// Fix type: 0 no fix, 1 dead reckoning only, 2 2D, 3 3D, 4 GNSS + dead reckoning, 5 time only.
+	fixType := p[20]
+	flags := p[21]
+	mySituation.FixType = fixType
+	if fixType == 0 || fixType == 5 || flags&0x01 == 0 { // No fix, or gnssFixOK not set.
+		return false
+	}
+
+	tmpSituation := mySituation // If we decide to not use the data in this message, then don't make incomplete changes in mySituation.
+
+	if fixType == 1 {
+		tmpSituation.Quality = 6
+	} else if flags&0x02 != 0 { // diffSoln: SBAS (WAAS) corrections applied.
+		tmpSituation.Quality = 2
+	} else {
+		tmpSituation.Quality = 1
+	}
+
+	hour, min, sec := int(p[8]), int(p[9]), int(p[10])
+	tmpSituation.LastFixSinceMidnightUTC = float32(3600*hour+60*min+sec) + float32(ubxI4(p[16:]))/1e9
+
+	tmpSituation.Lng = float32(float64(ubxI4(p[24:])) * 1e-7)
+	tmpSituation.Lat = float32(float64(ubxI4(p[28:])) * 1e-7)
+
+	// Height above ellipsoid and MSL, mm.
+	hae := float32(ubxI4(p[32:])) / 1000 * 3.28084
+	msl := float32(ubxI4(p[36:])) / 1000 * 3.28084
+	tmpSituation.HeightAboveEllipsoid = hae
+	tmpSituation.Alt = msl
+	tmpSituation.GeoidSep = hae - msl
+
+	// Horizontal and vertical accuracy, mm. UBX reports 1-sigma variation; we want 95% confidence (2-sigma).
+	tmpSituation.Accuracy = float32(ubxU4(p[40:])) / 1000 * 2
+	tmpSituation.NACp = calculateNACp(tmpSituation.Accuracy)
+	tmpSituation.AccuracyVert = float32(ubxU4(p[44:])) / 1000 * 2
+
+	tmpSituation.LastFixLocalTime = stratuxClock.Time
+
+	// Ground speed, mm/s, and heading of motion, 1e-5 deg.
+	groundspeed := float64(ubxI4(p[60:])) / 1000 * 1.94384 // convert to knots
+	tmpSituation.GroundSpeed = uint16(groundspeed)
+	if groundspeed > 3 { // TO-DO: use average groundspeed over last n seconds to avoid random "jumps"
+		tmpSituation.TrueCourse = float32(float64(ubxI4(p[64:])) * 1e-5)
+	}
+	tmpSituation.LastGroundTrackTime = stratuxClock.Time
+
+	// Velocity down, mm/s.
+	tmpSituation.GPSVertVel = float32(ubxI4(p[56:])) / 1000 * -3.28084 // convert to ft/sec and positive = up
+	tmpSituation.LastGPSVertVelTime = stratuxClock.Time
+
+	tmpSituation.Satellites = uint16(p[23])
+	tmpSituation.PDOP = float32(ubxU2(p[76:])) / 100
+
+	// We've made it this far, so that means we've processed "everything" and can now make the change to mySituation.
+	mySituation = tmpSituation
+	return true
+}
+
+// NAV-DOP: dilution of precision. Called with mu_GPS held.
+func processNAVDOP(p []byte) bool {
+	if len(p) < 18 {
+		return false
+	}
+	mySituation.PDOP = float32(ubxU2(p[6:])) / 100
+	mySituation.VDOP = float32(ubxU2(p[10:])) / 100
+	mySituation.HDOP = float32(ubxU2(p[12:])) / 100
+	return true
+}
+
+// NAV-SAT: satellite information. Called with mu_GPS held.
+func processNAVSAT(p []byte) bool {
+	if len(p) < 8 {
+		return false
+	}
+	numSvs := int(p[5])
+	if len(p) < 8+12*numSvs {
+		return false
+	}
+	lastNAVSATTime = stratuxClock.Time
+
+	// START OF PROTECTED BLOCK
+	satelliteMutex.Lock()
+	defer satelliteMutex.Unlock()
+
+	for i := 0; i < numSvs; i++ {
+		b := p[8+12*i:]
+		gnssID, sv := b[0], int(b[1])
+		cno, elev, az := int8(b[2]), int16(int8(b[3])), int16(ubxU2(b[4:]))
+		flags := ubxU4(b[8:])
+
+		// Satellite IDs as from NMEA: GPS NMEA = PRN. GLONASS NMEA = PRN + 64. SBAS NMEA = PRN - 87.
+		var svType uint8
+		var svStr string
+		nmea := 0
+		switch gnssID {
+		case 0:
+			svType = SAT_TYPE_GPS
+			svStr = fmt.Sprintf("G%d", sv)
+			nmea = sv
+		case 1:
+			svType = SAT_TYPE_SBAS
+			svStr = fmt.Sprintf("S%d", sv)
+			nmea = sv - 87
+		case 2:
+			svType = SAT_TYPE_GALILEO
+			svStr = fmt.Sprintf("E%d", sv)
+		case 3:
+			svType = SAT_TYPE_BEIDOU
+			svStr = fmt.Sprintf("B%d", sv)
+		case 6:
+			if sv == 255 { // Slot not known yet.
+				continue
+			}
+			svType = SAT_TYPE_GLONASS
+			svStr = fmt.Sprintf("R%d", sv)
+			nmea = sv + 64
+		default: // QZSS, IMES.
+			svType = SAT_TYPE_UNKNOWN
+			svStr = fmt.Sprintf("U%d", sv)
+		}
+
+		var thisSatellite SatelliteInfo
+		if val, ok := Satellites[svStr]; ok { // if we've already seen this satellite identifier, copy it in to do updates
+			thisSatellite = val
+		} else { // this satellite isn't in the Satellites data structure, so create it
+			thisSatellite.SatelliteID = svStr
+			thisSatellite.SatelliteNMEA = uint8(nmea)
+			thisSatellite.Type = svType
+		}
+		thisSatellite.TimeLastTracked = stratuxClock.Time
+
+		if flags&0x07 == 0 { // qualityInd: no signal. Represent as -99.
+			cno = -99
+		} else if cno > 0 {
+			thisSatellite.TimeLastSeen = stratuxClock.Time
+		}
+		thisSatellite.Signal = cno
+
+		if elev < -90 || elev > 90 { // Not known. Represent as -999.
+			elev = -999
+			az = -999
+		}
+		thisSatellite.Elevation = elev
+		thisSatellite.Azimuth = az
+
+		// svUsed.
+		thisSatellite.InSolution = flags&0x08 != 0
+		if thisSatellite.InSolution {
+			thisSatellite.TimeLastSolution = stratuxClock.Time
+		}
+
+		if globalSettings.DEBUG {
+			inSolnStr := " "
+			if thisSatellite.InSolution {
+				inSolnStr = "+"
+			}
+			log.Printf("NAV-SAT: Satellite %s%s at index %d. Type = %d, NMEA-ID = %d, Elev = %d, Azimuth = %d, Cno = %d\n", inSolnStr, svStr, i, svType, nmea, elev, az, cno)
+		}
+
+		Satellites[thisSatellite.SatelliteID] = thisSatellite // Update constellation with this satellite
+	}
+	updateConstellation()
+	// END OF PROTECTED BLOCK
+
+	return true
+}
+
+/*
+ubxSupersedesNMEA is true if the NMEA sentence 'x' (split at the commas) has information that NAV-PVT or NAV-SAT
+
+	has given us more recently, and more accurately. Called with mu_GPS held.
+*/
+func ubxSupersedesNMEA(x []string) bool {
+	if stratuxClock.Since(lastNAVPVTTime) < UBX_NAV_TIMEOUT {
+		switch x[0] {
+		case "GNVTG", "GPVTG", "GNGGA", "GPGGA", "GNRMC", "GPRMC", "GNGSA", "GPGSA":
+			return true
+		case "PUBX":
+			if len(x) > 1 && (x[1] == "00" || x[1] == "04") {
+				return true
+			}
+		}
+	}
+	if stratuxClock.Since(lastNAVSATTime) < UBX_NAV_TIMEOUT {
+		switch x[0] {
+		case "GPGSV", "GLGSV":
+			return true
+		case "PUBX":
+			if len(x) > 1 && x[1] == "03" {
+				return true
+			}
+		}
+	}
+	return false
+}
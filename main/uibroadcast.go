@@ -11,6 +11,7 @@
 package main
 
 import (
+	"encoding/json"
 	"golang.org/x/net/websocket"
 	"sync"
 	"time"
@@ -59,3 +60,21 @@ func (u *uibroadcaster) writer() {
 		u.sockets_mu.Unlock()
 	}
 }
+
+// Forward traffic and weather events to the websockets. The UI only needs the latest state, so old events are dropped
+// if the websockets fall behind.
+func uiEventForwarder() {
+	sub := subscribeEvents("websockets", EVENT_TRAFFIC|EVENT_WEATHER, 1024, EVENT_DROP_OLDEST)
+	for ev := range sub.C {
+		switch ev.Type {
+		case EVENT_TRAFFIC:
+			ti := ev.Data.(TrafficInfo)
+			tiJSON, _ := json.Marshal(&ti)
+			trafficUpdate.Send(tiJSON)
+		case EVENT_WEATHER:
+			wm := ev.Data.(WeatherMessage)
+			wmJSON, _ := json.Marshal(&wm)
+			weatherUpdate.Send(wmJSON)
+		}
+	}
+}
@@ -0,0 +1,383 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	weather.go: In-memory store of the current FIS-B weather products, with lookups by station, area and radius.
+*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"../uatparse"
+)
+
+const (
+	WX_METAR_MAX_AGE   = 2 * time.Hour  // From observation time.
+	WX_PIREP_MAX_AGE   = 2 * time.Hour  // From observation time.
+	WX_WINDS_MAX_AGE   = 6 * time.Hour  // After the forecast valid time.
+	WX_DEFAULT_MAX_AGE = 1 * time.Hour  // Other products, since last received - FIS-B repeats them every few minutes.
+	WX_LONG_MAX_AGE    = 24 * time.Hour // Products with their own end time (TAF, NOTAM, SUA) are kept at most this long.
+)
+
+// WeatherProduct is the latest version of one weather product. Text reports (product 413) are keyed by type and
+// station for METARs, TAFs and winds aloft, and by the report text for PIREPs. Graphical AIRMET/SIGMET/NOTAM/SUA
+// reports (products 8-13) are keyed by product and report number, with their text and overlay records merged as they
+// come in.
+type WeatherProduct struct {
+	WeatherMessage
+	Product_id   uint32 // 413 for text reports, or 8-13 for graphical reports.
+	ReportNumber uint16
+	ReportYear   uint16
+	Overlays     []*uatparse.UATOverlay `json:",omitempty"`
+
+	PositionValid bool // Station location (from the airport database) or overlay extent is known.
+	Lat           float64
+	Lng           float64
+	MinLat        float64
+	MinLng        float64
+	MaxLat        float64
+	MaxLng        float64
+
+	Received time.Time // System time.
+	Expires  time.Time
+}
+
+// Query for weatherQuery(). Empty/zero fields match everything.
+type WeatherQuery struct {
+	Type     string
+	Location string
+	// Bounding box.
+	HasBox bool
+	MinLat float64
+	MinLng float64
+	MaxLat float64
+	MaxLng float64
+	// Radius, nm.
+	HasRadius bool
+	Lat       float64
+	Lng       float64
+	Radius    float64
+}
+
+type stationLocation struct {
+	valid bool
+	lat   float64
+	lng   float64
+}
+
+var weatherProducts map[string]*WeatherProduct
+var weatherProductsMutex *sync.Mutex
+
+// Cache of airport database lookups, including misses.
+var stationLocations map[string]stationLocation
+var stationLocationsMutex *sync.Mutex
+
+var notamPeriodRe = regexp.MustCompile(`^\d{10}-(\d{10})`) // "1507280957-1507290930EST".
+
+// Parse a "YYMMDDhhmm" NOTAM/SUA time.
+func parseWxShortTime(s string) (time.Time, bool) {
+	t, err := time.Parse("0601021504", s)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// Location of a station ID from the airport database. Tries the ICAO ID, then the FAA ID. The first lookup of a
+// station reads the database, so don't call this with weatherProductsMutex held.
+func lookupStation(id string) stationLocation {
+	stationLocationsMutex.Lock()
+	s, ok := stationLocations[id]
+	stationLocationsMutex.Unlock()
+	if ok {
+		return s
+	}
+	apt, err := findAirportByID(id)
+	if err == nil {
+		s = stationLocation{valid: true, lat: apt.lat, lng: apt.lng}
+	}
+	stationLocationsMutex.Lock()
+	stationLocations[id] = s
+	stationLocationsMutex.Unlock()
+	return s
+}
+
+func (p *WeatherProduct) setPosition(lat, lng float64) {
+	p.PositionValid = true
+	p.Lat, p.Lng = lat, lng
+	p.MinLat, p.MaxLat = lat, lat
+	p.MinLng, p.MaxLng = lng, lng
+}
+
+// Position is the centre of the extent of all of the overlay vertices.
+func (p *WeatherProduct) setOverlayPosition() {
+	first := true
+	for _, o := range p.Overlays {
+		for _, pt := range o.Points {
+			if first {
+				p.setPosition(pt.Lat, pt.Lon)
+				first = false
+				continue
+			}
+			p.MinLat = math.Min(p.MinLat, pt.Lat)
+			p.MaxLat = math.Max(p.MaxLat, pt.Lat)
+			p.MinLng = math.Min(p.MinLng, pt.Lon)
+			p.MaxLng = math.Max(p.MaxLng, pt.Lon)
+		}
+	}
+	if !first {
+		p.Lat = (p.MinLat + p.MaxLat) / 2
+		p.Lng = (p.MinLng + p.MaxLng) / 2
+	}
+}
+
+// Expiry time of a text report. 'msg' is the full text of the report.
+func textReportExpires(wm *WeatherMessage, msg string, now time.Time) time.Time {
+	ret := now.Add(WX_DEFAULT_MAX_AGE)
+	switch {
+	case wm.METAR != nil:
+		ret = wm.METAR.Observed.Add(WX_METAR_MAX_AGE)
+	case wm.TAF != nil:
+		ret = wm.TAF.ValidTo
+	case wm.PIREP != nil:
+		ret = wm.PIREP.Observed.Add(WX_PIREP_MAX_AGE)
+	case wm.Winds != nil:
+		ret = wm.Winds.Valid.Add(WX_WINDS_MAX_AGE)
+	case strings.HasPrefix(wm.Type, "NOTAM"):
+		f := strings.Fields(msg)
+		if len(f) > 0 {
+			if m := notamPeriodRe.FindStringSubmatch(f[len(f)-1]); m != nil {
+				if t, ok := parseWxShortTime(m[1]); ok {
+					ret = t
+				}
+			}
+		}
+	case wm.Type == "SUA":
+		// "SUA 291245 3698675|25050|W|R|5802C|1507291245|1507292359|005|170|...".
+		f := strings.Split(msg, "|")
+		if len(f) > 6 {
+			if t, ok := parseWxShortTime(f[6]); ok {
+				ret = t
+			}
+		}
+	}
+	if ret.After(now.Add(WX_LONG_MAX_AGE)) {
+		ret = now.Add(WX_LONG_MAX_AGE)
+	}
+	return ret
+}
+
+// Add a product 413 text report. Other text reports (NOTAM, AIRMET, SIGMET, SUA) come from products 8-13 and are
+// added with their report numbers by weatherStoreAddFrame().
+func weatherStoreAddText(wm WeatherMessage, msg string) {
+	var key string
+	switch wm.Type {
+	case "METAR", "SPECI":
+		key = "METAR " + wm.Location
+	case "TAF", "TAF.AMD":
+		key = "TAF " + wm.Location
+	case "WINDS":
+		key = "WINDS " + wm.Location
+	case "PIREP":
+		key = "PIREP " + msg
+	default:
+		return
+	}
+
+	now := time.Now().UTC()
+	p := &WeatherProduct{WeatherMessage: wm, Product_id: 413, Received: now}
+	p.Expires = textReportExpires(&wm, msg, now)
+	if !p.Expires.After(now) {
+		return // Already expired.
+	}
+	if s := lookupStation(wm.Location); s.valid {
+		p.setPosition(s.lat, s.lng)
+	}
+
+	weatherProductsMutex.Lock()
+	defer weatherProductsMutex.Unlock()
+
+	// Don't replace a newer METAR with an older one that is still being rebroadcast.
+	if old, ok := weatherProducts[key]; ok && old.METAR != nil && wm.METAR != nil && old.METAR.Observed.After(wm.METAR.Observed) {
+		return
+	}
+
+	weatherProducts[key] = p
+}
+
+// Add the text and overlay records of a graphical AIRMET/SIGMET/NOTAM/SUA frame (products 8-13).
+func weatherStoreAddFrame(f *uatparse.UATFrame) {
+	switch f.Product_id {
+	case 8, 11, 12, 13:
+	default:
+		return
+	}
+	if len(f.TextRecords) == 0 && len(f.Overlays) == 0 {
+		return
+	}
+
+	// Parse the text records, and locate NOTAMs without a graphic at their airport (e.g. "KDTW.07/516"), before taking
+	// the lock.
+	type textRecord struct {
+		msg     string
+		wm      WeatherMessage
+		ok      bool
+		station stationLocation
+	}
+	texts := make([]textRecord, len(f.TextRecords))
+	for i, r := range f.TextRecords {
+		t := &texts[i]
+		t.msg = strings.Join(r.Text, "")
+		t.wm, t.ok = newWeatherMessage(t.msg)
+		if t.ok && strings.HasPrefix(t.wm.Type, "NOTAM") {
+			t.station = lookupStation(strings.Split(t.wm.Location, ".")[0])
+		}
+	}
+
+	now := time.Now().UTC()
+	weatherProductsMutex.Lock()
+	defer weatherProductsMutex.Unlock()
+
+	getProduct := func(report_number, report_year uint16) (string, *WeatherProduct) {
+		key := fmt.Sprintf("%d %d-%d", f.Product_id, report_number, report_year)
+		p, ok := weatherProducts[key]
+		if !ok {
+			p = &WeatherProduct{Product_id: f.Product_id, ReportNumber: report_number, ReportYear: report_year}
+			p.Type = product_name_map[int(f.Product_id)]
+			p.Location = fmt.Sprintf("%d-%d", report_number, report_year)
+			weatherProducts[key] = p
+		}
+		p.LocaltimeReceived = stratuxClock.Time
+		p.Received = now
+		if p.Expires.Before(now.Add(WX_DEFAULT_MAX_AGE)) {
+			p.Expires = now.Add(WX_DEFAULT_MAX_AGE) // Still being broadcast.
+		}
+		return key, p
+	}
+
+	for i, r := range f.TextRecords {
+		key, p := getProduct(r.ReportNumber, r.ReportYear)
+		if r.ReportStatus == uatparse.REPORT_STATUS_CANCELLED {
+			delete(weatherProducts, key)
+			continue
+		}
+		t := texts[i]
+		if t.ok {
+			p.Type, p.Location, p.Time, p.Data = t.wm.Type, t.wm.Location, t.wm.Time, t.wm.Data
+		} else {
+			p.Data = t.msg
+		}
+		p.Expires = textReportExpires(&p.WeatherMessage, t.msg, now)
+		if !p.PositionValid && t.station.valid {
+			p.setPosition(t.station.lat, t.station.lng)
+		}
+	}
+
+	for _, o := range f.Overlays {
+		_, p := getProduct(o.ReportNumber, o.ReportYear)
+		replaced := false
+		for i, old := range p.Overlays {
+			if old.RecordID == o.RecordID {
+				p.Overlays[i] = o
+				replaced = true
+			}
+		}
+		if !replaced {
+			p.Overlays = append(p.Overlays, o)
+		}
+		p.setOverlayPosition()
+		// Keep until the latest overlay end time, if sent.
+		for _, ov := range p.Overlays {
+			if !ov.HasEnd {
+				continue
+			}
+			if t := ov.End.Resolve(now); t.After(p.Expires) {
+				p.Expires = t
+			}
+		}
+		if p.Expires.After(now.Add(WX_LONG_MAX_AGE)) {
+			p.Expires = now.Add(WX_LONG_MAX_AGE)
+		}
+	}
+}
+
+// Remove expired products. Must be called with weatherProductsMutex held.
+func weatherStoreExpire(now time.Time) {
+	for k, p := range weatherProducts {
+		if !p.Expires.After(now) {
+			delete(weatherProducts, k)
+		}
+	}
+}
+
+func (p *WeatherProduct) matches(q WeatherQuery) bool {
+	if len(q.Type) > 0 && q.Type != p.Type {
+		// Match "METAR" to "SPECI" and "TAF" to "TAF.AMD" too.
+		if !(q.Type == "METAR" && p.Type == "SPECI") && !(q.Type == "TAF" && p.Type == "TAF.AMD") {
+			return false
+		}
+	}
+	if len(q.Location) > 0 && q.Location != p.Location {
+		return false
+	}
+	if (q.HasBox || q.HasRadius) && !p.PositionValid {
+		return false
+	}
+	if q.HasBox {
+		if p.MaxLat < q.MinLat || p.MinLat > q.MaxLat || p.MaxLng < q.MinLng || p.MinLng > q.MaxLng {
+			return false
+		}
+	}
+	if q.HasRadius {
+		// Inside the product's extent, or any point of it within the radius.
+		inside := q.Lat >= p.MinLat && q.Lat <= p.MaxLat && q.Lng >= p.MinLng && q.Lng <= p.MaxLng
+		if !inside {
+			dist, _ := distance(q.Lat, q.Lng, p.Lat, p.Lng)
+			inside = dist/1852.0 <= q.Radius
+		}
+		for _, o := range p.Overlays {
+			for _, pt := range o.Points {
+				if inside {
+					break
+				}
+				dist, _ := distance(q.Lat, q.Lng, pt.Lat, pt.Lon)
+				inside = dist/1852.0 <= q.Radius
+			}
+		}
+		if !inside {
+			return false
+		}
+	}
+	return true
+}
+
+// Current products matching 'q'.
+func weatherQuery(q WeatherQuery) []WeatherProduct {
+	weatherProductsMutex.Lock()
+	defer weatherProductsMutex.Unlock()
+	weatherStoreExpire(time.Now().UTC())
+
+	ret := make([]WeatherProduct, 0)
+	for _, p := range weatherProducts {
+		if p.matches(q) {
+			ret = append(ret, *p)
+		}
+	}
+	return ret
+}
+
+func weatherStoreInit() {
+	weatherProducts = make(map[string]*WeatherProduct)
+	weatherProductsMutex = &sync.Mutex{}
+	stationLocations = make(map[string]stationLocation)
+	stationLocationsMutex = &sync.Mutex{}
+}
@@ -0,0 +1,86 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	ak09916.go: Asahi Kasei AK09916 magnetometer, as found in the ICM-20948. It is on the bus once the IMU's
+	 auxiliary I2C bypass is on.
+
+	 https://invensense.tdk.com/wp-content/uploads/2016/06/DS-000189-ICM-20948-v1.3.pdf (magnetometer registers)
+*/
+
+package sensors
+
+import (
+	"errors"
+	"github.com/kidoman/embd"
+	"time"
+)
+
+const (
+	ak09916WIA2Reg  = 0x01
+	ak09916ST1Reg   = 0x10
+	ak09916HXLReg   = 0x11 // X, Y, Z, 16 bits each, little endian. Then a dummy register and ST2.
+	ak09916CNTL2Reg = 0x31
+	ak09916CNTL3Reg = 0x32
+
+	ak09916Scale = 0.15 // µT per LSB.
+)
+
+type ak09916 struct {
+	bus  embd.I2CBus
+	addr byte
+	last [3]float64
+}
+
+func init() {
+	Register(&Driver{
+		Name:      "AK09916",
+		Addresses: []byte{0x0C},
+		Probe: func(bus embd.I2CBus, addr byte) bool {
+			return probeID(bus, addr, ak8963WIAReg, akWIA) && probeID(bus, addr, ak09916WIA2Reg, ak09916WIA2)
+		},
+		NewMagnetometer: newAK09916,
+	})
+}
+
+func newAK09916(bus embd.I2CBus, addr byte) (Magnetometer, error) {
+	// Soft reset, then continuous measurements at 100 Hz.
+	if err := bus.WriteByteToReg(addr, ak09916CNTL3Reg, 0x01); err != nil {
+		return nil, err
+	}
+	time.Sleep(10 * time.Millisecond)
+	if err := bus.WriteByteToReg(addr, ak09916CNTL2Reg, 0x08); err != nil {
+		return nil, err
+	}
+	return &ak09916{bus: bus, addr: addr}, nil
+}
+
+// Returns the last reading if there isn't a new one.
+func (d *ak09916) ReadMag() (mag [3]float64, err error) {
+	st1, err := d.bus.ReadByteFromReg(d.addr, ak09916ST1Reg)
+	if err != nil {
+		return
+	}
+	if st1&0x01 == 0 {
+		return d.last, nil
+	}
+	buf := make([]byte, 8) // Reading ST2 ends the measurement.
+	if err = d.bus.ReadFromReg(d.addr, ak09916HXLReg, buf); err != nil {
+		return
+	}
+	if buf[7]&0x08 != 0 {
+		return d.last, errors.New("AK09916: magnetic sensor overflow")
+	}
+	// The AK09916's X is the IMU's, and its Y and Z are the other way: right and down.
+	for i := 0; i < 3; i++ {
+		d.last[i] = int16LE(buf[2*i:]) * ak09916Scale
+	}
+	return d.last, nil
+}
+
+// Power down.
+func (d *ak09916) Close() error {
+	return d.bus.WriteByteToReg(d.addr, ak09916CNTL2Reg, 0x00)
+}
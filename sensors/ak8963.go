@@ -0,0 +1,105 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	ak8963.go: Asahi Kasei AK8963 magnetometer, as found in the MPU-9250 and MPU-9255. It is on the bus once the
+	 IMU's auxiliary I2C bypass is on.
+
+	 https://www.invensense.com/wp-content/uploads/2015/02/RM-MPU-9250A-00-v1.6.pdf (magnetometer registers)
+*/
+
+package sensors
+
+import (
+	"errors"
+	"github.com/kidoman/embd"
+	"time"
+)
+
+const (
+	ak8963WIAReg   = 0x00
+	ak8963INFOReg  = 0x01
+	ak8963ST1Reg   = 0x02
+	ak8963HXLReg   = 0x03 // X, Y, Z, 16 bits each, little endian. Then ST2.
+	ak8963CNTL1Reg = 0x0A
+	ak8963ASAXReg  = 0x10 // Sensitivity adjustment, X, Y, Z. Fuse ROM.
+
+	akWIA       = 0x48 // Company ID. The same for the AK09916.
+	ak09916WIA2 = 0x09
+
+	ak8963Scale = 0.15 // µT per LSB, 16 bit output.
+)
+
+type ak8963 struct {
+	bus  embd.I2CBus
+	addr byte
+	adj  [3]float64 // Sensitivity adjustment.
+	last [3]float64
+}
+
+func init() {
+	Register(&Driver{
+		Name:      "AK8963",
+		Addresses: []byte{0x0C},
+		Probe: func(bus embd.I2CBus, addr byte) bool {
+			// Register 1 is device information on the AK8963, and the device ID on the AK09916.
+			return probeID(bus, addr, ak8963WIAReg, akWIA) && !probeID(bus, addr, ak8963INFOReg, ak09916WIA2)
+		},
+		NewMagnetometer: newAK8963,
+	})
+}
+
+func newAK8963(bus embd.I2CBus, addr byte) (Magnetometer, error) {
+	d := &ak8963{bus: bus, addr: addr}
+	// Power down, read the sensitivity adjustment from the fuse ROM, power down again and start continuous 16 bit
+	// measurements at 100 Hz. The chip needs 100 µs between modes.
+	steps := []byte{0x00, 0x0F, 0x00, 0x16}
+	for i, mode := range steps {
+		if err := bus.WriteByteToReg(addr, ak8963CNTL1Reg, mode); err != nil {
+			return nil, err
+		}
+		time.Sleep(10 * time.Millisecond)
+		if i == 1 {
+			asa := make([]byte, 3)
+			if err := bus.ReadFromReg(addr, ak8963ASAXReg, asa); err != nil {
+				return nil, err
+			}
+			for j := 0; j < 3; j++ {
+				d.adj[j] = (float64(asa[j])-128)/256 + 1
+			}
+		}
+	}
+	return d, nil
+}
+
+// Returns the last reading if there isn't a new one.
+func (d *ak8963) ReadMag() (mag [3]float64, err error) {
+	st1, err := d.bus.ReadByteFromReg(d.addr, ak8963ST1Reg)
+	if err != nil {
+		return
+	}
+	if st1&0x01 == 0 {
+		return d.last, nil
+	}
+	buf := make([]byte, 7) // Reading ST2 ends the measurement.
+	if err = d.bus.ReadFromReg(d.addr, ak8963HXLReg, buf); err != nil {
+		return
+	}
+	if buf[6]&0x08 != 0 {
+		return d.last, errors.New("AK8963: magnetic sensor overflow")
+	}
+	var h [3]float64
+	for i := 0; i < 3; i++ {
+		h[i] = int16LE(buf[2*i:]) * d.adj[i] * ak8963Scale
+	}
+	// The AK8963's X and Y are the IMU's Y and X, and its Z is down.
+	d.last = [3]float64{h[1], -h[0], h[2]}
+	return d.last, nil
+}
+
+// Power down.
+func (d *ak8963) Close() error {
+	return d.bus.WriteByteToReg(d.addr, ak8963CNTL1Reg, 0x00)
+}
@@ -0,0 +1,53 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	bmp180.go: Bosch BMP180 (and BMP085) temperature and pressure sensor, using the embd driver. Reads are slow:
+	 the driver waits for each conversion.
+*/
+
+package sensors
+
+import (
+	"github.com/kidoman/embd"
+	"github.com/kidoman/embd/sensor/bmp180"
+)
+
+const (
+	bmpIDReg = 0xD0 // Chip ID. The same on the BMP280 and BME280.
+
+	bmp180ID = 0x55
+)
+
+type bmp180Barometer struct {
+	dev *bmp180.BMP180
+}
+
+func init() {
+	Register(&Driver{
+		Name:      "BMP180",
+		Addresses: []byte{0x77}, // Fixed, and assumed by the embd driver.
+		Probe: func(bus embd.I2CBus, addr byte) bool {
+			return probeID(bus, addr, bmpIDReg, bmp180ID)
+		},
+		NewBarometer: func(bus embd.I2CBus, addr byte) (Barometer, error) {
+			return &bmp180Barometer{dev: bmp180.New(bus)}, nil
+		},
+	})
+}
+
+func (d *bmp180Barometer) ReadPressure() (temp, pressure float64, err error) {
+	if temp, err = d.dev.Temperature(); err != nil {
+		return
+	}
+	p, err := d.dev.Pressure() // Pa.
+	pressure = float64(p) / 100
+	return
+}
+
+func (d *bmp180Barometer) Close() error {
+	d.dev.Close()
+	return nil
+}
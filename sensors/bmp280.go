@@ -0,0 +1,145 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	bmp280.go: Bosch BMP280 and BME280 temperature and pressure sensors (the BME280's humidity sensor isn't used).
+	 Run in normal mode, measuring continuously, so reads are fast. Compensation is the floating point version from
+	 the datasheet.
+
+	 https://www.bosch-sensortec.com/media/boschsensortec/downloads/datasheets/bst-bmp280-ds001.pdf
+*/
+
+package sensors
+
+import (
+	"errors"
+	"github.com/kidoman/embd"
+	"time"
+)
+
+const (
+	bmp280CalibReg    = 0x88 // 24 bytes: T1-T3, P1-P9, 16 bits each, little endian.
+	bmp280ResetReg    = 0xE0
+	bmp280CtrlHumReg  = 0xF2 // BME280 only.
+	bmp280CtrlMeasReg = 0xF4
+	bmp280ConfigReg   = 0xF5
+	bmp280PressMSBReg = 0xF7 // Pressure, then temperature. 20 bits each, in three bytes.
+
+	bmp280ID = 0x58
+	bme280ID = 0x60
+
+	bmp280Skipped = 0x80000 // Output of a measurement that is off, or hasn't been made yet.
+)
+
+type bmp280 struct {
+	bus  embd.I2CBus
+	addr byte
+
+	t1             float64
+	t2, t3         float64
+	p1             float64
+	p2, p3, p4, p5 float64
+	p6, p7, p8, p9 float64
+}
+
+func init() {
+	Register(&Driver{
+		Name:      "BMP280",
+		Addresses: []byte{0x76, 0x77},
+		Probe: func(bus embd.I2CBus, addr byte) bool {
+			return probeID(bus, addr, bmpIDReg, bmp280ID)
+		},
+		NewBarometer: func(bus embd.I2CBus, addr byte) (Barometer, error) {
+			return newBMP280(bus, addr, false)
+		},
+	})
+	Register(&Driver{
+		Name:      "BME280",
+		Addresses: []byte{0x76, 0x77},
+		Probe: func(bus embd.I2CBus, addr byte) bool {
+			return probeID(bus, addr, bmpIDReg, bme280ID)
+		},
+		NewBarometer: func(bus embd.I2CBus, addr byte) (Barometer, error) {
+			return newBMP280(bus, addr, true)
+		},
+	})
+}
+
+func newBMP280(bus embd.I2CBus, addr byte, bme280 bool) (Barometer, error) {
+	if err := bus.WriteByteToReg(addr, bmp280ResetReg, 0xB6); err != nil {
+		return nil, err
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	cal := make([]byte, 24)
+	if err := bus.ReadFromReg(addr, bmp280CalibReg, cal); err != nil {
+		return nil, err
+	}
+	u16 := func(i int) float64 { return float64(uint16(cal[i+1])<<8 | uint16(cal[i])) }
+	d := &bmp280{bus: bus, addr: addr,
+		t1: u16(0), t2: int16LE(cal[2:]), t3: int16LE(cal[4:]),
+		p1: u16(6), p2: int16LE(cal[8:]), p3: int16LE(cal[10:]), p4: int16LE(cal[12:]), p5: int16LE(cal[14:]),
+		p6: int16LE(cal[16:]), p7: int16LE(cal[18:]), p8: int16LE(cal[20:]), p9: int16LE(cal[22:]),
+	}
+
+	if bme280 {
+		// Humidity off. Only takes effect with the write to ctrl_meas.
+		if err := bus.WriteByteToReg(addr, bmp280CtrlHumReg, 0x00); err != nil {
+			return nil, err
+		}
+	}
+	err := writeRegs(bus, addr,
+		bmp280ConfigReg, 0x08, // 0.5 ms standby, IIR filter coefficient 4.
+		bmp280CtrlMeasReg, 0x57, // Temperature x2 and pressure x16 oversampling, normal mode.
+	)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *bmp280) ReadPressure() (temp, pressure float64, err error) {
+	buf := make([]byte, 6)
+	if err = d.bus.ReadFromReg(d.addr, bmp280PressMSBReg, buf); err != nil {
+		return
+	}
+	adcP := int32(buf[0])<<12 | int32(buf[1])<<4 | int32(buf[2])>>4
+	adcT := int32(buf[3])<<12 | int32(buf[4])<<4 | int32(buf[5])>>4
+	if adcP == bmp280Skipped || adcT == bmp280Skipped {
+		err = errors.New("BMP280: no measurement")
+		return
+	}
+
+	// Temperature.
+	v1 := (float64(adcT)/16384 - d.t1/1024) * d.t2
+	v2 := float64(adcT)/131072 - d.t1/8192
+	v2 = v2 * v2 * d.t3
+	tFine := v1 + v2
+	temp = tFine / 5120
+
+	// Pressure.
+	v1 = tFine/2 - 64000
+	v2 = v1 * v1 * d.p6 / 32768
+	v2 = v2 + v1*d.p5*2
+	v2 = v2/4 + d.p4*65536
+	v1 = (d.p3*v1*v1/524288 + d.p2*v1) / 524288
+	v1 = (1 + v1/32768) * d.p1
+	if v1 == 0 {
+		err = errors.New("BMP280: invalid calibration")
+		return
+	}
+	p := 1048576 - float64(adcP)
+	p = (p - v2/4096) * 6250 / v1
+	v1 = d.p9 * p * p / 2147483648
+	v2 = p * d.p8 / 32768
+	p = p + (v1+v2+d.p7)/16 // Pa.
+	pressure = p / 100
+	return
+}
+
+// Sleep mode.
+func (d *bmp280) Close() error {
+	return d.bus.WriteByteToReg(d.addr, bmp280CtrlMeasReg, 0x54)
+}
@@ -0,0 +1,106 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	icm20948.go: TDK InvenSense ICM-20948 accelerometer and gyro. Registers are in four banks, selected with
+	 REG_BANK_SEL. The AK09916 magnetometer behind it is put on the bus by enabling the auxiliary I2C bypass.
+
+	 https://invensense.tdk.com/wp-content/uploads/2016/06/DS-000189-ICM-20948-v1.3.pdf
+*/
+
+package sensors
+
+import (
+	"github.com/kidoman/embd"
+	"time"
+)
+
+const (
+	icmRegBankSel = 0x7F // Bank in bits 5:4. Present in every bank.
+
+	// Bank 0.
+	icmWhoAmIReg     = 0x00
+	icmUserCtrlReg   = 0x03
+	icmPwrMgmt1Reg   = 0x06
+	icmPwrMgmt2Reg   = 0x07
+	icmIntPinCfgReg  = 0x0F
+	icmAccelXOutHReg = 0x2D // Accel X, Y, Z, then gyro X, Y, Z. 16 bits each, big endian.
+
+	// Bank 2.
+	icmGyroSmplrtDivReg   = 0x00
+	icmGyroConfig1Reg     = 0x01
+	icmAccelSmplrtDiv2Reg = 0x11
+	icmAccelConfigReg     = 0x14
+
+	icmID = 0xEA
+
+	// ±500 deg/s and ±4 g full scale.
+	icmGyroScale  = 65.5   // LSB per deg/s.
+	icmAccelScale = 8192.0 // LSB per g.
+)
+
+type icm20948 struct {
+	bus  embd.I2CBus
+	addr byte
+}
+
+func init() {
+	Register(&Driver{
+		Name:      "ICM-20948",
+		Addresses: []byte{0x68, 0x69},
+		Probe: func(bus embd.I2CBus, addr byte) bool {
+			// Bank 0 is selected at power on, and left selected by newICM20948(). Register 0 of the MPUs at the same
+			// addresses is a trim value, which might happen to match.
+			return probeID(bus, addr, icmWhoAmIReg, icmID) &&
+				!probeID(bus, addr, mpuWhoAmIReg, mpuIDMPU6050, mpuIDMPU6500, mpuIDMPU9250, mpuIDMPU9255)
+		},
+		NewIMU: newICM20948,
+	})
+}
+
+func newICM20948(bus embd.I2CBus, addr byte) (IMU, error) {
+	// Reset, then wake up with the best available clock.
+	if err := writeRegs(bus, addr, icmRegBankSel, 0x00, icmPwrMgmt1Reg, 0x80); err != nil {
+		return nil, err
+	}
+	time.Sleep(100 * time.Millisecond)
+	err := writeRegs(bus, addr,
+		icmRegBankSel, 0x00,
+		icmPwrMgmt1Reg, 0x01,
+		icmPwrMgmt2Reg, 0x00, // Accelerometer and gyro on.
+		icmUserCtrlReg, 0x00, // Auxiliary I2C master off...
+		icmIntPinCfgReg, 0x02, // ...and bypass on, for the AK09916.
+
+		icmRegBankSel, 0x20,
+		icmGyroSmplrtDivReg, 0x0A, // 100 Hz.
+		icmGyroConfig1Reg, 0x1B, // ~51 Hz low pass filter, ±500 deg/s.
+		icmAccelSmplrtDiv2Reg, 0x0A, // 100 Hz.
+		icmAccelConfigReg, 0x1B, // ~50 Hz low pass filter, ±4 g.
+
+		icmRegBankSel, 0x00,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &icm20948{bus: bus, addr: addr}, nil
+}
+
+func (d *icm20948) ReadIMU() (accel, gyro [3]float64, err error) {
+	buf := make([]byte, 12)
+	if err = d.bus.ReadFromReg(d.addr, icmAccelXOutHReg, buf); err != nil {
+		return
+	}
+	sign := [3]float64{1, -1, -1} // Chip to aircraft axes. The chip's are X forward, Y left, Z up.
+	for i := 0; i < 3; i++ {
+		accel[i] = sign[i] * int16BE(buf[2*i:]) / icmAccelScale
+		gyro[i] = sign[i] * int16BE(buf[6+2*i:]) / icmGyroScale
+	}
+	return
+}
+
+// Put the chip to sleep.
+func (d *icm20948) Close() error {
+	return d.bus.WriteByteToReg(d.addr, icmPwrMgmt1Reg, 0x41)
+}
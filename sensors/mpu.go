@@ -0,0 +1,112 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	mpu.go: InvenSense MPU-6050, MPU-6500, MPU-9250 and MPU-9255 accelerometer and gyro. These share a register map.
+	 The MPU-9250/9255 have an AK8963 magnetometer behind them, which is put on the bus by enabling the auxiliary
+	 I2C bypass.
+
+	 https://www.olimex.com/Products/Modules/Sensors/MOD-MPU6050/resources/RM-MPU-60xxA_rev_4.pdf
+	 https://www.invensense.com/wp-content/uploads/2015/02/RM-MPU-9250A-00-v1.6.pdf
+*/
+
+package sensors
+
+import (
+	"github.com/kidoman/embd"
+	"time"
+)
+
+const (
+	mpuSmplrtDivReg    = 0x19
+	mpuConfigReg       = 0x1A
+	mpuGyroConfigReg   = 0x1B
+	mpuAccelConfigReg  = 0x1C
+	mpuAccelConfig2Reg = 0x1D // MPU-6500 family only.
+	mpuIntPinCfgReg    = 0x37
+	mpuAccelXOutHReg   = 0x3B // Accel X, Y, Z, temperature, gyro X, Y, Z. 16 bits each, big endian.
+	mpuUserCtrlReg     = 0x6A
+	mpuPwrMgmt1Reg     = 0x6B
+	mpuWhoAmIReg       = 0x75
+
+	mpuIDMPU6050 = 0x68
+	mpuIDMPU6500 = 0x70
+	mpuIDMPU9250 = 0x71
+	mpuIDMPU9255 = 0x73
+
+	// ±500 deg/s and ±4 g full scale.
+	mpuGyroScale  = 65.5   // LSB per deg/s.
+	mpuAccelScale = 8192.0 // LSB per g.
+)
+
+type mpu struct {
+	bus  embd.I2CBus
+	addr byte
+}
+
+func init() {
+	Register(&Driver{
+		Name:      "MPU-6050",
+		Addresses: []byte{0x68, 0x69},
+		Probe: func(bus embd.I2CBus, addr byte) bool {
+			return probeID(bus, addr, mpuWhoAmIReg, mpuIDMPU6050)
+		},
+		NewIMU: func(bus embd.I2CBus, addr byte) (IMU, error) {
+			return newMPU(bus, addr, false)
+		},
+	})
+	Register(&Driver{
+		Name:      "MPU-9250",
+		Addresses: []byte{0x68, 0x69},
+		Probe: func(bus embd.I2CBus, addr byte) bool {
+			return probeID(bus, addr, mpuWhoAmIReg, mpuIDMPU6500, mpuIDMPU9250, mpuIDMPU9255)
+		},
+		NewIMU: func(bus embd.I2CBus, addr byte) (IMU, error) {
+			return newMPU(bus, addr, true)
+		},
+	})
+}
+
+func newMPU(bus embd.I2CBus, addr byte, mpu6500 bool) (IMU, error) {
+	// Reset, then wake up with the gyro PLL as the clock.
+	if err := bus.WriteByteToReg(addr, mpuPwrMgmt1Reg, 0x80); err != nil {
+		return nil, err
+	}
+	time.Sleep(100 * time.Millisecond)
+	err := writeRegs(bus, addr,
+		mpuPwrMgmt1Reg, 0x01,
+		mpuConfigReg, 0x03, // ~42 Hz low pass filter.
+		mpuSmplrtDivReg, 0x09, // 100 Hz.
+		mpuGyroConfigReg, 0x08, // ±500 deg/s.
+		mpuAccelConfigReg, 0x08, // ±4 g.
+		mpuUserCtrlReg, 0x00, // Auxiliary I2C master off...
+		mpuIntPinCfgReg, 0x02, // ...and bypass on, so a magnetometer behind the IMU can be reached.
+	)
+	if err == nil && mpu6500 {
+		err = bus.WriteByteToReg(addr, mpuAccelConfig2Reg, 0x03) // ~41 Hz accelerometer low pass filter.
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &mpu{bus: bus, addr: addr}, nil
+}
+
+func (d *mpu) ReadIMU() (accel, gyro [3]float64, err error) {
+	buf := make([]byte, 14)
+	if err = d.bus.ReadFromReg(d.addr, mpuAccelXOutHReg, buf); err != nil {
+		return
+	}
+	sign := [3]float64{1, -1, -1} // Chip to aircraft axes. The chip's are X forward, Y left, Z up.
+	for i := 0; i < 3; i++ {
+		accel[i] = sign[i] * int16BE(buf[2*i:]) / mpuAccelScale
+		gyro[i] = sign[i] * int16BE(buf[8+2*i:]) / mpuGyroScale
+	}
+	return
+}
+
+// Put the chip to sleep.
+func (d *mpu) Close() error {
+	return d.bus.WriteByteToReg(d.addr, mpuPwrMgmt1Reg, 0x40)
+}
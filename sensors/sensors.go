@@ -0,0 +1,168 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	sensors.go: Barometer, IMU and magnetometer interfaces, and a registry of I2C drivers for them. Each driver
+	 registers itself from an init() function with Register(), giving the bus addresses the chip can have and a
+	 function to recognise it (usually by its ID register). Detect*() try the registered drivers in turn.
+
+	 All outputs are in aircraft axes - X forward, Y right, Z down - for a board mounted face up with the chip's X axis
+	 forward.
+*/
+
+package sensors
+
+import (
+	"errors"
+	"fmt"
+	"github.com/kidoman/embd"
+	"math"
+	"sync"
+)
+
+// Barometer is a temperature and static pressure sensor.
+type Barometer interface {
+	ReadPressure() (temp, pressure float64, err error) // ºC, hPa.
+	Close() error
+}
+
+// IMU is an accelerometer and gyro.
+type IMU interface {
+	ReadIMU() (accel, gyro [3]float64, err error) // g, deg/s. Uncorrected.
+	Close() error
+}
+
+// Magnetometer is a three axis magnetic field sensor.
+type Magnetometer interface {
+	ReadMag() (mag [3]float64, err error) // µT. Uncorrected.
+	Close() error
+}
+
+// Driver is a chip that Detect*() can find. One of NewBarometer, NewIMU and NewMagnetometer is set.
+type Driver struct {
+	Name      string
+	Addresses []byte                                // Addresses to probe.
+	Probe     func(bus embd.I2CBus, addr byte) bool // Is this chip at 'addr'?
+
+	NewBarometer    func(bus embd.I2CBus, addr byte) (Barometer, error)
+	NewIMU          func(bus embd.I2CBus, addr byte) (IMU, error)
+	NewMagnetometer func(bus embd.I2CBus, addr byte) (Magnetometer, error)
+}
+
+var drivers []*Driver
+var driversMutex = &sync.Mutex{}
+
+// Register adds a driver. Call from the driver's init() function.
+func Register(d *Driver) {
+	driversMutex.Lock()
+	defer driversMutex.Unlock()
+	drivers = append(drivers, d)
+}
+
+// Drivers returns the registered drivers.
+func Drivers() []*Driver {
+	driversMutex.Lock()
+	defer driversMutex.Unlock()
+	ret := make([]*Driver, len(drivers))
+	copy(ret, drivers)
+	return ret
+}
+
+// Try each driver that 'use' accepts, at each of its addresses, until 'open' succeeds.
+func detect(bus embd.I2CBus, kind string, use func(d *Driver) bool, open func(d *Driver, addr byte) error) (*Driver, error) {
+	if bus == nil {
+		return nil, errors.New("no I2C bus")
+	}
+	var lastErr error
+	for _, d := range Drivers() {
+		if !use(d) {
+			continue
+		}
+		for _, addr := range d.Addresses {
+			if !d.Probe(bus, addr) {
+				continue
+			}
+			err := open(d, addr)
+			if err == nil {
+				return d, nil
+			}
+			lastErr = fmt.Errorf("%s at 0x%02X: %s", d.Name, addr, err.Error())
+		}
+	}
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	return nil, fmt.Errorf("no %s found", kind)
+}
+
+// DetectBarometer returns the first registered barometer found on the bus.
+func DetectBarometer(bus embd.I2CBus) (Barometer, *Driver, error) {
+	var ret Barometer
+	d, err := detect(bus, "barometer", func(d *Driver) bool { return d.NewBarometer != nil }, func(d *Driver, addr byte) (err error) {
+		ret, err = d.NewBarometer(bus, addr)
+		return
+	})
+	return ret, d, err
+}
+
+// DetectIMU returns the first registered IMU found on the bus. IMUs with a magnetometer behind them make it visible
+// on the bus, so call this before DetectMagnetometer().
+func DetectIMU(bus embd.I2CBus) (IMU, *Driver, error) {
+	var ret IMU
+	d, err := detect(bus, "IMU", func(d *Driver) bool { return d.NewIMU != nil }, func(d *Driver, addr byte) (err error) {
+		ret, err = d.NewIMU(bus, addr)
+		return
+	})
+	return ret, d, err
+}
+
+// DetectMagnetometer returns the first registered magnetometer found on the bus.
+func DetectMagnetometer(bus embd.I2CBus) (Magnetometer, *Driver, error) {
+	var ret Magnetometer
+	d, err := detect(bus, "magnetometer", func(d *Driver) bool { return d.NewMagnetometer != nil }, func(d *Driver, addr byte) (err error) {
+		ret, err = d.NewMagnetometer(bus, addr)
+		return
+	})
+	return ret, d, err
+}
+
+// PressureAltitude is the altitude (ft) of pressure 'p' (hPa) in the standard atmosphere.
+func PressureAltitude(p float64) float64 {
+	return 145366.45 * (1 - math.Pow(p/1013.25, 0.190284))
+}
+
+// Is the register 'reg' of the chip at 'addr' one of 'ids'?
+func probeID(bus embd.I2CBus, addr, reg byte, ids ...byte) bool {
+	v, err := bus.ReadByteFromReg(addr, reg)
+	if err != nil {
+		return false
+	}
+	for _, id := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Write a list of register, value pairs.
+func writeRegs(bus embd.I2CBus, addr byte, regs ...byte) error {
+	for i := 0; i+1 < len(regs); i += 2 {
+		if err := bus.WriteByteToReg(addr, regs[i], regs[i+1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Signed 16 bit values, big endian.
+func int16BE(b []byte) float64 {
+	return float64(int16(uint16(b[0])<<8 | uint16(b[1])))
+}
+
+// Signed 16 bit values, little endian.
+func int16LE(b []byte) float64 {
+	return float64(int16(uint16(b[1])<<8 | uint16(b[0])))
+}
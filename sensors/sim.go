@@ -0,0 +1,137 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	sim.go: Simulated sensors, for running the readers without hardware. They return the values last set, plus
+	 optional noise, or an error if one is set.
+*/
+
+package sensors
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+)
+
+// SimBarometer is a simulated Barometer.
+type SimBarometer struct {
+	mu       sync.Mutex
+	temp     float64 // ºC.
+	altitude float64 // ft, pressure altitude.
+	err      error
+}
+
+// NewSimBarometer returns a barometer reading 'temp' (ºC) at pressure altitude 'altitude' (ft).
+func NewSimBarometer(temp, altitude float64) *SimBarometer {
+	return &SimBarometer{temp: temp, altitude: altitude}
+}
+
+func (s *SimBarometer) Set(temp, altitude float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.temp, s.altitude = temp, altitude
+}
+
+// SetError makes reads fail with 'err', or succeed again if nil.
+func (s *SimBarometer) SetError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+func (s *SimBarometer) ReadPressure() (temp, pressure float64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Inverse of PressureAltitude().
+	return s.temp, 1013.25 * math.Pow(1-s.altitude/145366.45, 1/0.190284), s.err
+}
+
+func (s *SimBarometer) Close() error {
+	return nil
+}
+
+// SimIMU is a simulated IMU.
+type SimIMU struct {
+	mu    sync.Mutex
+	accel [3]float64 // g.
+	gyro  [3]float64 // deg/s.
+	noise float64    // Standard deviation, g and deg/s.
+	rnd   *rand.Rand
+	err   error
+}
+
+// NewSimIMU returns an IMU at rest and level, with readings that have Gaussian noise of standard deviation 'noise'
+// (g and deg/s). The noise is the same from run to run for the same 'seed'.
+func NewSimIMU(noise float64, seed int64) *SimIMU {
+	return &SimIMU{accel: [3]float64{0, 0, -1}, noise: noise, rnd: rand.New(rand.NewSource(seed))}
+}
+
+func (s *SimIMU) Set(accel, gyro [3]float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.accel, s.gyro = accel, gyro
+}
+
+// SetError makes reads fail with 'err', or succeed again if nil.
+func (s *SimIMU) SetError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+func (s *SimIMU) ReadIMU() (accel, gyro [3]float64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return accel, gyro, s.err
+	}
+	for i := 0; i < 3; i++ {
+		accel[i] = s.accel[i] + s.rnd.NormFloat64()*s.noise
+		gyro[i] = s.gyro[i] + s.rnd.NormFloat64()*s.noise
+	}
+	return
+}
+
+func (s *SimIMU) Close() error {
+	return nil
+}
+
+// SimMagnetometer is a simulated Magnetometer.
+type SimMagnetometer struct {
+	mu  sync.Mutex
+	mag [3]float64 // µT.
+	err error
+}
+
+// NewSimMagnetometer returns a magnetometer level and pointing at magnetic heading 'heading' (deg), in a field of
+// 20 µT horizontal and 45 µT down.
+func NewSimMagnetometer(heading float64) *SimMagnetometer {
+	h := heading * math.Pi / 180
+	return &SimMagnetometer{mag: [3]float64{20 * math.Cos(h), -20 * math.Sin(h), 45}}
+}
+
+func (s *SimMagnetometer) Set(mag [3]float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mag = mag
+}
+
+// SetError makes reads fail with 'err', or succeed again if nil.
+func (s *SimMagnetometer) SetError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+func (s *SimMagnetometer) ReadMag() (mag [3]float64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.mag, s.err
+}
+
+func (s *SimMagnetometer) Close() error {
+	return nil
+}
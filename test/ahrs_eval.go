@@ -0,0 +1,512 @@
+/*
+	ahrs_eval.go: Offline replay and scoring of the attitude estimator (package ahrs, the one stratux runs).
+
+	Input is the "ahrs" table of a flight log, recorded at debug flight log level - one row per estimator update,
+	with the sensor readings (in aircraft axes, as given by sensors.IMU.ReadIMU()), the GPS data and the attitude
+	stratux reported:
+
+		sqlite3 -header -csv /var/log/stratux.sqlite "SELECT * FROM ahrs" > flight.csv
+		ahrs_eval -out attitude.csv flight.csv
+
+	The samples are run through a new estimator and its attitude compared with a reference: by default the attitude
+	recorded in the log (where it was valid), or a CSV with Time, Roll, Pitch and Heading columns given with -ref,
+	matched to the nearest sample. -synth generates a deterministic simulated flight with a known attitude instead
+	of reading a log.
+
+	Prints error statistics, and writes the attitude time series with -out. Exits with status 1 if an error limit
+	(-max-attitude-rms, -max-heading-rms) is exceeded, or there are no valid samples to check it against, so filter
+	changes can be checked against recorded flights.
+*/
+
+package main
+
+import (
+	"../ahrs"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type reference struct {
+	Time          float64
+	Roll, Pitch   float64
+	Heading       float64
+	AttitudeValid bool
+	HeadingValid  bool
+}
+
+type errorStats struct {
+	n       int
+	sum, sq float64
+	maxAbs  float64
+}
+
+func (s *errorStats) add(e float64) {
+	s.n++
+	s.sum += e
+	s.sq += e * e
+	if math.Abs(e) > s.maxAbs {
+		s.maxAbs = math.Abs(e)
+	}
+}
+
+func (s *errorStats) rms() float64 {
+	if s.n == 0 {
+		return 0
+	}
+	return math.Sqrt(s.sq / float64(s.n))
+}
+
+func (s *errorStats) String() string {
+	if s.n == 0 {
+		return "no samples"
+	}
+	return fmt.Sprintf("n=%d mean=%.2f rms=%.2f max=%.2f", s.n, s.sum/float64(s.n), s.rms(), s.maxAbs)
+}
+
+// Angle difference, -180 to 180 degrees.
+func relAngle(a float64) float64 {
+	a = math.Mod(a, 360)
+	if a > 180 {
+		a -= 360
+	} else if a < -180 {
+		a += 360
+	}
+	return a
+}
+
+// CSV with a header row. Returns the rows as maps of column name to value.
+func readCSV(fn string) ([]map[string]string, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", fn, err.Error())
+	}
+	var rows []map[string]string
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", fn, err.Error())
+		}
+		row := make(map[string]string)
+		for i, v := range rec {
+			if i < len(header) {
+				row[strings.TrimSpace(header[i])] = strings.TrimSpace(v)
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func getFloat(row map[string]string, key string) (float64, error) {
+	v, ok := row[key]
+	if !ok || v == "" {
+		return 0, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %s", key, err.Error())
+	}
+	return f, nil
+}
+
+// SQLite logs bools as 0/1.
+func getBool(row map[string]string, key string) (bool, error) {
+	switch strings.ToLower(row[key]) {
+	case "", "0", "false":
+		return false, nil
+	case "1", "true":
+		return true, nil
+	}
+	return false, fmt.Errorf("%s: invalid bool '%s'", key, row[key])
+}
+
+// Samples from a CSV with a column per Sample field, by name. Missing columns are left zero.
+func readSamples(fn string) ([]ahrs.Sample, error) {
+	rows, err := readCSV(fn)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) > 0 {
+		if _, ok := rows[0]["Time"]; !ok {
+			return nil, fmt.Errorf("%s: no Time column", fn)
+		}
+	}
+	samples := make([]ahrs.Sample, 0, len(rows))
+	for i, row := range rows {
+		var s ahrs.Sample
+		floats := map[string]*float64{
+			"Time": &s.Time, "GyroX": &s.GyroX, "GyroY": &s.GyroY, "GyroZ": &s.GyroZ,
+			"AccelX": &s.AccelX, "AccelY": &s.AccelY, "AccelZ": &s.AccelZ, "MagX": &s.MagX, "MagY": &s.MagY, "MagZ": &s.MagZ,
+			"GroundSpeed": &s.GroundSpeed, "TrueCourse": &s.TrueCourse, "VertSpeed": &s.VertSpeed,
+			"Roll": &s.Roll, "Pitch": &s.Pitch, "Heading": &s.Heading,
+		}
+		bools := map[string]*bool{"MagValid": &s.MagValid, "GPSValid": &s.GPSValid, "Valid": &s.Valid, "HeadingValid": &s.HeadingValid}
+		for k, p := range floats {
+			if *p, err = getFloat(row, k); err != nil {
+				return nil, fmt.Errorf("%s: row %d: %s", fn, i+2, err.Error())
+			}
+		}
+		for k, p := range bools {
+			if *p, err = getBool(row, k); err != nil {
+				return nil, fmt.Errorf("%s: row %d: %s", fn, i+2, err.Error())
+			}
+		}
+		samples = append(samples, s)
+	}
+	return samples, nil
+}
+
+// Reference attitude. Rows without a Valid/HeadingValid column are taken as valid.
+func readReference(fn string) ([]reference, error) {
+	rows, err := readCSV(fn)
+	if err != nil {
+		return nil, err
+	}
+	refs := make([]reference, 0, len(rows))
+	for i, row := range rows {
+		r := reference{AttitudeValid: true, HeadingValid: true}
+		var errs [6]error
+		r.Time, errs[0] = getFloat(row, "Time")
+		r.Roll, errs[1] = getFloat(row, "Roll")
+		r.Pitch, errs[2] = getFloat(row, "Pitch")
+		r.Heading, errs[3] = getFloat(row, "Heading")
+		if _, ok := row["Valid"]; ok {
+			r.AttitudeValid, errs[4] = getBool(row, "Valid")
+		}
+		if _, ok := row["HeadingValid"]; ok {
+			r.HeadingValid, errs[5] = getBool(row, "HeadingValid")
+		}
+		if _, ok := row["Heading"]; !ok {
+			r.HeadingValid = false
+		}
+		for _, err := range errs {
+			if err != nil {
+				return nil, fmt.Errorf("%s: row %d: %s", fn, i+2, err.Error())
+			}
+		}
+		refs = append(refs, r)
+	}
+	return refs, nil
+}
+
+// The attitude recorded with the samples.
+func recordedReference(samples []ahrs.Sample) []reference {
+	refs := make([]reference, len(samples))
+	for i, s := range samples {
+		refs[i] = reference{Time: s.Time, Roll: s.Roll, Pitch: s.Pitch, Heading: s.Heading, AttitudeValid: s.Valid, HeadingValid: s.HeadingValid}
+	}
+	return refs
+}
+
+/*
+	Simulated flight: stationary for 10 s, a takeoff run to 70 kt heading east, a climb, then alternating 30 degree
+	coordinated turns. The sensors have a constant gyro bias and noise, GPS updates at 5 Hz, and an optional wind
+	from the north makes the GPS track differ from the heading once airborne.
+*/
+
+// Cosine ramp from 'a' at 't0' to 'b' at 't1'.
+func ramp(t, t0, t1, a, b float64) float64 {
+	if t <= t0 {
+		return a
+	}
+	if t >= t1 {
+		return b
+	}
+	return a + (b-a)*(1-math.Cos(math.Pi*(t-t0)/(t1-t0)))/2
+}
+
+func synthRoll(t float64) float64 {
+	if t < 100 {
+		return 0
+	}
+	c := math.Mod(t-100, 60)
+	if c < 30 {
+		return ramp(c, 10, 13, 0, 30) - ramp(c, 27, 30, 0, 30)
+	}
+	return ramp(c, 40, 43, 0, -30) - ramp(c, 57, 60, 0, -30)
+}
+
+func synthPitch(t float64) float64 {
+	return ramp(t, 30, 33, 0, 7) - ramp(t, 90, 93, 0, 7)
+}
+
+func synthSpeed(t float64) float64 { // kt.
+	return ramp(t, 10, 30, 0, 70)
+}
+
+type synthState struct {
+	roll, pitch, yaw float64    // rad.
+	vel              [3]float64 // m/s, north, east, down. Air mass.
+}
+
+// Body to earth rotation.
+func rotation(roll, pitch, yaw float64) [3][3]float64 {
+	cr, sr := math.Cos(roll), math.Sin(roll)
+	cp, sp := math.Cos(pitch), math.Sin(pitch)
+	cy, sy := math.Cos(yaw), math.Sin(yaw)
+	return [3][3]float64{
+		{cp * cy, sr*sp*cy - cr*sy, cr*sp*cy + sr*sy},
+		{cp * sy, sr*sp*sy + cr*cy, cr*sp*sy - sr*cy},
+		{-sp, sr * cp, cr * cp},
+	}
+}
+
+func synthSamples(seconds float64, windKt float64) []ahrs.Sample {
+	const dt = 1.0 / ahrs.UPDATE_RATE
+	const g = 9.80665
+	rnd := rand.New(rand.NewSource(1))
+	bias := [3]float64{0.8, -0.5, 0.3} // deg/s.
+
+	state := func(t, yaw float64) synthState {
+		s := synthState{roll: synthRoll(t) * math.Pi / 180, pitch: synthPitch(t) * math.Pi / 180, yaw: yaw}
+		v := synthSpeed(t) * 0.514444
+		s.vel = [3]float64{v * math.Cos(s.pitch) * math.Cos(yaw), v * math.Cos(s.pitch) * math.Sin(yaw), -v * math.Sin(s.pitch)}
+		return s
+	}
+
+	var samples []ahrs.Sample
+	yaw := math.Pi / 2
+	cur := state(0, yaw)
+	var gps ahrs.Sample
+	for i := 0; float64(i)*dt < seconds; i++ {
+		t := float64(i) * dt
+		// Coordinated turn: yaw rate g.tan(roll)/V.
+		if v := synthSpeed(t) * 0.514444; v > 1 {
+			yaw += g * math.Tan(cur.roll) / v * dt
+		}
+		next := state(t+dt, yaw)
+
+		// Body rates from the Euler angle rates.
+		dRoll, dPitch, dYaw := (next.roll-cur.roll)/dt, (next.pitch-cur.pitch)/dt, (next.yaw-cur.yaw)/dt
+		p := dRoll - dYaw*math.Sin(cur.pitch)
+		q := dPitch*math.Cos(cur.roll) + dYaw*math.Sin(cur.roll)*math.Cos(cur.pitch)
+		r := -dPitch*math.Sin(cur.roll) + dYaw*math.Cos(cur.roll)*math.Cos(cur.pitch)
+
+		// Specific force: acceleration less gravity, in body axes.
+		var f [3]float64
+		for j := 0; j < 3; j++ {
+			f[j] = (next.vel[j] - cur.vel[j]) / dt
+		}
+		f[2] -= g
+		rot := rotation(cur.roll, cur.pitch, cur.yaw)
+
+		var s ahrs.Sample
+		s.Time = t
+		rates := [3]float64{p, q, r}
+		var accel [3]float64
+		for j := 0; j < 3; j++ {
+			accel[j] = (rot[0][j]*f[0] + rot[1][j]*f[1] + rot[2][j]*f[2]) / g
+			accel[j] += rnd.NormFloat64() * 0.01
+			rates[j] = rates[j]*180/math.Pi + bias[j] + rnd.NormFloat64()*0.1
+		}
+		s.GyroX, s.GyroY, s.GyroZ = rates[0], rates[1], rates[2]
+		s.AccelX, s.AccelY, s.AccelZ = accel[0], accel[1], accel[2]
+
+		if i%(ahrs.UPDATE_RATE/5) == 0 {
+			vn, ve := cur.vel[0]-ramp(t, 30, 35, 0, windKt)*0.514444, cur.vel[1] // Wind once airborne.
+			gps.GPSValid = true
+			gps.GroundSpeed = math.Sqrt(vn*vn+ve*ve) / 0.514444
+			gps.TrueCourse = math.Mod(math.Atan2(ve, vn)*180/math.Pi+360, 360)
+			gps.VertSpeed = -cur.vel[2] / 0.3048
+		}
+		s.GPSValid, s.GroundSpeed, s.TrueCourse, s.VertSpeed = gps.GPSValid, gps.GroundSpeed, gps.TrueCourse, gps.VertSpeed
+
+		s.Roll = cur.roll * 180 / math.Pi
+		s.Pitch = cur.pitch * 180 / math.Pi
+		s.Heading = math.Mod(cur.yaw*180/math.Pi+360, 360)
+		s.Valid, s.HeadingValid = true, true
+		samples = append(samples, s)
+		cur = next
+	}
+	return samples
+}
+
+func b2i(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func firstAt(t float64) string {
+	if t < 0 {
+		return "never"
+	}
+	return fmt.Sprintf("first at %.1f s", t)
+}
+
+func main() {
+	refFile := flag.String("ref", "", "reference attitude CSV (Time, Roll, Pitch, Heading). Default: the attitude recorded with the samples")
+	outFile := flag.String("out", "", "write the attitude time series to this CSV")
+	every := flag.Int("every", 1, "write every n'th update to -out")
+	tolerance := flag.Float64("tolerance", 0.1, "seconds. Largest time difference to a reference row")
+	maxAttRMS := flag.Float64("max-attitude-rms", 0, "deg. Fail if the roll or pitch RMS error is larger (0: no limit)")
+	maxHdgRMS := flag.Float64("max-heading-rms", 0, "deg. Fail if the heading RMS error is larger (0: no limit)")
+	synth := flag.Float64("synth", 0, "seconds. Replay a simulated flight instead of a log")
+	wind := flag.Float64("wind", 0, "kt. Wind from the north in the simulated flight")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [options] <samples.csv>\n       %s [options] -synth <seconds>\n", os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	var samples []ahrs.Sample
+	var err error
+	if *synth > 0 {
+		samples = synthSamples(*synth, *wind)
+	} else if flag.NArg() == 1 {
+		if samples, err = readSamples(flag.Arg(0)); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			os.Exit(2)
+		}
+	} else {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if len(samples) == 0 {
+		fmt.Fprintf(os.Stderr, "no samples.\n")
+		os.Exit(2)
+	}
+	if *every < 1 {
+		*every = 1
+	}
+
+	refs := recordedReference(samples)
+	if *refFile != "" {
+		if refs, err = readReference(*refFile); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			os.Exit(2)
+		}
+	}
+
+	var out *csv.Writer
+	if *outFile != "" {
+		f, err := os.Create(*outFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			os.Exit(2)
+		}
+		defer f.Close()
+		out = csv.NewWriter(f)
+		out.Write([]string{"Time", "Roll", "Pitch", "Heading", "Valid", "HeadingValid", "SlipSkid", "YawRate", "GLoad",
+			"AttitudeUncertainty", "HeadingUncertainty", "HeadingSource", "RefRoll", "RefPitch", "RefHeading"})
+	}
+
+	var rollErr, pitchErr, hdgErr errorStats
+	var nValid, nHdgValid int
+	firstValid, firstHdgValid := -1.0, -1.0
+	e := ahrs.New()
+	last := samples[0].Time - 1.0/ahrs.UPDATE_RATE
+	j := 0 // Reference row nearest the sample.
+	for i, s := range samples {
+		e.Update(s.Input(), s.Time-last)
+		last = s.Time
+		roll, pitch, heading := e.Euler()
+		st := e.Status()
+		t := s.Time - samples[0].Time
+		if st.Valid {
+			nValid++
+			if firstValid < 0 {
+				firstValid = t
+			}
+		}
+		if st.HeadingValid {
+			nHdgValid++
+			if firstHdgValid < 0 {
+				firstHdgValid = t
+			}
+		}
+
+		for j+1 < len(refs) && math.Abs(refs[j+1].Time-s.Time) <= math.Abs(refs[j].Time-s.Time) {
+			j++
+		}
+		var ref *reference
+		if j < len(refs) && math.Abs(refs[j].Time-s.Time) <= *tolerance {
+			ref = &refs[j]
+		}
+		if ref != nil && ref.AttitudeValid && st.Valid {
+			rollErr.add(relAngle(roll - ref.Roll))
+			pitchErr.add(pitch - ref.Pitch)
+		}
+		if ref != nil && ref.HeadingValid && st.HeadingValid {
+			hdgErr.add(relAngle(heading - ref.Heading))
+		}
+
+		if out != nil && i%*every == 0 {
+			row := []string{
+				strconv.FormatFloat(s.Time, 'f', 3, 64),
+				strconv.FormatFloat(roll, 'f', 2, 64),
+				strconv.FormatFloat(pitch, 'f', 2, 64),
+				strconv.FormatFloat(heading, 'f', 2, 64),
+				strconv.Itoa(b2i(st.Valid)),
+				strconv.Itoa(b2i(st.HeadingValid)),
+				strconv.FormatFloat(e.SlipSkid(), 'f', 2, 64),
+				strconv.FormatFloat(e.YawRate(), 'f', 2, 64),
+				strconv.FormatFloat(e.GLoad(), 'f', 3, 64),
+				strconv.FormatFloat(st.AttitudeUncertainty, 'f', 2, 64),
+				strconv.FormatFloat(st.HeadingUncertainty, 'f', 2, 64),
+				st.HeadingSource,
+				"", "", "",
+			}
+			if ref != nil && ref.AttitudeValid {
+				row[12] = strconv.FormatFloat(ref.Roll, 'f', 2, 64)
+				row[13] = strconv.FormatFloat(ref.Pitch, 'f', 2, 64)
+			}
+			if ref != nil && ref.HeadingValid {
+				row[14] = strconv.FormatFloat(ref.Heading, 'f', 2, 64)
+			}
+			out.Write(row)
+		}
+	}
+	if out != nil {
+		out.Flush()
+		if err := out.Error(); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", *outFile, err.Error())
+			os.Exit(2)
+		}
+	}
+
+	st := e.Status()
+	duration := samples[len(samples)-1].Time - samples[0].Time
+	fmt.Printf("samples:  %d (%.1f s)\n", len(samples), duration)
+	fmt.Printf("calibration: %s, gyro bias %.2f %.2f %.2f deg/s\n", st.Calibration, st.GyroBias[0], st.GyroBias[1], st.GyroBias[2])
+	fmt.Printf("attitude valid: %.1f%%, %s\n", 100*float64(nValid)/float64(len(samples)), firstAt(firstValid))
+	fmt.Printf("heading valid:  %.1f%%, %s\n", 100*float64(nHdgValid)/float64(len(samples)), firstAt(firstHdgValid))
+	fmt.Printf("roll error:    %s\n", rollErr.String())
+	fmt.Printf("pitch error:   %s\n", pitchErr.String())
+	fmt.Printf("heading error: %s\n", hdgErr.String())
+
+	failed := false
+	if (*maxAttRMS > 0 && rollErr.n == 0) || (*maxHdgRMS > 0 && hdgErr.n == 0) {
+		fmt.Printf("FAIL: no valid samples to check.\n")
+		failed = true
+	}
+	if *maxAttRMS > 0 && (rollErr.rms() > *maxAttRMS || pitchErr.rms() > *maxAttRMS) {
+		fmt.Printf("FAIL: attitude RMS error over %.2f deg.\n", *maxAttRMS)
+		failed = true
+	}
+	if *maxHdgRMS > 0 && hdgErr.rms() > *maxHdgRMS {
+		fmt.Printf("FAIL: heading RMS error over %.2f deg.\n", *maxHdgRMS)
+		failed = true
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
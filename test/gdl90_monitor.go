@@ -0,0 +1,62 @@
+/*
+	gdl90_monitor.go: Listen for the GDL90 stream from stratux (UDP port 4000 by default) and print every
+	decoded message, with CRC and decode errors.
+
+	Usage: gdl90_monitor [port]
+*/
+
+package main
+
+import (
+	"../gdl90"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+func main() {
+	port := 4000
+	if len(os.Args) > 1 {
+		p, err := strconv.Atoi(os.Args[1])
+		if err != nil {
+			fmt.Printf("invalid port '%s'.\n", os.Args[1])
+			return
+		}
+		port = p
+	}
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+	if err != nil {
+		fmt.Printf("can't listen on port %d: %s\n", port, err.Error())
+		return
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			fmt.Printf("read error: %s\n", err.Error())
+			return
+		}
+		t := time.Now().UTC().Format("15:04:05.000")
+		msgs, errs := gdl90.Parse(buf[:n])
+		for _, m := range msgs {
+			switch v := m.(type) {
+			case *gdl90.Uplink:
+				fmt.Printf("%s Uplink TOR=%d valid=%t\n", t, v.TOR, v.TORValid)
+			case *gdl90.PassThroughReport:
+				fmt.Printf("%s PassThroughReport long=%t TOR=%d\n", t, v.Long, v.TOR)
+			case *gdl90.Unknown:
+				fmt.Printf("%s Unknown ID=%02X % X\n", t, v.ID, v.Data)
+			default:
+				fmt.Printf("%s %T %+v\n", t, m, m)
+			}
+		}
+		for _, err := range errs {
+			fmt.Printf("%s ERROR %s\n", t, err.Error())
+		}
+	}
+}
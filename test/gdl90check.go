@@ -0,0 +1,341 @@
+/*
+	gdl90check.go: Conformance check of the gdl90 package against the examples in the GDL90 ICD
+	(notes/GDL90_Public_ICD_RevA.PDF) and the stratux extension messages.
+
+	With a capture file as an argument (raw GDL90 stream, e.g. from "nc -ul 4000 > capture"), also decodes
+	every message in the capture and prints the ones that fail.
+*/
+
+package main
+
+import (
+	"../gdl90"
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+var failures int
+
+func check(ok bool, format string, args ...interface{}) {
+	if !ok {
+		failures++
+		fmt.Printf("FAIL: "+format+"\n", args...)
+	}
+}
+
+func near(a, b, tol float64) bool {
+	return math.Abs(a-b) <= tol
+}
+
+// Unframe and decode one framed message, and check that re-framing gives the same bytes.
+func roundTrip(name string, frame []byte) interface{} {
+	msg, err := gdl90.Unframe(frame)
+	if err != nil {
+		check(false, "%s: %s", name, err.Error())
+		return nil
+	}
+	check(bytes.Equal(gdl90.Frame(msg), frame), "%s: re-framed as % X", name, gdl90.Frame(msg))
+	m, err := gdl90.Decode(msg)
+	if err != nil {
+		check(false, "%s: %s", name, err.Error())
+		return nil
+	}
+	return m
+}
+
+// p.7, p.12.
+func checkHeartbeat() {
+	m := roundTrip("heartbeat", []byte{0x7E, 0x00, 0x81, 0x41, 0xDB, 0xD0, 0x08, 0x02, 0xB3, 0x8B, 0x7E})
+	h, ok := m.(*gdl90.Heartbeat)
+	if !ok {
+		check(false, "heartbeat: decoded as %T", m)
+		return
+	}
+	check(h.GPSPositionValid && h.UATInitialized && !h.MaintRequired && !h.IDENT, "heartbeat: status 1 %+v", h)
+	check(h.CSARequested && h.UTCOK && !h.CSANotAvailable, "heartbeat: status 2 %+v", h)
+	check(h.Timestamp == 0xD0DB, "heartbeat: timestamp %d", h.Timestamp)
+	check(h.UplinkMessages == 1 && h.BasicLongMessages == 2, "heartbeat: counts %d/%d", h.UplinkMessages, h.BasicLongMessages)
+
+	// Message count example, and timestamp bit 16: 23:59:59Z.
+	m, _ = gdl90.Decode([]byte{0x00, 0x01, 0x81, 0x7F, 0x51, 0x22, 0x37})
+	h = m.(*gdl90.Heartbeat)
+	check(h.UplinkMessages == 4 && h.BasicLongMessages == 567, "heartbeat: counts %d/%d", h.UplinkMessages, h.BasicLongMessages)
+	check(h.Timestamp == 86399, "heartbeat: timestamp %d", h.Timestamp)
+}
+
+// p.25.
+func checkTraffic() {
+	report := []byte{0x14, 0x00, 0xAB, 0x45, 0x49, 0x1F, 0xEF, 0x15, 0xA8, 0x89, 0x78, 0x0F, 0x09, 0xA9, 0x07, 0xB0,
+		0x01, 0x20, 0x01, 0x4E, 0x38, 0x32, 0x35, 0x56, 0x20, 0x20, 0x20, 0x00}
+	m := roundTrip("traffic", gdl90.Frame(report))
+	t, ok := m.(*gdl90.TrafficReport)
+	if !ok {
+		check(false, "traffic: decoded as %T", m)
+		return
+	}
+	check(t.AlertStatus == 0 && t.AddressType == 0 && t.Address == 052642511, "traffic: address %d/%o", t.AddressType, t.Address)
+	check(near(t.Lat, 44.90708, 0.00002) && near(t.Lng, -122.99488, 0.00002) && t.PositionValid, "traffic: position %f,%f", t.Lat, t.Lng)
+	check(t.AltitudeValid && t.Altitude == 5000, "traffic: altitude %d", t.Altitude)
+	check(t.Airborne && !t.Extrapolated && t.TrackType == gdl90.TRACK_TYPE_TRUE_TRACK, "traffic: misc %+v", t)
+	check(t.NIC == 10 && t.NACp == 9, "traffic: NIC %d NACp %d", t.NIC, t.NACp)
+	check(t.SpeedValid && t.Speed == 123 && t.VvelValid && t.Vvel == 64, "traffic: speed %d vvel %d", t.Speed, t.Vvel)
+	check(t.Track == 45, "traffic: track %f", t.Track)
+	check(t.EmitterCategory == 1 && t.Callsign == "N825V" && t.Priority == 0, "traffic: emitter %d callsign '%s'", t.EmitterCategory, t.Callsign)
+
+	// Same data as ownship.
+	report[0] = gdl90.MSG_OWNSHIP
+	m, _ = gdl90.Decode(report)
+	o, ok := m.(*gdl90.OwnshipReport)
+	check(ok && o.Callsign == "N825V", "ownship: decoded as %T", m)
+
+	// Latitude/longitude examples, p.19.
+	latlng := map[uint32]float64{0x000000: 0, 0x200000: 45, 0xE00000: -45, 0x400000: 90, 0x800000: -180}
+	for raw, deg := range latlng {
+		report[5], report[6], report[7] = byte(raw>>16), byte(raw>>8), byte(raw)
+		m, _ = gdl90.Decode(report)
+		check(m.(*gdl90.OwnshipReport).Lat == deg, "traffic: %06X is %f, expected %f", raw, m.(*gdl90.OwnshipReport).Lat, deg)
+	}
+
+	// Vertical velocity examples, p.22.
+	vvel := map[uint16]int32{0x000: 0, 0x001: 64, 0xFFF: -64, 0x1FD: 32576, 0xE03: -32576}
+	for raw, fpm := range vvel {
+		report[15] = (report[15] & 0xF0) | byte(raw>>8)
+		report[16] = byte(raw)
+		t, _ := gdl90.Decode(report)
+		check(t.(*gdl90.OwnshipReport).Vvel == fpm, "traffic: vvel %03X is %d, expected %d", raw, t.(*gdl90.OwnshipReport).Vvel, fpm)
+	}
+
+	// No position, invalid altitude, speed and vertical velocity.
+	invalid := make([]byte, 28)
+	invalid[0] = gdl90.MSG_TRAFFIC
+	invalid[11], invalid[12] = 0xFF, 0xF0
+	invalid[14], invalid[15], invalid[16] = 0xFF, 0xF8, 0x00
+	m, _ = gdl90.Decode(invalid)
+	t = m.(*gdl90.TrafficReport)
+	check(!t.PositionValid && !t.AltitudeValid && !t.SpeedValid && !t.VvelValid, "traffic: invalid fields %+v", t)
+}
+
+// p.15, p.26, p.28.
+func checkOther() {
+	// Geo altitude examples.
+	geo := map[[4]byte][2]int32{
+		{0xFF, 0x38, 0xFF, 0xFF}: {-1000, -1},
+		{0x00, 0x00, 0x7F, 0xFE}: {0, 32766},
+		{0x00, 0xC8, 0x00, 0x0A}: {1000, 10},
+		{0x00, 0xC8, 0x80, 0x32}: {1000, 50},
+	}
+	for raw, v := range geo {
+		m := roundTrip("geo altitude", gdl90.Frame([]byte{0x0B, raw[0], raw[1], raw[2], raw[3]}))
+		g, ok := m.(*gdl90.OwnshipGeoAltitude)
+		if !ok {
+			check(false, "geo altitude: decoded as %T", m)
+			continue
+		}
+		check(g.Altitude == v[0], "geo altitude: % X is %d, expected %d", raw, g.Altitude, v[0])
+		check((v[1] < 0 && !g.VFOMValid) || (g.VFOMValid && int32(g.VFOM) == v[1]), "geo altitude: VFOM %d", g.VFOM)
+		check(g.VerticalWarning == (raw[2]&0x80 != 0), "geo altitude: vertical warning")
+	}
+
+	// Uplink, TOR least significant byte first.
+	uplink := make([]byte, 4+gdl90.UPLINK_PAYLOAD_BYTES)
+	uplink[0] = gdl90.MSG_UPLINK
+	uplink[1], uplink[2], uplink[3] = 0x1F, 0xBC, 0xBE // 12,499,999, the maximum.
+	uplink[4] = 0x7E                                   // Needs escaping.
+	m := roundTrip("uplink", gdl90.Frame(uplink))
+	u, ok := m.(*gdl90.Uplink)
+	check(ok && u.TORValid && u.TOR == 12499999 && len(u.Payload) == 432 && u.Payload[0] == 0x7E, "uplink: %T %+v", m, u)
+	uplink[1], uplink[2], uplink[3] = 0xFF, 0xFF, 0xFF
+	m, _ = gdl90.Decode(uplink)
+	check(!m.(*gdl90.Uplink).TORValid, "uplink: TOR 0xFFFFFF valid")
+	_, err := gdl90.Decode(uplink[:100])
+	check(err != nil, "uplink: short message decoded")
+
+	// Pass-through reports.
+	long := make([]byte, 4+gdl90.LONG_PAYLOAD_BYTES)
+	long[0] = gdl90.MSG_LONG_REPORT
+	m, _ = gdl90.Decode(long)
+	p, ok := m.(*gdl90.PassThroughReport)
+	check(ok && p.Long && len(p.Payload) == 34 && p.TORValid, "long report: %+v", m)
+
+	// Height above terrain, p.27.
+	m, _ = gdl90.Decode([]byte{0x09, 0x01, 0x00})
+	hat, ok := m.(*gdl90.HeightAboveTerrain)
+	check(ok && hat.Valid && hat.Height == 256, "height above terrain: %+v", m)
+}
+
+// Stratux messages, built the way gen_gdl90.go and ry835ai.go build them.
+func checkStratux() {
+	// makeStratuxHeartbeat(): protocol 1, GPS valid.
+	m := roundTrip("stratux heartbeat", gdl90.Frame([]byte{0xCC, 0x06}))
+	h, ok := m.(*gdl90.StratuxHeartbeat)
+	check(ok && h.ProtocolVersion == 1 && h.GPSValid && !h.AHRSValid, "stratux heartbeat: %+v", m)
+
+	// makeStratuxStatus(): v0.8r2, 3D GPS, UAT+ES+GPS enabled, two radios, one tower at -21 dB.
+	sx := []byte{'S', 'X', 1, 1, 0, 8, 2, 2, 0xFF, 0xFF, 0xFF, 0xFF, 0x00, 0xE1, 0x00, 0x02, 9, 12, 0x00, 0x03,
+		0x01, 0x02, 0x02, 0x00, 0x10, 0x00, 0x01, 0xC2, 1, 0x20, 0x00, 0x00, 0xE0, 0x00, 0x00, 0xEB}
+	m = roundTrip("stratux status", gdl90.Frame(sx))
+	s, ok := m.(*gdl90.StratuxStatus)
+	if !ok {
+		check(false, "stratux status: decoded as %T", m)
+	} else {
+		check(s.StatusID == 1 && s.MessageVersion == 1, "stratux status: ID %d version %d", s.StatusID, s.MessageVersion)
+		check(s.VersionMajor == 0 && s.VersionMinor == 8 && s.VersionType == 2 && s.VersionBuild == 2, "stratux status: version %+v", s)
+		check(s.HardwareRevision == 0xFFFFFFFF, "stratux status: hardware revision %08X", s.HardwareRevision)
+		check(s.GPSFix == 1 && s.UATEnabled && s.ESEnabled && s.GPSEnabled && !s.AHRSValid && !s.AHRSEnabled, "stratux status: flags %+v", s)
+		check(s.Radios == 2 && !s.IMUConnected && s.SatellitesLocked == 9 && s.SatellitesTracked == 12, "stratux status: hardware %+v", s)
+		check(s.UATTraffic == 3 && s.ESTraffic == 258 && s.UATMessagesPerMin == 512 && s.ESMessagesPerMin == 4096, "stratux status: counts %+v", s)
+		check(near(s.CPUTemp, 45.0, 0.01), "stratux status: CPU temperature %f", s.CPUTemp)
+		check(len(s.Towers) == 1 && s.Towers[0].Lat == 45 && s.Towers[0].Lng == -45, "stratux status: towers %+v", s.Towers)
+		check(len(s.Towers) == 1 && s.Towers[0].SignalValid && s.Towers[0].Signal == -21, "stratux status: tower signal %+v", s.Towers)
+	}
+	// V104, without the signal strengths.
+	m, err := gdl90.Decode(sx[:len(sx)-1])
+	s, ok = m.(*gdl90.StratuxStatus)
+	check(err == nil && ok && len(s.Towers) == 1 && !s.Towers[0].SignalValid, "stratux status: V104 towers %v", err)
+	_, err = gdl90.Decode(sx[:len(sx)-2])
+	check(err != nil, "stratux status: truncated tower list decoded")
+
+	// makeAHRSGDL90Report(): roll -12.3, pitch 4.5, heading 359.9, G 1.0, yaw rate invalid.
+	le := []byte{0x4C, 0x45, 0x01, 0x00, 0xFF, 0x85, 0x00, 0x2D, 0x0E, 0x0F, 0x00, 0x00, 0x7F, 0xFF, 0x00, 0x0A}
+	m = roundTrip("AHRS", gdl90.Frame(le))
+	a, ok := m.(*gdl90.AHRSReport)
+	if !ok {
+		check(false, "AHRS: decoded as %T", m)
+	} else {
+		check(a.SubID == 1 && near(a.Roll, -12.3, 0.001) && near(a.Pitch, 4.5, 0.001) && near(a.Heading, 359.9, 0.001), "AHRS: %+v", a)
+		check(a.SlipSkidValid && a.SlipSkid == 0 && !a.YawRateValid && a.GValid && a.G == 1, "AHRS: %+v", a)
+	}
+
+	// Version 1: slip/skid -1.5, yaw rate 3.0, G 1.2, no airspeed, pressure altitude 1200 ft, vertical speed -500 fpm.
+	le = []byte{0x4C, 0x45, 0x01, 0x01, 0xFF, 0x85, 0x00, 0x2D, 0x0E, 0x0F, 0xFF, 0xF1, 0x00, 0x1E, 0x00, 0x0C,
+		0x7F, 0xFF, 0x18, 0x38, 0xFE, 0x0C, 0x7F, 0xFF}
+	m = roundTrip("AHRS v1", gdl90.Frame(le))
+	a, ok = m.(*gdl90.AHRSReport)
+	if !ok {
+		check(false, "AHRS v1: decoded as %T", m)
+	} else {
+		check(near(a.SlipSkid, -1.5, 0.001) && near(a.YawRate, 3.0, 0.001) && near(a.G, 1.2, 0.001), "AHRS v1: %+v", a)
+		check(!a.AirspeedValid && a.PressureAltValid && a.PressureAlt == 1200 && a.VerticalSpeedValid && a.VerticalSpeed == -500, "AHRS v1: %+v", a)
+	}
+	_, err = gdl90.Decode(le[:20])
+	check(err != nil, "AHRS v1: truncated report decoded")
+
+	// makeFFAHRSSimReport().
+	msgs, errs := gdl90.Parse([]byte(fmt.Sprintf("XATTStratux,%f,%f,%f", 123.4, 2.5, -10.1)))
+	if len(msgs) != 1 || len(errs) != 0 {
+		check(false, "XATT: %v %v", msgs, errs)
+	} else {
+		x := msgs[0].(*gdl90.XATTReport)
+		check(x.Name == "Stratux" && x.Heading == 123.4 && x.Pitch == 2.5 && x.Roll == -10.1, "XATT: %+v", x)
+	}
+	_, err = gdl90.ParseXATT("XATTStratux,1,2")
+	check(err != nil, "XATT: short message parsed")
+}
+
+// Datagram and stream splitting, byte stuffing and CRC errors.
+func checkFraming() {
+	stuffed := gdl90.Frame([]byte{0x0B, 0x7E, 0x7D, 0x00, 0x0A})
+	check(bytes.Count(stuffed, []byte{0x7E}) == 2, "framing: unescaped flag in % X", stuffed)
+	msg, err := gdl90.Unframe(stuffed)
+	check(err == nil && bytes.Equal(msg, []byte{0x0B, 0x7E, 0x7D, 0x00, 0x0A}), "framing: un-stuffed to % X (%v)", msg, err)
+
+	bad := append([]byte{}, stuffed...)
+	bad[len(bad)-2] ^= 0x01
+	_, err = gdl90.Unframe(bad)
+	check(err != nil, "framing: CRC error not detected")
+	_, err = gdl90.Unframe([]byte{0x7E, 0x00, 0x7D, 0x7E})
+	check(err != nil, "framing: trailing control-escape not detected")
+
+	// One datagram as sent by sendTrafficUpdates(): several traffic reports back to back, plus junk, a
+	// corrupted message and a shared flag.
+	heartbeat := []byte{0x7E, 0x00, 0x81, 0x41, 0xDB, 0xD0, 0x08, 0x02, 0xB3, 0x8B, 0x7E}
+	traffic := gdl90.Frame([]byte{0x14, 0x00, 0xAB, 0x45, 0x49, 0x1F, 0xEF, 0x15, 0xA8, 0x89, 0x78, 0x0F, 0x09, 0xA9, 0x07, 0xB0,
+		0x01, 0x20, 0x01, 0x4E, 0x38, 0x32, 0x35, 0x56, 0x20, 0x20, 0x20, 0x00})
+	var dgram []byte
+	dgram = append(dgram, 0x01, 0x02)
+	dgram = append(dgram, heartbeat...)
+	dgram = append(dgram, traffic...)
+	dgram = append(dgram, bad...)
+	dgram = append(dgram, traffic...)
+	dgram = append(dgram, traffic[1:]...) // Shares the previous end flag.
+	msgs, errs := gdl90.Parse(dgram)
+	check(len(msgs) == 4 && len(errs) == 1, "framing: datagram gave %d messages, %d errors", len(msgs), len(errs))
+
+	// The same as a stream, a few bytes at a time.
+	n := 0
+	scanner := bufio.NewScanner(&slowReader{data: dgram})
+	scanner.Split(gdl90.ScanFrames)
+	for scanner.Scan() {
+		if msg, err := gdl90.Unframe(scanner.Bytes()); err == nil {
+			if _, err := gdl90.Decode(msg); err == nil {
+				n++
+			}
+		}
+	}
+	check(n == 4, "framing: stream gave %d messages", n)
+}
+
+type slowReader struct {
+	data []byte
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p[:3], r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func parseCapture(fn string) {
+	fp, err := os.Open(fn)
+	if err != nil {
+		fmt.Printf("can't open '%s'.\n", fn)
+		return
+	}
+	defer fp.Close()
+
+	counts := make(map[string]int)
+	scanner := bufio.NewScanner(fp)
+	scanner.Buffer(make([]byte, 4096), 65536)
+	scanner.Split(gdl90.ScanFrames)
+	for scanner.Scan() {
+		msg, err := gdl90.Unframe(scanner.Bytes())
+		if err != nil {
+			check(false, "% X: %s", scanner.Bytes(), err.Error())
+			continue
+		}
+		m, err := gdl90.Decode(msg)
+		if err != nil {
+			check(false, "% X: %s", msg, err.Error())
+			continue
+		}
+		counts[fmt.Sprintf("%T", m)]++
+	}
+	for t, n := range counts {
+		fmt.Printf("%s: %d\n", t, n)
+	}
+}
+
+func main() {
+	checkHeartbeat()
+	checkTraffic()
+	checkOther()
+	checkStratux()
+	checkFraming()
+
+	if len(os.Args) > 1 {
+		parseCapture(os.Args[1])
+	}
+
+	if failures > 0 {
+		fmt.Printf("%d failures.\n", failures)
+		os.Exit(1)
+	}
+	fmt.Printf("ok.\n")
+}
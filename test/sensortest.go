@@ -1,36 +1,87 @@
+/*
+	sensortest.go: Finds the IMU, magnetometer and barometer on I2C bus 1, runs the attitude estimator on them and
+	sends the attitude as ForeFlight simulator (XATT) messages. With -sim, uses simulated sensors instead.
+*/
+
 package main
 
 import (
-	"../mpu6050"
+	"../ahrs"
+	"../sensors"
+	"flag"
 	"fmt"
+	"github.com/kidoman/embd"
+	_ "github.com/kidoman/embd/host/all"
 	"net"
 	"time"
 )
 
-var attSensor *mpu6050.MPU6050
-
-func readMPU6050() (float64, float64) {
-	pitch, roll := attSensor.PitchAndRoll()
-
-	return pitch, roll
-}
+func main() {
+	sim := flag.Bool("sim", false, "use simulated sensors")
+	dest := flag.String("addr", "192.168.1.255:49002", "send XATT messages to this address")
+	flag.Parse()
 
-func initMPU6050() {
-	attSensor = mpu6050.New()
-}
+	var imu sensors.IMU
+	var mag sensors.Magnetometer
+	var baro sensors.Barometer
+	if *sim {
+		imu = sensors.NewSimIMU(0.01, 1)
+		mag = sensors.NewSimMagnetometer(90)
+		baro = sensors.NewSimBarometer(15, 1000)
+	} else {
+		bus := embd.NewI2CBus(1)
+		defer bus.Close()
+		var d *sensors.Driver
+		var err error
+		if imu, d, err = sensors.DetectIMU(bus); err != nil {
+			panic(err)
+		}
+		fmt.Printf("IMU: %s\n", d.Name)
+		if mag, d, err = sensors.DetectMagnetometer(bus); err == nil {
+			fmt.Printf("magnetometer: %s\n", d.Name)
+		}
+		if baro, d, err = sensors.DetectBarometer(bus); err == nil {
+			fmt.Printf("barometer: %s\n", d.Name)
+		}
+	}
 
-func main() {
-	initMPU6050()
-	addr, err := net.ResolveUDPAddr("udp", "192.168.1.255:49002")
+	addr, err := net.ResolveUDPAddr("udp", *dest)
 	if err != nil {
 		panic(err)
 	}
 	outConn, err := net.DialUDP("udp", nil, addr)
-	for {
-		pitch, roll := readMPU6050()
-		s := fmt.Sprintf("XATTMy Sim,%f,%f,%f", attSensor.Heading(), pitch, roll)
-		fmt.Printf("%f, %f\n", pitch, roll)
-		outConn.Write([]byte(s))
-		time.Sleep(50 * time.Millisecond)
+	if err != nil {
+		panic(err)
+	}
+
+	e := ahrs.New()
+	timer := time.NewTicker(time.Second / ahrs.UPDATE_RATE)
+	for i := 0; ; i++ {
+		<-timer.C
+		var in ahrs.Input
+		if in.Accel, in.Gyro, err = imu.ReadIMU(); err != nil {
+			fmt.Printf("ReadIMU(): %s\n", err.Error())
+			continue
+		}
+		if mag != nil {
+			in.Mag, err = mag.ReadMag()
+			in.MagValid = err == nil
+		}
+		e.Update(in, 1.0/ahrs.UPDATE_RATE)
+		if i%(ahrs.UPDATE_RATE/10) != 0 {
+			continue
+		}
+		roll, pitch, heading := e.Euler()
+		outConn.Write([]byte(fmt.Sprintf("XATTMy Sim,%f,%f,%f", heading, pitch, roll)))
+		if i%ahrs.UPDATE_RATE == 0 {
+			st := e.Status()
+			fmt.Printf("roll %.1f, pitch %.1f, heading %.1f (%s, valid %t, heading valid %t)", roll, pitch, heading, st.Calibration, st.Valid, st.HeadingValid)
+			if baro != nil {
+				if temp, p, err := baro.ReadPressure(); err == nil {
+					fmt.Printf(", %.1f ºC, %.2f hPa, %.0f ft", temp, p, sensors.PressureAltitude(p))
+				}
+			}
+			fmt.Printf("\n")
+		}
 	}
 }
@@ -0,0 +1,453 @@
+/*
+	uatairmet.go: Check of the graphical AIRMET/SIGMET/NOTAM/SUA (product ids 8-13) decoding in uatparse.
+
+	Builds uplink frames with known overlay and text records and checks what comes back out of uatparse.New().
+	With a dump978 log as an argument, also prints every overlay decoded from the log.
+*/
+
+package main
+
+import (
+	"../uatparse"
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+)
+
+var failures int
+
+func check(ok bool, format string, args ...interface{}) {
+	if !ok {
+		failures++
+		fmt.Printf("FAIL: "+format+"\n", args...)
+	}
+}
+
+// MSB first bit packer.
+type bitWriter struct {
+	buf []byte
+	n   uint
+}
+
+func (w *bitWriter) put(v uint32, bits uint) {
+	for i := int(bits) - 1; i >= 0; i-- {
+		if w.n%8 == 0 {
+			w.buf = append(w.buf, 0)
+		}
+		if (v>>uint(i))&0x01 != 0 {
+			w.buf[w.n/8] |= 0x80 >> (w.n % 8)
+		}
+		w.n++
+	}
+}
+
+// Angular weighted binary, 'bits' wide.
+func awb(deg float64, bits uint) uint32 {
+	return uint32(int32(math.Floor(deg/(360.0/float64(uint32(1)<<bits))+0.5))) & ((1 << bits) - 1)
+}
+
+// APDU header with t_opt=0 (hours, minutes) and an optional segmentation block.
+func apduHeader(product_id uint32, seg_file, seg_count, seg_num uint32) []byte {
+	w := new(bitWriter)
+	w.put(0, 3) // a_f, g_f, p_f.
+	w.put(product_id, 11)
+	if seg_count > 0 {
+		w.put(1, 1)
+	} else {
+		w.put(0, 1)
+	}
+	w.put(0, 2)  // t_opt.
+	w.put(12, 5) // Hours.
+	w.put(34, 6) // Minutes.
+	if seg_count > 0 {
+		w.put(seg_file, 10)
+		w.put(seg_count, 9)
+		w.put(seg_num, 9)
+	}
+	return w.buf
+}
+
+// Payload header (4-3). Location identifier is left empty.
+func payloadHeader(record_format, record_count byte) []byte {
+	return []byte{record_format<<4 | 0x01, record_count << 4, 0, 0, 0, 0}
+}
+
+// Wrap APDUs in a dump978 formatted uplink message.
+func uplink(apdus ...[]byte) string {
+	frame := make([]byte, uatparse.UPLINK_FRAME_DATA_BYTES)
+	frame[6] = 0x20 // Application data valid.
+	pos := 8
+	for _, a := range apdus {
+		frame[pos] = byte(len(a) >> 1)
+		frame[pos+1] = byte(len(a)&0x01) << 7 // Frame type 0 (FIS-B APDU).
+		copy(frame[pos+2:], a)
+		pos += 2 + len(a)
+	}
+	return "+" + hex.EncodeToString(frame) + ";rs=0;"
+}
+
+type vertex struct {
+	lat, lng float64
+	alt      uint32 // ft.
+}
+
+// Graphical overlay record (6-1) with a numeric label, start and end times (hours, minutes) and the given vertices.
+func overlayRecord(report_number uint32, geometry byte, vertices []byte, count int) []byte {
+	body := []byte{
+		0x00, 0x00, // Object label (numeric).
+		0x00,            // No element, qualifier or parameter.
+		0xEF,            // Object type 14 (airspace), status 15 (in effect).
+		0xF0 | geometry, // Start and end times, hours/minutes.
+		byte(count - 1),
+		17, 30, // Start.
+		23, 45, // End.
+	}
+	body = append(body, vertices...)
+	l := uint32(5 + len(body))
+	w := new(bitWriter)
+	w.put(l, 10)
+	w.put(report_number, 14)
+	w.put(16, 7) // Report year.
+	w.put(0, 1)  // Spare.
+	w.put(0, 3)  // Spare.
+	w.put(0, 4)  // Overlay record identifier (1).
+	w.put(0, 1)  // Object label flag (numeric).
+	return append(w.buf, body...)
+}
+
+func polygonVertices(v []vertex) []byte {
+	w := new(bitWriter)
+	for _, p := range v {
+		w.put(awb(p.lng, 19), 19)
+		w.put(awb(p.lat, 19), 19)
+		w.put(p.alt/100, 10)
+	}
+	return w.buf
+}
+
+// Surface polygon (geometry 1 or 2): the reference point, then each vertex as east and north offsets in meters from
+// it. 'alt' is only sent at high resolution.
+func surfaceVertices(geometry byte, ref vertex, v []offset) []byte {
+	w := new(bitWriter)
+	w.put(awb(ref.lng, 19), 19)
+	w.put(awb(ref.lat, 19), 19)
+	w.put(ref.alt/100, 10)
+	for _, o := range v {
+		if geometry == 2 {
+			w.put(uint32(o.east)&0xFFFF, 16)
+			w.put(uint32(o.north)&0xFFFF, 16)
+			w.put(o.alt/100, 8)
+		} else {
+			w.put(uint32(o.east/100)&0xFF, 8)
+			w.put(uint32(o.north/100)&0xFF, 8)
+		}
+	}
+	return w.buf
+}
+
+type offset struct {
+	east, north int // m.
+	alt         uint32
+}
+
+// Where 'o' should be decoded to, from 'ref'.
+func (o offset) from(ref vertex) vertex {
+	return vertex{
+		lat: ref.lat + float64(o.north)/1852.0/60.0,
+		lng: ref.lng + float64(o.east)/1852.0/(60.0*math.Cos(ref.lat*math.Pi/180.0)),
+		alt: o.alt,
+	}
+}
+
+// Surface ellipse (geometry 5 or 6): centre, radii (nm) and rotation. 'top' is only sent at high resolution.
+func surfaceEllipse(geometry byte, centre vertex, top uint32, r_lng, r_lat float64, angle uint32) []byte {
+	w := new(bitWriter)
+	w.put(awb(centre.lng, 19), 19)
+	w.put(awb(centre.lat, 19), 19)
+	w.put(centre.alt/100, 10)
+	if geometry == 6 {
+		w.put(top/100, 8)
+		w.put(uint32(r_lng/0.05+0.5), 12)
+		w.put(uint32(r_lat/0.05+0.5), 12)
+	} else {
+		w.put(uint32(r_lng/0.2+0.5), 8)
+		w.put(uint32(r_lat/0.2+0.5), 8)
+	}
+	w.put(angle, 8)
+	return w.buf
+}
+
+// Unformatted ASCII text record (5-1).
+func textRecord(report_number uint32, text string) []byte {
+	w := new(bitWriter)
+	w.put(uint32(5+len(text)), 16)
+	w.put(report_number, 14)
+	w.put(16, 7) // Report year.
+	w.put(1, 1)  // Active.
+	w.put(0, 2)
+	return append(w.buf, []byte(text)...)
+}
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 0.002
+}
+
+func decode(s string) []*uatparse.UATFrame {
+	msg, err := uatparse.New(s)
+	if err != nil {
+		check(false, "uatparse.New(): %s", err.Error())
+		return nil
+	}
+	msg.DecodeUplink()
+	return msg.Frames
+}
+
+func checkPolygon() {
+	v := []vertex{{44.1, -91.5, 18000}, {42.0, -92.9, 18000}, {40.3, -91.9, 18000}, {44.1, -91.5, 18000},
+		{44.1, -91.5, 3000}, {42.0, -92.9, 3000}, {40.3, -91.9, 3000}, {44.1, -91.5, 3000}}
+	apdu := append(apduHeader(11, 0, 0, 0), payloadHeader(8, 1)...)
+	apdu = append(apdu, overlayRecord(1234, 3, polygonVertices(v), len(v))...)
+	frames := decode(uplink(apdu))
+	if len(frames) != 1 || len(frames[0].Overlays) != 1 {
+		check(false, "polygon: expected one frame with one overlay")
+		return
+	}
+	f := frames[0]
+	o := f.Overlays[0]
+	check(f.Product_id == 11, "polygon: product id %d", f.Product_id)
+	check(o.ReportNumber == 1234 && o.ReportYear == 16, "polygon: report %d-%d", o.ReportNumber, o.ReportYear)
+	check(o.Geometry == uatparse.AIRMET_POLYGON && !o.AGL, "polygon: geometry %d, AGL %t", o.Geometry, o.AGL)
+	check(o.HasStart && o.HasEnd && o.Start.String() == "17:30" && o.End.String() == "23:45", "polygon: times %s-%s", o.Start, o.End)
+	check(f.ReportStart == "17:30" && f.ReportEnd == "23:45", "polygon: frame times %s-%s", f.ReportStart, f.ReportEnd)
+	check(o.AltBottom == 3000 && o.AltTop == 18000, "polygon: altitudes %d-%d", o.AltBottom, o.AltTop)
+	check(len(o.Points) == len(v), "polygon: %d points", len(o.Points))
+	for i := 0; i < len(v) && i < len(o.Points); i++ {
+		check(near(o.Points[i].Lat, v[i].lat) && near(o.Points[i].Lon, v[i].lng) && o.Points[i].Alt == int32(v[i].alt),
+			"polygon: point %d %v", i, o.Points[i])
+	}
+}
+
+func checkPrism() {
+	w := new(bitWriter)
+	w.put(awb(-77.04, 18), 18) // Bottom.
+	w.put(awb(38.9, 18), 18)
+	w.put(awb(-77.03, 18), 18) // Top.
+	w.put(awb(38.91, 18), 18)
+	w.put(0, 7)   // 0 ft.
+	w.put(36, 7)  // 18000 ft.
+	w.put(150, 9) // 30 nm.
+	w.put(75, 9)  // 15 nm.
+	w.put(90, 8)
+	apdu := append(apduHeader(8, 0, 0, 0), payloadHeader(8, 1)...)
+	apdu = append(apdu, overlayRecord(42, 7, w.buf, 1)...)
+	frames := decode(uplink(apdu))
+	if len(frames) != 1 || len(frames[0].Overlays) != 1 {
+		check(false, "prism: expected one frame with one overlay")
+		return
+	}
+	o := frames[0].Overlays[0]
+	check(o.Geometry == uatparse.AIRMET_PRISM && len(o.Ellipses) == 1 && len(o.Points) == 1, "prism: geometry %d", o.Geometry)
+	if len(o.Ellipses) != 1 {
+		return
+	}
+	e := o.Ellipses[0]
+	check(near(e.Bottom.Lat, 38.9) && near(e.Bottom.Lon, -77.04), "prism: bottom %v", e.Bottom)
+	check(near(e.Top.Lat, 38.91) && near(e.Top.Lon, -77.03), "prism: top %v", e.Top)
+	check(o.AltBottom == 0 && o.AltTop == 18000, "prism: altitudes %d-%d", o.AltBottom, o.AltTop)
+	check(e.RadiusLon == 30 && e.RadiusLat == 15 && e.Angle == 90, "prism: radii %f,%f angle %d", e.RadiusLon, e.RadiusLat, e.Angle)
+	p := e.Polygon(4)
+	// Rotated 90 degrees clockwise, so the 15 nm "north" radius points east.
+	check(len(p) == 5 && near(p[0].Lat, 38.9) && p[0].Lon > -77.04, "prism: polygon %v", p)
+}
+
+func checkSurfacePolygon(geometry byte) {
+	name := fmt.Sprintf("surface polygon %d", geometry)
+	ref := vertex{44.0, -90.0, 0}
+	v := []offset{{5000, 0, 8000}, {0, 5000, 8000}, {-5000, -5000, 8000}, {5000, 0, 3000}, {0, 5000, 3000}, {-5000, -5000, 3000}}
+	if geometry == 1 {
+		v = v[:3]
+		for i := range v {
+			v[i].alt = 0
+		}
+	}
+	apdu := append(apduHeader(13, 0, 0, 0), payloadHeader(8, 1)...)
+	apdu = append(apdu, overlayRecord(300, geometry, surfaceVertices(geometry, ref, v), len(v))...)
+	frames := decode(uplink(apdu))
+	if len(frames) != 1 || len(frames[0].Overlays) != 1 {
+		check(false, "%s: expected one frame with one overlay", name)
+		return
+	}
+	o := frames[0].Overlays[0]
+	check(o.Geometry == uatparse.AIRMET_POLYGON && o.Option == geometry, "%s: geometry %d", name, o.Geometry)
+	if geometry == 2 {
+		check(o.AltBottom == 3000 && o.AltTop == 8000, "%s: altitudes %d-%d", name, o.AltBottom, o.AltTop)
+	} else {
+		check(o.AltBottom == 0 && o.AltTop == 0, "%s: altitudes %d-%d", name, o.AltBottom, o.AltTop)
+	}
+	check(len(o.Points) == len(v), "%s: %d points", name, len(o.Points))
+	for i := 0; i < len(v) && i < len(o.Points); i++ {
+		want := v[i].from(ref)
+		check(near(o.Points[i].Lat, want.lat) && near(o.Points[i].Lon, want.lng) && o.Points[i].Alt == int32(want.alt),
+			"%s: point %d %v, expected %v", name, i, o.Points[i], want)
+	}
+}
+
+func checkSurfaceEllipse(geometry byte) {
+	name := fmt.Sprintf("surface ellipse %d", geometry)
+	centre := vertex{39.0, -104.7, 0}
+	var top uint32
+	r_lng, r_lat, angle := 10.0, 5.0, uint32(0)
+	if geometry == 6 {
+		centre.alt, top = 2000, 12000
+		r_lng, r_lat, angle = 2.5, 1.25, 90
+	}
+	apdu := append(apduHeader(13, 0, 0, 0), payloadHeader(8, 1)...)
+	apdu = append(apdu, overlayRecord(301, geometry, surfaceEllipse(geometry, centre, top, r_lng, r_lat, angle), 1)...)
+	frames := decode(uplink(apdu))
+	if len(frames) != 1 || len(frames[0].Overlays) != 1 {
+		check(false, "%s: expected one frame with one overlay", name)
+		return
+	}
+	o := frames[0].Overlays[0]
+	check(o.Geometry == uatparse.AIRMET_ELLIPSE && len(o.Ellipses) == 1, "%s: geometry %d, %d ellipses", name, o.Geometry, len(o.Ellipses))
+	check(o.AltBottom == int32(centre.alt) && o.AltTop == int32(top), "%s: altitudes %d-%d", name, o.AltBottom, o.AltTop)
+	if len(o.Ellipses) != 1 {
+		return
+	}
+	e := o.Ellipses[0]
+	check(near(e.Bottom.Lat, centre.lat) && near(e.Bottom.Lon, centre.lng), "%s: centre %v", name, e.Bottom)
+	check(near(e.RadiusLon, r_lng) && near(e.RadiusLat, r_lat) && e.Angle == int(angle), "%s: radii %f,%f angle %d", name, e.RadiusLon, e.RadiusLat, e.Angle)
+
+	// The outline starts at the end of the "north" radius and goes clockwise, a quarter of the way round at each axis.
+	n := uatparse.AIRMET_ELLIPSE_POINTS
+	if len(o.Points) != n+1 {
+		check(false, "%s: %d points", name, len(o.Points))
+		return
+	}
+	cos := 60.0 * math.Cos(centre.lat*math.Pi/180.0)
+	var first, quarter vertex
+	if angle == 0 {
+		first = vertex{centre.lat + r_lat/60.0, centre.lng, centre.alt}
+		quarter = vertex{centre.lat, centre.lng + r_lng/cos, centre.alt}
+	} else { // 90 degrees: the "north" radius points east, and the "east" radius south.
+		first = vertex{centre.lat, centre.lng + r_lat/cos, centre.alt}
+		quarter = vertex{centre.lat - r_lng/60.0, centre.lng, centre.alt}
+	}
+	for _, c := range []struct {
+		i    int
+		want vertex
+	}{{0, first}, {n / 4, quarter}, {n, first}} {
+		p := o.Points[c.i]
+		check(near(p.Lat, c.want.lat) && near(p.Lon, c.want.lng) && p.Alt == int32(c.want.alt), "%s: point %d %v, expected %v", name, c.i, p, c.want)
+	}
+}
+
+func checkPoints() {
+	v := []vertex{{41.5867, -83.8078, 0}, {43.4324, -83.8614, 500}}
+	apdu := append(apduHeader(8, 0, 0, 0), payloadHeader(8, 1)...)
+	apdu = append(apdu, overlayRecord(12028, 9, polygonVertices(v), len(v))...)
+	frames := decode(uplink(apdu))
+	if len(frames) != 1 || len(frames[0].Overlays) != 1 {
+		check(false, "points: expected one frame with one overlay")
+		return
+	}
+	o := frames[0].Overlays[0]
+	check(o.Geometry == uatparse.AIRMET_3D && o.AGL, "points: geometry %d, AGL %t", o.Geometry, o.AGL)
+	check(len(o.Points) == 2 && near(o.Points[1].Lat, 43.4324) && o.Points[1].Alt == 500, "points: %v", o.Points)
+}
+
+func checkMultipleRecords() {
+	apdu := append(apduHeader(12, 0, 0, 0), payloadHeader(1, 2)...)
+	apdu = append(apdu, textRecord(100, "SIGMET ONE")...)
+	apdu = append(apdu, textRecord(101, "SIGMET TWO")...)
+	frames := decode(uplink(apdu))
+	if len(frames) != 1 {
+		check(false, "records: expected one frame")
+		return
+	}
+	f := frames[0]
+	check(len(f.TextRecords) == 2, "records: %d text records", len(f.TextRecords))
+	if len(f.TextRecords) == 2 {
+		check(f.TextRecords[1].ReportNumber == 101 && f.TextRecords[1].Text[0] == "SIGMET TWO", "records: %v", f.TextRecords[1])
+		check(f.TextRecords[0].ReportStatus == uatparse.REPORT_STATUS_ACTIVE, "records: status %d", f.TextRecords[0].ReportStatus)
+	}
+	check(f.ReportNumber == 100, "records: frame report number %d", f.ReportNumber)
+}
+
+func checkSegmentation() {
+	text := strings.Repeat("NOTAM TEXT ", 30)
+	record := textRecord(12345, text)
+	half := len(record) / 2
+
+	seg1 := append(apduHeader(8, 511, 2, 1), payloadHeader(1, 1)...)
+	seg1 = append(seg1, record[:half]...)
+	seg2 := append(apduHeader(8, 511, 2, 2), payloadHeader(1, 1)...)
+	seg2 = append(seg2, record[half:]...)
+
+	// Second segment first - the file is put back together in order.
+	frames := decode(uplink(seg2))
+	check(len(frames) == 1 && frames[0].SegmentNumber == 2 && frames[0].SegmentCount == 2 && frames[0].SegmentFileID == 511,
+		"segmentation: segment 2 header")
+	check(len(frames) == 1 && len(frames[0].Text_data) == 0, "segmentation: partial report decoded")
+	frames = decode(uplink(seg1))
+	if len(frames) != 2 || !frames[1].Reassembled {
+		check(false, "segmentation: expected the reassembled frame after the last segment")
+		return
+	}
+	f := frames[1]
+	check(f.ReportNumber == 12345 && len(f.Text_data) == 1 && f.Text_data[0] == text,
+		"segmentation: reassembled report %d %v", f.ReportNumber, f.Text_data)
+}
+
+func dumpLog(fn string) {
+	fp, err := os.Open(fn)
+	if err != nil {
+		fmt.Printf("can't open '%s'.\n", fn)
+		return
+	}
+	defer fp.Close()
+
+	scanner := bufio.NewScanner(fp)
+	scanner.Buffer(make([]byte, 4096), 65536)
+	for scanner.Scan() {
+		msg, err := uatparse.New(scanner.Text())
+		if err != nil {
+			continue
+		}
+		msg.DecodeUplink()
+		for _, f := range msg.Frames {
+			for _, o := range f.Overlays {
+				fmt.Printf("product=%d report=%d-%d label=%s geometry=%d alt=%d-%d agl=%t start=%s end=%s points=%v\n",
+					f.Product_id, o.ReportNumber, o.ReportYear, o.ObjectLabel, o.Option, o.AltBottom, o.AltTop, o.AGL, o.Start, o.End, o.Points)
+			}
+			if f.Reassembled {
+				fmt.Printf("product=%d report=%d-%d reassembled from %d segments\n", f.Product_id, f.ReportNumber, f.ReportYear, f.SegmentCount)
+			}
+		}
+	}
+}
+
+func main() {
+	checkPolygon()
+	checkPrism()
+	checkSurfacePolygon(1)
+	checkSurfacePolygon(2)
+	checkSurfaceEllipse(5)
+	checkSurfaceEllipse(6)
+	checkPoints()
+	checkMultipleRecords()
+	checkSegmentation()
+
+	if len(os.Args) > 1 {
+		dumpLog(os.Args[1])
+	}
+
+	if failures > 0 {
+		fmt.Printf("%d failures.\n", failures)
+		os.Exit(1)
+	}
+	fmt.Printf("ok.\n")
+}
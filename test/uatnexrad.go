@@ -0,0 +1,276 @@
+/*
+	uatnexrad.go: Check of the NEXRAD (product ids 63 and 64) decoding and mosaic in uatparse.
+
+	Builds uplink frames with known run-length encoded and empty blocks and checks what comes back out of uatparse.New().
+	With a dump978 log as an argument, also prints every block decoded from the log in the same format as
+	dump978/extract_nexrad.
+*/
+
+package main
+
+import (
+	"../uatparse"
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"os"
+	"time"
+)
+
+var failures int
+
+func check(ok bool, format string, args ...interface{}) {
+	if !ok {
+		failures++
+		fmt.Printf("FAIL: "+format+"\n", args...)
+	}
+}
+
+// APDU header with t_opt=0 (hours, minutes), no segmentation.
+func apduHeader(product_id uint32) []byte {
+	hours, minutes := byte(12), byte(34)
+	return []byte{
+		byte(product_id>>6) & 0x1f,    // a_f, g_f, p_f, product id.
+		byte(product_id<<2) & 0xfc,    // Product id, s_f, t_opt.
+		(hours << 2) | (minutes >> 4), // Hours, minutes.
+		(minutes & 0x0f) << 4,
+	}
+}
+
+// Block header - RLE flag, NS flag, scale factor and block number.
+func blockHeader(rle, ns bool, scale int, block_num int) []byte {
+	b := byte(scale<<4) | byte(block_num>>16)&0x0f
+	if rle {
+		b |= 0x80
+	}
+	if ns {
+		b |= 0x40
+	}
+	return []byte{b, byte(block_num >> 8), byte(block_num)}
+}
+
+func uplink(apdus ...[]byte) string {
+	frame := make([]byte, uatparse.UPLINK_FRAME_DATA_BYTES)
+	frame[6] = 0x20 // Application data valid.
+	pos := 8
+	for _, a := range apdus {
+		frame[pos] = byte(len(a) >> 1)
+		frame[pos+1] = byte(len(a)&0x01) << 7 // Frame type 0 (FIS-B APDU).
+		copy(frame[pos+2:], a)
+		pos += 2 + len(a)
+	}
+	return "+" + hex.EncodeToString(frame) + ";rs=0;"
+}
+
+func apdu(product_id uint32, data ...[]byte) []byte {
+	ret := apduHeader(product_id)
+	for _, d := range data {
+		ret = append(ret, d...)
+	}
+	return ret
+}
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 0.0001
+}
+
+func decode(s string) []uatparse.NEXRADBlock {
+	msg, err := uatparse.New(s)
+	if err != nil {
+		check(false, "uatparse.New(): %s", err.Error())
+		return nil
+	}
+	msg.DecodeUplink()
+	ret := make([]uatparse.NEXRADBlock, 0)
+	for _, f := range msg.Frames {
+		ret = append(ret, f.NEXRAD...)
+	}
+	return ret
+}
+
+// Block containing 41.6N, 83.8W.
+const testBlock = 624*uatparse.NEXRAD_BLOCKS_PER_RING + 345
+
+func checkRLE() {
+	rle := []byte{31<<3 | 0, 0<<3 | 5, 30<<3 | 2, 31<<3 | 7, 31<<3 | 1}
+	blocks := decode(uplink(apdu(uatparse.NEXRAD_REGIONAL, blockHeader(true, false, 0, testBlock), rle)))
+	if len(blocks) != 1 {
+		check(false, "rle: %d blocks, expected 1", len(blocks))
+		return
+	}
+	b := blocks[0]
+	check(b.Product_id == uatparse.NEXRAD_REGIONAL && b.BlockNumber == testBlock && !b.Empty, "rle: header %+v", b)
+	check(b.Hours == 12 && b.Minutes == 34, "rle: time %02d:%02d", b.Hours, b.Minutes)
+	check(near(b.LatNorth, 41.0+40.0/60.0) && near(b.LonWest, -84.0), "rle: location %f,%f", b.LatNorth, b.LonWest)
+	check(near(b.Height, 4.0/60.0) && near(b.Width, 0.8), "rle: size %f x %f", b.Height, b.Width)
+	for i, v := range b.Intensity {
+		var expected uint8
+		switch {
+		case i < 32:
+			expected = 0
+		case i == 32:
+			expected = 5
+		case i < 64:
+			expected = 2
+		case i < 96:
+			expected = 7
+		default:
+			expected = 1
+		}
+		if v != expected {
+			check(false, "rle: bin %d = %d, expected %d", i, v, expected)
+			break
+		}
+	}
+
+	lat, lon := b.BinLocation(33)
+	check(near(lat, 41.65) && near(lon, -84.0+0.8/32), "rle: bin 33 at %f,%f", lat, lon)
+	v, ok := b.IntensityAt(41.65, -83.99)
+	check(ok && v == 5, "rle: IntensityAt() = %d,%t, expected 5", v, ok)
+	_, ok = b.IntensityAt(41.5, -83.99)
+	check(!ok, "rle: IntensityAt() outside of the block")
+
+	// Truncated - fewer than 128 bins.
+	blocks = decode(uplink(apdu(uatparse.NEXRAD_REGIONAL, blockHeader(true, false, 0, testBlock), rle[:3])))
+	check(len(blocks) == 0, "rle: truncated block decoded")
+}
+
+func checkEmpty() {
+	// b, b+2, b+5, b+12.
+	blocks := decode(uplink(apdu(uatparse.NEXRAD_CONUS, blockHeader(false, false, 0, testBlock), []byte{0x20 | 2, 0x81})))
+	expected := []int{testBlock, testBlock + 2, testBlock + 5, testBlock + 12}
+	if len(blocks) != len(expected) {
+		check(false, "empty: %d blocks, expected %d", len(blocks), len(expected))
+		return
+	}
+	for i, b := range blocks {
+		check(b.BlockNumber == expected[i] && b.Empty, "empty: block %d is %d, expected %d", i, b.BlockNumber, expected[i])
+		check(b.Intensity[0] == 1 && b.Intensity[127] == 1, "empty: CONUS intensity %d", b.Intensity[0])
+	}
+
+	// Regional empty blocks are "no data".
+	blocks = decode(uplink(apdu(uatparse.NEXRAD_REGIONAL, blockHeader(false, false, 0, testBlock), []byte{0x01})))
+	check(len(blocks) == 1 && blocks[0].Intensity[0] == 0, "empty: regional")
+
+	// Wraps around to the start of the row.
+	blocks = decode(uplink(apdu(uatparse.NEXRAD_CONUS, blockHeader(false, false, 0, 449), []byte{0x10 | 1})))
+	check(len(blocks) == 2, "empty: wrap %d blocks", len(blocks))
+	if len(blocks) == 2 {
+		check(blocks[0].BlockNumber == 449 && near(blocks[0].LonWest, -0.8), "empty: wrap block %d at %f", blocks[0].BlockNumber, blocks[0].LonWest)
+		check(blocks[1].BlockNumber == 0 && near(blocks[1].LonWest, 0), "empty: wrap block %d at %f", blocks[1].BlockNumber, blocks[1].LonWest)
+	}
+}
+
+func checkLocation() {
+	blocks := decode(uplink(
+		apdu(uatparse.NEXRAD_CONUS, blockHeader(false, true, 0, 450), []byte{0x01}),                                // Southern hemisphere.
+		apdu(uatparse.NEXRAD_CONUS, blockHeader(false, false, 0, uatparse.NEXRAD_BLOCK_THRESHOLD+1), []byte{0x01}), // Above 60N.
+		apdu(uatparse.NEXRAD_CONUS, blockHeader(false, false, 1, testBlock), []byte{0x01}),                         // Medium resolution.
+		apdu(uatparse.NEXRAD_CONUS, blockHeader(false, false, 2, testBlock), []byte{0x01}),                         // Low resolution.
+	))
+	if len(blocks) != 4 {
+		check(false, "location: %d blocks, expected 4", len(blocks))
+		return
+	}
+	check(blocks[0].Southern && near(blocks[0].LatNorth, -4.0/60.0) && near(blocks[0].LonWest, 0), "location: southern %f,%f", blocks[0].LatNorth, blocks[0].LonWest)
+	check(near(blocks[1].LatNorth, 60.0+4.0/60.0) && near(blocks[1].LonWest, 0) && near(blocks[1].Width, 1.6), "location: wide %f,%f %f", blocks[1].LatNorth, blocks[1].LonWest, blocks[1].Width)
+	check(blocks[2].Scale == 1 && near(blocks[2].Height, 20.0/60.0) && near(blocks[2].Width, 4.0), "location: scale 1 %f x %f", blocks[2].Height, blocks[2].Width)
+	check(blocks[3].Scale == 2 && near(blocks[3].Height, 36.0/60.0) && near(blocks[3].Width, 7.2), "location: scale 2 %f x %f", blocks[3].Height, blocks[3].Width)
+}
+
+func rleBlock(product_id uint32, scale int, block_num int, intensity uint8) uatparse.NEXRADBlock {
+	rle := []byte{31<<3 | intensity, 31<<3 | intensity, 31<<3 | intensity, 31<<3 | intensity}
+	blocks := decode(uplink(apdu(product_id, blockHeader(true, false, scale, block_num), rle)))
+	if len(blocks) != 1 {
+		check(false, "rleBlock: %d blocks", len(blocks))
+		return uatparse.NEXRADBlock{}
+	}
+	return blocks[0]
+}
+
+func checkMosaic() {
+	t0 := time.Date(2016, 3, 1, 12, 0, 0, 0, time.UTC)
+	m := uatparse.NewNEXRADMosaic(10 * time.Minute)
+
+	m.Add(rleBlock(uatparse.NEXRAD_REGIONAL, 0, testBlock, 3), t0)
+	m.Add(rleBlock(uatparse.NEXRAD_REGIONAL, 0, testBlock, 4), t0.Add(1*time.Minute)) // Replaces the first.
+	m.Add(rleBlock(uatparse.NEXRAD_REGIONAL, 0, testBlock+1, 2), t0.Add(5*time.Minute))
+	m.Add(rleBlock(uatparse.NEXRAD_CONUS, 2, testBlock, 6), t0.Add(5*time.Minute))
+	check(m.Len() == 3, "mosaic: %d blocks, expected 3", m.Len())
+
+	blocks := m.Blocks(uatparse.NEXRAD_REGIONAL, t0.Add(8*time.Minute))
+	check(len(blocks) == 2 && blocks[0].Intensity[0] == 4, "mosaic: blocks %d", len(blocks))
+
+	v, ok := m.IntensityAt(uatparse.NEXRAD_REGIONAL, 41.65, -83.99, t0.Add(8*time.Minute))
+	check(ok && v == 4, "mosaic: IntensityAt() = %d,%t, expected 4", v, ok)
+
+	// First block ages out.
+	blocks = m.Blocks(uatparse.NEXRAD_REGIONAL, t0.Add(12*time.Minute))
+	check(len(blocks) == 1 && blocks[0].BlockNumber == testBlock+1, "mosaic: after expiry %d blocks", len(blocks))
+	_, ok = m.IntensityAt(uatparse.NEXRAD_REGIONAL, 41.65, -83.99, t0.Add(12*time.Minute))
+	check(!ok, "mosaic: expired block still covers point")
+
+	// Higher resolution takes precedence over lower resolution.
+	m.Add(rleBlock(uatparse.NEXRAD_CONUS, 0, testBlock, 5), t0.Add(12*time.Minute))
+	v, ok = m.IntensityAt(uatparse.NEXRAD_CONUS, 41.65, -83.99, t0.Add(12*time.Minute))
+	check(ok && v == 5, "mosaic: high resolution IntensityAt() = %d,%t, expected 5", v, ok)
+	v, ok = m.IntensityAt(uatparse.NEXRAD_CONUS, 41.65, -80.0, t0.Add(12*time.Minute))
+	check(ok && v == 6, "mosaic: low resolution IntensityAt() = %d,%t, expected 6", v, ok)
+
+	m.Expire(t0.Add(30 * time.Minute))
+	check(m.Len() == 0, "mosaic: %d blocks after Expire()", m.Len())
+}
+
+func dumpLog(fn string) {
+	fp, err := os.Open(fn)
+	if err != nil {
+		fmt.Printf("can't open '%s'.\n", fn)
+		return
+	}
+	defer fp.Close()
+
+	scanner := bufio.NewScanner(fp)
+	scanner.Buffer(make([]byte, 4096), 65536)
+	for scanner.Scan() {
+		msg, err := uatparse.New(scanner.Text())
+		if err != nil {
+			continue
+		}
+		msg.DecodeUplink()
+		for _, f := range msg.Frames {
+			for _, b := range f.NEXRAD {
+				t := "CONUS"
+				if b.Product_id == uatparse.NEXRAD_REGIONAL {
+					t = "Regional"
+				}
+				lonW := b.LonWest
+				if lonW < 0 {
+					lonW += 360.0
+				}
+				fmt.Printf("NEXRAD %s %02d:%02d %d %.0f %.0f %.0f %.0f ", t, b.Hours, b.Minutes, b.Scale, b.LatNorth*60, lonW*60, b.Height*60, b.Width*60)
+				for _, v := range b.Intensity {
+					fmt.Printf("%d", v)
+				}
+				fmt.Printf("\n")
+			}
+		}
+	}
+}
+
+func main() {
+	checkRLE()
+	checkEmpty()
+	checkLocation()
+	checkMosaic()
+
+	if len(os.Args) > 1 {
+		dumpLog(os.Args[1])
+	}
+
+	if failures > 0 {
+		fmt.Printf("%d failures.\n", failures)
+		os.Exit(1)
+	}
+	fmt.Printf("ok.\n")
+}
@@ -0,0 +1,189 @@
+/*
+	wxreport.go: Check of the METAR/TAF/PIREP/winds aloft text report parsing in uatparse.
+
+	With a dump978 log as an argument, also parses every text report in the log and prints the ones that fail.
+*/
+
+package main
+
+import (
+	"../uatparse"
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+var failures int
+
+func check(ok bool, format string, args ...interface{}) {
+	if !ok {
+		failures++
+		fmt.Printf("FAIL: "+format+"\n", args...)
+	}
+}
+
+var ref = time.Date(2015, 7, 28, 23, 0, 0, 0, time.UTC)
+
+func checkMETAR() {
+	m, err := uatparse.ParseMETAR("METAR KLEX 282202Z 24012G22KT 210V270 1 1/2SM -RA BR FEW004 BKN008 OVC020 M02/M04 A2998 \n    RMK AO2 T10221044=\n", ref)
+	if err != nil {
+		check(false, "METAR: %s", err.Error())
+		return
+	}
+	check(m.Station == "KLEX" && !m.Special, "METAR: station %s", m.Station)
+	check(m.Observed.Equal(time.Date(2015, 7, 28, 22, 2, 0, 0, time.UTC)), "METAR: observed %s", m.Observed)
+	check(m.WindDirection == 240 && m.WindSpeed == 12 && m.WindGust == 22, "METAR: wind %d@%dG%d", m.WindDirection, m.WindSpeed, m.WindGust)
+	check(m.WindVariableFrom == 210 && m.WindVariableTo == 270, "METAR: variable %dV%d", m.WindVariableFrom, m.WindVariableTo)
+	check(m.Visibility == 1.5, "METAR: visibility %f", m.Visibility)
+	check(len(m.Weather) == 2 && m.Weather[0] == "-RA" && m.Weather[1] == "BR", "METAR: weather %v", m.Weather)
+	check(len(m.Clouds) == 3 && m.Ceiling == 800, "METAR: clouds %v, ceiling %d", m.Clouds, m.Ceiling)
+	check(m.Temperature == -2.2 && m.Dewpoint == -4.4, "METAR: temp %f/%f", m.Temperature, m.Dewpoint)
+	check(math.Abs(m.Altimeter-29.98) < 0.001, "METAR: altimeter %f", m.Altimeter)
+	check(m.FlightCategory == uatparse.FLIGHT_CATEGORY_IFR, "METAR: category %s", m.FlightCategory)
+
+	// Flight categories.
+	categories := map[string]string{
+		"METAR KAAA 282215Z 00000KT 10SM CLR 20/10 A3000=":        uatparse.FLIGHT_CATEGORY_VFR,
+		"METAR KAAA 282215Z 00000KT 10SM BKN030 20/10 A3000=":     uatparse.FLIGHT_CATEGORY_MVFR,
+		"METAR KAAA 282215Z 00000KT 5SM HZ SCT100 20/10 A3000=":   uatparse.FLIGHT_CATEGORY_MVFR,
+		"METAR KAAA 282215Z 00000KT 10SM OVC009 20/10 A3000=":     uatparse.FLIGHT_CATEGORY_IFR,
+		"METAR KAAA 282215Z 00000KT 1/2SM FG VV002 20/20 A3000=":  uatparse.FLIGHT_CATEGORY_LIFR,
+		"METAR KAAA 282215Z 00000KT M1/4SM FG SKC 20/20 A3000=":   uatparse.FLIGHT_CATEGORY_LIFR,
+		"METAR KAAA 282215Z AUTO 10007KT 26/21 A2999 RMK AO1=":    "",
+		"SPECI KAAA 282215Z 00000KT P6SM FEW250 20/10 Q1013 RMK=": uatparse.FLIGHT_CATEGORY_VFR,
+	}
+	for s, cat := range categories {
+		m, err := uatparse.ParseMETAR(s, ref)
+		if err != nil {
+			check(false, "METAR: %s", err.Error())
+			continue
+		}
+		check(m.FlightCategory == cat, "METAR: '%s' is %s, expected %s", s, m.FlightCategory, cat)
+	}
+
+	_, err = uatparse.ParseMETAR("TAF KAAA 282215Z", ref)
+	check(err != nil, "METAR: parsed a TAF")
+}
+
+func checkTAF() {
+	t, err := uatparse.ParseTAF("TAF.AMD KDPA 282222Z 2822/2918 20010KT P6SM SCT040\n     FM290900 26009KT P6SM VCTS OVC040CB PROB30 TEMPO 2910/2913 3SM\n      TSRA BKN008\n     BECMG 2914/2916 29011G16KT 9999 SCT040 AMD 2230=\n", ref)
+	if err != nil {
+		check(false, "TAF: %s", err.Error())
+		return
+	}
+	check(t.Station == "KDPA" && t.Amended, "TAF: station %s", t.Station)
+	check(t.Issued.Equal(time.Date(2015, 7, 28, 22, 22, 0, 0, time.UTC)), "TAF: issued %s", t.Issued)
+	check(t.ValidFrom.Equal(time.Date(2015, 7, 28, 22, 0, 0, 0, time.UTC)) && t.ValidTo.Equal(time.Date(2015, 7, 29, 18, 0, 0, 0, time.UTC)), "TAF: valid %s-%s", t.ValidFrom, t.ValidTo)
+	if len(t.Periods) != 4 {
+		check(false, "TAF: %d periods, expected 4", len(t.Periods))
+		return
+	}
+	p := t.Periods
+	check(p[0].Type == "" && p[0].To.Equal(time.Date(2015, 7, 29, 9, 0, 0, 0, time.UTC)) && p[0].FlightCategory == uatparse.FLIGHT_CATEGORY_VFR, "TAF: initial period %+v", p[0])
+	check(p[1].Type == "FM" && p[1].From.Equal(time.Date(2015, 7, 29, 9, 0, 0, 0, time.UTC)) && p[1].To.Equal(t.ValidTo) && p[1].Ceiling == 4000, "TAF: FM period %+v", p[1])
+	check(p[2].Type == "PROB" && p[2].Probability == 30 && p[2].From.Equal(time.Date(2015, 7, 29, 10, 0, 0, 0, time.UTC)) && p[2].FlightCategory == uatparse.FLIGHT_CATEGORY_IFR, "TAF: PROB period %+v", p[2])
+	check(p[3].Type == "BECMG" && p[3].WindGust == 16 && p[3].VisibilityPlus && p[3].To.Equal(time.Date(2015, 7, 29, 16, 0, 0, 0, time.UTC)), "TAF: BECMG period %+v", p[3])
+
+	// Without an issue time, and hour 24.
+	t, err = uatparse.ParseTAF("TAF KFFO 2818/2824 08006KT 9999 FEW030=", ref)
+	if err != nil {
+		check(false, "TAF: %s", err.Error())
+		return
+	}
+	check(t.Issued.IsZero() && t.ValidTo.Equal(time.Date(2015, 7, 29, 0, 0, 0, 0, time.UTC)), "TAF: issued %s, valid to %s", t.Issued, t.ValidTo)
+}
+
+func checkPIREP() {
+	p, err := uatparse.ParsePIREP("PIREP BAE 282138Z MWC UUA /OV BAE160020/TM 2138/FL200/TP A320/TA M12/IC MOD RIME/TB LGT ABV 170 /RM NEG ABV 200\n", ref)
+	if err != nil {
+		check(false, "PIREP: %s", err.Error())
+		return
+	}
+	check(p.Station == "BAE" && p.Urgent && p.Location == "BAE160020", "PIREP: %+v", p)
+	check(p.Observed.Equal(time.Date(2015, 7, 28, 21, 38, 0, 0, time.UTC)), "PIREP: observed %s", p.Observed)
+	check(p.Altitude == 20000 && p.AircraftType == "A320", "PIREP: altitude %d, type %s", p.Altitude, p.AircraftType)
+	check(p.TemperatureReported && p.Temperature == -12, "PIREP: temperature %d", p.Temperature)
+	check(p.Icing == "MOD RIME" && p.Turbulence == "LGT ABV 170" && p.Remarks == "NEG ABV 200", "PIREP: %+v", p)
+
+	p, err = uatparse.ParsePIREP("PIREP VHP 281959Z IND UA /OV VHP/TM 1959/FLUNKN/TP UNKN/SK OVC020", ref)
+	check(err == nil && p.Altitude == -1 && !p.Urgent && p.SkyCondition == "OVC020", "PIREP: unknown altitude")
+}
+
+func checkWindsAloft() {
+	w, err := uatparse.ParseWindsAloft("WINDS PSB 291800Z  FT 3000 6000      9000   12000       18000   24000   30000    34000  39000                         \n             2307+17 9900+10 2809+06 3014-05 3125-16 343330 744240 344952\n", ref)
+	if err != nil {
+		check(false, "WINDS: %s", err.Error())
+		return
+	}
+	check(w.Station == "PSB" && w.Valid.Equal(time.Date(2015, 7, 29, 18, 0, 0, 0, time.UTC)), "WINDS: %s %s", w.Station, w.Valid)
+	if len(w.Levels) != 8 {
+		check(false, "WINDS: %d levels, expected 8", len(w.Levels))
+		return
+	}
+	l := w.Levels
+	check(l[0].Altitude == 6000 && l[0].Direction == 230 && l[0].Speed == 7 && l[0].Temperature == 17, "WINDS: 6000 %+v", l[0])
+	check(l[1].Direction == -1 && l[1].Speed == 0 && l[1].Temperature == 10, "WINDS: light and variable %+v", l[1])
+	check(l[5].Altitude == 30000 && l[5].Temperature == -30, "WINDS: 30000 %+v", l[5])
+	check(l[6].Altitude == 34000 && l[6].Direction == 240 && l[6].Speed == 142 && l[6].Temperature == -40, "WINDS: over 100 kts %+v", l[6])
+}
+
+func parseLog(fn string) {
+	fp, err := os.Open(fn)
+	if err != nil {
+		fmt.Printf("can't open '%s'.\n", fn)
+		return
+	}
+	defer fp.Close()
+
+	n := 0
+	scanner := bufio.NewScanner(fp)
+	scanner.Buffer(make([]byte, 4096), 65536)
+	for scanner.Scan() {
+		msg, err := uatparse.New(scanner.Text())
+		if err != nil {
+			continue
+		}
+		reports, _ := msg.GetTextReports()
+		for _, r := range reports {
+			x := strings.Fields(r)
+			if len(x) == 0 {
+				continue
+			}
+			switch x[0] {
+			case "METAR", "SPECI":
+				_, err = uatparse.ParseMETAR(r, ref)
+			case "TAF", "TAF.AMD":
+				_, err = uatparse.ParseTAF(r, ref)
+			case "PIREP":
+				_, err = uatparse.ParsePIREP(r, ref)
+			case "WINDS":
+				_, err = uatparse.ParseWindsAloft(r, ref)
+			default:
+				continue
+			}
+			n++
+			check(err == nil, "%q: %v", r, err)
+		}
+	}
+	fmt.Printf("%d reports parsed.\n", n)
+}
+
+func main() {
+	checkMETAR()
+	checkTAF()
+	checkPIREP()
+	checkWindsAloft()
+
+	if len(os.Args) > 1 {
+		parseLog(os.Args[1])
+	}
+
+	if failures > 0 {
+		fmt.Printf("%d failures.\n", failures)
+		os.Exit(1)
+	}
+	fmt.Printf("ok.\n")
+}
@@ -0,0 +1,321 @@
+package uatparse
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+	NEXRAD Global Block Representation - products 63 (Regional) and 64 (CONUS).
+
+	Adapted from dump978/extract_nexrad.c.
+
+	Blocks are 48 arcminutes of longitude by 4 arcminutes of latitude between 0 and 60 degrees latitude (450 blocks per
+	ring) and 96 arcminutes wide between 60 and 90 degrees (225 blocks per ring, but only even block numbers are used).
+	Block zero is immediately northeast of (0,0) and blocks are numbered west-to-east, south-to-north. The southern
+	hemisphere is mirrored around the equator and indicated by the NS flag.
+
+	Each block is made up of 32 (longitude) x 4 (latitude) bins, numbered from the northwest corner west-to-east then
+	north-to-south. With scale factor 1 or 2 the same numbering locates the northwest corner, but each bin is 5x or 9x
+	larger in both axes.
+*/
+
+const (
+	NEXRAD_REGIONAL = 63
+	NEXRAD_CONUS    = 64
+
+	NEXRAD_SCALE_HIGH   = 0
+	NEXRAD_SCALE_MEDIUM = 1
+	NEXRAD_SCALE_LOW    = 2
+
+	NEXRAD_BINS_LON = 32
+	NEXRAD_BINS_LAT = 4
+	NEXRAD_BINS     = NEXRAD_BINS_LON * NEXRAD_BINS_LAT
+
+	NEXRAD_BLOCK_WIDTH      = float64(48.0 / 60.0) // Degrees.
+	NEXRAD_WIDE_BLOCK_WIDTH = float64(96.0 / 60.0) // Degrees, above 60 degrees latitude.
+	NEXRAD_BLOCK_HEIGHT     = float64(4.0 / 60.0)  // Degrees.
+	NEXRAD_BLOCK_THRESHOLD  = 405000               // First block number above 60 degrees latitude.
+	NEXRAD_BLOCKS_PER_RING  = 450
+)
+
+// One decoded NEXRAD block.
+type NEXRADBlock struct {
+	Product_id  uint32 // NEXRAD_REGIONAL or NEXRAD_CONUS.
+	Hours       uint32 // Time from the APDU header - all blocks from one composite image have the same time.
+	Minutes     uint32
+	BlockNumber int
+	Southern    bool // NS flag.
+	Scale       int  // NEXRAD_SCALE_HIGH, NEXRAD_SCALE_MEDIUM or NEXRAD_SCALE_LOW.
+	LatNorth    float64
+	LonWest     float64 // -180..180.
+	Height      float64 // Degrees of latitude.
+	Width       float64 // Degrees of longitude.
+	Empty       bool    // Sent as part of an empty block representation rather than run-length encoded.
+	Intensity   [NEXRAD_BINS]uint8
+}
+
+// Compute the northwest corner and size, in degrees, of block 'block_num'.
+func nexradBlockLocation(block_num int, ns_flag bool, scale_factor int) (latN, lonW, latSize, lonSize float64) {
+	scale := float64(1.0)
+	if scale_factor == NEXRAD_SCALE_MEDIUM {
+		scale = 5.0
+	} else if scale_factor == NEXRAD_SCALE_LOW {
+		scale = 9.0
+	}
+
+	if block_num >= NEXRAD_BLOCK_THRESHOLD {
+		block_num = block_num & ^1 // 60-90 degrees - even-numbered blocks only.
+	}
+
+	raw_lat := NEXRAD_BLOCK_HEIGHT * float64(block_num/NEXRAD_BLOCKS_PER_RING)
+	raw_lon := float64(block_num%NEXRAD_BLOCKS_PER_RING) * NEXRAD_BLOCK_WIDTH
+
+	if block_num >= NEXRAD_BLOCK_THRESHOLD {
+		lonSize = NEXRAD_WIDE_BLOCK_WIDTH * scale
+	} else {
+		lonSize = NEXRAD_BLOCK_WIDTH * scale
+	}
+	latSize = NEXRAD_BLOCK_HEIGHT * scale
+
+	// raw_lat/raw_lon is the southwest corner in the northern hemisphere.
+	if ns_flag {
+		latN = 0 - raw_lat // Southern hemisphere, mirror along the equator.
+	} else {
+		latN = raw_lat + NEXRAD_BLOCK_HEIGHT
+	}
+	lonW = raw_lon
+	if lonW > 180.0 {
+		lonW = lonW - 360.0
+	}
+	return
+}
+
+func (f *UATFrame) newNEXRADBlock(block_num int, ns_flag bool, scale_factor int) NEXRADBlock {
+	var b NEXRADBlock
+	b.Product_id = f.Product_id
+	b.Hours = f.FISB_hours
+	b.Minutes = f.FISB_minutes
+	b.BlockNumber = block_num
+	b.Southern = ns_flag
+	b.Scale = scale_factor
+	b.LatNorth, b.LonWest, b.Height, b.Width = nexradBlockLocation(block_num, ns_flag, scale_factor)
+	return b
+}
+
+func (f *UATFrame) decodeNEXRAD() {
+	if len(f.FISB_data) < 4 {
+		return
+	}
+
+	// Header:
+	//
+	// byte/bit 7   6   5   4   3   2   1   0
+	//   0    |RLE|NS | Scale |  MSB Block #  |
+	//   1    |        Block #                |
+	//   2    |        Block #            LSB |
+	rle_flag := (f.FISB_data[0] & 0x80) != 0
+	ns_flag := (f.FISB_data[0] & 0x40) != 0
+	block_num := ((int(f.FISB_data[0]) & 0x0f) << 16) | (int(f.FISB_data[1]) << 8) | int(f.FISB_data[2])
+	scale_factor := (int(f.FISB_data[0]) & 0x30) >> 4
+
+	if rle_flag {
+		// One block, 128 bins. Each byte following the header is:
+		//   7   6   5   4   3   2   1   0
+		// |   runlength - 1   | intensity |
+		b := f.newNEXRADBlock(block_num, ns_flag, scale_factor)
+		n := 0
+		for _, v := range f.FISB_data[3:] {
+			intensity := v & 0x07
+			runlength := int(v>>3) + 1
+			for ; runlength > 0 && n < NEXRAD_BINS; runlength-- {
+				b.Intensity[n] = intensity
+				n++
+			}
+		}
+		if n < NEXRAD_BINS {
+			return // Truncated.
+		}
+		f.NEXRAD = append(f.NEXRAD, b)
+		return
+	}
+
+	// Empty block representation, one or more blocks that are completely empty of data.
+	//
+	//       7    6    5    4    3    2    1    0
+	// 3   |b+4 |b+3 |b+2 |b+1 |    length (L)     |
+	// 4   |b+12|b+11|b+10|b+9 |b+8 |b+7 |b+6 |b+5 |
+	// ...
+	//
+	// The bitmap is for blocks on the same row as 'b', wrapping around.
+	var row_start, row_size int
+	if block_num >= NEXRAD_BLOCK_THRESHOLD {
+		row_start = block_num - ((block_num - NEXRAD_BLOCK_THRESHOLD) % 225)
+		row_size = 225
+	} else {
+		row_start = block_num - (block_num % NEXRAD_BLOCKS_PER_RING)
+		row_size = NEXRAD_BLOCKS_PER_RING
+	}
+	row_offset := block_num - row_start
+
+	// "Empty" is no precipitation on CONUS and "no data" on Regional.
+	var empty uint8
+	if f.Product_id == NEXRAD_CONUS {
+		empty = 1
+	}
+
+	L := int(f.FISB_data[3] & 0x0f)
+	if len(f.FISB_data) < 3+L {
+		return
+	}
+	for i := 0; i < L; i++ {
+		var bb byte
+		if i == 0 {
+			bb = (f.FISB_data[3] & 0xf0) | 0x08 // Bit 3 is block 'b' itself.
+		} else {
+			bb = f.FISB_data[i+3]
+		}
+		for j := 0; j < 8; j++ {
+			if bb&(1<<uint(j)) == 0 {
+				continue
+			}
+			row_x := (row_offset + 8*i + j - 3) % row_size
+			b := f.newNEXRADBlock(row_start+row_x, ns_flag, scale_factor)
+			b.Empty = true
+			for k := range b.Intensity {
+				b.Intensity[k] = empty
+			}
+			f.NEXRAD = append(f.NEXRAD, b)
+		}
+	}
+}
+
+// Northwest corner of bin 'i', in degrees.
+func (b *NEXRADBlock) BinLocation(i int) (lat, lon float64) {
+	x := i % NEXRAD_BINS_LON
+	y := i / NEXRAD_BINS_LON
+	lat = b.LatNorth - float64(y)*b.Height/NEXRAD_BINS_LAT
+	lon = b.LonWest + float64(x)*b.Width/NEXRAD_BINS_LON
+	return
+}
+
+// Intensity of the bin that covers (lat, lon). ok is false if the point isn't within the block.
+func (b *NEXRADBlock) IntensityAt(lat, lon float64) (intensity uint8, ok bool) {
+	y := (b.LatNorth - lat) / b.Height
+	x := (lon - b.LonWest) / b.Width
+	if x < 0 {
+		x += 360.0 / b.Width // Block crosses the antimeridian.
+	}
+	if y < 0 || y >= 1 || x < 0 || x >= 1 {
+		return 0, false
+	}
+	return b.Intensity[int(y*NEXRAD_BINS_LAT)*NEXRAD_BINS_LON+int(x*NEXRAD_BINS_LON)], true
+}
+
+/*
+	NEXRADMosaic accumulates blocks from products 63 and 64 into a current radar picture.
+
+	A block replaces any previously received block for the same product, scale and location. Blocks that haven't been
+	refreshed within MaxAge are dropped.
+*/
+
+type nexradKey struct {
+	product  uint32
+	scale    int
+	southern bool
+	block    int
+}
+
+type nexradMosaicBlock struct {
+	block    NEXRADBlock
+	received time.Time
+}
+
+type NEXRADMosaic struct {
+	MaxAge time.Duration
+	mu     *sync.Mutex
+	blocks map[nexradKey]*nexradMosaicBlock
+}
+
+func NewNEXRADMosaic(maxAge time.Duration) *NEXRADMosaic {
+	return &NEXRADMosaic{MaxAge: maxAge, mu: &sync.Mutex{}, blocks: make(map[nexradKey]*nexradMosaicBlock)}
+}
+
+// Add a block, received at time 't'.
+func (m *NEXRADMosaic) Add(b NEXRADBlock, t time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := nexradKey{product: b.Product_id, scale: b.Scale, southern: b.Southern, block: b.BlockNumber}
+	m.blocks[k] = &nexradMosaicBlock{block: b, received: t}
+}
+
+// Add all NEXRAD blocks from a decoded uplink.
+func (m *NEXRADMosaic) AddUplink(u *UATMsg, t time.Time) {
+	for _, f := range u.Frames {
+		for _, b := range f.NEXRAD {
+			m.Add(b, t)
+		}
+	}
+}
+
+// Drop blocks that are older than MaxAge at time 't'.
+func (m *NEXRADMosaic) Expire(t time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for k, v := range m.blocks {
+		if t.Sub(v.received) > m.MaxAge {
+			delete(m.blocks, k)
+		}
+	}
+}
+
+// Low resolution first, then north before south, then by block number.
+type nexradByScale []NEXRADBlock
+
+func (a nexradByScale) Len() int      { return len(a) }
+func (a nexradByScale) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a nexradByScale) Less(i, j int) bool {
+	if a[i].Scale != a[j].Scale {
+		return a[i].Scale > a[j].Scale
+	}
+	if a[i].Southern != a[j].Southern {
+		return !a[i].Southern
+	}
+	return a[i].BlockNumber < a[j].BlockNumber
+}
+
+// Current blocks for 'product' at time 't', low resolution first so that higher resolution blocks are drawn on top.
+// Stale blocks are expired first.
+func (m *NEXRADMosaic) Blocks(product uint32, t time.Time) []NEXRADBlock {
+	m.Expire(t)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ret := make([]NEXRADBlock, 0)
+	for k, v := range m.blocks {
+		if k.product == product {
+			ret = append(ret, v.block)
+		}
+	}
+	sort.Sort(nexradByScale(ret))
+	return ret
+}
+
+// Intensity at (lat, lon) for 'product', from the highest resolution block that covers the point. ok is false if no
+// current block covers it.
+func (m *NEXRADMosaic) IntensityAt(product uint32, lat, lon float64, t time.Time) (intensity uint8, ok bool) {
+	blocks := m.Blocks(product, t)
+	for i := len(blocks) - 1; i >= 0; i-- {
+		if v, found := blocks[i].IntensityAt(lat, lon); found {
+			return v, true
+		}
+	}
+	return 0, false
+}
+
+// Number of blocks currently held.
+func (m *NEXRADMosaic) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.blocks)
+}
@@ -0,0 +1,105 @@
+package uatparse
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+	Reassembly of segmented APDUs (Aero_FISB_ProdDef_Rev4.pdf, 3.1).
+
+	Reports that don't fit in a single APDU are split up and each segment is sent with a Product File Identifier,
+	the total number of segments and its position. The segments of a file can be received from different ground
+	stations, and the Payload Header is repeated at the start of each one.
+*/
+
+const (
+	SEGMENT_MAX_AGE = 15 * time.Minute // Discard partial files that haven't seen a new segment in this long.
+)
+
+type segmentKey struct {
+	product uint32
+	file    uint16
+}
+
+type segmentedFile struct {
+	first    *UATFrame
+	data     [][]byte // FISB_data of each segment, indexed by APDU Number - 1.
+	received int
+	lastSeen time.Time
+}
+
+type segmentCache struct {
+	mu    *sync.Mutex
+	files map[segmentKey]*segmentedFile
+}
+
+var segments = &segmentCache{mu: &sync.Mutex{}, files: make(map[segmentKey]*segmentedFile)}
+
+// Add a segment. Returns the reassembled and decoded frame when this was the last missing segment, otherwise nil.
+func (c *segmentCache) add(f *UATFrame) *UATFrame {
+	switch f.Product_id {
+	case 8, 11, 12, 13:
+	default:
+		return nil // Don't know how to decode anything else.
+	}
+	if f.SegmentCount == 0 || f.SegmentNumber == 0 || f.SegmentNumber > f.SegmentCount {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for k, v := range c.files {
+		if now.Sub(v.lastSeen) > SEGMENT_MAX_AGE {
+			delete(c.files, k)
+		}
+	}
+
+	k := segmentKey{product: f.Product_id, file: f.SegmentFileID}
+	s, ok := c.files[k]
+	if !ok || len(s.data) != int(f.SegmentCount) {
+		s = &segmentedFile{data: make([][]byte, f.SegmentCount)}
+		c.files[k] = s
+	}
+	s.lastSeen = now
+
+	i := f.SegmentNumber - 1
+	if s.data[i] != nil {
+		return nil // Already have this one.
+	}
+	s.data[i] = f.FISB_data
+	s.received++
+	if i == 0 {
+		s.first = f
+	}
+	if s.received < len(s.data) {
+		return nil
+	}
+	delete(c.files, k)
+
+	// Payload Header from the first segment, followed by the rest of each segment.
+	fisb_data := make([]byte, 0)
+	for j, d := range s.data {
+		if j > 0 {
+			if len(d) < 6 {
+				return nil
+			}
+			d = d[6:]
+		}
+		fisb_data = append(fisb_data, d...)
+	}
+
+	ret := new(UATFrame)
+	*ret = *s.first
+	ret.FISB_data = fisb_data
+	ret.FISB_length = uint32(len(fisb_data))
+	ret.Reassembled = true
+	ret.Text_data = nil
+	ret.Points = nil
+	ret.TextRecords = nil
+	ret.Overlays = nil
+	ret.decodeAirmet()
+	return ret
+}
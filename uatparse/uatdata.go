@@ -1,5 +1,11 @@
 package uatparse
 
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
 // AIRMET = AIRMET/SIGMET/ (TFR?)
 
 const (
@@ -12,6 +18,12 @@ const (
 	AIRMET_ELLIPSE = 2
 	AIRMET_PRISM   = 3
 	AIRMET_3D      = 4
+
+	AIRMET_ELLIPSE_POINTS = 36 // Points in the outline of a surface ellipse.
+
+	// Report Status (Table 5-2).
+	REPORT_STATUS_CANCELLED = 0
+	REPORT_STATUS_ACTIVE    = 1
 )
 
 // Points can be in 3D - take care that altitude is used correctly.
@@ -28,3 +40,129 @@ type UATAirmet struct {
 type UATMsgDecoded struct {
 	Type int
 }
+
+// Text record from products 8-13 (Aero_FISB_ProdDef_Rev4.pdf, 5).
+type UATTextRecord struct {
+	ReportNumber uint16
+	ReportYear   uint16
+	ReportStatus uint8
+	Text         []string
+}
+
+// Record Applicability Start/End (6.17). Fields that were not sent are -1.
+type UATOverlayTime struct {
+	Month   int
+	Day     int
+	Hours   int
+	Minutes int
+}
+
+// Surface ellipse, or the elliptical cross-section of an Extended Range Circular Prism (6.18.7). For a surface ellipse,
+// Bottom and Top are both the centre.
+type GeoEllipse struct {
+	Bottom    GeoPoint // Centroid of the bottom face. Alt is the bottom of the prism.
+	Top       GeoPoint // Centroid of the top face. Alt is the top of the prism.
+	RadiusLon float64  // nm.
+	RadiusLat float64  // nm.
+	Angle     int      // Rotation, degrees clockwise from north (0-179).
+}
+
+// Graphical overlay record from products 8-13 (Aero_FISB_ProdDef_Rev4.pdf, 6).
+type UATOverlay struct {
+	ReportNumber    uint16
+	ReportYear      uint16
+	RecordID        uint8 // Overlay Record Identifier (1-16).
+	ObjectLabel     string
+	ObjectType      uint8 // Table 6-3.
+	ObjectElement   uint8 // Tables 6-4 through 6-15. Only valid if ObjectElementSet.
+	ObjectStatus    uint8 // Table 6-16.
+	ObjectQualifier uint32
+	ParamType       uint8 // Table 6-18. 0 if no parameter was sent.
+	ParamValue      uint16
+
+	ObjectElementSet bool
+
+	Start     UATOverlayTime
+	End       UATOverlayTime
+	HasStart  bool
+	HasEnd    bool
+	Operator  uint8 // Overlay Operator (Table 6-23).
+	Option    uint8 // Raw Overlay Geometry Options value (Table 6-21).
+	Geometry  int   // AIRMET_POLYGON, AIRMET_ELLIPSE, AIRMET_PRISM or AIRMET_3D.
+	AGL       bool  // Altitudes are AGL rather than MSL.
+	AltBottom int32 // Altitude band covered by the geometry, feet.
+	AltTop    int32
+
+	// Vertices for polygons and 3D points. For prisms, the bottom centroid of each entry in Ellipses. For ellipses, the
+	// outline of each entry in Ellipses, from GeoEllipse.Polygon().
+	Points   []GeoPoint
+	Ellipses []GeoEllipse
+}
+
+// Formats as "MM-DD HH:MM", "DD HH:MM" or "HH:MM", depending on which fields were sent.
+func (t UATOverlayTime) String() string {
+	if t.Month >= 0 {
+		return fmt.Sprintf("%02d-%02d %02d:%02d", t.Month, t.Day, t.Hours, t.Minutes)
+	} else if t.Day >= 0 {
+		return fmt.Sprintf("%02d %02d:%02d", t.Day, t.Hours, t.Minutes)
+	}
+	return fmt.Sprintf("%02d:%02d", t.Hours, t.Minutes)
+}
+
+// Resolve the time to an absolute UTC time, taking the fields that were not sent from 'ref'.
+// The result is the occurrence closest to 'ref'.
+func (t UATOverlayTime) Resolve(ref time.Time) time.Time {
+	ref = ref.UTC()
+	month := ref.Month()
+	day := ref.Day()
+	if t.Month >= 0 {
+		month = time.Month(t.Month)
+	}
+	if t.Day >= 0 {
+		day = t.Day
+	}
+	ret := time.Date(ref.Year(), month, day, t.Hours, t.Minutes, 0, 0, time.UTC)
+
+	// Choose the closest occurrence, e.g. for a "31 23:00" end time received on the 1st.
+	var next, prev time.Time
+	switch {
+	case t.Month >= 0:
+		next = ret.AddDate(1, 0, 0)
+		prev = ret.AddDate(-1, 0, 0)
+	case t.Day >= 0:
+		next = ret.AddDate(0, 1, 0)
+		prev = ret.AddDate(0, -1, 0)
+	default:
+		next = ret.AddDate(0, 0, 1)
+		prev = ret.AddDate(0, 0, -1)
+	}
+	for _, c := range []time.Time{next, prev} {
+		if math.Abs(c.Sub(ref).Seconds()) < math.Abs(ret.Sub(ref).Seconds()) {
+			ret = c
+		}
+	}
+	return ret
+}
+
+// The point 'east' and 'north' nm from 'p'. Flat earth - good over the size of an overlay.
+func (p GeoPoint) Offset(east, north float64) GeoPoint {
+	p.Lon += east / (60.0 * math.Cos(p.Lat*math.Pi/180.0))
+	p.Lat += north / 60.0
+	return p
+}
+
+// Approximate the bottom face of the prism with 'n' points, for drawing.
+func (e GeoEllipse) Polygon(n int) []GeoPoint {
+	ret := make([]GeoPoint, 0, n+1)
+	rot := float64(e.Angle) * math.Pi / 180.0
+	for i := 0; i <= n; i++ {
+		theta := 2 * math.Pi * float64(i) / float64(n)
+		// Ellipse in a north/east frame, then rotated clockwise from north.
+		x := e.RadiusLon * math.Sin(theta) // East, nm.
+		y := e.RadiusLat * math.Cos(theta) // North, nm.
+		east := x*math.Cos(rot) + y*math.Sin(rot)
+		north := -x*math.Sin(rot) + y*math.Cos(rot)
+		ret = append(ret, e.Bottom.Offset(east, north))
+	}
+	return ret
+}
@@ -50,17 +50,31 @@ type UATFrame struct {
 	a_f bool
 	g_f bool
 	p_f bool
-	s_f bool //TODO: Segmentation.
+	s_f bool
+
+	// Segmentation data block (Aero_FISB_ProdDef_Rev4.pdf, 3.1). Only set if the APDU is segmented.
+	SegmentFileID uint16 // Product File Identifier.
+	SegmentCount  uint16 // Product File Length - number of APDUs in the file.
+	SegmentNumber uint16 // APDU Number, 1..SegmentCount.
+	Reassembled   bool   // Frame was put back together from all of its segments.
 
 	// For AIRMET/NOTAM.
 	//FIXME: Temporary.
 	Points             []GeoPoint
 	ReportNumber       uint16
 	ReportYear         uint16
+	ReportStatus       uint8
 	LocationIdentifier string
 	RecordFormat       uint8
 	ReportStart        string
 	ReportEnd          string
+
+	// Individual records from products 8-13.
+	TextRecords []*UATTextRecord
+	Overlays    []*UATOverlay
+
+	// For NEXRAD (products 63 and 64).
+	NEXRAD []NEXRADBlock
 }
 
 type UATMsg struct {
@@ -118,7 +132,8 @@ func (f *UATFrame) decodeTimeFormat() {
 
 	t_opt := ((uint32(f.Raw_data[1]) & 0x01) << 1) | (uint32(f.Raw_data[2]) >> 7)
 
-	var fisb_data []byte
+	// Number of header bits (flags, product id, segmentation flag, time option and time fields).
+	var hdr_bits uint32
 	switch t_opt {
 	case 0: // Hours, Minutes.
 		if f.frame_length < 4 {
@@ -126,8 +141,7 @@ func (f *UATFrame) decodeTimeFormat() {
 		}
 		f.FISB_hours = (uint32(f.Raw_data[2]) & 0x7c) >> 2
 		f.FISB_minutes = ((uint32(f.Raw_data[2]) & 0x03) << 4) | (uint32(f.Raw_data[3]) >> 4)
-		f.FISB_length = f.frame_length - 4
-		fisb_data = f.Raw_data[4:]
+		hdr_bits = 28
 	case 1: // Hours, Minutes, Seconds.
 		if f.frame_length < 5 {
 			return
@@ -135,8 +149,7 @@ func (f *UATFrame) decodeTimeFormat() {
 		f.FISB_hours = (uint32(f.Raw_data[2]) & 0x7c) >> 2
 		f.FISB_minutes = ((uint32(f.Raw_data[2]) & 0x03) << 4) | (uint32(f.Raw_data[3]) >> 4)
 		f.FISB_seconds = ((uint32(f.Raw_data[3]) & 0x0f) << 2) | (uint32(f.Raw_data[4]) >> 6)
-		f.FISB_length = f.frame_length - 5
-		fisb_data = f.Raw_data[5:]
+		hdr_bits = 34
 	case 2: // Month, Day, Hours, Minutes.
 		if f.frame_length < 5 {
 			return
@@ -145,8 +158,7 @@ func (f *UATFrame) decodeTimeFormat() {
 		f.FISB_day = ((uint32(f.Raw_data[2]) & 0x07) << 2) | (uint32(f.Raw_data[3]) >> 6)
 		f.FISB_hours = (uint32(f.Raw_data[3]) & 0x3e) >> 1
 		f.FISB_minutes = ((uint32(f.Raw_data[3]) & 0x01) << 5) | (uint32(f.Raw_data[4]) >> 3)
-		f.FISB_length = f.frame_length - 5
-		fisb_data = f.Raw_data[5:]
+		hdr_bits = 37
 	case 3: // Month, Day, Hours, Minutes, Seconds.
 		if f.frame_length < 6 {
 			return
@@ -156,17 +168,38 @@ func (f *UATFrame) decodeTimeFormat() {
 		f.FISB_hours = (uint32(f.Raw_data[3]) & 0x3e) >> 1
 		f.FISB_minutes = ((uint32(f.Raw_data[3]) & 0x01) << 5) | (uint32(f.Raw_data[4]) >> 3)
 		f.FISB_seconds = ((uint32(f.Raw_data[4]) & 0x03) << 3) | (uint32(f.Raw_data[5]) >> 5)
-		f.FISB_length = f.frame_length - 6
-		fisb_data = f.Raw_data[6:]
+		hdr_bits = 43
 	default:
 		return // Should never reach this.
 	}
 
-	f.FISB_data = fisb_data
-
 	if (uint16(f.Raw_data[1]) & 0x02) != 0 {
 		f.s_f = true // Default false.
+
+		// Segmentation data block follows the time fields (Aero_FISB_ProdDef_Rev4.pdf, Figure 3-2).
+		//  Product File Identifier (10 bits), Product File Length (9 bits), APDU Number (9 bits).
+		if f.frame_length*8 < hdr_bits+28 {
+			return
+		}
+		f.SegmentFileID = uint16(getBits(f.Raw_data, hdr_bits, 10))
+		f.SegmentCount = uint16(getBits(f.Raw_data, hdr_bits+10, 9))
+		f.SegmentNumber = uint16(getBits(f.Raw_data, hdr_bits+19, 9))
+		hdr_bits += 28
 	}
+
+	// Payload starts at the next byte boundary.
+	hdr_len := (hdr_bits + 7) / 8
+	f.FISB_length = f.frame_length - hdr_len
+	f.FISB_data = f.Raw_data[hdr_len:]
+}
+
+// Get 'n' bits (MSB first) starting at bit 'start' of 'data'.
+func getBits(data []byte, start, n uint32) uint32 {
+	var ret uint32
+	for i := start; i < start+n; i++ {
+		ret = (ret << 1) | ((uint32(data[i/8]) >> (7 - (i % 8))) & 0x01)
+	}
+	return ret
 }
 
 // Format newlines.
@@ -198,41 +231,17 @@ func (f *UATFrame) decodeTextFrame() {
 	f.Text_data = formatDLACData(p)
 }
 
-// Gets month, day, hours, minutes.
-// Formats into a string.
-func airmetParseDate(b []byte, date_time_format uint8) string {
-	switch date_time_format {
-	case 0: // No date/time used.
-		return ""
-	case 1: // Month, Day, Hours, Minutes.
-		month := uint8(b[0])
-		day := uint8(b[1])
-		hours := uint8(b[2])
-		minutes := uint8(b[3])
-		return fmt.Sprintf("%02d-%02d %02d:%02d", month, day, hours, minutes)
-	case 2: // Day, Hours, Minutes.
-		day := uint8(b[0])
-		hours := uint8(b[1])
-		minutes := uint8(b[2])
-		return fmt.Sprintf("%02d %02d:%02d", day, hours, minutes)
-	case 3: // Hours, Minutes.
-		hours := uint8(b[0])
-		minutes := uint8(b[1])
-		return fmt.Sprintf("%02d:%02d", hours, minutes)
-	}
-
-	return ""
-}
-
+// Angular weighted binary (Appendix B): two's complement, 360/2^b degrees per bit.
+// 19 bit coordinates (0.000687 deg), or 18 bit coordinates (0.001373 deg) if 'alt' is set.
 func airmetLatLng(lat_raw, lng_raw int32, alt bool) (float64, float64) {
-	fct := float64(0.000687)
+	fct := float64(360.0 / (1 << 19))
 	if alt {
-		fct = float64(0.001373)
+		fct = float64(360.0 / (1 << 18))
 	}
 	lat := fct * float64(lat_raw)
 	lng := fct * float64(lng_raw)
-	if lat > 90.0 {
-		lat = lat - 180.0
+	if lat > 180.0 {
+		lat = lat - 360.0
 	}
 	if lng > 180.0 {
 		lng = lng - 360.0
@@ -240,11 +249,138 @@ func airmetLatLng(lat_raw, lng_raw int32, alt bool) (float64, float64) {
 	return lat, lng
 }
 
-//TODO: Ignoring flags (segmentation, etc.)
+// Number of bytes in each Record Applicability field for a Date/Time Format (Table 6-20).
+func airmetDateLength(date_time_format uint8) int {
+	switch date_time_format {
+	case 1: // Month, Day, Hours, Minutes.
+		return 4
+	case 2: // Day, Hours, Minutes.
+		return 3
+	case 3: // Hours, Minutes.
+		return 2
+	}
+	return 0 // No date/time used.
+}
+
+// Gets month, day, hours, minutes from a Record Applicability field.
+func airmetParseTime(b []byte, date_time_format uint8) UATOverlayTime {
+	t := UATOverlayTime{Month: -1, Day: -1}
+	switch date_time_format {
+	case 1: // Month, Day, Hours, Minutes.
+		t.Month = int(b[0])
+		t.Day = int(b[1])
+		t.Hours = int(b[2])
+		t.Minutes = int(b[3])
+	case 2: // Day, Hours, Minutes.
+		t.Day = int(b[0])
+		t.Hours = int(b[1])
+		t.Minutes = int(b[2])
+	case 3: // Hours, Minutes.
+		t.Hours = int(b[0])
+		t.Minutes = int(b[1])
+	}
+	return t
+}
+
+// Extended Range 3D Polygon and Extended Range 3D Point vertex (6 bytes): lng (19 bits), lat (19 bits), alt (10 bits).
+func airmetVertex(b []byte) GeoPoint {
+	lng_raw := (int32(b[0]) << 11) | (int32(b[1]) << 3) | (int32(b[2]) & 0xE0 >> 5)
+	lat_raw := ((int32(b[2]) & 0x1F) << 14) | (int32(b[3]) << 6) | ((int32(b[4]) & 0xFC) >> 2)
+	alt_raw := ((int32(b[4]) & 0x03) << 8) | int32(b[5])
+
+	fmt.Fprintf(ioutil.Discard, "lat_raw=%d, lng_raw=%d, alt_raw=%d\n", lat_raw, lng_raw, alt_raw)
+	lat, lng := airmetLatLng(lat_raw, lng_raw, false)
+
+	var point GeoPoint
+	point.Lat = lat
+	point.Lon = lng
+	point.Alt = alt_raw * 100
+	return point
+}
+
+// Surface polygon vertex: east and north offsets, signed, from the reference point 'ref'. Low Resolution 2D Polygon
+// (2 bytes): 8 bits each, 100 m. High Resolution 3D Polygon (5 bytes): 16 bits each, 1 m, then alt (8 bits, 100 ft).
+func airmetOffsetVertex(ref GeoPoint, b []byte, high_res bool) GeoPoint {
+	var east, north float64 // m.
+	alt := ref.Alt
+	if high_res {
+		east = float64(int16((uint16(b[0]) << 8) | uint16(b[1])))
+		north = float64(int16((uint16(b[2]) << 8) | uint16(b[3])))
+		alt = int32(b[4]) * 100
+	} else {
+		east = float64(int8(b[0])) * 100
+		north = float64(int8(b[1])) * 100
+	}
+
+	point := ref.Offset(east/1852.0, north/1852.0)
+	point.Alt = alt
+	return point
+}
+
+// Surface ellipse. Centre as an Extended Range 3D Point (6 bytes), then the radii and rotation. Low Resolution 2D
+// Ellipse (9 bytes): r_lng, r_lat (8 bits each, 0.2 nm), alpha (8 bits). High Resolution 3D Ellipse (11 bytes): top
+// alt (8 bits, 100 ft), r_lng, r_lat (12 bits each, 0.05 nm), alpha (8 bits). The centre's alt is the bottom.
+func airmetEllipse(b []byte, high_res bool) GeoEllipse {
+	var e GeoEllipse
+	e.Bottom = airmetVertex(b)
+	e.Top = e.Bottom
+	b = b[6:]
+	if high_res {
+		r_lng_raw := (int32(b[1]) << 4) | ((int32(b[2]) & 0xF0) >> 4)
+		r_lat_raw := ((int32(b[2]) & 0x0F) << 8) | int32(b[3])
+		e.Top.Alt = int32(b[0]) * 100
+		e.RadiusLon = float64(r_lng_raw) * float64(0.05)
+		e.RadiusLat = float64(r_lat_raw) * float64(0.05)
+		e.Angle = int(b[4])
+	} else {
+		e.RadiusLon = float64(b[0]) * float64(0.2)
+		e.RadiusLat = float64(b[1]) * float64(0.2)
+		e.Angle = int(b[2])
+	}
+
+	fmt.Fprintf(ioutil.Discard, "centre=%f,%f alt=%d-%d r_lng=%f r_lat=%f alpha=%d\n", e.Bottom.Lat, e.Bottom.Lon, e.Bottom.Alt, e.Top.Alt, e.RadiusLon, e.RadiusLat, e.Angle)
+	return e
+}
+
+// Extended Range Circular Prism vertex (14 bytes).
+func airmetPrism(b []byte) GeoEllipse {
+	lng_bot_raw := (int32(b[0]) << 10) | (int32(b[1]) << 2) | (int32(b[2]) & 0xC0 >> 6)
+	lat_bot_raw := ((int32(b[2]) & 0x3F) << 12) | (int32(b[3]) << 4) | ((int32(b[4]) & 0xF0) >> 4)
+	lng_top_raw := ((int32(b[4]) & 0x0F) << 14) | (int32(b[5]) << 6) | ((int32(b[6]) & 0xFC) >> 2)
+	lat_top_raw := ((int32(b[6]) & 0x03) << 16) | (int32(b[7]) << 8) | int32(b[8])
+
+	alt_bot_raw := (int32(b[9]) & 0xFE) >> 1
+	alt_top_raw := ((int32(b[9]) & 0x01) << 6) | ((int32(b[10]) & 0xFC) >> 2)
+
+	r_lng_raw := ((int32(b[10]) & 0x03) << 7) | ((int32(b[11]) & 0xFE) >> 1)
+	r_lat_raw := ((int32(b[11]) & 0x01) << 8) | int32(b[12])
+	alpha := int(b[13])
+
+	var e GeoEllipse
+	e.Bottom.Lat, e.Bottom.Lon = airmetLatLng(lat_bot_raw, lng_bot_raw, true)
+	e.Top.Lat, e.Top.Lon = airmetLatLng(lat_top_raw, lng_top_raw, true)
+	e.Bottom.Alt = alt_bot_raw * 500 // Table 6-22 says 5 ft, but the text (6.18.7) says 500 ft.
+	e.Top.Alt = alt_top_raw * 500
+	e.RadiusLon = float64(r_lng_raw) * float64(0.2)
+	e.RadiusLat = float64(r_lat_raw) * float64(0.2)
+	e.Angle = alpha
+
+	fmt.Fprintf(ioutil.Discard, "bot=%f,%f,%d top=%f,%f,%d r_lng=%f r_lat=%f alpha=%d\n", e.Bottom.Lat, e.Bottom.Lon, e.Bottom.Alt, e.Top.Lat, e.Top.Lon, e.Top.Alt, e.RadiusLon, e.RadiusLat, alpha)
+	return e
+}
+
 // Aero_FISB_ProdDef_Rev4.pdf
 // Decode product IDs 8-13.
 func (f *UATFrame) decodeAirmet() {
-	// APDU header: 48 bits  (3-3) - assume no segmentation.
+	if f.s_f && !f.Reassembled {
+		return // Only part of a report. Decoded once all of the segments have been received.
+	}
+
+	// Payload header (4-3).
+	if len(f.FISB_data) < 6 {
+		fmt.Fprintf(ioutil.Discard, "FISB payload header too short: %d\n", len(f.FISB_data))
+		return
+	}
 
 	record_format := (uint8(f.FISB_data[0]) & 0xF0) >> 4
 	f.RecordFormat = record_format
@@ -263,11 +399,6 @@ func (f *UATFrame) decodeAirmet() {
 	// rwy_designator := (record_reference & FC) >> 4
 	// parallel_rwy_designator := record_reference & 0x03 // 0 = NA, 1 = R, 2 = L, 3 = C (Figure 4-2).
 
-	//FIXME: Assume one record.
-	if record_count != 1 {
-		fmt.Fprintf(ioutil.Discard, "record_count=%d, != 1\n", record_count)
-		return
-	}
 	/*
 		0 - No data
 		1 - Unformatted ASCII Text
@@ -278,205 +409,280 @@ func (f *UATFrame) decodeAirmet() {
 		8 - Graphical Overlay
 		9-15 - Future Use
 	*/
-	switch record_format {
-	case 2:
-		record_length := (uint16(f.FISB_data[6]) << 8) | uint16(f.FISB_data[7])
-		if len(f.FISB_data)-int(record_length) < 6 {
-			fmt.Fprintf(ioutil.Discard, "FISB record not long enough: record_length=%d, len(f.FISB_data)=%d\n", record_length, len(f.FISB_data))
-			return
+	records := f.FISB_data[6:]
+	for i := 0; i < int(record_count); i++ {
+		var n int
+		switch record_format {
+		case 1, 2:
+			n = f.decodeTextRecord(records, record_format)
+		case 8:
+			n = f.decodeOverlayRecord(records)
+		default:
+			fmt.Fprintf(ioutil.Discard, "unknown record format: %d\n", record_format)
 		}
-		fmt.Fprintf(ioutil.Discard, "record_length=%d\n", record_length)
-		// Report identifier = report number + report year.
-		report_number := (uint16(f.FISB_data[8]) << 6) | ((uint16(f.FISB_data[9]) & 0xFC) >> 2)
-		f.ReportNumber = report_number
-		fmt.Fprintf(ioutil.Discard, "report_number=%d\n", report_number)
-		report_year := ((uint16(f.FISB_data[9]) & 0x03) << 5) | ((uint16(f.FISB_data[10]) & 0xF8) >> 3)
-		f.ReportYear = report_year
-		fmt.Fprintf(ioutil.Discard, "report_year=%d\n", report_year)
-		report_status := (uint8(f.FISB_data[10]) & 0x04) >> 2 //TODO: 0 = cancelled, 1 = active.
-		fmt.Fprintf(ioutil.Discard, "report_status=%d\n", report_status)
-		fmt.Fprintf(ioutil.Discard, "record_length=%d,len=%d\n", record_length, len(f.FISB_data))
-		text_data_len := record_length - 5
-		text_data := dlac_decode(f.FISB_data[11:], uint32(text_data_len))
-		fmt.Fprintf(ioutil.Discard, "text_data=%s\n", text_data)
-		f.Text_data = formatDLACData(text_data)
-	case 8:
-		// (6-1). (6.22 - Graphical Overlay Record Format).
-		record_data := f.FISB_data[6:] // Start after the record header.
-		record_length := (uint16(record_data[0]) << 2) | ((uint16(record_data[1]) & 0xC0) >> 6)
-		fmt.Fprintf(ioutil.Discard, "record_length=%d\n", record_length)
-		// Report identifier = report number + report year.
-		report_number := ((uint16(record_data[1]) & 0x3F) << 8) | uint16(record_data[2])
-		f.ReportNumber = report_number
-		fmt.Fprintf(ioutil.Discard, "report_number=%d\n", report_number)
-		report_year := (uint16(record_data[3]) & 0xFE) >> 1
-		f.ReportYear = report_year
-		fmt.Fprintf(ioutil.Discard, "report_year=%d\n", report_year)
-		overlay_record_identifier := ((uint8(record_data[4]) & 0x1E) >> 1) + 1 // Document instructs to add 1.
-		fmt.Fprintf(ioutil.Discard, "overlay_record_identifier=%d\n", overlay_record_identifier)
-		object_label_flag := uint8(record_data[4] & 0x01)
-		fmt.Fprintf(ioutil.Discard, "object_label_flag=%d\n", object_label_flag)
-
-		if object_label_flag == 0 { // Numeric index.
-			object_label := (uint8(record_data[5]) << 8) | uint8(record_data[6])
-			record_data = record_data[7:]
-			fmt.Fprintf(ioutil.Discard, "object_label=%d\n", object_label)
-		} else {
-			object_label := dlac_decode(record_data[5:], 9)
-			record_data = record_data[14:]
-			fmt.Fprintf(ioutil.Discard, "object_label=%s\n", object_label)
+		if n == 0 {
+			return // Can't find the next record.
 		}
+		records = records[n:]
+	}
+	fmt.Fprintf(ioutil.Discard, "\n\n\n")
+}
 
-		element_flag := (uint8(record_data[0]) & 0x80) >> 7
-		fmt.Fprintf(ioutil.Discard, "element_flag=%d\n", element_flag)
-		qualifier_flag := (uint8(record_data[0]) & 0x40) >> 6
-		fmt.Fprintf(ioutil.Discard, "qualifier_flag=%d\n", qualifier_flag)
-		param_flag := (uint8(record_data[0]) & 0x20) >> 5
-		fmt.Fprintf(ioutil.Discard, "param_flag=%d\n", param_flag)
-		object_element := uint8(record_data[0]) & 0x1F
-		fmt.Fprintf(ioutil.Discard, "object_element=%d\n", object_element)
+// Text record (5-1). Returns the number of bytes used, or 0 if the record couldn't be decoded.
+func (f *UATFrame) decodeTextRecord(record_data []byte, record_format uint8) int {
+	if len(record_data) < 5 {
+		return 0
+	}
+	record_length := (int(record_data[0]) << 8) | int(record_data[1])
+	if record_length < 5 || record_length > len(record_data) {
+		fmt.Fprintf(ioutil.Discard, "FISB record not long enough: record_length=%d, len(record_data)=%d\n", record_length, len(record_data))
+		return 0
+	}
+	fmt.Fprintf(ioutil.Discard, "record_length=%d\n", record_length)
+
+	r := new(UATTextRecord)
+	// Report identifier = report number + report year.
+	r.ReportNumber = (uint16(record_data[2]) << 6) | ((uint16(record_data[3]) & 0xFC) >> 2)
+	fmt.Fprintf(ioutil.Discard, "report_number=%d\n", r.ReportNumber)
+	r.ReportYear = ((uint16(record_data[3]) & 0x03) << 5) | ((uint16(record_data[4]) & 0xF8) >> 3)
+	fmt.Fprintf(ioutil.Discard, "report_year=%d\n", r.ReportYear)
+	r.ReportStatus = (uint8(record_data[4]) & 0x04) >> 2 // 0 = cancelled, 1 = active.
+	fmt.Fprintf(ioutil.Discard, "report_status=%d\n", r.ReportStatus)
+
+	text_data := record_data[5:record_length]
+	if record_format == 1 { // Unformatted ASCII Text.
+		r.Text = strings.Split(strings.Trim(string(text_data), "\x00\r\n"), "\n")
+	} else {
+		r.Text = formatDLACData(dlac_decode(text_data, uint32(len(text_data))))
+	}
+	fmt.Fprintf(ioutil.Discard, "text_data=%v\n", r.Text)
 
-		object_type := (uint8(record_data[1]) & 0xF0) >> 4
-		fmt.Fprintf(ioutil.Discard, "object_type=%d\n", object_type)
+	if len(f.TextRecords) == 0 {
+		f.ReportNumber = r.ReportNumber
+		f.ReportYear = r.ReportYear
+		f.ReportStatus = r.ReportStatus
+	}
+	f.TextRecords = append(f.TextRecords, r)
+	f.Text_data = append(f.Text_data, r.Text...)
 
-		object_status := uint8(record_data[1]) & 0x0F
-		fmt.Fprintf(ioutil.Discard, "object_status=%d\n", object_status)
+	return record_length
+}
 
-		//FIXME
-		if qualifier_flag == 0 { //TODO: Check.
-			record_data = record_data[2:]
-		} else {
-			object_qualifier := (uint32(record_data[2]) << 16) | (uint32(record_data[3]) << 8) | uint32(record_data[4])
-			fmt.Fprintf(ioutil.Discard, "object_qualifier=%d\n", object_qualifier)
-			fmt.Fprintf(ioutil.Discard, "%02x%02x%02x\n", record_data[2], record_data[3], record_data[4])
-			record_data = record_data[5:]
+// Graphical overlay record (6-1). Returns the number of bytes used, or 0 if the record couldn't be decoded.
+func (f *UATFrame) decodeOverlayRecord(b []byte) int {
+	if len(b) < 5 {
+		return 0
+	}
+	// (6-1). (6.22 - Graphical Overlay Record Format).
+	record_length := (int(b[0]) << 2) | ((int(b[1]) & 0xC0) >> 6)
+	if record_length < 5 || record_length > len(b) {
+		fmt.Fprintf(ioutil.Discard, "overlay record not long enough: record_length=%d, len(b)=%d\n", record_length, len(b))
+		return 0
+	}
+	fmt.Fprintf(ioutil.Discard, "record_length=%d\n", record_length)
+	record_data := b[:record_length]
+
+	o := new(UATOverlay)
+	// Report identifier = report number + report year.
+	o.ReportNumber = ((uint16(record_data[1]) & 0x3F) << 8) | uint16(record_data[2])
+	fmt.Fprintf(ioutil.Discard, "report_number=%d\n", o.ReportNumber)
+	o.ReportYear = (uint16(record_data[3]) & 0xFE) >> 1
+	fmt.Fprintf(ioutil.Discard, "report_year=%d\n", o.ReportYear)
+	o.RecordID = ((uint8(record_data[4]) & 0x1E) >> 1) + 1 // Document instructs to add 1.
+	fmt.Fprintf(ioutil.Discard, "overlay_record_identifier=%d\n", o.RecordID)
+	object_label_flag := uint8(record_data[4] & 0x01)
+	fmt.Fprintf(ioutil.Discard, "object_label_flag=%d\n", object_label_flag)
+	record_data = record_data[5:]
+
+	if object_label_flag == 0 { // Numeric index.
+		if len(record_data) < 2 {
+			return 0
 		}
-		//FIXME
-		//if param_flag == 0 { //TODO: Check.
-		//	record_data = record_data[2:]
-		//} else {
-		//	//TODO.
-		//	//			record_data = record_data[4:]
-		//}
-
-		record_applicability_options := (uint8(record_data[0]) & 0xC0) >> 6
-		fmt.Fprintf(ioutil.Discard, "record_applicability_options=%d\n", record_applicability_options)
-		date_time_format := (uint8(record_data[0]) & 0x30) >> 4
-		fmt.Fprintf(ioutil.Discard, "date_time_format=%d\n", date_time_format)
-		geometry_overlay_options := uint8(record_data[0]) & 0x0F
-		fmt.Fprintf(ioutil.Discard, "geometry_overlay_options=%d\n", geometry_overlay_options)
-
-		overlay_operator := (uint8(record_data[1]) & 0xC0) >> 6
-		fmt.Fprintf(ioutil.Discard, "overlay_operator=%d\n", overlay_operator)
-
-		overlay_vertices_count := (uint8(record_data[1]) & 0x3F) + 1 // Document instructs to add 1. (6.20).
-		fmt.Fprintf(ioutil.Discard, "overlay_vertices_count=%d\n", overlay_vertices_count)
-
-		// Parse all of the dates.
-		switch record_applicability_options {
-		case 0: // No times given. UFN.
-			record_data = record_data[2:]
-		case 1: // Start time only. WEF.
-			f.ReportStart = airmetParseDate(record_data[2:], date_time_format)
-			record_data = record_data[6:]
-		case 2: // End time only. TIL.
-			f.ReportEnd = airmetParseDate(record_data[2:], date_time_format)
-			record_data = record_data[6:]
-		case 3: // Both start and end times. WEF.
-			f.ReportStart = airmetParseDate(record_data[2:], date_time_format)
-			f.ReportEnd = airmetParseDate(record_data[6:], date_time_format)
-			record_data = record_data[10:]
+		object_label := (uint16(record_data[0]) << 8) | uint16(record_data[1])
+		o.ObjectLabel = strconv.Itoa(int(object_label))
+		record_data = record_data[2:]
+	} else {
+		if len(record_data) < 9 {
+			return 0
 		}
+		o.ObjectLabel = strings.TrimRight(dlac_decode(record_data, 9), "\x03 ")
+		record_data = record_data[9:]
+	}
+	fmt.Fprintf(ioutil.Discard, "object_label=%s\n", o.ObjectLabel)
 
-		// Now we have the vertices.
-		switch geometry_overlay_options {
-		case 3: // Extended Range 3D Polygon (MSL).
-			points := make([]GeoPoint, 0) // Slice containing all of the points.
-			fmt.Fprintf(ioutil.Discard, "%d\n", len(record_data))
-			for i := 0; i < int(overlay_vertices_count); i++ {
-				lng_raw := (int32(record_data[6*i]) << 11) | (int32(record_data[6*i+1]) << 3) | (int32(record_data[6*i+2]) & 0xE0 >> 5)
-				lat_raw := ((int32(record_data[6*i+2]) & 0x1F) << 14) | (int32(record_data[6*i+3]) << 6) | ((int32(record_data[6*i+4]) & 0xFC) >> 2)
-				alt_raw := ((int32(record_data[6*i+4]) & 0x03) << 8) | int32(record_data[6*i+5])
-
-				fmt.Fprintf(ioutil.Discard, "lat_raw=%d, lng_raw=%d, alt_raw=%d\n", lat_raw, lng_raw, alt_raw)
-				lat, lng := airmetLatLng(lat_raw, lng_raw, false)
-
-				alt := alt_raw * 100
-				fmt.Fprintf(ioutil.Discard, "lat=%f,lng=%f,alt=%d\n", lat, lng, alt)
-				fmt.Fprintf(ioutil.Discard, "coord:%f,%f\n", lat, lng)
-				var point GeoPoint
-				point.Lat = lat
-				point.Lon = lng
-				point.Alt = alt
-				points = append(points, point)
-				f.Points = points
-			}
-		case 9: // Extended Range 3D Point (AGL). p.47.
-			if len(record_data) < 6 {
-				fmt.Fprintf(ioutil.Discard, "invalid data: Extended Range 3D Point. Should be 6 bytes; % seen.\n", len(record_data))
-			} else {
-				lng_raw := (int32(record_data[0]) << 11) | (int32(record_data[1]) << 3) | (int32(record_data[2]) & 0xE0 >> 5)
-				lat_raw := ((int32(record_data[2]) & 0x1F) << 14) | (int32(record_data[3]) << 6) | ((int32(record_data[4]) & 0xFC) >> 2)
-				alt_raw := ((int32(record_data[4]) & 0x03) << 8) | int32(record_data[5])
-
-				fmt.Fprintf(ioutil.Discard, "lat_raw=%d, lng_raw=%d, alt_raw=%d\n", lat_raw, lng_raw, alt_raw)
-				lat, lng := airmetLatLng(lat_raw, lng_raw, false)
-
-				alt := alt_raw * 100
-				fmt.Fprintf(ioutil.Discard, "lat=%f,lng=%f,alt=%d\n", lat, lng, alt)
-				fmt.Fprintf(ioutil.Discard, "coord:%f,%f\n", lat, lng)
-				var point GeoPoint
-				point.Lat = lat
-				point.Lon = lng
-				point.Alt = alt
-				f.Points = []GeoPoint{point}
-			}
-		case 7, 8: // Extended Range Circular Prism (7 = MSL, 8 = AGL)
-			if len(record_data) < 14 {
-				fmt.Fprintf(ioutil.Discard, "invalid data: Extended Range Circular Prism. Should be 14 bytes; % seen.\n", len(record_data))
-			} else {
-
-				lng_bot_raw := (int32(record_data[0]) << 10) | (int32(record_data[1]) << 2) | (int32(record_data[2]) & 0xC0 >> 6)
-				lat_bot_raw := ((int32(record_data[2]) & 0x3F) << 12) | (int32(record_data[3]) << 4) | ((int32(record_data[4]) & 0xF0) >> 4)
-				lng_top_raw := ((int32(record_data[4]) & 0x0F) << 14) | (int32(record_data[5]) << 6) | ((int32(record_data[6]) & 0xFC) >> 2)
-				lat_top_raw := ((int32(record_data[6]) & 0x03) << 16) | (int32(record_data[7]) << 8) | int32(record_data[8])
-
-				alt_bot_raw := (int32(record_data[9]) & 0xFE) >> 1
-				alt_top_raw := ((int32(record_data[9]) & 0x01) << 6) | ((int32(record_data[10]) & 0xFC) >> 2)
-
-				r_lng_raw := ((int32(record_data[10]) & 0x03) << 7) | ((int32(record_data[11]) & 0xFE) >> 1)
-				r_lat_raw := ((int32(record_data[11]) & 0x01) << 8) | int32(record_data[12])
-				alpha := int32(record_data[13])
+	if len(record_data) < 2 {
+		return 0
+	}
+	element_flag := (uint8(record_data[0]) & 0x80) >> 7
+	qualifier_flag := (uint8(record_data[0]) & 0x40) >> 6
+	param_flag := (uint8(record_data[0]) & 0x20) >> 5
+	o.ObjectElementSet = element_flag != 0
+	o.ObjectElement = uint8(record_data[0]) & 0x1F
+	o.ObjectType = (uint8(record_data[1]) & 0xF0) >> 4
+	o.ObjectStatus = uint8(record_data[1]) & 0x0F
+	fmt.Fprintf(ioutil.Discard, "element_flag=%d, qualifier_flag=%d, param_flag=%d, object_element=%d, object_type=%d, object_status=%d\n", element_flag, qualifier_flag, param_flag, o.ObjectElement, o.ObjectType, o.ObjectStatus)
+	record_data = record_data[2:]
+
+	if qualifier_flag != 0 {
+		if len(record_data) < 3 {
+			return 0
+		}
+		o.ObjectQualifier = (uint32(record_data[0]) << 16) | (uint32(record_data[1]) << 8) | uint32(record_data[2])
+		fmt.Fprintf(ioutil.Discard, "object_qualifier=%06x\n", o.ObjectQualifier)
+		record_data = record_data[3:]
+	}
 
-				lat_bot, lng_bot := airmetLatLng(lat_bot_raw, lng_bot_raw, true)
-				lat_top, lng_top := airmetLatLng(lat_top_raw, lng_top_raw, true)
+	if param_flag != 0 {
+		// Object Parameter Type (5 bits), Object Parameter Value (11 bits).
+		if len(record_data) < 2 {
+			return 0
+		}
+		o.ParamType = (uint8(record_data[0]) & 0xF8) >> 3
+		o.ParamValue = ((uint16(record_data[0]) & 0x07) << 8) | uint16(record_data[1])
+		fmt.Fprintf(ioutil.Discard, "param_type=%d, param_value=%d\n", o.ParamType, o.ParamValue)
+		record_data = record_data[2:]
+	}
 
-				alt_bot := alt_bot_raw * 5
-				alt_top := alt_top_raw * 500
+	if len(record_data) < 2 {
+		return 0
+	}
+	record_applicability_options := (uint8(record_data[0]) & 0xC0) >> 6
+	fmt.Fprintf(ioutil.Discard, "record_applicability_options=%d\n", record_applicability_options)
+	date_time_format := (uint8(record_data[0]) & 0x30) >> 4
+	fmt.Fprintf(ioutil.Discard, "date_time_format=%d\n", date_time_format)
+	o.Option = uint8(record_data[0]) & 0x0F
+	fmt.Fprintf(ioutil.Discard, "geometry_overlay_options=%d\n", o.Option)
+	o.Operator = (uint8(record_data[1]) & 0xC0) >> 6
+	fmt.Fprintf(ioutil.Discard, "overlay_operator=%d\n", o.Operator)
+	overlay_vertices_count := int(uint8(record_data[1])&0x3F) + 1 // Document instructs to add 1. (6.20).
+	fmt.Fprintf(ioutil.Discard, "overlay_vertices_count=%d\n", overlay_vertices_count)
+	record_data = record_data[2:]
+
+	// Parse all of the dates.
+	date_len := airmetDateLength(date_time_format)
+	if (record_applicability_options == 1 || record_applicability_options == 3) && date_len > 0 { // Start time. WEF.
+		if len(record_data) < date_len {
+			return 0
+		}
+		o.Start = airmetParseTime(record_data, date_time_format)
+		o.HasStart = true
+		record_data = record_data[date_len:]
+	}
+	if (record_applicability_options == 2 || record_applicability_options == 3) && date_len > 0 { // End time. TIL.
+		if len(record_data) < date_len {
+			return 0
+		}
+		o.End = airmetParseTime(record_data, date_time_format)
+		o.HasEnd = true
+		record_data = record_data[date_len:]
+	}
 
-				r_lng := float64(r_lng_raw) * float64(0.2)
-				r_lat := float64(r_lat_raw) * float64(0.2)
+	// Now we have the vertices.
+	vertex_len := 0
+	switch o.Option {
+	case 0: // No geometry.
+	case 1: // Low Resolution 2D Polygon.
+		o.Geometry = AIRMET_POLYGON
+		vertex_len = 2
+	case 2: // High Resolution 3D Polygon.
+		o.Geometry = AIRMET_POLYGON
+		vertex_len = 5
+	case 3, 4: // Extended Range 3D Polygon (3 = MSL, 4 = AGL).
+		o.Geometry = AIRMET_POLYGON
+		o.AGL = o.Option == 4
+		vertex_len = 6
+	case 5: // Low Resolution 2D Ellipse.
+		o.Geometry = AIRMET_ELLIPSE
+		vertex_len = 9
+	case 6: // High Resolution 3D Ellipse.
+		o.Geometry = AIRMET_ELLIPSE
+		vertex_len = 11
+	case 7, 8: // Extended Range Circular Prism (7 = MSL, 8 = AGL).
+		o.Geometry = AIRMET_PRISM
+		o.AGL = o.Option == 8
+		vertex_len = 14
+	case 9: // Extended Range 3D Point (AGL). p.47.
+		o.Geometry = AIRMET_3D
+		o.AGL = true
+		vertex_len = 6
+	default:
+		fmt.Fprintf(ioutil.Discard, "unknown geometry: %d\n", o.Option)
+	}
 
-				fmt.Fprintf(ioutil.Discard, "lat_bot, lng_bot = %f, %f\n", lat_bot, lng_bot)
-				fmt.Fprintf(ioutil.Discard, "lat_top, lng_top = %f, %f\n", lat_top, lng_top)
+	// Surface polygons (1, 2) start with the reference point that their vertices are offsets from, in the Extended Range
+	//  3D Point format. Surface ellipses (5, 6) carry their own centres.
+	var ref GeoPoint
+	if o.Option == 1 || o.Option == 2 {
+		if len(record_data) < 6 {
+			return 0
+		}
+		ref = airmetVertex(record_data)
+		fmt.Fprintf(ioutil.Discard, "reference:%f,%f\n", ref.Lat, ref.Lon)
+		record_data = record_data[6:]
+	}
+	has_alt := o.Option != 1 && o.Option != 5 // 2D geometries have no altitude band.
 
-				if geometry_overlay_options == 8 {
-					fmt.Fprintf(ioutil.Discard, "alt_bot, alt_top = %d AGL, %d AGL\n", alt_bot, alt_top)
+	if vertex_len > 0 {
+		if len(record_data) < vertex_len*overlay_vertices_count {
+			fmt.Fprintf(ioutil.Discard, "invalid data: %d vertices of %d bytes; %d seen.\n", overlay_vertices_count, vertex_len, len(record_data))
+			return 0
+		}
+		for i := 0; i < overlay_vertices_count; i++ {
+			v := record_data[vertex_len*i:]
+			if o.Geometry == AIRMET_ELLIPSE {
+				e := airmetEllipse(v, o.Option == 6)
+				o.Ellipses = append(o.Ellipses, e)
+				o.Points = append(o.Points, e.Polygon(AIRMET_ELLIPSE_POINTS)...)
+				if has_alt && (i == 0 || e.Bottom.Alt < o.AltBottom) {
+					o.AltBottom = e.Bottom.Alt
+				}
+				if has_alt && (i == 0 || e.Top.Alt > o.AltTop) {
+					o.AltTop = e.Top.Alt
+				}
+			} else if o.Geometry == AIRMET_PRISM {
+				e := airmetPrism(v)
+				o.Ellipses = append(o.Ellipses, e)
+				o.Points = append(o.Points, e.Bottom)
+				if i == 0 || e.Bottom.Alt < o.AltBottom {
+					o.AltBottom = e.Bottom.Alt
+				}
+				if i == 0 || e.Top.Alt > o.AltTop {
+					o.AltTop = e.Top.Alt
+				}
+			} else {
+				var p GeoPoint
+				if o.Option == 1 || o.Option == 2 {
+					p = airmetOffsetVertex(ref, v, o.Option == 2)
 				} else {
-					fmt.Fprintf(ioutil.Discard, "alt_bot, alt_top = %d MSL, %d MSL\n", alt_bot, alt_top)
+					p = airmetVertex(v)
+				}
+				fmt.Fprintf(ioutil.Discard, "coord:%f,%f\n", p.Lat, p.Lon)
+				o.Points = append(o.Points, p)
+				// 3D polygons with an altitude range list the top ring first, then the bottom ring (6.18.4).
+				if has_alt && (i == 0 || p.Alt < o.AltBottom) {
+					o.AltBottom = p.Alt
+				}
+				if has_alt && (i == 0 || p.Alt > o.AltTop) {
+					o.AltTop = p.Alt
 				}
-				fmt.Fprintf(ioutil.Discard, "r_lng, r_lat = %f, %f\n", r_lng, r_lat)
-
-				fmt.Fprintf(ioutil.Discard, "alpha=%d\n", alpha)
 			}
-		default:
-			fmt.Fprintf(ioutil.Discard, "unknown geometry: %d\n", geometry_overlay_options)
 		}
-	//case 1: // Unformatted ASCII Text.
-	default:
-		fmt.Fprintf(ioutil.Discard, "unknown record format: %d\n", record_format)
 	}
-	fmt.Fprintf(ioutil.Discard, "\n\n\n")
+
+	if len(f.Overlays) == 0 {
+		f.ReportNumber = o.ReportNumber
+		f.ReportYear = o.ReportYear
+	}
+	if o.HasStart && len(f.ReportStart) == 0 {
+		f.ReportStart = o.Start.String()
+	}
+	if o.HasEnd && len(f.ReportEnd) == 0 {
+		f.ReportEnd = o.End.String()
+	}
+	f.Overlays = append(f.Overlays, o)
+	f.Points = append(f.Points, o.Points...)
+
+	return record_length
 }
 
 func (f *UATFrame) decodeInfoFrame() {
@@ -496,10 +702,10 @@ func (f *UATFrame) decodeInfoFrame() {
 	switch f.Product_id {
 	case 413:
 		f.decodeTextFrame()
-		/*
-			case 8, 11, 13:
-				f.decodeAirmet()
-		*/
+	case 8, 11, 12, 13:
+		f.decodeAirmet()
+	case NEXRAD_REGIONAL, NEXRAD_CONUS:
+		f.decodeNEXRAD()
 	default:
 		fmt.Fprintf(ioutil.Discard, "don't know what to do with product id: %d\n", f.Product_id)
 	}
@@ -572,6 +778,13 @@ func (u *UATMsg) DecodeUplink() error {
 		// Save the decoded frame.
 		u.Frames = append(u.Frames, thisFrame)
 
+		// If this was the last missing segment of a report, add the reassembled frame too.
+		if thisFrame.s_f {
+			if r := segments.add(thisFrame); r != nil {
+				u.Frames = append(u.Frames, r)
+			}
+		}
+
 		pos = pos + int(frame_length)
 	}
 
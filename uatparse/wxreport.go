@@ -0,0 +1,551 @@
+package uatparse
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	Parsing of the FIS-B text reports (product 413) returned by GetTextReports() into typed records.
+
+	Reports look like "<TYPE> <LOCATION> <DDHHMMZ> <DATA>", with DATA wrapped onto several lines and METARs and TAFs
+	terminated by '='. Times in the reports only carry the day of month, so they are resolved against a reference
+	time (normally "now").
+*/
+
+const (
+	FLIGHT_CATEGORY_VFR  = "VFR"
+	FLIGHT_CATEGORY_MVFR = "MVFR"
+	FLIGHT_CATEGORY_IFR  = "IFR"
+	FLIGHT_CATEGORY_LIFR = "LIFR"
+
+	metersPerStatuteMile = 1609.344
+)
+
+// Sky condition layer.
+type CloudLayer struct {
+	Cover  string // FEW, SCT, BKN, OVC, VV (vertical visibility), or SKC/CLR/NSC/NCD with no height.
+	Height int    // Feet AGL. -1 if not reported.
+	Type   string // CB or TCU, if reported.
+}
+
+// Wind, visibility, weather and sky condition - common to METARs and TAF forecast periods.
+type WxConditions struct {
+	WindReported     bool
+	WindDirection    int // Degrees true. -1 if variable.
+	WindSpeed        int // Knots.
+	WindGust         int // Knots. 0 if no gusts.
+	WindVariableFrom int // Degrees true, from a "dddVddd" group. -1 if not reported.
+	WindVariableTo   int
+	Visibility       float64 // Statute miles. -1 if not reported.
+	VisibilityPlus   bool    // Visibility is greater than the value given, e.g. "P6SM" or "9999".
+	Weather          []string
+	Clouds           []CloudLayer
+	Ceiling          int    // Feet AGL - lowest BKN, OVC or VV layer. -1 if there is none.
+	FlightCategory   string // FLIGHT_CATEGORY_*. Empty if neither visibility nor sky condition was reported.
+}
+
+type METAR struct {
+	Station   string
+	Special   bool // SPECI.
+	Observed  time.Time
+	Auto      bool
+	Corrected bool
+	WxConditions
+	TemperatureReported bool
+	Temperature         float64 // Degrees C. From the "T" remark if available.
+	Dewpoint            float64
+	Altimeter           float64 // inHg. 0 if not reported.
+	Remarks             string
+}
+
+// One forecast group from a TAF.
+type TAFPeriod struct {
+	Type        string // "" for the initial forecast, then FM, BECMG, TEMPO or PROB.
+	Probability int    // PROB30/PROB40.
+	From        time.Time
+	To          time.Time
+	WxConditions
+}
+
+type TAF struct {
+	Station   string
+	Amended   bool
+	Issued    time.Time // Zero if the issue time wasn't sent.
+	ValidFrom time.Time
+	ValidTo   time.Time
+	Periods   []TAFPeriod
+}
+
+type PIREP struct {
+	Station             string
+	Observed            time.Time
+	Urgent              bool   // UUA.
+	Location            string // /OV.
+	Altitude            int    // /FL, feet MSL. -1 if unknown or during climb/descent.
+	AircraftType        string // /TP.
+	SkyCondition        string // /SK.
+	Weather             string // /WX.
+	TemperatureReported bool
+	Temperature         int    // /TA, degrees C.
+	Wind                string // /WV.
+	Turbulence          string // /TB.
+	Icing               string // /IC.
+	Remarks             string // /RM.
+}
+
+// Forecast winds and temperatures at one altitude.
+type WindsAloftLevel struct {
+	Altitude            int // Feet MSL.
+	Direction           int // Degrees true. -1 if light and variable.
+	Speed               int // Knots.
+	TemperatureReported bool
+	Temperature         int // Degrees C.
+}
+
+type WindsAloft struct {
+	Station string
+	Valid   time.Time
+	Levels  []WindsAloftLevel
+}
+
+var (
+	wxWindRe        = regexp.MustCompile(`^(\d{3}|VRB)(\d{2,3})(?:G(\d{2,3}))?(KT|MPS)$`)
+	wxWindVarRe     = regexp.MustCompile(`^(\d{3})V(\d{3})$`)
+	wxVisRe         = regexp.MustCompile(`^([MP])?(\d+)?(?:(\d)/(\d{1,2}))?SM$`)
+	wxVisMetersRe   = regexp.MustCompile(`^\d{4}$`)
+	wxWeatherRe     = regexp.MustCompile(`^(-|\+|VC)?(MI|PR|BC|DR|BL|SH|TS|FZ)?((?:DZ|RA|SN|SG|IC|PL|GR|GS|UP|BR|FG|FU|VA|DU|SA|HZ|PY|PO|SQ|FC|SS|DS)*)$`)
+	wxCloudRe       = regexp.MustCompile(`^(FEW|SCT|BKN|OVC|VV)(\d{3}|///)(CB|TCU)?$`)
+	wxClearRe       = regexp.MustCompile(`^(SKC|CLR|NSC|NCD)$`)
+	wxTempRe        = regexp.MustCompile(`^(M?\d{2})/(M?\d{2})?$`)
+	wxTempRemarkRe  = regexp.MustCompile(`^T([01])(\d{3})([01])(\d{3})$`)
+	wxTimeRe        = regexp.MustCompile(`^(\d{2})(\d{2})(\d{2})Z$`)
+	wxPeriodRe      = regexp.MustCompile(`^(\d{2})(\d{2})/(\d{2})(\d{2})$`)
+	wxFromRe        = regexp.MustCompile(`^FM(\d{2})(\d{2})(\d{2})$`)
+	wxProbRe        = regexp.MustCompile(`^PROB(\d{2})$`)
+	wxWindsGroupRe  = regexp.MustCompile(`^(\d{2})(\d{2})([+-]?\d{2})?$`)
+	wxFlightLevelRe = regexp.MustCompile(`^FL(\d{3})`)
+)
+
+func newWxConditions() WxConditions {
+	return WxConditions{WindVariableFrom: -1, WindVariableTo: -1, Visibility: -1, Ceiling: -1}
+}
+
+// Split the report into words, without the terminating '='.
+func wxFields(s string) []string {
+	s = strings.TrimSpace(s)
+	s = strings.TrimSuffix(s, "=")
+	return strings.Fields(s)
+}
+
+func wxAtoi(s string) int {
+	neg := strings.HasPrefix(s, "M") || strings.HasPrefix(s, "-")
+	s = strings.TrimLeft(s, "M-+")
+	i, _ := strconv.Atoi(s)
+	if neg {
+		i = -i
+	}
+	return i
+}
+
+// "DDHHMMZ" time, resolved to the occurrence closest to 'ref'.
+func wxParseTime(s string, ref time.Time) (time.Time, bool) {
+	m := wxTimeRe.FindStringSubmatch(s)
+	if m == nil {
+		return time.Time{}, false
+	}
+	t := UATOverlayTime{Month: -1, Day: wxAtoi(m[1]), Hours: wxAtoi(m[2]), Minutes: wxAtoi(m[3])}
+	return t.Resolve(ref), true
+}
+
+// "DDHH" as used in TAF validity periods. Hour 24 is midnight at the end of the day.
+func wxParseDayHour(day, hour string, ref time.Time) time.Time {
+	t := UATOverlayTime{Month: -1, Day: wxAtoi(day), Hours: 0}
+	return t.Resolve(ref).Add(time.Duration(wxAtoi(hour)) * time.Hour)
+}
+
+// Parse the group(s) starting at f[i] as wind, visibility, weather or sky condition. Returns the number of words used,
+// or 0 if f[i] isn't one of these.
+func (c *WxConditions) parseGroup(f []string, i int) int {
+	s := f[i]
+	if m := wxWindRe.FindStringSubmatch(s); m != nil {
+		c.WindReported = true
+		if m[1] == "VRB" {
+			c.WindDirection = -1
+		} else {
+			c.WindDirection = wxAtoi(m[1])
+		}
+		c.WindSpeed = wxAtoi(m[2])
+		c.WindGust = wxAtoi(m[3])
+		if m[4] == "MPS" {
+			c.WindSpeed = int(float64(c.WindSpeed)*1.94384 + 0.5)
+			c.WindGust = int(float64(c.WindGust)*1.94384 + 0.5)
+		}
+		return 1
+	}
+	if m := wxWindVarRe.FindStringSubmatch(s); m != nil {
+		c.WindVariableFrom = wxAtoi(m[1])
+		c.WindVariableTo = wxAtoi(m[2])
+		return 1
+	}
+	// Whole and fractional statute miles split into two words, e.g. "1 1/2SM".
+	if i+1 < len(f) && len(s) == 1 && s[0] >= '1' && s[0] <= '9' && strings.Contains(f[i+1], "/") {
+		if m := wxVisRe.FindStringSubmatch(f[i+1]); m != nil && m[1] == "" && m[2] == "" {
+			c.Visibility = float64(wxAtoi(s)) + float64(wxAtoi(m[3]))/float64(wxAtoi(m[4]))
+			c.VisibilityPlus = false
+			return 2
+		}
+	}
+	if m := wxVisRe.FindStringSubmatch(s); m != nil && (m[2] != "" || m[3] != "") {
+		c.Visibility = float64(wxAtoi(m[2]))
+		if m[3] != "" && wxAtoi(m[4]) != 0 {
+			c.Visibility += float64(wxAtoi(m[3])) / float64(wxAtoi(m[4]))
+		}
+		c.VisibilityPlus = m[1] == "P"
+		return 1
+	}
+	if c.Visibility < 0 && wxVisMetersRe.MatchString(s) {
+		meters := wxAtoi(s)
+		if meters == 9999 {
+			meters = 10000
+			c.VisibilityPlus = true
+		}
+		c.Visibility = float64(meters) / metersPerStatuteMile
+		return 1
+	}
+	if s == "NSW" {
+		c.Weather = append(c.Weather, s)
+		return 1
+	}
+	if m := wxWeatherRe.FindStringSubmatch(s); m != nil && (m[2] != "" || m[3] != "") {
+		c.Weather = append(c.Weather, s)
+		return 1
+	}
+	if m := wxCloudRe.FindStringSubmatch(s); m != nil {
+		l := CloudLayer{Cover: m[1], Height: -1, Type: m[3]}
+		if m[2] != "///" {
+			l.Height = wxAtoi(m[2]) * 100
+		}
+		c.Clouds = append(c.Clouds, l)
+		if (l.Cover == "BKN" || l.Cover == "OVC" || l.Cover == "VV") && l.Height >= 0 && (c.Ceiling < 0 || l.Height < c.Ceiling) {
+			c.Ceiling = l.Height
+		}
+		return 1
+	}
+	if wxClearRe.MatchString(s) {
+		c.Clouds = append(c.Clouds, CloudLayer{Cover: s, Height: -1})
+		return 1
+	}
+	return 0
+}
+
+// Flight category from ceiling and visibility. LIFR is a ceiling below 500 ft or visibility less than 1 SM, IFR is a
+// ceiling below 1000 ft or visibility less than 3 SM, MVFR is a ceiling of 3000 ft or below or visibility of 5 SM or
+// less, otherwise VFR.
+func (c *WxConditions) computeFlightCategory() {
+	if c.Visibility < 0 && len(c.Clouds) == 0 {
+		c.FlightCategory = ""
+		return
+	}
+	cig := c.Ceiling
+	vis := c.Visibility
+	switch {
+	case (cig >= 0 && cig < 500) || (vis >= 0 && vis < 1):
+		c.FlightCategory = FLIGHT_CATEGORY_LIFR
+	case (cig >= 0 && cig < 1000) || (vis >= 0 && vis < 3):
+		c.FlightCategory = FLIGHT_CATEGORY_IFR
+	case (cig >= 0 && cig <= 3000) || (vis >= 0 && vis <= 5 && !c.VisibilityPlus):
+		c.FlightCategory = FLIGHT_CATEGORY_MVFR
+	default:
+		c.FlightCategory = FLIGHT_CATEGORY_VFR
+	}
+}
+
+// Parse a METAR or SPECI text report, e.g. "METAR KOLY 282215Z AUTO 01005KT 10SM SCT034 32/26 A2993 RMK AO2=".
+func ParseMETAR(s string, ref time.Time) (*METAR, error) {
+	f := wxFields(s)
+	if len(f) < 3 || (f[0] != "METAR" && f[0] != "SPECI") {
+		return nil, errors.New(fmt.Sprintf("ParseMETAR: not a METAR (%s).", s))
+	}
+	ret := &METAR{Station: f[1], Special: f[0] == "SPECI", WxConditions: newWxConditions()}
+	t, ok := wxParseTime(f[2], ref)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("ParseMETAR: invalid time '%s'.", f[2]))
+	}
+	ret.Observed = t
+
+	for i := 3; i < len(f); {
+		w := f[i]
+		if w == "RMK" {
+			rmk := f[i+1:]
+			ret.Remarks = strings.Join(rmk, " ")
+			for _, r := range rmk {
+				// Temperature and dewpoint to tenths of a degree.
+				if m := wxTempRemarkRe.FindStringSubmatch(r); m != nil {
+					ret.TemperatureReported = true
+					ret.Temperature = float64(wxAtoi(m[2])) / 10.0
+					if m[1] == "1" {
+						ret.Temperature = -ret.Temperature
+					}
+					ret.Dewpoint = float64(wxAtoi(m[4])) / 10.0
+					if m[3] == "1" {
+						ret.Dewpoint = -ret.Dewpoint
+					}
+				}
+			}
+			break
+		}
+		if n := ret.parseGroup(f, i); n > 0 {
+			i += n
+			continue
+		}
+		switch {
+		case w == "AUTO":
+			ret.Auto = true
+		case w == "COR":
+			ret.Corrected = true
+		case wxTempRe.MatchString(w):
+			m := wxTempRe.FindStringSubmatch(w)
+			ret.TemperatureReported = true
+			ret.Temperature = float64(wxAtoi(m[1]))
+			ret.Dewpoint = float64(wxAtoi(m[2]))
+		case len(w) == 5 && w[0] == 'A':
+			if v, err := strconv.Atoi(w[1:]); err == nil {
+				ret.Altimeter = float64(v) / 100.0
+			}
+		case len(w) == 5 && w[0] == 'Q':
+			if v, err := strconv.Atoi(w[1:]); err == nil {
+				ret.Altimeter = float64(v) * 0.0295300
+			}
+		}
+		i++
+	}
+	ret.computeFlightCategory()
+	return ret, nil
+}
+
+// Parse a TAF or amended TAF text report, e.g. "TAF KEKN 281725Z 2818/2918 28006KT P6SM VCTS SCT040CB FM282200 ...".
+// The flight category of each period is from the groups in that period only.
+func ParseTAF(s string, ref time.Time) (*TAF, error) {
+	f := wxFields(s)
+	if len(f) < 3 || (f[0] != "TAF" && f[0] != "TAF.AMD") {
+		return nil, errors.New(fmt.Sprintf("ParseTAF: not a TAF (%s).", s))
+	}
+	ret := &TAF{Station: f[1], Amended: f[0] == "TAF.AMD"}
+
+	i := 2
+	if t, ok := wxParseTime(f[i], ref); ok {
+		ret.Issued = t
+		i++
+	}
+	if i >= len(f) {
+		return nil, errors.New(fmt.Sprintf("ParseTAF: no valid period (%s).", s))
+	}
+	m := wxPeriodRe.FindStringSubmatch(f[i])
+	if m == nil {
+		return nil, errors.New(fmt.Sprintf("ParseTAF: invalid valid period '%s'.", f[i]))
+	}
+	ret.ValidFrom = wxParseDayHour(m[1], m[2], ref)
+	ret.ValidTo = wxParseDayHour(m[3], m[4], ref)
+	if ret.ValidTo.Before(ret.ValidFrom) {
+		ret.ValidTo = ret.ValidTo.AddDate(0, 1, 0) // Crosses the end of the month.
+	}
+	i++
+
+	cur := TAFPeriod{From: ret.ValidFrom, WxConditions: newWxConditions()}
+	groups := 0 // Groups parsed into 'cur'.
+	newPeriod := func(p TAFPeriod) {
+		cur.computeFlightCategory()
+		ret.Periods = append(ret.Periods, cur)
+		cur = p
+		cur.WxConditions = newWxConditions()
+		groups = 0
+	}
+	for i < len(f) {
+		w := f[i]
+		if w == "RMK" || w == "AMD" {
+			break // Remarks, or "AMD 2210" - the time the TAF was amended.
+		}
+		if n := cur.parseGroup(f, i); n > 0 {
+			groups++
+			i += n
+			continue
+		}
+		changeGroup := false
+		if m := wxFromRe.FindStringSubmatch(w); m != nil {
+			t := UATOverlayTime{Month: -1, Day: wxAtoi(m[1]), Hours: wxAtoi(m[2]), Minutes: wxAtoi(m[3])}
+			newPeriod(TAFPeriod{Type: "FM", From: t.Resolve(ret.ValidFrom)})
+		} else if w == "TEMPO" && cur.Type == "PROB" && groups == 0 {
+			changeGroup = true // "PROB30 TEMPO" - same period.
+		} else if w == "BECMG" || w == "TEMPO" {
+			newPeriod(TAFPeriod{Type: w})
+			changeGroup = true
+		} else if m := wxProbRe.FindStringSubmatch(w); m != nil {
+			newPeriod(TAFPeriod{Type: "PROB", Probability: wxAtoi(m[1])})
+			changeGroup = true
+		}
+		// BECMG, TEMPO and PROB are followed by their own period.
+		if changeGroup && i+1 < len(f) {
+			if m := wxPeriodRe.FindStringSubmatch(f[i+1]); m != nil {
+				cur.From = wxParseDayHour(m[1], m[2], ret.ValidFrom)
+				cur.To = wxParseDayHour(m[3], m[4], ret.ValidFrom)
+				i++
+			}
+		}
+		i++
+	}
+	newPeriod(TAFPeriod{})
+
+	// Initial and FM periods run until the next FM period or the end of the TAF.
+	for j := range ret.Periods {
+		p := &ret.Periods[j]
+		if p.Type != "" && p.Type != "FM" {
+			continue
+		}
+		p.To = ret.ValidTo
+		for k := j + 1; k < len(ret.Periods); k++ {
+			if ret.Periods[k].Type == "FM" {
+				p.To = ret.Periods[k].From
+				break
+			}
+		}
+	}
+	return ret, nil
+}
+
+// Parse a PIREP text report, e.g. "PIREP VHP 281959Z IND UA /OV VHP/TM 1959/FL350/TP A319/TB CONT LGT CHOP".
+func ParsePIREP(s string, ref time.Time) (*PIREP, error) {
+	f := wxFields(s)
+	if len(f) < 3 || f[0] != "PIREP" {
+		return nil, errors.New(fmt.Sprintf("ParsePIREP: not a PIREP (%s).", s))
+	}
+	ret := &PIREP{Station: f[1], Altitude: -1}
+	t, ok := wxParseTime(f[2], ref)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("ParsePIREP: invalid time '%s'.", f[2]))
+	}
+	ret.Observed = t
+
+	body := strings.Join(f[3:], " ")
+	idx := strings.Index(body, "/")
+	if idx < 0 {
+		return nil, errors.New(fmt.Sprintf("ParsePIREP: no fields (%s).", s))
+	}
+	for _, w := range strings.Fields(body[:idx]) {
+		if w == "UUA" {
+			ret.Urgent = true
+		}
+	}
+
+	for _, fld := range strings.Split(body[idx+1:], "/") {
+		fld = strings.TrimSpace(fld)
+		if len(fld) < 2 {
+			continue
+		}
+		val := strings.TrimSpace(fld[2:])
+		switch fld[:2] {
+		case "OV":
+			ret.Location = val
+		case "TM":
+			if len(val) == 4 {
+				t := UATOverlayTime{Month: -1, Day: -1, Hours: wxAtoi(val[:2]), Minutes: wxAtoi(val[2:])}
+				ret.Observed = t.Resolve(ret.Observed)
+			}
+		case "FL":
+			if m := wxFlightLevelRe.FindStringSubmatch(fld); m != nil {
+				ret.Altitude = wxAtoi(m[1]) * 100
+			}
+		case "TP":
+			ret.AircraftType = val
+		case "SK":
+			ret.SkyCondition = val
+		case "WX":
+			ret.Weather = val
+		case "TA":
+			if _, err := strconv.Atoi(strings.TrimLeft(val, "M-+")); err == nil {
+				ret.TemperatureReported = true
+				ret.Temperature = wxAtoi(val)
+			}
+		case "WV":
+			ret.Wind = val
+		case "TB":
+			ret.Turbulence = val
+		case "IC":
+			ret.Icing = val
+		case "RM":
+			ret.Remarks = val
+		}
+	}
+	return ret, nil
+}
+
+// Decode one "DDff", "DDff+TT" or "DDffTT" (temperature implicitly negative) winds aloft group.
+func parseWindsAloftGroup(s string, alt int) (WindsAloftLevel, bool) {
+	l := WindsAloftLevel{Altitude: alt}
+	m := wxWindsGroupRe.FindStringSubmatch(s)
+	if m == nil {
+		return l, false
+	}
+	dir := wxAtoi(m[1]) * 10
+	spd := wxAtoi(m[2])
+	if dir == 990 && spd == 0 {
+		dir = -1 // Light and variable.
+	} else if dir > 360 {
+		dir -= 500 // Speeds of 100 kts or more.
+		spd += 100
+	}
+	l.Direction = dir
+	l.Speed = spd
+	if m[3] != "" {
+		l.TemperatureReported = true
+		l.Temperature = wxAtoi(m[3])
+		if m[3][0] != '+' && m[3][0] != '-' {
+			l.Temperature = -l.Temperature // Always negative above 24000 ft.
+		}
+	}
+	return l, true
+}
+
+// Parse a winds and temperatures aloft text report, e.g. "WINDS LOU 291800Z  FT 3000 6000 ...\n   9900 3408+19 ...".
+// Levels that aren't forecast for the station are left out.
+func ParseWindsAloft(s string, ref time.Time) (*WindsAloft, error) {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	f := strings.Fields(lines[0])
+	if len(f) < 4 || f[0] != "WINDS" || f[3] != "FT" {
+		return nil, errors.New(fmt.Sprintf("ParseWindsAloft: not a winds aloft forecast (%s).", s))
+	}
+	ret := &WindsAloft{Station: f[1]}
+	t, ok := wxParseTime(f[2], ref)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("ParseWindsAloft: invalid time '%s'.", f[2]))
+	}
+	ret.Valid = t
+
+	alts := make([]int, 0)
+	for _, w := range f[4:] {
+		a, err := strconv.Atoi(w)
+		if err != nil {
+			break
+		}
+		alts = append(alts, a)
+	}
+	groups := make([]string, 0)
+	for _, line := range lines[1:] {
+		groups = append(groups, strings.Fields(line)...)
+	}
+	if len(groups) > len(alts) {
+		return nil, errors.New(fmt.Sprintf("ParseWindsAloft: %d groups for %d levels.", len(groups), len(alts)))
+	}
+	// Missing levels are at the bottom (below the station elevation), so line up from the top.
+	alts = alts[len(alts)-len(groups):]
+	for j, g := range groups {
+		if l, ok := parseWindsAloftGroup(g, alts[j]); ok {
+			ret.Levels = append(ret.Levels, l)
+		}
+	}
+	return ret, nil
+}
@@ -6,6 +6,8 @@ var URL_GPS_GET 		= "http://"	+ URL_HOST_BASE + "/getSituation";
 var URL_TOWERS_GET 		= "http://"	+ URL_HOST_BASE + "/getTowers"
 var URL_STATUS_GET 		= "http://"	+ URL_HOST_BASE + "/getStatus"
 var URL_SATELLITES_GET	= "http://"	+ URL_HOST_BASE + "/getSatellites"
+var URL_AHRS_GET		= "http://"	+ URL_HOST_BASE + "/getAHRS"
+var URL_AHRS_CALIBRATE	= "http://"	+ URL_HOST_BASE + "/calibrateAHRS"
 var URL_STATUS_WS 		= "ws://"	+ URL_HOST_BASE + "/status"
 var URL_TRAFFIC_WS 		= "ws://"	+ URL_HOST_BASE + "/traffic";
 var URL_WEATHER_WS 		= "ws://"	+ URL_HOST_BASE + "/weather";
@@ -67,8 +67,12 @@ function GPSCtrl($rootScope, $scope, $state, $http, $interval) {
 		var solutionText = "No Fix";
 		if (status.Quality == 2) {
 			solutionText = "GPS + SBAS (WAAS / EGNOS)";
+		} else if (status.Quality == 1 && status.FixType == 2) {
+			solutionText = "2D GPS";
 		} else if (status.Quality == 1) {
 			solutionText = "3D GPS"
+		} else if (status.Quality == 6) {
+			solutionText = "Dead Reckoning";
 		}
 		$scope.SolutionText = solutionText;
 		
@@ -99,6 +103,10 @@ function GPSCtrl($rootScope, $scope, $state, $http, $interval) {
 		// pitch and roll are in degrees
 		$scope.ahrs_pitch = Math.round(status.Pitch);
 		$scope.ahrs_roll = Math.round(status.Roll);
+		// slip/skid is ball deflection in degrees, positive right; yaw rate in degrees per second, positive right
+		$scope.ahrs_slip_skid = status.SlipSkid.toFixed(1);
+		$scope.ahrs_yaw_rate = status.YawRate.toFixed(1);
+		$scope.ahrs_g = status.GLoad.toFixed(2);
 		// "LastAttitudeTime":"2015-10-11T16:47:03.534615187Z"
 
 		setGeoReferenceMap(status.Lat, status.Lng);
@@ -118,6 +126,34 @@ function GPSCtrl($rootScope, $scope, $state, $http, $interval) {
 		});
 	};
 
+	function loadAHRS(data) {
+		$scope.ahrs_calibration = data.Calibration;
+		$scope.ahrs_valid = data.Valid;
+		$scope.ahrs_heading_valid = data.HeadingValid;
+		$scope.ahrs_heading_source = data.HeadingSource;
+		$scope.ahrs_attitude_uncertainty = data.AttitudeUncertainty.toFixed(1);
+		$scope.ahrs_heading_uncertainty = data.HeadingUncertainty.toFixed(0);
+	}
+
+	function getAHRS() {
+		$http.get(URL_AHRS_GET).
+		then(function (response) {
+			loadAHRS(response.data);
+		}, function (response) {
+			$scope.raw_data = "error getting ahrs status";
+		});
+	};
+
+	// Re-measure the gyro bias. The aircraft must be kept still.
+	$scope.calibrateAHRS = function () {
+		$http.post(URL_AHRS_CALIBRATE).
+		then(function (response) {
+			loadAHRS(response.data);
+		}, function (response) {
+			$scope.raw_data = "error starting ahrs calibration";
+		});
+	};
+
 	function getSatellites() {
 		// Simple GET request example (note: response is asynchronous)
 		$http.get(URL_SATELLITES_GET).
@@ -160,6 +196,7 @@ function GPSCtrl($rootScope, $scope, $state, $http, $interval) {
 		// refresh GPS/AHRS status once each half second (aka polling)
 		getStatus();
 		getSatellites();
+		getAHRS();
 	}, (1 * 500), 0, false);
 
 	$state.get('gps').onEnter = function () {
@@ -6,21 +6,27 @@ function SettingsCtrl($rootScope, $scope, $state, $location, $window, $http) {
 
 	$scope.$parent.helppage = 'plates/settings-help.html';
 
-	var toggles = ['UAT_Enabled', 'ES_Enabled', 'Ping_Enabled', 'GPS_Enabled', 'AHRS_Enabled', 'DisplayTrafficSource', 'DEBUG', 'ReplayLog']; 
+	var toggles = ['UAT_Enabled', 'ES_Enabled', 'Ping_Enabled', 'GPS_Enabled', 'AHRS_Enabled', 'DisplayTrafficSource', 'DEBUG', 'ReplayLog', 'TrafficAlert_Enabled']; 
 	var settings = {};
 	for (i = 0; i < toggles.length; i++) {
 		settings[toggles[i]] = undefined;
 	}
 	$scope.update_files = '';
+	$scope.SettingsErrors = [];
 	
 	function loadSettings(data) {
 		settings = angular.fromJson(data);
 		// consider using angular.extend()
 		$scope.rawSettings = angular.toJson(data, true);
 		$scope.visible_serialout = false;
-		if ((settings.SerialOutputs !== undefined) && (settings.SerialOutputs !== null) && (settings.SerialOutputs['/dev/serialout0'] !== undefined)) {
-			$scope.Baud = settings.SerialOutputs['/dev/serialout0'].Baud;
-			$scope.visible_serialout = true;
+		if ((settings.Outputs !== undefined) && (settings.Outputs !== null)) {
+			for (var i = 0; i < settings.Outputs.length; i++) {
+				if ((settings.Outputs[i].Transport === 'serial') && (settings.Outputs[i].Host === '/dev/serialout0')) {
+					$scope.Baud = settings.Outputs[i].Baud;
+					$scope.SerialCapability = settings.Outputs[i].Capability;
+					$scope.visible_serialout = true;
+				}
+			}
 		}
 		$scope.UAT_Enabled = settings.UAT_Enabled;
 		$scope.ES_Enabled = settings.ES_Enabled;
@@ -33,7 +39,17 @@ function SettingsCtrl($rootScope, $scope, $state, $location, $window, $http) {
 		$scope.PPM = settings.PPM;
 		$scope.WatchList = settings.WatchList;
 		$scope.OwnshipModeS = settings.OwnshipModeS;
+		$scope.OwnshipTail = settings.OwnshipTail;
+		$scope.OwnshipCategory = settings.OwnshipCategory;
+		$scope.OwnshipAircraftType = settings.OwnshipAircraftType;
+		$scope.SerialCapabilities = [{"value": 1, "description": "GDL90"}, {"value": 8, "description": "NMEA (FLARM)"}];
+		$scope.OwnshipCategories = [{"value": 1, "description": "Light"}, {"value": 2, "description": "Small"}, {"value": 3, "description": "Large"}, {"value": 4, "description": "High vortex"}, {"value": 5, "description": "Heavy"}, {"value": 6, "description": "Highly maneuverable"}, {"value": 7, "description": "Rotorcraft"}, {"value": 9, "description": "Glider"}, {"value": 10, "description": "Lighter than air"}, {"value": 11, "description": "Parachutist"}, {"value": 12, "description": "Ultralight"}, {"value": 14, "description": "UAV"}];
 		$scope.FlightLogLevel = settings.FlightLogLevel;
+		$scope.TrafficAlert_Enabled = settings.TrafficAlert_Enabled;
+		$scope.TrafficAlertDistance = settings.TrafficAlertDistance;
+		$scope.TrafficAlertAltitude = settings.TrafficAlertAltitude;
+		$scope.TrafficAlertTime = settings.TrafficAlertTime;
+		$scope.TrafficCoastTime = settings.TrafficCoastTime;
 		$scope.FlightLogLevels = [{"value": 1, "description": "Logbook"}, {"value": 2, "description": "Debrief"}, {"value": 3, "description": "Demo"}, {"value": 4, "description": "Debug"}];
 		$scope.HardwareBuild = "FlightBox";
 	}
@@ -66,9 +82,19 @@ function SettingsCtrl($rootScope, $scope, $state, $location, $window, $http) {
 		// Simple POST request example (note: responce is asynchronous)
 		$http.post(URL_SETTINGS_SET, msg).
 		then(function (response) {
+			$scope.SettingsErrors = [];
 			loadSettings(response.data);
 			// $scope.$apply();
 		}, function (response) {
+			if (response.data && response.data.Errors) {
+				// Rejected settings. Show why, and put the controls back to the saved values.
+				$scope.SettingsErrors = [];
+				for (var key in response.data.Errors) {
+					$scope.SettingsErrors.push(key + ": " + response.data.Errors[key]);
+				}
+				getSettings();
+				return;
+			}
 			$scope.rawSettings = "error setting settings";
 			for (i = 0; i < toggles.length; i++) {
 				settings[toggles[i]] = false;
@@ -121,6 +147,38 @@ function SettingsCtrl($rootScope, $scope, $state, $location, $window, $http) {
 		}
 	};
 
+	$scope.updatealerts = function () {
+		var newsettings = {};
+		var dirty = false;
+		if (($scope.TrafficAlertDistance !== undefined) && ($scope.TrafficAlertDistance !== null) && (parseFloat($scope.TrafficAlertDistance) !== settings["TrafficAlertDistance"])) {
+			newsettings["TrafficAlertDistance"] = parseFloat($scope.TrafficAlertDistance);
+			dirty = true;
+		}
+		if (($scope.TrafficAlertAltitude !== undefined) && ($scope.TrafficAlertAltitude !== null) && (parseInt($scope.TrafficAlertAltitude) !== settings["TrafficAlertAltitude"])) {
+			newsettings["TrafficAlertAltitude"] = parseInt($scope.TrafficAlertAltitude);
+			dirty = true;
+		}
+		if (($scope.TrafficAlertTime !== undefined) && ($scope.TrafficAlertTime !== null) && (parseInt($scope.TrafficAlertTime) !== settings["TrafficAlertTime"])) {
+			newsettings["TrafficAlertTime"] = parseInt($scope.TrafficAlertTime);
+			dirty = true;
+		}
+		if (dirty) {
+			// console.log(angular.toJson(newsettings));
+			setSettings(angular.toJson(newsettings));
+		}
+	};
+
+	$scope.updatecoast = function () {
+		if (($scope.TrafficCoastTime !== undefined) && ($scope.TrafficCoastTime !== null) && (parseInt($scope.TrafficCoastTime) !== settings["TrafficCoastTime"])) {
+			settings["TrafficCoastTime"] = parseInt($scope.TrafficCoastTime);
+			newsettings = {
+				"TrafficCoastTime": settings["TrafficCoastTime"]
+			};
+			// console.log(angular.toJson(newsettings));
+			setSettings(angular.toJson(newsettings));
+		}
+	};
+
 	$scope.updateBaud = function () {
 		settings["Baud"] = 0
 		if (($scope.Baud !== undefined) && ($scope.Baud !== null) && ($scope.Baud !== settings["Baud"])) {
@@ -133,6 +191,16 @@ function SettingsCtrl($rootScope, $scope, $state, $location, $window, $http) {
 		}
 	};
 
+	$scope.updateSerialCapability = function () {
+		if (($scope.SerialCapability !== undefined) && ($scope.SerialCapability !== null)) {
+			newsettings = {
+				"SerialCapability": parseInt($scope.SerialCapability)
+			};
+			// console.log(angular.toJson(newsettings));
+			setSettings(angular.toJson(newsettings));
+		}
+	};
+
 	$scope.updatewatchlist = function () {
 		if ($scope.WatchList !== settings["WatchList"]) {
 			settings["WatchList"] = "";
@@ -157,6 +225,27 @@ function SettingsCtrl($rootScope, $scope, $state, $location, $window, $http) {
 		}
 	};
 
+	$scope.updateownship = function () {
+		var newsettings = {};
+		var dirty = false;
+		if (($scope.OwnshipTail !== undefined) && ($scope.OwnshipTail !== null) && ($scope.OwnshipTail.toUpperCase() !== settings["OwnshipTail"])) {
+			newsettings["OwnshipTail"] = $scope.OwnshipTail.toUpperCase();
+			dirty = true;
+		}
+		if (($scope.OwnshipCategory !== undefined) && ($scope.OwnshipCategory !== null) && (parseInt($scope.OwnshipCategory) !== settings["OwnshipCategory"])) {
+			newsettings["OwnshipCategory"] = parseInt($scope.OwnshipCategory);
+			dirty = true;
+		}
+		if (($scope.OwnshipAircraftType !== undefined) && ($scope.OwnshipAircraftType !== null) && ($scope.OwnshipAircraftType.toUpperCase() !== settings["OwnshipAircraftType"])) {
+			newsettings["OwnshipAircraftType"] = $scope.OwnshipAircraftType.toUpperCase();
+			dirty = true;
+		}
+		if (dirty) {
+			// console.log(angular.toJson(newsettings));
+			setSettings(angular.toJson(newsettings));
+		}
+	};
+
 	$scope.postShutdown = function () {
 		$window.location.href = "/";
 		$location.path('/home');
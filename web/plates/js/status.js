@@ -56,6 +56,7 @@ function StatusCtrl($rootScope, $scope, $state, $http, $interval) {
 			$scope.GPS_solution = status.GPS_solution;
 			$scope.GPS_position_accuracy = String(status.GPS_solution ? ", " + status.GPS_position_accuracy.toFixed(1) : "");
 			$scope.RY835AI_connected = status.RY835AI_connected;
+			$scope.AHRS_sensors = status.AHRS_sensors;
 			$scope.UAT_METAR_total = status.UAT_METAR_total;
 			$scope.UAT_TAF_total = status.UAT_TAF_total;
 			$scope.UAT_NEXRAD_total = status.UAT_NEXRAD_total;
@@ -64,6 +65,8 @@ function StatusCtrl($rootScope, $scope, $state, $http, $interval) {
 			$scope.UAT_NOTAM_total = status.UAT_NOTAM_total;
 			$scope.UAT_OTHER_total = status.UAT_OTHER_total;
 			$scope.ReplayMode = status.ReplayMode;
+			$scope.Plugins = status.Plugins;
+			$scope.visible_plugins = (status.Plugins && status.Plugins.length > 0);
 			// Errors array.
 			if (status.Errors.length > 0) {
 				$scope.visible_errors = true;
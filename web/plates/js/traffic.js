@@ -83,6 +83,10 @@ function TrafficCtrl($rootScope, $scope, $state, $http, $interval) {
 		new_traffic.src = obj.Last_source; // 1=ES, 2=UAT
 		new_traffic.bearing = Math.round(obj.Bearing); // degrees true 
 		new_traffic.dist = (obj.Distance/1852); // nautical miles
+		new_traffic.alert = obj.Alert;
+		new_traffic.coasted = obj.ExtrapolatedPosition;
+		new_traffic.duplicate = obj.Duplicate;
+		new_traffic.ownship_echo = obj.Ownship_echo;
 		// return new_aircraft;
 	}
 
@@ -124,6 +128,11 @@ function TrafficCtrl($rootScope, $scope, $state, $http, $interval) {
 			var message = JSON.parse(msg.data);
 			$scope.raw_data = angular.toJson(msg.data, true);
 
+			// Traffic alert events. The target's own update carries the alert status.
+			if (message.Event !== undefined) {
+				return;
+			}
+
 
 
 				// we need to use an array so AngularJS can perform sorting; it also means we need to loop to find an aircraft in the traffic set